@@ -18,17 +18,424 @@ CREATE TABLE accounts (
     secret CHAR(64) NOT NULL,
     -- We represent the balance as integers where the last two digits are the
     -- BRL cents. We don't need more precision sicne we only add/substract
-    -- from the account balance.
+    -- from the account balance. Negative when the account uses its
+    -- overdraft. Overdraft interest may take it below the limit.
     balance INTEGER NOT NULL,
     -- No time zone, store always as UTC
+    created_at TIMESTAMP NOT NULL,
+    -- IANA time zone name, used for the daily, monthly and nighttime transfer
+    -- limits, which follow the account owner's local time.
+    timezone VARCHAR(64) NOT NULL DEFAULT 'America/Sao_Paulo',
+    -- Admins can review transfers parked by the risk rules. Only settable
+    -- directly in the DB.
+    admin BOOLEAN NOT NULL DEFAULT false,
+    -- Picks the fee schedule, see fee_schedules
+    tier VARCHAR(16) NOT NULL DEFAULT 'basic',
+    -- The account that transfer fees are credited to. Set by hand on a
+    -- single account.
+    house BOOLEAN NOT NULL DEFAULT false,
+    -- How far below zero transfers can take the balance
+    overdraft_limit INTEGER NOT NULL DEFAULT 0 CHECK (overdraft_limit >= 0),
+    -- The account that holds the money of open escrows. Set by hand on a
+    -- single account.
+    escrow BOOLEAN NOT NULL DEFAULT false,
+    -- Frozen accounts can't send money. Closed accounts can't log in, send
+    -- or receive, but their rows and transfers are kept.
+    status VARCHAR(16) NOT NULL DEFAULT 'active'
+        CHECK (status IN ('active', 'frozen', 'closed')),
+    -- Why an admin froze the account
+    status_reason VARCHAR(140),
+    closed_at TIMESTAMP
+);
+
+CREATE UNIQUE INDEX accounts_house ON accounts (house) WHERE house;
+CREATE UNIQUE INDEX accounts_escrow ON accounts (escrow) WHERE escrow;
+
+-- Every change of an account's status, and who made it.
+CREATE TABLE account_status_changes (
+    id INTEGER PRIMARY KEY GENERATED ALWAYS AS IDENTITY (START 1),
+    account_id INTEGER NOT NULL REFERENCES accounts (id),
+    status VARCHAR(16) NOT NULL,
+    reason VARCHAR(140) NOT NULL,
+    -- The owner when closing, an admin when freezing or unfreezing
+    changed_by INTEGER NOT NULL REFERENCES accounts (id),
     created_at TIMESTAMP NOT NULL
 );
 
+CREATE INDEX account_status_changes_account_id
+    ON account_status_changes (account_id);
+
+-- One-time codes to reset a forgotten password, see reset.go.
+CREATE TABLE password_resets (
+    id INTEGER PRIMARY KEY GENERATED ALWAYS AS IDENTITY (START 1),
+    account_id INTEGER NOT NULL REFERENCES accounts (id),
+    -- sha256 of the code, like accounts.secret
+    code_hash CHAR(64) NOT NULL,
+    created_at TIMESTAMP NOT NULL,
+    expires_at TIMESTAMP NOT NULL,
+    -- Wrong codes tried
+    attempts INTEGER NOT NULL DEFAULT 0,
+    used_at TIMESTAMP
+);
+
+CREATE INDEX password_resets_account_id ON password_resets (account_id);
+
+-- Responses to requests sent with an Idempotency-Key header, to replay them
+-- when the client retries, see idempotency.go.
+CREATE TABLE idempotency_keys (
+    account_id INTEGER NOT NULL REFERENCES accounts (id),
+    key VARCHAR(64) NOT NULL,
+    -- sha256 of the method, URL and body, as 64 hex digits
+    request_hash CHAR(64) NOT NULL,
+    -- NULL while the first request is still being handled
+    status INTEGER,
+    content_type VARCHAR(64) NOT NULL DEFAULT '',
+    body BYTEA,
+    created_at TIMESTAMP NOT NULL,
+    PRIMARY KEY (account_id, key)
+);
+
+-- Transfers sent together with POST /transfers/batch.
+CREATE TABLE transfer_batches (
+    id INTEGER PRIMARY KEY GENERATED ALWAYS AS IDENTITY (START 1),
+    origin_id INTEGER NOT NULL REFERENCES accounts (id),
+    -- All items commit or none do
+    atomic BOOLEAN NOT NULL,
+    -- processing, completed, partial or failed
+    status VARCHAR(16) NOT NULL,
+    total INTEGER NOT NULL,
+    -- Why the whole batch failed, for atomic batches, or why a best effort
+    -- batch stopped before its last item
+    error VARCHAR(64),
+    created_at TIMESTAMP NOT NULL,
+    -- A split payment sent to POST /transfers, always atomic
+    split BOOLEAN NOT NULL DEFAULT false
+);
+
 CREATE TABLE transfers (
     id INTEGER PRIMARY KEY GENERATED ALWAYS AS IDENTITY (START 1),
     origin_id INTEGER NOT NULL REFERENCES accounts (id),
     destination_id INTEGER NOT NULL REFERENCES accounts (id),
     amount INTEGER NOT NULL,
     -- No time zone, store always as UTC
+    created_at TIMESTAMP NOT NULL,
+    batch_id INTEGER REFERENCES transfer_batches (id),
+    description VARCHAR(140) NOT NULL DEFAULT '',
+    -- An id from the client's own systems, e.g. an invoice number
+    reference VARCHAR(64) NOT NULL DEFAULT '',
+    -- Flat object of string keys and values, NULL if there is none
+    metadata JSONB,
+    -- Fee paid by the origin on top of the amount
+    fee INTEGER NOT NULL DEFAULT 0,
+    -- Set on the transfer that moves a fee to the house account, to the
+    -- transfer it was charged for
+    fee_for INTEGER REFERENCES transfers (id)
+);
+
+-- For listing an account's transfers, which is paginated by id by default
+CREATE INDEX transfers_origin ON transfers (origin_id, id);
+CREATE INDEX transfers_destination ON transfers (destination_id, id);
+CREATE INDEX transfers_reference ON transfers (reference)
+    WHERE reference <> '';
+CREATE INDEX transfers_metadata ON transfers USING GIN (metadata);
+
+-- Tell the servers listening on the transfers channel about each transfer,
+-- when its transaction commits, to stream it to the accounts, see events.go.
+CREATE FUNCTION notify_transfer() RETURNS trigger AS $$
+BEGIN
+    PERFORM pg_notify('transfers', json_build_object('id', NEW.id,
+        'origin_id', NEW.origin_id,
+        'destination_id', NEW.destination_id)::text);
+    RETURN NULL;
+END;
+$$ LANGUAGE plpgsql;
+
+CREATE TRIGGER transfers_notify AFTER INSERT ON transfers
+    FOR EACH ROW EXECUTE FUNCTION notify_transfer();
+
+-- Per-account transfer limits. Accounts without a row here use the server
+-- defaults. Amounts are in cents, like the balance.
+CREATE TABLE account_limits (
+    account_id INTEGER PRIMARY KEY REFERENCES accounts (id),
+    per_transfer INTEGER NOT NULL,
+    daily INTEGER NOT NULL,
+    monthly INTEGER NOT NULL,
+    nighttime INTEGER NOT NULL
+);
+
+-- Transfers parked for review by the risk rules. No money moved for these
+-- until they are approved, when a row in transfers is made for them.
+CREATE TABLE pending_transfers (
+    id INTEGER PRIMARY KEY GENERATED ALWAYS AS IDENTITY (START 1),
+    origin_id INTEGER NOT NULL REFERENCES accounts (id),
+    destination_id INTEGER NOT NULL REFERENCES accounts (id),
+    amount INTEGER NOT NULL,
+    -- pending, approved or rejected
+    status VARCHAR(8) NOT NULL,
+    -- The rule that sent the transfer to review
+    rule VARCHAR(32) NOT NULL,
+    created_at TIMESTAMP NOT NULL,
+    reviewed_by INTEGER REFERENCES accounts (id),
+    reviewed_at TIMESTAMP,
+    transfer_id INTEGER REFERENCES transfers (id),
+    -- Copied to the transfer when approved
+    description VARCHAR(140) NOT NULL DEFAULT '',
+    reference VARCHAR(64) NOT NULL DEFAULT '',
+    metadata JSONB
+);
+
+-- Every decision made by the risk rules, one per transfer attempt.
+CREATE TABLE risk_decisions (
+    id INTEGER PRIMARY KEY GENERATED ALWAYS AS IDENTITY (START 1),
+    origin_id INTEGER NOT NULL REFERENCES accounts (id),
+    destination_id INTEGER NOT NULL REFERENCES accounts (id),
+    amount INTEGER NOT NULL,
+    -- allow, review or deny by the rules, or approve or reject by an admin
+    -- reviewing a pending transfer
+    decision VARCHAR(8) NOT NULL,
+    -- The rule that made the decision, null if all rules allowed it or an
+    -- admin made it
+    rule VARCHAR(32),
+    transfer_id INTEGER REFERENCES transfers (id),
+    pending_id INTEGER REFERENCES pending_transfers (id),
+    -- The admin who approved or rejected the pending transfer
+    decided_by INTEGER REFERENCES accounts (id),
+    created_at TIMESTAMP NOT NULL
+);
+
+-- The outcome of each item of a batch.
+CREATE TABLE transfer_batch_items (
+    batch_id INTEGER NOT NULL REFERENCES transfer_batches (id),
+    item_index INTEGER NOT NULL,
+    -- Not a reference, the item may have failed because the account doesn't
+    -- exist.
+    destination_id INTEGER NOT NULL,
+    amount INTEGER NOT NULL,
+    -- completed, pending, failed or rolled_back
+    status VARCHAR(16) NOT NULL,
+    error VARCHAR(64),
+    transfer_id INTEGER REFERENCES transfers (id),
+    pending_id INTEGER REFERENCES pending_transfers (id),
+    PRIMARY KEY (batch_id, item_index)
+);
+
+-- Keys that address an account in transfers instead of its id, like PIX keys.
+CREATE TABLE transfer_keys (
+    -- Normalized, see keys.go
+    key VARCHAR(77) PRIMARY KEY,
+    -- cpf, email, phone or random
+    type VARCHAR(8) NOT NULL,
+    account_id INTEGER NOT NULL REFERENCES accounts (id),
+    created_at TIMESTAMP NOT NULL
+);
+
+CREATE INDEX transfer_keys_account ON transfer_keys (account_id);
+
+-- Charges created by an account, paid by others with a payload string.
+CREATE TABLE payment_requests (
+    id INTEGER PRIMARY KEY GENERATED ALWAYS AS IDENTITY (START 1),
+    -- Who gets paid
+    account_id INTEGER NOT NULL REFERENCES accounts (id),
+    amount INTEGER NOT NULL,
+    description VARCHAR(140) NOT NULL DEFAULT '',
+    -- Multi-use requests can be paid any number of times until they expire
+    multi_use BOOLEAN NOT NULL DEFAULT false,
+    -- open or cancelled. Whether it was paid comes from its payments.
+    status VARCHAR(16) NOT NULL DEFAULT 'open',
+    expires_at TIMESTAMP NOT NULL,
+    created_at TIMESTAMP NOT NULL,
+    last_paid_at TIMESTAMP
+);
+
+CREATE INDEX payment_requests_account ON payment_requests (account_id, id);
+
+-- Each payment of a request. Either the transfer or, if the payment was sent
+-- to review, the pending transfer is set.
+CREATE TABLE payment_request_payments (
+    id INTEGER PRIMARY KEY GENERATED ALWAYS AS IDENTITY (START 1),
+    request_id INTEGER NOT NULL REFERENCES payment_requests (id),
+    payer_id INTEGER NOT NULL REFERENCES accounts (id),
+    transfer_id INTEGER REFERENCES transfers (id),
+    pending_id INTEGER REFERENCES pending_transfers (id),
+    created_at TIMESTAMP NOT NULL
+);
+
+CREATE INDEX payment_request_payments_request
+ON payment_request_payments (request_id);
+
+-- Transfer fees for each account tier. Tiers without a row pay no fees.
+CREATE TABLE fee_schedules (
+    tier VARCHAR(16) PRIMARY KEY,
+    flat INTEGER NOT NULL DEFAULT 0 CHECK (flat >= 0),
+    -- Percentage of the amount, in hundredths of a percent
+    percent_bps INTEGER NOT NULL DEFAULT 0
+        CHECK (percent_bps BETWEEN 0 AND 10000),
+    -- Bounds for the total fee, 0 for none
+    min_fee INTEGER NOT NULL DEFAULT 0 CHECK (min_fee >= 0),
+    max_fee INTEGER NOT NULL DEFAULT 0 CHECK (max_fee >= 0),
+    -- Transfers each calendar month that pay no fee
+    free_per_month INTEGER NOT NULL DEFAULT 0 CHECK (free_per_month >= 0)
+);
+
+-- Annual interest paid on positive balances, for each account tier. Tiers
+-- without a row earn no interest.
+CREATE TABLE interest_rates (
+    tier VARCHAR(16) PRIMARY KEY,
+    -- Hundredths of a percent a year
+    annual_bps INTEGER NOT NULL CHECK (annual_bps BETWEEN 0 AND 100000),
+    -- Charged on negative balances, in the same unit
+    overdraft_bps INTEGER NOT NULL DEFAULT 0
+        CHECK (overdraft_bps BETWEEN 0 AND 100000)
+);
+
+-- Interest earned by an account on one day, on its end of day balance.
+CREATE TABLE interest_accruals (
+    account_id INTEGER NOT NULL REFERENCES accounts (id),
+    date DATE NOT NULL,
+    balance INTEGER NOT NULL,
+    annual_bps INTEGER NOT NULL,
+    -- Millionths of a cent, so fractions add up across the month
+    micros BIGINT NOT NULL,
+    PRIMARY KEY (account_id, date)
+);
+
+-- Interest credited for a month. The fraction of a cent left over is carried
+-- to the next month.
+CREATE TABLE interest_postings (
+    account_id INTEGER NOT NULL REFERENCES accounts (id),
+    -- First day of the month
+    month DATE NOT NULL,
+    accrued_micros BIGINT NOT NULL,
+    carry_micros BIGINT NOT NULL,
+    amount INTEGER NOT NULL,
+    -- NULL if the amount rounded down to 0
+    transfer_id INTEGER REFERENCES transfers (id),
+    created_at TIMESTAMP NOT NULL,
+    PRIMARY KEY (account_id, month)
+);
+
+-- Dates the interest job ran for, with every account done. The job goes
+-- back to the first date missing here, to catch up after it was down.
+CREATE TABLE interest_runs (
+    date DATE PRIMARY KEY,
+    created_at TIMESTAMP NOT NULL
+);
+
+-- Overdraft interest charged for one day, on a negative end of day balance.
+-- Charged daily, the fraction of a cent left over is carried to the next
+-- charge.
+CREATE TABLE overdraft_charges (
+    account_id INTEGER NOT NULL REFERENCES accounts (id),
+    date DATE NOT NULL,
+    balance INTEGER NOT NULL,
+    overdraft_bps INTEGER NOT NULL,
+    -- Millionths of a cent
+    micros BIGINT NOT NULL,
+    carry_micros BIGINT NOT NULL,
+    amount INTEGER NOT NULL,
+    -- NULL if the amount rounded down to 0
+    transfer_id INTEGER REFERENCES transfers (id),
+    PRIMARY KEY (account_id, date)
+);
+
+-- Money from a payer, held in the escrow account until both parties agree to
+-- release it to the payee or refund it, or until the deadline.
+CREATE TABLE escrows (
+    id INTEGER PRIMARY KEY GENERATED ALWAYS AS IDENTITY (START 1),
+    payer_id INTEGER NOT NULL REFERENCES accounts (id),
+    payee_id INTEGER NOT NULL REFERENCES accounts (id),
+    amount INTEGER NOT NULL CHECK (amount > 0),
+    description VARCHAR(140) NOT NULL DEFAULT '',
+    -- held, released or refunded
+    status VARCHAR(16) NOT NULL,
+    -- No time zone, UTC
+    deadline TIMESTAMP NOT NULL,
+    -- What happens at the deadline: release or refund
+    default_action VARCHAR(8) NOT NULL,
+    -- What each party asked for so far: confirm, cancel or NULL
+    payer_decision VARCHAR(8),
+    payee_decision VARCHAR(8),
+    funding_transfer_id INTEGER REFERENCES transfers (id),
+    -- The transfer out of the escrow account, once resolved
+    resolution_transfer_id INTEGER REFERENCES transfers (id),
+    created_at TIMESTAMP NOT NULL,
+    resolved_at TIMESTAMP
+);
+
+CREATE INDEX escrows_payer_id ON escrows (payer_id);
+CREATE INDEX escrows_payee_id ON escrows (payee_id);
+CREATE INDEX escrows_held_deadline ON escrows (deadline) WHERE status = 'held';
+
+-- URLs that accounts register to be told about their events, see webhooks.go.
+CREATE TABLE webhooks (
+    id INTEGER PRIMARY KEY GENERATED ALWAYS AS IDENTITY (START 1),
+    account_id INTEGER NOT NULL REFERENCES accounts (id),
+    url VARCHAR(2048) NOT NULL,
+    -- Key of the HMAC-SHA256 signatures, as 64 hex digits
+    secret CHAR(64) NOT NULL,
+    -- JSON array of the event types sent, e.g. ["transfer.received"]
+    events JSONB NOT NULL,
     created_at TIMESTAMP NOT NULL
-);
\ No newline at end of file
+);
+
+CREATE INDEX webhooks_account ON webhooks (account_id);
+
+-- The outbox. Events are written in the transaction of the change they tell
+-- about, and only if some webhook of the account wants them.
+CREATE TABLE webhook_events (
+    id INTEGER PRIMARY KEY GENERATED ALWAYS AS IDENTITY (START 1),
+    account_id INTEGER NOT NULL REFERENCES accounts (id),
+    type VARCHAR(32) NOT NULL,
+    data JSONB NOT NULL,
+    created_at TIMESTAMP NOT NULL
+);
+
+-- One event sent to one webhook, and how that went so far.
+CREATE TABLE webhook_deliveries (
+    id INTEGER PRIMARY KEY GENERATED ALWAYS AS IDENTITY (START 1),
+    webhook_id INTEGER NOT NULL REFERENCES webhooks (id) ON DELETE CASCADE,
+    event_id INTEGER NOT NULL REFERENCES webhook_events (id),
+    -- pending, delivered or dead, after the last attempt failed
+    status VARCHAR(16) NOT NULL DEFAULT 'pending'
+        CHECK (status IN ('pending', 'delivered', 'dead')),
+    attempts INTEGER NOT NULL DEFAULT 0,
+    -- When a worker can try it. Pushed forward while a worker has it, so
+    -- the other servers leave it alone.
+    next_attempt_at TIMESTAMP NOT NULL,
+    last_attempt_at TIMESTAMP,
+    -- The HTTP status of the last attempt, NULL if there was no response
+    last_status INTEGER,
+    last_error VARCHAR(256),
+    delivered_at TIMESTAMP,
+    created_at TIMESTAMP NOT NULL
+);
+
+CREATE INDEX webhook_deliveries_webhook ON webhook_deliveries (webhook_id, id);
+CREATE INDEX webhook_deliveries_due ON webhook_deliveries (next_attempt_at)
+    WHERE status = 'pending';
+
+-- The outbox of domain events, see domain_events.go. Each event is written
+-- in the transaction of the change it tells about.
+CREATE TABLE domain_events (
+    id BIGINT PRIMARY KEY GENERATED ALWAYS AS IDENTITY (START 1),
+    -- The transaction that wrote the event. Ids are taken before commit, so
+    -- the events are read in (tx_id, id) order, and only once every
+    -- transaction that could still add one before them is over.
+    tx_id BIGINT NOT NULL DEFAULT pg_current_xact_id()::text::bigint,
+    type VARCHAR(32) NOT NULL,
+    -- The account the event is about, if any
+    account_id INTEGER REFERENCES accounts (id),
+    data JSONB NOT NULL,
+    created_at TIMESTAMP NOT NULL
+);
+
+CREATE INDEX domain_events_order ON domain_events (tx_id, id);
+
+-- How far each publisher of the domain events got.
+CREATE TABLE event_consumers (
+    name VARCHAR(64) PRIMARY KEY,
+    -- The last event published, in the order of domain_events_order
+    last_tx_id BIGINT NOT NULL DEFAULT 0,
+    last_event_id BIGINT NOT NULL DEFAULT 0,
+    updated_at TIMESTAMP NOT NULL
+);
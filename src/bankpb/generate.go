@@ -0,0 +1,5 @@
+// Package bankpb has the protobuf messages and the gRPC service of the
+// PedroBank gRPC API, generated from bank.proto.
+package bankpb
+
+//go:generate protoc --go_out=. --go_opt=paths=source_relative --go-grpc_out=. --go-grpc_opt=paths=source_relative bank.proto
@@ -0,0 +1,228 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+// A fake API, where logins give token-1, token-2, ... and only the last
+// token is valid.
+type fakeAPI struct {
+	logins    int
+	transfers int
+	requests  []string
+}
+
+func (api *fakeAPI) ServeHTTP(rw http.ResponseWriter, req *http.Request) {
+	api.requests = append(api.requests, req.Method+" "+req.URL.Path)
+	body, _ := io.ReadAll(req.Body)
+
+	if req.URL.Path != "/login" && !strings.HasSuffix(req.URL.Path,
+		"/balance") && req.Header.Get("Authorization") !=
+		fmt.Sprintf("token-%d", api.logins) {
+
+		rw.WriteHeader(http.StatusUnauthorized)
+		fmt.Fprint(rw, `{"error": "unauthorized", "code": "unauthorized",
+			"message": "unauthorized"}`)
+		return
+	}
+
+	switch req.Method + " " + req.URL.Path {
+	case "POST /login":
+		if !strings.Contains(string(body), `"secret":"toto"`) {
+			rw.WriteHeader(http.StatusUnauthorized)
+			fmt.Fprint(rw, `{"error": "wrong password", "code":
+				"wrong_password", "message": "wrong password",
+				"request_id": "req-9"}`)
+			return
+		}
+
+		api.logins++
+		fmt.Fprintf(rw, `{"token": "token-%d"}`, api.logins)
+	case "GET /id":
+		fmt.Fprint(rw, `{"id": 7}`)
+	case "GET /accounts/7/balance":
+		fmt.Fprint(rw, `{"balance": 100.50, "status": "active",
+			"overdraft_limit": 0.00, "overdraft_used": 0.00,
+			"available": 100.50}`)
+	case "POST /transfers":
+		api.transfers++
+		rw.WriteHeader(http.StatusCreated)
+		fmt.Fprintf(rw, `{"id": %d, "account_origin_id": 7,
+			"account_destination_id": 2, "amount": 10.50, "fee": 0.00,
+			"created_at": "2021-08-01T10:00:00Z", "description": "lunch"}`,
+			api.transfers)
+	case "POST /admin/accounts/2/freeze":
+		fmt.Fprintf(rw, `{"account_id": 2, "status": "frozen",
+			"reason": "fraud", "changed_by": 7,
+			"created_at": "2021-08-01T10:00:00Z"}`)
+	default:
+		rw.WriteHeader(http.StatusNotFound)
+	}
+}
+
+// Run the command line with the config in dir, and return the exit status
+// and what was printed.
+func runCLI(api string, dir string, stdin string,
+	args ...string) (int, string, string) {
+
+	var stdout, stderr strings.Builder
+
+	args = append([]string{"-config", filepath.Join(dir, "config.json"),
+		"-url", api}, args...)
+	status := run(args, strings.NewReader(stdin), &stdout, &stderr)
+
+	return status, stdout.String(), stderr.String()
+}
+
+func TestSession(t *testing.T) {
+	api := &fakeAPI{}
+	server := httptest.NewServer(api)
+	defer server.Close()
+
+	dir := t.TempDir()
+
+	status, _, stderr := runCLI(server.URL, dir, "", "transfer", "-to", "2",
+		"-amount", "10.50")
+
+	if status != 1 || !strings.Contains(stderr, "not logged in") {
+		t.Error(status, stderr)
+	}
+
+	status, _, stderr = runCLI(server.URL, dir, "wrong\n", "login", "-cpf",
+		"123.456-78")
+
+	if status != 1 || !strings.Contains(stderr, "wrong password "+
+		"(request req-9)") {
+
+		t.Error(status, stderr)
+	}
+
+	status, stdout, _ := runCLI(server.URL, dir, "toto\n", "login", "-cpf",
+		"123.456-78")
+
+	if status != 0 || stdout != "Logged in to account 7\n" {
+		t.Fatal(status, stdout)
+	}
+
+	path := filepath.Join(dir, "config.json")
+	info, err := os.Stat(path)
+
+	if err != nil || info.Mode().Perm() != 0600 {
+		t.Fatal(info, err)
+	}
+
+	data, _ := os.ReadFile(path)
+
+	var cfg config
+
+	if err = json.Unmarshal(data, &cfg); err != nil || cfg.Token !=
+		"token-1" || cfg.AccountID != 7 || cfg.URL != server.URL ||
+		strings.Contains(string(data), "toto") {
+
+		t.Error(string(data), err)
+	}
+
+	// The balance of the logged in account, by default
+	status, stdout, _ = runCLI(server.URL, dir, "", "balance")
+
+	if status != 0 || !strings.Contains(stdout, "BALANCE") ||
+		!strings.Contains(stdout, "100.50") {
+
+		t.Error(status, stdout)
+	}
+
+	// The session expired on the server, so the secret is asked again
+	api.logins++
+
+	status, stdout, stderr = runCLI(server.URL, dir, "toto\n", "transfer",
+		"-to", "2", "-amount", "10.5", "-json")
+
+	var transf map[string]interface{}
+
+	if status != 0 || json.Unmarshal([]byte(stdout), &transf) != nil ||
+		transf["amount"] != 10.5 || !strings.Contains(stderr, "expired") ||
+		api.transfers != 1 {
+
+		t.Error(status, stdout, stderr)
+	}
+
+	data, _ = os.ReadFile(path)
+
+	if !strings.Contains(string(data), `"token": "token-3"`) {
+		t.Error(string(data))
+	}
+
+	status, _, _ = runCLI(server.URL, dir, "", "logout")
+	data, _ = os.ReadFile(path)
+
+	if status != 0 || strings.Contains(string(data), "token") {
+		t.Error(status, string(data))
+	}
+}
+
+func TestArgs(t *testing.T) {
+	api := &fakeAPI{logins: 1}
+	server := httptest.NewServer(api)
+	defer server.Close()
+
+	dir := t.TempDir()
+
+	err := saveConfig(filepath.Join(dir, "config.json"), &config{
+		URL: server.URL, Token: "token-1", AccountID: 7})
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var usages = [][]string{
+		{"nope"},
+		{"transfer", "-to", "2"},
+		{"transfer", "-to", "2", "-to-key", "ana@example.com",
+			"-amount", "1"},
+		{"transfer", "-to", "2", "-amount", "1.505"},
+		{"transfer", "-to", "2", "-amount", "1", "extra"},
+		{"transfers", "list", "-from", "yesterday"},
+		{"admin", "freeze", "2"},
+		{"admin", "freeze", "-reason", "fraud"},
+		{"admin", "freeze", "two", "-reason", "fraud"},
+		{"admin", "overdraft", "2"},
+	}
+
+	for _, args := range usages {
+		status, _, stderr := runCLI(server.URL, dir, "", args...)
+
+		if status != 2 || !strings.Contains(stderr, "usage: pedro-bank") {
+			t.Error(args, status, stderr)
+		}
+	}
+
+	if len(api.requests) != 0 {
+		t.Error(api.requests)
+	}
+
+	// The id can go before or after the flags
+	for _, args := range [][]string{
+		{"admin", "freeze", "2", "-reason", "fraud"},
+		{"admin", "freeze", "-reason", "fraud", "2"},
+	} {
+		status, stdout, stderr := runCLI(server.URL, dir, "", args...)
+
+		if status != 0 || !strings.Contains(stdout, "frozen") {
+			t.Error(args, status, stdout, stderr)
+		}
+	}
+
+	status, stdout, _ := runCLI(server.URL, dir, "", "help")
+
+	if status != 0 || !strings.Contains(stdout, "transfers list") {
+		t.Error(status, stdout)
+	}
+}
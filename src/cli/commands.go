@@ -0,0 +1,483 @@
+package main
+
+import (
+	"context"
+	"flag"
+	"fmt"
+	"io"
+	"strconv"
+	"time"
+
+	"pedro-bank/client"
+)
+
+// A flag set for a command, with -json too, so it can go after the command.
+func (cli *cli) newFlagSet(name string) *flag.FlagSet {
+	fs := flag.NewFlagSet(name, flag.ContinueOnError)
+	fs.SetOutput(io.Discard)
+	fs.BoolVar(&cli.json, "json", cli.json, "Print JSON instead of tables")
+
+	return fs
+}
+
+// Parse args, which take no positional arguments.
+func parseFlags(fs *flag.FlagSet, args []string) error {
+	if err := fs.Parse(args); err != nil {
+		return newUsageError("%s", err)
+	}
+
+	if fs.NArg() > 0 {
+		return newUsageError("unexpected %q", fs.Arg(0))
+	}
+
+	return nil
+}
+
+// Parse args, which take an id before or after the flags.
+func parseFlagsWithID(fs *flag.FlagSet, args []string) (int, error) {
+	if err := fs.Parse(args); err != nil {
+		return 0, newUsageError("%s", err)
+	}
+
+	if fs.NArg() == 0 {
+		return 0, newUsageError("missing the id")
+	}
+
+	id, err := strconv.Atoi(fs.Arg(0))
+
+	if err != nil || id <= 0 {
+		return 0, newUsageError("bad id %q", fs.Arg(0))
+	}
+
+	return id, parseFlags(fs, fs.Args()[1:])
+}
+
+// A flag.Value for amounts, e.g. 10 or 10.50.
+type moneyFlag struct {
+	money *client.Money
+}
+
+func (f moneyFlag) String() string {
+	if f.money == nil {
+		return ""
+	}
+
+	return f.money.String()
+}
+
+func (f moneyFlag) Set(str string) error {
+	money, err := client.ParseMoney(str)
+
+	if err != nil {
+		return err
+	}
+
+	*f.money = money
+
+	return nil
+}
+
+// A flag.Value for times, as dates or RFC 3339 times. Dates are midnight
+// in the local time zone, or the last second of the day if endOfDay.
+type timeFlag struct {
+	time     *time.Time
+	endOfDay bool
+}
+
+func (f timeFlag) String() string {
+	if f.time == nil || f.time.IsZero() {
+		return ""
+	}
+
+	return f.time.Format(time.RFC3339)
+}
+
+func (f timeFlag) Set(str string) error {
+	t, err := time.Parse(time.RFC3339, str)
+
+	if err != nil {
+		t, err = time.ParseInLocation("2006-01-02", str, time.Local)
+
+		if err != nil {
+			return fmt.Errorf("want YYYY-MM-DD or an RFC 3339 time")
+		}
+
+		if f.endOfDay {
+			t = t.AddDate(0, 0, 1).Add(-time.Second)
+		}
+	}
+
+	*f.time = t
+
+	return nil
+}
+
+func addPageFlags(fs *flag.FlagSet, opts *client.PageOptions) {
+	fs.IntVar(&opts.Limit, "limit", 0, "Size of the page, up to 200")
+	fs.StringVar(&opts.Cursor, "cursor", "", "Cursor of the next page")
+	fs.StringVar(&opts.Sort, "sort", "", "Field to sort by")
+	fs.StringVar(&opts.Order, "order", "", "asc or desc")
+}
+
+func createAccount(ctx context.Context, cli *cli, args []string) error {
+	var req client.CreateAccountRequest
+
+	fs := cli.newFlagSet("accounts create")
+	fs.StringVar(&req.Name, "name", "", "Name of the owner")
+	fs.StringVar(&req.CPF, "cpf", "", "CPF, as XXX.XXX-XX")
+	fs.StringVar(&req.Timezone, "timezone", "", "IANA time zone")
+
+	if err := parseFlags(fs, args); err != nil {
+		return err
+	}
+
+	if req.Name == "" || req.CPF == "" {
+		return newUsageError("-name and -cpf are needed")
+	}
+
+	var err error
+	req.Secret, err = cli.readSecret(req.CPF)
+
+	if err != nil {
+		return err
+	}
+
+	acc, err := cli.bank.CreateAccount(ctx, req)
+
+	if err != nil {
+		return err
+	}
+
+	return cli.printAccounts(acc, []client.Account{*acc}, "")
+}
+
+func listAccounts(ctx context.Context, cli *cli, args []string) error {
+	var opts client.ListAccountsOptions
+
+	fs := cli.newFlagSet("accounts list")
+	addPageFlags(fs, &opts.PageOptions)
+
+	if err := parseFlags(fs, args); err != nil {
+		return err
+	}
+
+	page, err := cli.bank.ListAccounts(ctx, opts)
+
+	if err != nil {
+		return err
+	}
+
+	return cli.printAccounts(page, page.Accounts, page.NextCursor)
+}
+
+func login(ctx context.Context, cli *cli, args []string) error {
+	var cpf string
+
+	fs := cli.newFlagSet("login")
+	fs.StringVar(&cpf, "cpf", cli.cfg.CPF, "CPF, as XXX.XXX-XX")
+
+	if err := parseFlags(fs, args); err != nil {
+		return err
+	}
+
+	if cpf == "" {
+		return newUsageError("-cpf is needed")
+	}
+
+	if err := cli.login(ctx, cpf); err != nil {
+		return err
+	}
+
+	if cli.json {
+		return cli.printJSON(map[string]int{"id": cli.cfg.AccountID})
+	}
+
+	fmt.Fprintf(cli.stdout, "Logged in to account %d\n", cli.cfg.AccountID)
+
+	return nil
+}
+
+// Log in as cpf and save the session.
+func (cli *cli) login(ctx context.Context, cpf string) error {
+	secret, err := cli.readSecret(cpf)
+
+	if err != nil {
+		return err
+	}
+
+	if err = cli.bank.Login(ctx, cpf, secret); err != nil {
+		return err
+	}
+
+	id, err := cli.bank.AccountID(ctx)
+
+	if err != nil {
+		return err
+	}
+
+	cli.cfg.CPF = cpf
+	cli.cfg.AccountID = id
+	cli.cfg.Token = cli.bank.Token()
+
+	return saveConfig(cli.cfgPath, cli.cfg)
+}
+
+func logout(ctx context.Context, cli *cli, args []string) error {
+	if err := parseFlags(cli.newFlagSet("logout"), args); err != nil {
+		return err
+	}
+
+	cli.cfg.CPF = ""
+	cli.cfg.AccountID = 0
+	cli.cfg.Token = ""
+	cli.bank.SetToken("")
+
+	return saveConfig(cli.cfgPath, cli.cfg)
+}
+
+func balance(ctx context.Context, cli *cli, args []string) error {
+	var id int
+
+	fs := cli.newFlagSet("balance")
+	fs.IntVar(&id, "account", cli.cfg.AccountID,
+		"Account id, defaults to the logged in one")
+
+	if err := parseFlags(fs, args); err != nil {
+		return err
+	}
+
+	if id == 0 {
+		return newUsageError("-account is needed when not logged in")
+	}
+
+	bal, err := cli.bank.Balance(ctx, id)
+
+	if err != nil {
+		return err
+	}
+
+	return cli.printBalance(bal)
+}
+
+func transfer(ctx context.Context, cli *cli, args []string) error {
+	var req client.TransferRequest
+
+	fs := cli.newFlagSet("transfer")
+	fs.IntVar(&req.DestinationID, "to", 0, "Id of the destination")
+	fs.StringVar(&req.DestinationKey, "to-key", "",
+		"Transfer key of the destination")
+	fs.Var(moneyFlag{&req.Amount}, "amount", "Amount, e.g. 10.50")
+	fs.StringVar(&req.Description, "description", "", "Description")
+	fs.StringVar(&req.Reference, "reference", "",
+		"Id in your own systems, e.g. an invoice number")
+	fs.StringVar(&req.IdempotencyKey, "idempotency-key", "",
+		"Key to run the same transfer again safely")
+
+	if err := parseFlags(fs, args); err != nil {
+		return err
+	}
+
+	if (req.DestinationID == 0) == (req.DestinationKey == "") {
+		return newUsageError("one of -to and -to-key is needed")
+	} else if req.Amount <= 0 {
+		return newUsageError("a positive -amount is needed")
+	}
+
+	result, err := cli.bank.Transfer(ctx, req)
+
+	if err != nil {
+		return err
+	}
+
+	return cli.printTransferResult(result)
+}
+
+func listTransfers(ctx context.Context, cli *cli, args []string) error {
+	var opts client.ListTransfersOptions
+	var minAmount, maxAmount client.Money
+
+	fs := cli.newFlagSet("transfers list")
+	addPageFlags(fs, &opts.PageOptions)
+	fs.StringVar(&opts.Direction, "direction", "", "sent or received")
+	fs.IntVar(&opts.Counterparty, "counterparty", 0,
+		"Only transfers with this account")
+	fs.Var(moneyFlag{&minAmount}, "min", "Smallest amount")
+	fs.Var(moneyFlag{&maxAmount}, "max", "Largest amount")
+	fs.Var(timeFlag{time: &opts.From}, "from", "Only transfers since")
+	fs.Var(timeFlag{time: &opts.To, endOfDay: true}, "to",
+		"Only transfers until, including the day if a date")
+	fs.StringVar(&opts.Reference, "reference", "",
+		"Only transfers with this reference")
+	fs.StringVar(&opts.Description, "description", "",
+		"Only transfers whose description contains this")
+
+	if err := parseFlags(fs, args); err != nil {
+		return err
+	}
+
+	fs.Visit(func(f *flag.Flag) {
+		switch f.Name {
+		case "min":
+			opts.MinAmount = &minAmount
+		case "max":
+			opts.MaxAmount = &maxAmount
+		}
+	})
+
+	page, err := cli.bank.ListTransfers(ctx, opts)
+
+	if err != nil {
+		return err
+	}
+
+	return cli.printTransfers(page, page.Transfers, page.NextCursor)
+}
+
+func adminPending(ctx context.Context, cli *cli, args []string) error {
+	if err := parseFlags(cli.newFlagSet("admin pending"), args); err != nil {
+		return err
+	}
+
+	pendings, err := cli.bank.PendingTransfers(ctx)
+
+	if err != nil {
+		return err
+	}
+
+	return cli.printPendingTransfers(pendings, pendings)
+}
+
+func adminApprove(ctx context.Context, cli *cli, args []string) error {
+	id, err := parseFlagsWithID(cli.newFlagSet("admin approve"), args)
+
+	if err != nil {
+		return err
+	}
+
+	pending, err := cli.bank.ApprovePendingTransfer(ctx, id)
+
+	if err != nil {
+		return err
+	}
+
+	return cli.printPendingTransfers(pending,
+		[]client.PendingTransfer{*pending})
+}
+
+func adminReject(ctx context.Context, cli *cli, args []string) error {
+	id, err := parseFlagsWithID(cli.newFlagSet("admin reject"), args)
+
+	if err != nil {
+		return err
+	}
+
+	pending, err := cli.bank.RejectPendingTransfer(ctx, id)
+
+	if err != nil {
+		return err
+	}
+
+	return cli.printPendingTransfers(pending,
+		[]client.PendingTransfer{*pending})
+}
+
+func adminFreeze(ctx context.Context, cli *cli, args []string) error {
+	return setAccountFrozen(ctx, cli, args, true)
+}
+
+func adminUnfreeze(ctx context.Context, cli *cli, args []string) error {
+	return setAccountFrozen(ctx, cli, args, false)
+}
+
+func setAccountFrozen(ctx context.Context, cli *cli, args []string,
+	freeze bool) error {
+
+	var reason string
+
+	name := "admin unfreeze"
+
+	if freeze {
+		name = "admin freeze"
+	}
+
+	fs := cli.newFlagSet(name)
+	fs.StringVar(&reason, "reason", "", "Why, kept with the change")
+
+	id, err := parseFlagsWithID(fs, args)
+
+	if err != nil {
+		return err
+	}
+
+	if reason == "" {
+		return newUsageError("-reason is needed")
+	}
+
+	var change *client.StatusChange
+
+	if freeze {
+		change, err = cli.bank.FreezeAccount(ctx, id, reason)
+	} else {
+		change, err = cli.bank.UnfreezeAccount(ctx, id, reason)
+	}
+
+	if err != nil {
+		return err
+	}
+
+	return cli.printStatusChange(change)
+}
+
+func adminOverdraft(ctx context.Context, cli *cli, args []string) error {
+	var limit client.Money
+
+	fs := cli.newFlagSet("admin overdraft")
+	fs.Var(moneyFlag{&limit}, "limit", "Overdraft limit, e.g. 500.00")
+
+	id, err := parseFlagsWithID(fs, args)
+
+	if err != nil {
+		return err
+	}
+
+	limitSet := false
+
+	fs.Visit(func(f *flag.Flag) {
+		limitSet = limitSet || f.Name == "limit"
+	})
+
+	if !limitSet {
+		return newUsageError("-limit is needed")
+	}
+
+	bal, err := cli.bank.SetOverdraftLimit(ctx, id, limit)
+
+	if err != nil {
+		return err
+	}
+
+	return cli.printBalance(bal)
+}
+
+func adminInterest(ctx context.Context, cli *cli, args []string) error {
+	var date time.Time
+
+	fs := cli.newFlagSet("admin interest")
+	fs.Var(timeFlag{time: &date}, "date", "Date to run the interest for")
+
+	if err := parseFlags(fs, args); err != nil {
+		return err
+	}
+
+	if date.IsZero() {
+		return newUsageError("-date is needed")
+	}
+
+	run, err := cli.bank.RunInterest(ctx, date)
+
+	if err != nil {
+		return err
+	}
+
+	return cli.printInterestRun(run)
+}
@@ -0,0 +1,81 @@
+package main
+
+import (
+	"encoding/json"
+	"os"
+	"path/filepath"
+)
+
+const defaultURL = "https://localhost:8080"
+
+// What's kept between commands. The secret never is, only the token, which
+// expires.
+type config struct {
+	URL string `json:"url"`
+	// File with the certificate that signed the API's
+	CACert   string `json:"cacert,omitempty"`
+	Insecure bool   `json:"insecure,omitempty"`
+
+	// The session
+	CPF       string `json:"cpf,omitempty"`
+	AccountID int    `json:"account_id,omitempty"`
+	Token     string `json:"token,omitempty"`
+}
+
+// $PEDROBANK_CONFIG, or pedro-bank/config.json in the user's config
+// directory, e.g. ~/.config on Linux.
+func defaultConfigPath() string {
+	if path := os.Getenv(configEnv); path != "" {
+		return path
+	}
+
+	dir, err := os.UserConfigDir()
+
+	if err != nil {
+		return ".pedro-bank.json"
+	}
+
+	return filepath.Join(dir, "pedro-bank", "config.json")
+}
+
+// The config in path, or the default one if there's no file yet.
+func loadConfig(path string) (*config, error) {
+	cfg := config{URL: defaultURL}
+
+	data, err := os.ReadFile(path)
+
+	if os.IsNotExist(err) {
+		return &cfg, nil
+	} else if err != nil {
+		return nil, err
+	}
+
+	if err = json.Unmarshal(data, &cfg); err != nil {
+		return nil, err
+	}
+
+	return &cfg, nil
+}
+
+// Write cfg to path, readable only by the user since it has the token.
+func saveConfig(path string, cfg *config) error {
+	data, err := json.MarshalIndent(cfg, "", "  ")
+
+	if err != nil {
+		return err
+	}
+
+	if err = os.MkdirAll(filepath.Dir(path), 0700); err != nil {
+		return err
+	}
+
+	// Write a new file and rename it, so a failed write doesn't lose the
+	// old config
+	tmp := path + ".tmp"
+
+	if err = os.WriteFile(tmp, append(data, '\n'), 0600); err != nil {
+		return err
+	}
+
+	return os.Rename(tmp, path)
+}
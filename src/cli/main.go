@@ -0,0 +1,334 @@
+// Command pedro-bank is a command line client of the PedroBank API.
+//
+//	pedro-bank login -cpf 123.456-78
+//	pedro-bank balance
+//	pedro-bank transfer -to 2 -amount 34.72
+//	pedro-bank transfers list -direction sent
+//
+// The session is kept in a config file, so commands don't need the token.
+// Run pedro-bank help for all the commands.
+package main
+
+import (
+	"bufio"
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"strings"
+	"time"
+
+	"pedro-bank/client"
+)
+
+// Environment variable with the secret, to log in without a prompt, and
+// again when the token expires.
+const secretEnv = "PEDROBANK_SECRET"
+
+// Environment variable with the path of the config file.
+const configEnv = "PEDROBANK_CONFIG"
+
+const requestTimeout = 30 * time.Second
+
+// A command, e.g. transfers list.
+type command struct {
+	name  string
+	usage string
+	// Needs a login
+	auth bool
+	run  func(ctx context.Context, cli *cli, args []string) error
+}
+
+var commands []command
+
+func init() {
+	commands = []command{
+		{"accounts create", "-name NAME -cpf CPF [-timezone TZ]",
+			false, createAccount},
+		{"accounts list", "[-limit N] [-cursor C] [-sort S] [-order O]",
+			false, listAccounts},
+		{"login", "-cpf CPF", false, login},
+		{"logout", "", false, logout},
+		{"balance", "[-account ID]", false, balance},
+		{"transfer", "-to ID|-to-key KEY -amount AMOUNT " +
+			"[-description D] [-reference R] [-idempotency-key K]",
+			true, transfer},
+		{"transfers list", "[-limit N] [-cursor C] [-sort S] [-order O] " +
+			"[-direction sent|received] [-counterparty ID] [-min AMOUNT] " +
+			"[-max AMOUNT] [-from DATE] [-to DATE] [-reference R] " +
+			"[-description D]", true, listTransfers},
+		{"admin pending", "", true, adminPending},
+		{"admin approve", "ID", true, adminApprove},
+		{"admin reject", "ID", true, adminReject},
+		{"admin freeze", "ID -reason REASON", true, adminFreeze},
+		{"admin unfreeze", "ID -reason REASON", true, adminUnfreeze},
+		{"admin overdraft", "ID -limit AMOUNT", true, adminOverdraft},
+		{"admin interest", "-date YYYY-MM-DD", true, adminInterest},
+	}
+}
+
+// What the commands share.
+type cli struct {
+	cfgPath string
+	cfg     *config
+	bank    *client.Client
+	// Print JSON instead of tables
+	json   bool
+	stdin  *bufio.Reader
+	stdout io.Writer
+	stderr io.Writer
+}
+
+// An error in the arguments, printed with the usage of the command.
+type usageError struct {
+	msg string
+}
+
+func (err *usageError) Error() string {
+	return err.msg
+}
+
+func newUsageError(format string, args ...interface{}) error {
+	return &usageError{fmt.Sprintf(format, args...)}
+}
+
+func main() {
+	os.Exit(run(os.Args[1:], os.Stdin, os.Stdout, os.Stderr))
+}
+
+// Run the command in args, and return the exit status.
+func run(args []string, stdin io.Reader, stdout io.Writer,
+	stderr io.Writer) int {
+
+	cli := &cli{
+		stdin:  bufio.NewReader(stdin),
+		stdout: stdout,
+		stderr: stderr,
+	}
+
+	var apiURL, caCert string
+	var insecure bool
+
+	global := flag.NewFlagSet("pedro-bank", flag.ContinueOnError)
+	global.SetOutput(stderr)
+	global.Usage = func() { printUsage(stderr) }
+	global.StringVar(&cli.cfgPath, "config", defaultConfigPath(),
+		"Config file with the session")
+	global.StringVar(&apiURL, "url", "", "URL of the API, e.g. "+defaultURL)
+	global.StringVar(&caCert, "cacert", "",
+		"File with the certificate that signed the API's")
+	global.BoolVar(&insecure, "insecure", false,
+		"Don't verify the API's certificate")
+	global.BoolVar(&cli.json, "json", false, "Print JSON instead of tables")
+
+	if err := global.Parse(args); err != nil {
+		return 2
+	}
+
+	if global.NArg() == 1 && global.Arg(0) == "help" {
+		printUsage(stdout)
+		return 0
+	}
+
+	cmd, args := findCommand(global.Args())
+
+	if cmd == nil {
+		printUsage(stderr)
+		return 2
+	}
+
+	cfg, err := loadConfig(cli.cfgPath)
+
+	if err != nil {
+		fmt.Fprintln(stderr, "pedro-bank:", err)
+		return 1
+	}
+
+	// Given flags override the config, and are saved by login
+	global.Visit(func(f *flag.Flag) {
+		switch f.Name {
+		case "url":
+			cfg.URL = apiURL
+		case "cacert":
+			cfg.CACert = caCert
+		case "insecure":
+			cfg.Insecure = insecure
+		}
+	})
+
+	cli.cfg = cfg
+
+	httpClient, err := newHTTPClient(cfg)
+
+	if err != nil {
+		fmt.Fprintln(stderr, "pedro-bank:", err)
+		return 1
+	}
+
+	cli.bank = client.New(cfg.URL, httpClient)
+	cli.bank.SetToken(cfg.Token)
+
+	if secret := os.Getenv(secretEnv); secret != "" && cfg.CPF != "" {
+		cli.bank.SetCredentials(cfg.CPF, secret)
+	}
+
+	err = cli.runCommand(cmd, args)
+
+	var usageErr *usageError
+
+	if errors.As(err, &usageErr) {
+		fmt.Fprintf(stderr, "pedro-bank %s: %s\nusage: pedro-bank %s %s\n",
+			cmd.name, usageErr.msg, cmd.name, cmd.usage)
+		return 2
+	} else if err == flag.ErrHelp {
+		return 2
+	} else if err != nil {
+		fmt.Fprintf(stderr, "pedro-bank %s: %s\n", cmd.name,
+			errorMessage(err))
+		return 1
+	}
+
+	return 0
+}
+
+// Run cmd. If the session expired, ask for the secret, log in again and run
+// it once more: the API refuses the token before doing anything.
+func (cli *cli) runCommand(cmd *command, args []string) error {
+	if cmd.auth && cli.cfg.Token == "" {
+		return errors.New("not logged in, run pedro-bank login first")
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), requestTimeout)
+	err := cmd.run(ctx, cli, args)
+	cancel()
+
+	if cmd.auth && errors.Is(err, client.ErrUnauthorized) &&
+		cli.cfg.CPF != "" {
+
+		fmt.Fprintln(cli.stderr, "The session expired.")
+
+		ctx, cancel = context.WithTimeout(context.Background(),
+			requestTimeout)
+		defer cancel()
+
+		if err = cli.login(ctx, cli.cfg.CPF); err != nil {
+			return err
+		}
+
+		err = cmd.run(ctx, cli, args)
+	}
+
+	// The client may have logged in again by itself
+	if token := cli.bank.Token(); cmd.auth && token != cli.cfg.Token {
+		cli.cfg.Token = token
+
+		if saveErr := saveConfig(cli.cfgPath, cli.cfg); saveErr != nil {
+			fmt.Fprintln(cli.stderr, "pedro-bank:", saveErr)
+		}
+	}
+
+	return err
+}
+
+// The command named by the first words of args, and the rest of args.
+func findCommand(args []string) (*command, []string) {
+	if len(args) >= 2 {
+		for i := range commands {
+			if commands[i].name == args[0]+" "+args[1] {
+				return &commands[i], args[2:]
+			}
+		}
+	}
+
+	if len(args) >= 1 {
+		for i := range commands {
+			if commands[i].name == args[0] {
+				return &commands[i], args[1:]
+			}
+		}
+	}
+
+	return nil, nil
+}
+
+func printUsage(out io.Writer) {
+	fmt.Fprintln(out, "usage: pedro-bank [-config FILE] [-url URL] "+
+		"[-cacert FILE] [-insecure] [-json] COMMAND [ARGS]")
+	fmt.Fprintln(out, "\ncommands:")
+
+	for _, cmd := range commands {
+		fmt.Fprintln(out, strings.TrimSpace("  "+cmd.name+" "+cmd.usage))
+	}
+
+	fmt.Fprintf(out, "\nThe secret is read from $%s, or asked for.\n",
+		secretEnv)
+}
+
+// The message of err for people, with the request id of API errors.
+func errorMessage(err error) string {
+	var apiErr *client.Error
+
+	if !errors.As(err, &apiErr) {
+		return err.Error()
+	}
+
+	msg := apiErr.Message
+
+	if apiErr.RequestID != "" {
+		msg += " (request " + apiErr.RequestID + ")"
+	}
+
+	return msg
+}
+
+// The HTTP client for the API, trusting the certificate in cfg.CACert if
+// set, since the API's certificate is usually self-signed.
+func newHTTPClient(cfg *config) (*http.Client, error) {
+	tlsConfig := &tls.Config{InsecureSkipVerify: cfg.Insecure}
+
+	if cfg.CACert != "" {
+		pem, err := os.ReadFile(cfg.CACert)
+
+		if err != nil {
+			return nil, err
+		}
+
+		tlsConfig.RootCAs = x509.NewCertPool()
+
+		if !tlsConfig.RootCAs.AppendCertsFromPEM(pem) {
+			return nil, fmt.Errorf("no certificate in %s", cfg.CACert)
+		}
+	}
+
+	transport := http.DefaultTransport.(*http.Transport).Clone()
+	transport.TLSClientConfig = tlsConfig
+
+	return &http.Client{Transport: transport}, nil
+}
+
+// The secret, from the environment or asked for.
+func (cli *cli) readSecret(cpf string) (string, error) {
+	if secret := os.Getenv(secretEnv); secret != "" {
+		return secret, nil
+	}
+
+	fmt.Fprintf(cli.stderr, "Secret for %s: ", cpf)
+
+	line, err := cli.stdin.ReadString('\n')
+	line = strings.TrimRight(line, "\r\n")
+
+	if line == "" {
+		if err == nil || err == io.EOF {
+			err = errors.New("no secret given")
+		}
+
+		return "", err
+	}
+
+	return line, nil
+}
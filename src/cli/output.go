@@ -0,0 +1,157 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"strconv"
+	"text/tabwriter"
+	"time"
+
+	"pedro-bank/client"
+)
+
+// Print v as indented JSON.
+func (cli *cli) printJSON(v interface{}) error {
+	enc := json.NewEncoder(cli.stdout)
+	enc.SetIndent("", "  ")
+
+	return enc.Encode(v)
+}
+
+// Print rows as a table with header, or v as JSON.
+func (cli *cli) printTable(v interface{}, header []string, rows [][]string,
+	nextCursor string) error {
+
+	if cli.json {
+		return cli.printJSON(v)
+	}
+
+	tw := tabwriter.NewWriter(cli.stdout, 0, 0, 2, ' ', 0)
+
+	for _, row := range append([][]string{header}, rows...) {
+		for i, cell := range row {
+			if i > 0 {
+				fmt.Fprint(tw, "\t")
+			}
+
+			fmt.Fprint(tw, cell)
+		}
+
+		fmt.Fprintln(tw)
+	}
+
+	if err := tw.Flush(); err != nil {
+		return err
+	}
+
+	if nextCursor != "" {
+		fmt.Fprintf(cli.stdout, "\nMore with -cursor %s\n", nextCursor)
+	}
+
+	return nil
+}
+
+func formatTime(t time.Time) string {
+	return t.Local().Format("2006-01-02 15:04:05")
+}
+
+func formatIDPtr(id *int) string {
+	if id == nil {
+		return "-"
+	}
+
+	return strconv.Itoa(*id)
+}
+
+func (cli *cli) printAccounts(v interface{}, accs []client.Account,
+	nextCursor string) error {
+
+	rows := make([][]string, 0, len(accs))
+
+	for _, acc := range accs {
+		rows = append(rows, []string{strconv.Itoa(acc.ID), acc.Name, acc.CPF,
+			acc.Balance.String(), acc.Status, formatTime(acc.CreatedAt)})
+	}
+
+	return cli.printTable(v, []string{"ID", "NAME", "CPF", "BALANCE",
+		"STATUS", "CREATED"}, rows, nextCursor)
+}
+
+func (cli *cli) printBalance(bal *client.Balance) error {
+	return cli.printTable(bal, []string{"BALANCE", "AVAILABLE",
+		"OVERDRAFT LIMIT", "OVERDRAFT USED", "STATUS"},
+		[][]string{{bal.Balance.String(), bal.Available.String(),
+			bal.OverdraftLimit.String(), bal.OverdraftUsed.String(),
+			bal.Status}}, "")
+}
+
+func (cli *cli) printTransfers(v interface{}, transfers []client.Transfer,
+	nextCursor string) error {
+
+	rows := make([][]string, 0, len(transfers))
+
+	for _, transf := range transfers {
+		rows = append(rows, []string{strconv.Itoa(transf.ID),
+			strconv.Itoa(transf.OriginID),
+			strconv.Itoa(transf.DestinationID), transf.Amount.String(),
+			transf.Fee.String(), formatTime(transf.CreatedAt),
+			transf.Description})
+	}
+
+	return cli.printTable(v, []string{"ID", "FROM", "TO", "AMOUNT", "FEE",
+		"CREATED", "DESCRIPTION"}, rows, nextCursor)
+}
+
+func (cli *cli) printPendingTransfers(v interface{},
+	pendings []client.PendingTransfer) error {
+
+	rows := make([][]string, 0, len(pendings))
+
+	for _, pending := range pendings {
+		rows = append(rows, []string{strconv.Itoa(pending.ID),
+			strconv.Itoa(pending.OriginID),
+			strconv.Itoa(pending.DestinationID), pending.Amount.String(),
+			pending.Rule, pending.Status, formatIDPtr(pending.TransferID),
+			formatTime(pending.CreatedAt)})
+	}
+
+	return cli.printTable(v, []string{"ID", "FROM", "TO", "AMOUNT", "RULE",
+		"STATUS", "TRANSFER", "CREATED"}, rows, "")
+}
+
+// Print the transfer made, or the pending transfer if it was held for
+// review.
+func (cli *cli) printTransferResult(result *client.TransferResult) error {
+	if result.Pending != nil {
+		if cli.json {
+			return cli.printJSON(result.Pending)
+		}
+
+		fmt.Fprintf(cli.stdout, "Held for review by the bank (rule %s), "+
+			"as pending transfer %d\n", result.Pending.Rule,
+			result.Pending.ID)
+
+		return nil
+	}
+
+	if result.Replayed && !cli.json {
+		fmt.Fprintln(cli.stderr, "Already made with this idempotency key.")
+	}
+
+	return cli.printTransfers(result.Transfer,
+		[]client.Transfer{*result.Transfer}, "")
+}
+
+func (cli *cli) printStatusChange(change *client.StatusChange) error {
+	return cli.printTable(change, []string{"ACCOUNT", "STATUS", "REASON",
+		"BY", "CREATED"}, [][]string{{strconv.Itoa(change.AccountID),
+		change.Status, change.Reason, strconv.Itoa(change.ChangedBy),
+		formatTime(change.CreatedAt)}}, "")
+}
+
+func (cli *cli) printInterestRun(run *client.InterestRun) error {
+	return cli.printTable(run, []string{"DATE", "ACCRUED", "PENDING",
+		"POSTED", "CHARGED"}, [][]string{{run.Date,
+		strconv.Itoa(run.Accrued), strconv.Itoa(run.Pending),
+		strconv.Itoa(run.Posted), strconv.Itoa(run.Charged)}}, "")
+}
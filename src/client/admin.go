@@ -0,0 +1,136 @@
+package client
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"net/url"
+	"time"
+)
+
+// The methods in this file need the client to be logged in as an admin.
+
+// The transfers waiting for review.
+func (c *Client) PendingTransfers(ctx context.Context) ([]PendingTransfer,
+	error) {
+
+	var pendings []PendingTransfer
+
+	_, err := c.do(ctx, &request{
+		method: http.MethodGet,
+		path:   "/admin/pending-transfers",
+		auth:   true,
+		retry:  true,
+	}, &pendings)
+
+	return pendings, err
+}
+
+// Approve the pending transfer with id, making the transfer. Not retried,
+// the transfer may have been made by a try that failed to respond.
+func (c *Client) ApprovePendingTransfer(ctx context.Context,
+	id int) (*PendingTransfer, error) {
+
+	return c.reviewPendingTransfer(ctx, id, "approve")
+}
+
+// Reject the pending transfer with id.
+func (c *Client) RejectPendingTransfer(ctx context.Context,
+	id int) (*PendingTransfer, error) {
+
+	return c.reviewPendingTransfer(ctx, id, "reject")
+}
+
+func (c *Client) reviewPendingTransfer(ctx context.Context, id int,
+	action string) (*PendingTransfer, error) {
+
+	var pending PendingTransfer
+
+	_, err := c.do(ctx, &request{
+		method: http.MethodPost,
+		path:   fmt.Sprintf("/admin/pending-transfers/%d/%s", id, action),
+		auth:   true,
+	}, &pending)
+
+	if err != nil {
+		return nil, err
+	}
+
+	return &pending, nil
+}
+
+// Freeze the account with id, so it can't send money.
+func (c *Client) FreezeAccount(ctx context.Context, id int,
+	reason string) (*StatusChange, error) {
+
+	return c.setAccountFrozen(ctx, id, "freeze", reason)
+}
+
+// Unfreeze the account with id.
+func (c *Client) UnfreezeAccount(ctx context.Context, id int,
+	reason string) (*StatusChange, error) {
+
+	return c.setAccountFrozen(ctx, id, "unfreeze", reason)
+}
+
+func (c *Client) setAccountFrozen(ctx context.Context, id int,
+	action string, reason string) (*StatusChange, error) {
+
+	var change StatusChange
+
+	_, err := c.do(ctx, &request{
+		method: http.MethodPost,
+		path:   fmt.Sprintf("/admin/accounts/%d/%s", id, action),
+		body:   map[string]string{"reason": reason},
+		auth:   true,
+	}, &change)
+
+	if err != nil {
+		return nil, err
+	}
+
+	return &change, nil
+}
+
+// Set how far below zero the balance of the account with id can go.
+func (c *Client) SetOverdraftLimit(ctx context.Context, id int,
+	limit Money) (*Balance, error) {
+
+	var balance Balance
+
+	_, err := c.do(ctx, &request{
+		method: http.MethodPost,
+		path:   fmt.Sprintf("/admin/accounts/%d/overdraft", id),
+		body:   map[string]Money{"limit": limit},
+		auth:   true,
+		retry:  true,
+	}, &balance)
+
+	if err != nil {
+		return nil, err
+	}
+
+	return &balance, nil
+}
+
+// Run the interest for date, which is safe to run again: accounts already
+// accrued for the date are skipped.
+func (c *Client) RunInterest(ctx context.Context,
+	date time.Time) (*InterestRun, error) {
+
+	var run InterestRun
+
+	_, err := c.do(ctx, &request{
+		method: http.MethodPost,
+		path:   "/admin/interest",
+		query:  url.Values{"date": {date.Format("2006-01-02")}},
+		auth:   true,
+		retry:  true,
+	}, &run)
+
+	if err != nil {
+		return nil, err
+	}
+
+	return &run, nil
+}
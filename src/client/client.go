@@ -0,0 +1,513 @@
+// Package client is a Go client for the PedroBank API.
+//
+//	bank := client.New("https://localhost:8080", nil)
+//
+//	if err := bank.Login(ctx, "123.456-78", "secret"); err != nil {
+//	    ...
+//	}
+//
+//	result, err := bank.Transfer(ctx, client.TransferRequest{
+//	    DestinationID: 2, Amount: 1050})
+//
+// The client logs in again when the token expires, and retries requests
+// that are safe to retry when the server can't be reached or fails.
+// Transfers are sent with an idempotency key, so retrying them never
+// transfers twice.
+package client
+
+import (
+	"bytes"
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"strconv"
+	"sync"
+	"time"
+)
+
+const defaultMaxRetries = 3
+const defaultRetryWait = 200 * time.Millisecond
+
+// Largest response read, the API's responses are much smaller.
+const maxResponseLen = 4 << 20
+
+// A client of the API. Safe to use from several goroutines.
+type Client struct {
+	baseURL    string
+	httpClient *http.Client
+	maxRetries int
+	retryWait  time.Duration
+
+	mu     sync.Mutex
+	token  string
+	cpf    string
+	secret string
+}
+
+// A client of the API at baseURL, e.g. https://localhost:8080, sending
+// requests with httpClient, or http.DefaultClient if nil.
+func New(baseURL string, httpClient *http.Client) *Client {
+	if httpClient == nil {
+		httpClient = http.DefaultClient
+	}
+
+	return &Client{
+		baseURL:    baseURL,
+		httpClient: httpClient,
+		maxRetries: defaultMaxRetries,
+		retryWait:  defaultRetryWait,
+	}
+}
+
+// Retry requests up to maxRetries times after the first try, waiting wait
+// before the first retry and twice as long before each of the next ones.
+func (c *Client) SetRetries(maxRetries int, wait time.Duration) {
+	c.maxRetries = maxRetries
+	c.retryWait = wait
+}
+
+// The token of the last login, for the Authorization header.
+func (c *Client) Token() string {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	return c.token
+}
+
+// Use a token from an earlier login, e.g. one saved by a command-line tool.
+func (c *Client) SetToken(token string) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	c.token = token
+}
+
+// Log in with cpf and secret when the token expires, without logging in
+// now.
+func (c *Client) SetCredentials(cpf string, secret string) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	c.cpf, c.secret = cpf, secret
+}
+
+// Options of a request, for do.
+type request struct {
+	method string
+	path   string
+	query  url.Values
+	body   interface{}
+	// Send the token, and log in again if it expired
+	auth bool
+	// Safe to send more than once, e.g. with an idempotency key
+	retry          bool
+	idempotencyKey string
+}
+
+// A random idempotency key.
+func newIdempotencyKey() (string, error) {
+	var key [16]byte
+
+	if _, err := rand.Read(key[:]); err != nil {
+		return "", err
+	}
+
+	return hex.EncodeToString(key[:]), nil
+}
+
+// Whether a failed response is worth retrying, if the request is safe to
+// retry.
+func retryable(status int, err *Error) bool {
+	return status >= http.StatusInternalServerError ||
+		errors.Is(err, ErrTryAgain) || errors.Is(err, ErrIdempotencyKeyInUse)
+}
+
+// Wait before the retry after attempt, unless ctx is done first.
+func (c *Client) wait(ctx context.Context, attempt int) error {
+	timer := time.NewTimer(c.retryWait << uint(attempt))
+	defer timer.Stop()
+
+	select {
+	case <-ctx.Done():
+		return ctx.Err()
+	case <-timer.C:
+		return nil
+	}
+}
+
+// Send a request, retrying and logging in again as needed, and decode the
+// response's JSON into out, if not nil. Returns the response of the last
+// try.
+func (c *Client) do(ctx context.Context, r *request,
+	out interface{}) (*http.Response, error) {
+
+	var body []byte
+
+	if r.body != nil {
+		var err error
+		body, err = json.Marshal(r.body)
+
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	reqURL := c.baseURL + r.path
+
+	if len(r.query) > 0 {
+		reqURL += "?" + r.query.Encode()
+	}
+
+	relogged := false
+
+	for attempt := 0; ; attempt++ {
+		token := c.Token()
+		resp, data, err := c.send(ctx, r, reqURL, body, token)
+
+		if err != nil {
+			if !r.retry || attempt >= c.maxRetries || ctx.Err() != nil {
+				return nil, err
+			}
+		} else if resp.StatusCode < http.StatusBadRequest {
+			if out != nil && len(data) > 0 {
+				err = json.Unmarshal(data, out)
+			}
+
+			return resp, err
+		} else {
+			apiErr := parseError(resp, data)
+
+			// A login again doesn't count as a retry
+			if resp.StatusCode == http.StatusUnauthorized && r.auth &&
+				!relogged {
+
+				relogged = true
+				attempt--
+
+				ok, err := c.relogin(ctx, token)
+
+				if err != nil {
+					return resp, err
+				} else if !ok {
+					return resp, apiErr
+				}
+
+				continue
+			}
+
+			if !r.retry || attempt >= c.maxRetries ||
+				!retryable(resp.StatusCode, apiErr) {
+
+				return resp, apiErr
+			}
+		}
+
+		if err = c.wait(ctx, attempt); err != nil {
+			return nil, err
+		}
+	}
+}
+
+// Send a request once, and read the response.
+func (c *Client) send(ctx context.Context, r *request, reqURL string,
+	body []byte, token string) (*http.Response, []byte, error) {
+
+	var bodyReader io.Reader
+
+	if body != nil {
+		bodyReader = bytes.NewReader(body)
+	}
+
+	req, err := http.NewRequestWithContext(ctx, r.method, reqURL, bodyReader)
+
+	if err != nil {
+		return nil, nil, err
+	}
+
+	if body != nil {
+		req.Header.Set("Content-Type", "application/json")
+	}
+
+	if r.auth {
+		req.Header.Set("Authorization", token)
+	}
+
+	if r.idempotencyKey != "" {
+		req.Header.Set("Idempotency-Key", r.idempotencyKey)
+	}
+
+	resp, err := c.httpClient.Do(req)
+
+	if err != nil {
+		return nil, nil, err
+	}
+
+	defer resp.Body.Close()
+
+	data, err := io.ReadAll(io.LimitReader(resp.Body, maxResponseLen))
+
+	if err != nil {
+		return nil, nil, err
+	}
+
+	return resp, data, nil
+}
+
+// Log in again after usedToken was refused, unless another request already
+// did. Returns false if the client never logged in, so it can't.
+func (c *Client) relogin(ctx context.Context, usedToken string) (bool,
+	error) {
+
+	c.mu.Lock()
+	token, cpf, secret := c.token, c.cpf, c.secret
+	c.mu.Unlock()
+
+	if token != usedToken {
+		return true, nil
+	}
+
+	if cpf == "" {
+		return false, nil
+	}
+
+	return true, c.Login(ctx, cpf, secret)
+}
+
+// Create an account. Not retried, since the account may have been created
+// by a try that failed to respond.
+func (c *Client) CreateAccount(ctx context.Context,
+	req CreateAccountRequest) (*Account, error) {
+
+	var acc Account
+
+	_, err := c.do(ctx, &request{
+		method: http.MethodPost,
+		path:   "/accounts",
+		body:   &req,
+	}, &acc)
+
+	if err != nil {
+		return nil, err
+	}
+
+	return &acc, nil
+}
+
+// Log in, and keep the CPF and secret to log in again when the token
+// expires.
+func (c *Client) Login(ctx context.Context, cpf string, secret string) error {
+	var tok struct {
+		Token string `json:"token"`
+	}
+
+	_, err := c.do(ctx, &request{
+		method: http.MethodPost,
+		path:   "/login",
+		body:   map[string]string{"cpf": cpf, "secret": secret},
+		retry:  true,
+	}, &tok)
+
+	if err != nil {
+		return err
+	}
+
+	c.mu.Lock()
+	c.token, c.cpf, c.secret = tok.Token, cpf, secret
+	c.mu.Unlock()
+
+	return nil
+}
+
+// The id of the logged in account.
+func (c *Client) AccountID(ctx context.Context) (int, error) {
+	var resp struct {
+		ID int `json:"id"`
+	}
+
+	_, err := c.do(ctx, &request{
+		method: http.MethodGet,
+		path:   "/id",
+		auth:   true,
+		retry:  true,
+	}, &resp)
+
+	return resp.ID, err
+}
+
+// A page of all the accounts.
+func (c *Client) ListAccounts(ctx context.Context,
+	opts ListAccountsOptions) (*AccountPage, error) {
+
+	query := url.Values{}
+	opts.PageOptions.addTo(query)
+
+	var page AccountPage
+
+	_, err := c.do(ctx, &request{
+		method: http.MethodGet,
+		path:   "/accounts",
+		query:  query,
+		retry:  true,
+	}, &page)
+
+	if err != nil {
+		return nil, err
+	}
+
+	return &page, nil
+}
+
+// The balance of the account with id.
+func (c *Client) Balance(ctx context.Context, id int) (*Balance, error) {
+	var balance Balance
+
+	_, err := c.do(ctx, &request{
+		method: http.MethodGet,
+		path:   fmt.Sprintf("/accounts/%d/balance", id),
+		retry:  true,
+	}, &balance)
+
+	if err != nil {
+		return nil, err
+	}
+
+	return &balance, nil
+}
+
+// Transfer from the logged in account. The result has the pending transfer
+// instead of the transfer when the bank holds it for review.
+func (c *Client) Transfer(ctx context.Context,
+	req TransferRequest) (*TransferResult, error) {
+
+	key := req.IdempotencyKey
+
+	if key == "" {
+		var err error
+		key, err = newIdempotencyKey()
+
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	var data json.RawMessage
+
+	resp, err := c.do(ctx, &request{
+		method:         http.MethodPost,
+		path:           "/transfers",
+		body:           &req,
+		auth:           true,
+		retry:          true,
+		idempotencyKey: key,
+	}, &data)
+
+	if err != nil {
+		return nil, err
+	}
+
+	result := TransferResult{
+		Replayed: resp.Header.Get("Idempotent-Replayed") == "true"}
+
+	if resp.StatusCode == http.StatusAccepted {
+		result.Pending = &PendingTransfer{}
+		err = json.Unmarshal(data, result.Pending)
+	} else {
+		result.Transfer = &Transfer{}
+		err = json.Unmarshal(data, result.Transfer)
+	}
+
+	if err != nil {
+		return nil, err
+	}
+
+	return &result, nil
+}
+
+// The size of the pages when PageOptions.Limit is 0, as on the server.
+const defaultPageLimit = 50
+
+// Add the options that aren't zero to query. The limit is always sent, since
+// without it the server responds to some lists with every row, as an array.
+func (opts PageOptions) addTo(query url.Values) {
+	for param, value := range map[string]string{
+		"cursor": opts.Cursor,
+		"sort":   opts.Sort,
+		"order":  opts.Order,
+	} {
+		if value != "" {
+			query.Set(param, value)
+		}
+	}
+
+	limit := opts.Limit
+
+	if limit == 0 {
+		limit = defaultPageLimit
+	}
+
+	query.Set("limit", strconv.Itoa(limit))
+}
+
+// A page of the transfers of the logged in account.
+func (c *Client) ListTransfers(ctx context.Context,
+	opts ListTransfersOptions) (*TransferPage, error) {
+
+	query := url.Values{}
+	opts.PageOptions.addTo(query)
+
+	for param, value := range map[string]string{
+		"direction":   opts.Direction,
+		"reference":   opts.Reference,
+		"description": opts.Description,
+	} {
+		if value != "" {
+			query.Set(param, value)
+		}
+	}
+
+	if opts.Counterparty != 0 {
+		query.Set("counterparty", strconv.Itoa(opts.Counterparty))
+	}
+
+	if opts.MinAmount != nil {
+		query.Set("min_amount", opts.MinAmount.String())
+	}
+
+	if opts.MaxAmount != nil {
+		query.Set("max_amount", opts.MaxAmount.String())
+	}
+
+	if !opts.From.IsZero() {
+		query.Set("from", opts.From.Format(time.RFC3339))
+	}
+
+	if !opts.To.IsZero() {
+		query.Set("to", opts.To.Format(time.RFC3339))
+	}
+
+	for key, value := range opts.Metadata {
+		query.Set("metadata."+key, value)
+	}
+
+	var page TransferPage
+
+	_, err := c.do(ctx, &request{
+		method: http.MethodGet,
+		path:   "/transfers",
+		query:  query,
+		auth:   true,
+		retry:  true,
+	}, &page)
+
+	if err != nil {
+		return nil, err
+	}
+
+	return &page, nil
+}
@@ -0,0 +1,278 @@
+package client
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestMoney(t *testing.T) {
+	var values = []struct {
+		money Money
+		json  string
+	}{
+		{0, "0.00"},
+		{5, "0.05"},
+		{1050, "10.50"},
+		{-1050, "-10.50"},
+		{123456789, "1234567.89"},
+	}
+
+	for _, value := range values {
+		data, err := json.Marshal(value.money)
+
+		if err != nil || string(data) != value.json {
+			t.Error(value.money, string(data), err)
+		}
+
+		var parsed Money
+
+		err = json.Unmarshal([]byte(value.json), &parsed)
+
+		if err != nil || parsed != value.money {
+			t.Error(value.json, parsed, err)
+		}
+	}
+
+	for _, bad := range []string{"10.5", "10", `"10.50"`, "1e3"} {
+		var parsed Money
+
+		if json.Unmarshal([]byte(bad), &parsed) == nil {
+			t.Error("parsed", bad)
+		}
+	}
+}
+
+func TestParseMoney(t *testing.T) {
+	for str, money := range map[string]Money{
+		"10": 1000, "10.5": 1050, "10.50": 1050, "0.05": 5, "-0.50": -50} {
+
+		if parsed, err := ParseMoney(str); err != nil || parsed != money {
+			t.Error(str, parsed, err)
+		}
+	}
+
+	for _, bad := range []string{"", "10.", "10.505", ".50", "1e3", "R$10"} {
+		if _, err := ParseMoney(bad); err == nil {
+			t.Error("parsed", bad)
+		}
+	}
+}
+
+// Respond like the API does with an error.
+func respondWithError(rw http.ResponseWriter, status int, code string,
+	message string) {
+
+	rw.Header().Set("Content-Type", "application/json;charset=UTF-8")
+	rw.WriteHeader(status)
+	fmt.Fprintf(rw, `{"error": %[1]q, "code": %[2]q, "message": %[1]q,
+		"details": {"limit": "daily"}, "request_id": "req-1"}`, message,
+		code)
+}
+
+func newTestClient(handler http.HandlerFunc) (*Client, func()) {
+	server := httptest.NewServer(handler)
+	c := New(server.URL, server.Client())
+	c.SetRetries(2, time.Millisecond)
+
+	return c, server.Close
+}
+
+func TestLoginAgain(t *testing.T) {
+	logins := 0
+
+	c, done := newTestClient(func(rw http.ResponseWriter, req *http.Request) {
+		switch req.URL.Path {
+		case "/login":
+			logins++
+			fmt.Fprintf(rw, `{"token":"token-%d"}`, logins)
+		case "/transfers":
+			// The first token expired
+			if req.Header.Get("Authorization") != "token-2" {
+				respondWithError(rw, http.StatusUnauthorized, "unauthorized",
+					"unauthorized")
+				return
+			}
+
+			// Without a limit the server sends an array, not a page
+			if req.URL.Query().Get("direction") != "sent" ||
+				req.URL.Query().Get("limit") != "50" ||
+				req.URL.Query().Get("min_amount") != "1.00" ||
+				req.URL.Query().Get("metadata.order") != "7" {
+
+				respondWithError(rw, http.StatusBadRequest, "invalid_param",
+					"invalid query parameter")
+				return
+			}
+
+			fmt.Fprint(rw, `{"transfers": [{"id": 1, "amount": 1.50,
+				"fee": 0.00, "created_at": "2021-08-01T10:00:00Z"}]}`)
+		}
+	})
+	defer done()
+
+	ctx := context.Background()
+
+	if err := c.Login(ctx, "123.456-78", "secret"); err != nil {
+		t.Fatal(err)
+	}
+
+	minAmount := Money(100)
+
+	page, err := c.ListTransfers(ctx, ListTransfersOptions{
+		Direction: "sent", MinAmount: &minAmount,
+		Metadata: map[string]string{"order": "7"}})
+
+	if err != nil || len(page.Transfers) != 1 ||
+		page.Transfers[0].Amount != 150 || logins != 2 ||
+		c.Token() != "token-2" {
+
+		t.Error(page, err, logins)
+	}
+
+	// Without a login, there's nothing to log in again with
+	c = New(c.baseURL, c.httpClient)
+
+	_, err = c.ListTransfers(ctx, ListTransfersOptions{})
+
+	if !errors.Is(err, ErrUnauthorized) {
+		t.Error(err)
+	}
+}
+
+func TestTransferRetries(t *testing.T) {
+	var keys []string
+
+	c, done := newTestClient(func(rw http.ResponseWriter, req *http.Request) {
+		keys = append(keys, req.Header.Get("Idempotency-Key"))
+
+		switch len(keys) {
+		case 1:
+			respondWithError(rw, http.StatusInternalServerError,
+				"internal_error", "internal server error")
+		case 2:
+			// The connection drops
+			hijacker, _ := rw.(http.Hijacker)
+			conn, _, _ := hijacker.Hijack()
+			conn.Close()
+		default:
+			rw.Header().Set("Idempotent-Replayed", "true")
+			rw.WriteHeader(http.StatusCreated)
+			fmt.Fprint(rw, `{"id": 7, "account_origin_id": 1,
+				"account_destination_id": 2, "amount": 10.50, "fee": 0.00,
+				"created_at": "2021-08-01T10:00:00Z"}`)
+		}
+	})
+	defer done()
+
+	result, err := c.Transfer(context.Background(), TransferRequest{
+		DestinationID: 2, Amount: 1050})
+
+	if err != nil || result.Transfer == nil || result.Transfer.ID != 7 ||
+		!result.Replayed || len(keys) != 3 {
+
+		t.Fatal(result, err, keys)
+	}
+
+	if keys[0] == "" || keys[1] != keys[0] || keys[2] != keys[0] {
+		t.Error(keys)
+	}
+
+	// The next transfer gets its own key
+	keys = keys[:2]
+
+	_, err = c.Transfer(context.Background(), TransferRequest{
+		DestinationID: 2, Amount: 1050})
+
+	if err != nil || keys[2] == keys[0] {
+		t.Error(err, keys)
+	}
+}
+
+func TestTransferPending(t *testing.T) {
+	c, done := newTestClient(func(rw http.ResponseWriter, req *http.Request) {
+		if req.Header.Get("Idempotency-Key") != "invoice-1" {
+			t.Error(req.Header)
+		}
+
+		rw.WriteHeader(http.StatusAccepted)
+		fmt.Fprint(rw, `{"id": 3, "account_origin_id": 1,
+			"account_destination_id": 2, "amount": 2000.00,
+			"status": "pending", "rule": "new_destination",
+			"created_at": "2021-08-01T10:00:00Z"}`)
+	})
+	defer done()
+
+	result, err := c.Transfer(context.Background(), TransferRequest{
+		DestinationID: 2, Amount: 200000, IdempotencyKey: "invoice-1"})
+
+	if err != nil || result.Transfer != nil || result.Pending == nil ||
+		result.Pending.Rule != "new_destination" {
+
+		t.Error(result, err)
+	}
+}
+
+func TestErrors(t *testing.T) {
+	tries := 0
+
+	c, done := newTestClient(func(rw http.ResponseWriter, req *http.Request) {
+		tries++
+
+		switch req.URL.Path {
+		case "/transfers":
+			respondWithError(rw, http.StatusBadRequest, "limit_exceeded",
+				"transfer limit exceeded")
+		case "/accounts":
+			respondWithError(rw, http.StatusInternalServerError,
+				"internal_error", "internal server error")
+		default:
+			rw.WriteHeader(http.StatusBadGateway)
+			fmt.Fprint(rw, "<html>bad gateway</html>")
+		}
+	})
+	defer done()
+
+	ctx := context.Background()
+
+	_, err := c.Transfer(ctx, TransferRequest{DestinationID: 2, Amount: 1})
+
+	var apiErr *Error
+
+	if !errors.Is(err, ErrLimitExceeded) || errors.Is(err,
+		ErrInsufficientFunds) || !errors.As(err, &apiErr) ||
+		apiErr.StatusCode != http.StatusBadRequest ||
+		apiErr.RequestID != "req-1" || apiErr.Details["limit"] != "daily" ||
+		tries != 1 {
+
+		t.Error(err, tries)
+	}
+
+	// Creating an account isn't retried
+	tries = 0
+
+	_, err = c.CreateAccount(ctx, CreateAccountRequest{Name: "Ana"})
+
+	if !errors.Is(err, ErrInternal) || tries != 1 {
+		t.Error(err, tries)
+	}
+
+	// Errors that aren't from the API have no code, and getting a balance is
+	// retried
+	tries = 0
+
+	_, err = c.Balance(ctx, 1)
+
+	if !errors.As(err, &apiErr) || apiErr.Code != "" ||
+		apiErr.StatusCode != http.StatusBadGateway || tries != 3 ||
+		!strings.Contains(err.Error(), "Bad Gateway") {
+
+		t.Error(err, tries)
+	}
+}
@@ -0,0 +1,97 @@
+package client
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+)
+
+// An error response of the API. Compare with the Err variables with
+// errors.Is, which matches on the code, or get it with errors.As for the
+// details:
+//
+//	if errors.Is(err, client.ErrInsufficientFunds) {
+//	    ...
+//	}
+type Error struct {
+	StatusCode int
+	// Stable and machine-readable, e.g. insufficient_funds
+	Code    string
+	Message string
+	// More about the error, for some codes. See the API's documentation.
+	Details map[string]interface{}
+	// Give it to the bank when asking about the error
+	RequestID string
+}
+
+func (err *Error) Error() string {
+	msg := fmt.Sprintf("pedrobank: %s (status %d", err.Message,
+		err.StatusCode)
+
+	if err.Code != "" {
+		msg += ", code " + err.Code
+	}
+
+	if err.RequestID != "" {
+		msg += ", request " + err.RequestID
+	}
+
+	return msg + ")"
+}
+
+// Whether target is an *Error with the same code.
+func (err *Error) Is(target error) bool {
+	targetErr, ok := target.(*Error)
+	return ok && targetErr.Code == err.Code
+}
+
+// Some of the codes the API responds with. See errors.go in the server for
+// all of them.
+var (
+	ErrInternal             = &Error{Code: "internal_error"}
+	ErrUnauthorized         = &Error{Code: "unauthorized"}
+	ErrWrongPassword        = &Error{Code: "wrong_password"}
+	ErrTryAgain             = &Error{Code: "try_again"}
+	ErrAccountExists        = &Error{Code: "account_exists"}
+	ErrAccountNotFound      = &Error{Code: "account_not_found"}
+	ErrAccountFrozen        = &Error{Code: "account_frozen"}
+	ErrAccountClosed        = &Error{Code: "account_closed"}
+	ErrDestinationNotFound  = &Error{Code: "destination_not_found"}
+	ErrDestinationClosed    = &Error{Code: "destination_closed"}
+	ErrInsufficientFunds    = &Error{Code: "insufficient_funds"}
+	ErrLimitExceeded        = &Error{Code: "limit_exceeded"}
+	ErrTransferDenied       = &Error{Code: "transfer_denied"}
+	ErrKeyNotFound          = &Error{Code: "key_not_found"}
+	ErrIdempotencyKeyReused = &Error{Code: "idempotency_key_reused"}
+	ErrIdempotencyKeyInUse  = &Error{Code: "idempotency_key_in_progress"}
+)
+
+// The JSON of the API's error responses.
+type errorEnvelope struct {
+	Code      string                 `json:"code"`
+	Message   string                 `json:"message"`
+	Details   map[string]interface{} `json:"details"`
+	RequestID string                 `json:"request_id"`
+}
+
+// The error for an error response. Responses that aren't the API's JSON,
+// e.g. from a proxy, get an Error without a code.
+func parseError(resp *http.Response, data []byte) *Error {
+	var env errorEnvelope
+
+	if json.Unmarshal(data, &env) != nil || env.Code == "" {
+		return &Error{
+			StatusCode: resp.StatusCode,
+			Message:    http.StatusText(resp.StatusCode),
+			RequestID:  resp.Header.Get("X-Request-ID"),
+		}
+	}
+
+	return &Error{
+		StatusCode: resp.StatusCode,
+		Code:       env.Code,
+		Message:    env.Message,
+		Details:    env.Details,
+		RequestID:  env.RequestID,
+	}
+}
@@ -0,0 +1,77 @@
+package client
+
+import (
+	"fmt"
+	"regexp"
+	"strconv"
+)
+
+// An amount in BRL, in cents, so Money(1050) is 10.50. The API writes
+// amounts as JSON numbers with exactly two decimals, and only accepts them
+// written like that.
+type Money int64
+
+func (num Money) String() string {
+	abs := int64(num)
+	sign := ""
+
+	if abs < 0 {
+		abs = -abs
+		sign = "-"
+	}
+
+	return fmt.Sprintf("%s%d.%02d", sign, abs/100, abs%100)
+}
+
+func (num Money) MarshalJSON() ([]byte, error) {
+	return []byte(num.String()), nil
+}
+
+var moneyRegex *regexp.Regexp = regexp.MustCompile(
+	`^(-?[0-9]+)\.([0-9][0-9])$`)
+
+func (num *Money) UnmarshalJSON(bytes []byte) error {
+	strVal := string(bytes)
+
+	if !moneyRegex.MatchString(strVal) {
+		return fmt.Errorf("pedrobank: bad amount %s", strVal)
+	}
+
+	val, err := strconv.ParseInt(moneyRegex.ReplaceAllString(strVal, "$1$2"),
+		10, 64)
+
+	if err != nil {
+		return fmt.Errorf("pedrobank: bad amount %s: %w", strVal, err)
+	}
+
+	*num = Money(val)
+
+	return nil
+}
+
+var looseMoneyRegex *regexp.Regexp = regexp.MustCompile(
+	`^(-?[0-9]+)(?:\.([0-9]{1,2}))?$`)
+
+// Parse an amount typed by a person, e.g. 10, 10.5 or 10.50, which the API
+// wouldn't accept as JSON.
+func ParseMoney(str string) (Money, error) {
+	match := looseMoneyRegex.FindStringSubmatch(str)
+
+	if match == nil {
+		return 0, fmt.Errorf("pedrobank: bad amount %q", str)
+	}
+
+	cents := match[2]
+
+	for len(cents) < 2 {
+		cents += "0"
+	}
+
+	val, err := strconv.ParseInt(match[1]+cents, 10, 64)
+
+	if err != nil {
+		return 0, fmt.Errorf("pedrobank: bad amount %q: %w", str, err)
+	}
+
+	return Money(val), nil
+}
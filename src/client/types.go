@@ -0,0 +1,169 @@
+package client
+
+import "time"
+
+// An account, as the API shows it to anyone.
+type Account struct {
+	ID   int    `json:"id"`
+	Name string `json:"name"`
+	// In the format XXX.XXX-XX
+	CPF       string    `json:"cpf"`
+	Balance   Money     `json:"balance"`
+	CreatedAt time.Time `json:"created_at"`
+	Timezone  string    `json:"timezone"`
+	// active, frozen or closed
+	Status string `json:"status"`
+}
+
+type CreateAccountRequest struct {
+	Name   string `json:"name"`
+	CPF    string `json:"cpf"`
+	Secret string `json:"secret"`
+	// IANA time zone name, defaults to America/Sao_Paulo
+	Timezone string `json:"timezone,omitempty"`
+}
+
+type Balance struct {
+	Balance Money `json:"balance"`
+	// active or frozen
+	Status string `json:"status,omitempty"`
+	// How far below zero the balance can go, and how much of that is used
+	OverdraftLimit Money `json:"overdraft_limit"`
+	OverdraftUsed  Money `json:"overdraft_used"`
+	// What can still be sent, balance plus the unused overdraft
+	Available Money `json:"available"`
+}
+
+// A transfer from the logged in account, to the destination with the id or
+// with the key.
+type TransferRequest struct {
+	DestinationID  int    `json:"account_destination_id,omitempty"`
+	DestinationKey string `json:"destination_key,omitempty"`
+	Amount         Money  `json:"amount"`
+	Description    string `json:"description,omitempty"`
+	// An id from the caller's own systems, e.g. an invoice number
+	Reference string            `json:"reference,omitempty"`
+	Metadata  map[string]string `json:"metadata,omitempty"`
+
+	// Sent in the Idempotency-Key header, so that retries don't transfer
+	// twice. Transfer generates one if empty. Set it to retry a transfer
+	// across restarts of the caller.
+	IdempotencyKey string `json:"-"`
+}
+
+type Transfer struct {
+	ID            int       `json:"id"`
+	OriginID      int       `json:"account_origin_id"`
+	DestinationID int       `json:"account_destination_id"`
+	Amount        Money     `json:"amount"`
+	CreatedAt     time.Time `json:"created_at"`
+	// Set if the transfer was made as part of a batch
+	BatchID     *int              `json:"batch_id,omitempty"`
+	Description string            `json:"description,omitempty"`
+	Reference   string            `json:"reference,omitempty"`
+	Metadata    map[string]string `json:"metadata,omitempty"`
+	// Paid by the origin on top of the amount
+	Fee Money `json:"fee"`
+	// Set if this transfer is the fee of another one
+	FeeFor *int `json:"fee_for,omitempty"`
+}
+
+// A transfer the bank's risk rules held for review by an admin. The money
+// moves only if it's approved.
+type PendingTransfer struct {
+	ID            int   `json:"id"`
+	OriginID      int   `json:"account_origin_id"`
+	DestinationID int   `json:"account_destination_id"`
+	Amount        Money `json:"amount"`
+	// pending, approved or rejected
+	Status    string    `json:"status"`
+	Rule      string    `json:"rule"`
+	CreatedAt time.Time `json:"created_at"`
+	// The transfer made when it was approved
+	TransferID  *int              `json:"transfer_id,omitempty"`
+	Description string            `json:"description,omitempty"`
+	Reference   string            `json:"reference,omitempty"`
+	Metadata    map[string]string `json:"metadata,omitempty"`
+}
+
+// What Transfer did: either Transfer or Pending is set.
+type TransferResult struct {
+	Transfer *Transfer
+	Pending  *PendingTransfer
+	// Whether the server replayed the response to an earlier request with
+	// the same idempotency key
+	Replayed bool
+}
+
+type TransferPage struct {
+	Transfers []Transfer `json:"transfers"`
+	// Pass as PageOptions.Cursor to get the next page. Empty on the last
+	// page.
+	NextCursor string `json:"next_cursor,omitempty"`
+}
+
+// Pagination of the lists. Zero values are left out.
+type PageOptions struct {
+	// Up to 200, defaults to 50
+	Limit int
+	// The NextCursor of the previous page
+	Cursor string
+	// What the list can be sorted by, always id
+	Sort string
+	// asc or desc
+	Order string
+}
+
+type AccountPage struct {
+	Accounts   []Account `json:"accounts"`
+	NextCursor string    `json:"next_cursor,omitempty"`
+}
+
+// Pagination for ListAccounts, which can sort by id, name or created_at.
+type ListAccountsOptions struct {
+	PageOptions
+}
+
+// Filters and pagination for ListTransfers, which can sort by id,
+// created_at or amount. Zero values are left out.
+type ListTransfersOptions struct {
+	PageOptions
+	// sent or received
+	Direction string
+	// Only transfers to or from this account
+	Counterparty int
+	// Amount range, inclusive
+	MinAmount *Money
+	MaxAmount *Money
+	// Creation time range, inclusive
+	From time.Time
+	To   time.Time
+	// Only transfers with exactly this reference
+	Reference string
+	// Only transfers whose description contains this, ignoring case
+	Description string
+	// Only transfers with these pairs in their metadata
+	Metadata map[string]string
+}
+
+// A change of an account's status by an admin.
+type StatusChange struct {
+	AccountID int `json:"account_id"`
+	// active or frozen
+	Status    string    `json:"status"`
+	Reason    string    `json:"reason"`
+	ChangedBy int       `json:"changed_by"`
+	CreatedAt time.Time `json:"created_at"`
+}
+
+// What RunInterest did, in numbers of accounts.
+type InterestRun struct {
+	Date    string `json:"date"`
+	Accrued int    `json:"accrued"`
+	// Accounts whose day hadn't ended yet in their time zone
+	Pending int `json:"pending"`
+	// Credited with the month's interest, on the last day of the month
+	Posted int `json:"posted"`
+	// Charged overdraft interest
+	Charged int `json:"charged"`
+}
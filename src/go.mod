@@ -2,4 +2,10 @@ module pedro-bank
 
 go 1.16
 
-require github.com/jackc/pgx/v4 v4.13.0
+require (
+	github.com/jackc/pgconn v1.10.0
+	github.com/jackc/pgx/v4 v4.13.0
+	google.golang.org/genproto v0.0.0-20200526211855-cb27e3aa2013
+	google.golang.org/grpc v1.41.0
+	google.golang.org/protobuf v1.27.1
+)
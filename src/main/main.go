@@ -6,6 +6,7 @@ import (
 	"os"
 	"os/signal"
 	"pedro-bank/server"
+	"strings"
 )
 
 func main() {
@@ -24,8 +25,42 @@ func main() {
 	flag.StringVar(&certsDir, "certs", ".",
 		"Directory with key.pem and cert.pem")
 
+	var notifyFile string
+	flag.StringVar(&notifyFile, "notify-file", "",
+		"File to write messages for account owners to, instead of the log")
+
+	var corsOrigins string
+	flag.StringVar(&corsOrigins, "cors-origins", "",
+		"Comma-separated origins of web apps allowed to call the API")
+
+	var eventsFile string
+	flag.StringVar(&eventsFile, "events-file", "",
+		"File to append the domain events to, as JSON lines")
+
+	var eventsNATS string
+	flag.StringVar(&eventsNATS, "events-nats", "",
+		"Address of a NATS server to publish the domain events to JetStream")
+
 	flag.Parse()
 
+	if corsOrigins != "" {
+		server.SetCORSOrigins(strings.Split(corsOrigins, ","))
+	}
+
+	if notifyFile != "" {
+		server.SetNotifier(server.NewFileNotifier(notifyFile))
+	}
+
+	if eventsFile != "" {
+		server.AddEventPublisher("file",
+			server.NewFileEventPublisher(eventsFile))
+	}
+
+	if eventsNATS != "" {
+		server.AddEventPublisher("nats", server.NewBrokerEventPublisher(
+			server.NewNATSProducer(eventsNATS), "pedrobank"))
+	}
+
 	go server.Run(certsDir)
 
 	<-sigintStop
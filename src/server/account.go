@@ -2,14 +2,10 @@ package server
 
 import (
 	"context"
-	"crypto/sha256"
 	"database/sql"
 	"encoding/json"
-	"errors"
-	"fmt"
+	"math"
 	"net/http"
-	"regexp"
-	"strconv"
 	"time"
 )
 
@@ -23,6 +19,9 @@ type account struct {
 	secret    string    // Un-exported so won't be JSON-ified for response
 	Balance   money     `json:"balance"`
 	CreatedAt time.Time `json:"created_at"`
+	Timezone  string    `json:"timezone"`
+	// active, frozen or closed, see status.go
+	Status string `json:"status"`
 }
 
 // JSON that the client sends to create a new account. Fields exported
@@ -31,11 +30,37 @@ type accountCreateRequest struct {
 	Name   string `json:"name"`
 	CPF    string `json:"cpf"`
 	Secret string `json:"secret"`
+	// Optional, defaults to defaultTimezone
+	Timezone string `json:"timezone,omitempty"`
 }
 
 // JSON response to /accounts/<id>/balance
 type accountBalanceResponse struct {
 	Balance money `json:"balance"`
+	// active or frozen. Closed accounts have no balance.
+	Status string `json:"status,omitempty"`
+	// How far below zero the balance can go, and how much of that is used
+	OverdraftLimit money `json:"overdraft_limit"`
+	OverdraftUsed  money `json:"overdraft_used"`
+	// What can still be sent, balance plus the unused overdraft
+	Available money `json:"available"`
+}
+
+// Fill in OverdraftUsed and Available from Balance and OverdraftLimit.
+func (balanceResp *accountBalanceResponse) fillOverdraft() {
+	available := int64(balanceResp.Balance) +
+		int64(balanceResp.OverdraftLimit)
+
+	if available > math.MaxInt32 {
+		available = math.MaxInt32
+	}
+
+	balanceResp.Available = money(available)
+	balanceResp.OverdraftUsed = 0
+
+	if balanceResp.Balance < 0 {
+		balanceResp.OverdraftUsed = -balanceResp.Balance
+	}
 }
 
 // Check if the account creation request from the client is valid.
@@ -52,11 +77,24 @@ func (accReq *accountCreateRequest) validate() error {
 		return cpfInvalidError
 	}
 
+	if accReq.Timezone != "" {
+		if len(accReq.Timezone) > 64 {
+			return timezoneInvalidError
+		}
+
+		if _, err := time.LoadLocation(accReq.Timezone); err != nil {
+			return timezoneInvalidError
+		}
+	}
+
 	return nil
 }
 
 const startingBalance = "233472"
 
+// Time zone for accounts created without one.
+const defaultTimezone = "America/Sao_Paulo"
+
 // Insert a new account into the database, using the values from the client's
 // request.
 //
@@ -106,14 +144,22 @@ func insertAccount(ctx context.Context,
 		return nil, err
 	}
 
+	timezone := accountReq.Timezone
+
+	if timezone == "" {
+		timezone = defaultTimezone
+	}
+
 	row = tx.QueryRow(
-		`insert into accounts (name, cpf, secret, balance, created_at)
-		values ($1, $2, $3, $4, current_timestamp at time zone 'UTC')
+		`insert into accounts (name, cpf, secret, balance, created_at,
+		timezone)
+		values ($1, $2, $3, $4, current_timestamp at time zone 'UTC', $5)
 		returning id`,
 		accountReq.Name,
 		accountReq.CPF,
-		fmt.Sprintf("%x", sha256.Sum256([]byte(accountReq.Secret))),
-		startingBalance)
+		hashSecret(accountReq.Secret),
+		startingBalance,
+		timezone)
 
 	err = row.Scan(&id)
 
@@ -125,12 +171,12 @@ func insertAccount(ctx context.Context,
 
 	row = tx.QueryRow(
 		`select id,name,cpf,secret,balance,
-		created_at from accounts where id = $1`, id)
+		created_at,timezone,status from accounts where id = $1`, id)
 
 	err = row.Scan(
 		&acc.ID, &acc.Name, &acc.CPF,
 		&acc.secret, &acc.Balance,
-		&acc.CreatedAt)
+		&acc.CreatedAt, &acc.Timezone, &acc.Status)
 
 	if err != nil {
 		logger.Printf("Error retrieving inserted account")
@@ -138,6 +184,14 @@ func insertAccount(ctx context.Context,
 		return nil, err
 	}
 
+	err = recordDomainEvent(tx, EventAccountCreated, acc.ID, &acc)
+
+	if err != nil {
+		logger.Printf("Error recording account created")
+		rollbackTx(tx)
+		return nil, err
+	}
+
 	err = tx.Commit()
 
 	if err != nil {
@@ -154,8 +208,8 @@ func createAccount(rw http.ResponseWriter, req *http.Request) {
 	var acc *account
 	var accountReq accountCreateRequest
 
-	// About 32 + 10 + 32 = 74 bytes for the values, plus change for json
-	// enconding and field names.
+	// About 32 + 10 + 32 + 64 = 138 bytes for the values, plus change for
+	// json enconding and field names.
 	var data, err = readFromReq(req, 256)
 
 	if err != nil {
@@ -210,142 +264,182 @@ func createAccount(rw http.ResponseWriter, req *http.Request) {
 	}
 }
 
-// Handler for getting a list of accounts for GET requests at /accounts
-func getAccounts(rw http.ResponseWriter, req *http.Request) {
+// A page of GET /accounts.
+type accountPage struct {
+	Accounts []account `json:"accounts"`
+	// Pass as the cursor query parameter to get the next page. Empty on the
+	// last page.
+	NextCursor string `json:"next_cursor,omitempty"`
+}
 
-	rows, err := DB.Query(
-		"select id, name, cpf, balance, created_at from accounts")
+// Columns GET /accounts can be sorted by, and their SQL types.
+var accountSortTypes = map[string]string{
+	"id":         "integer",
+	"name":       "varchar",
+	"created_at": "timestamp",
+}
+
+// The value of the column accounts are sorted by, for the next page cursor.
+func accountSortValue(acc *account, sort string) string {
+	switch sort {
+	case "name":
+		return acc.Name
+	case "created_at":
+		return cursorTime(acc.CreatedAt)
+	default:
+		return ""
+	}
+}
+
+// The page of accounts for the query of req. Paginated, see
+// parsePageParams, unless all is true, in which case every account is in the
+// page. The accounts can be filtered by creation time with from=<time> and
+// to=<time>, see parseTimeParam.
+func listAccounts(req *http.Request, all bool) (*accountPage, error) {
+	params, err := parsePageParams(req, accountSortTypes, "id")
 
 	if err != nil {
-		respondWithError(rw, err)
-		return
+		return nil, err
 	}
 
-	defer rows.Close()
+	if all {
+		params.limit = 0
+	}
 
-	var acc account
+	var where whereBuilder
+
+	for _, timeFilter := range []struct {
+		param    string
+		cond     string
+		endOfDay bool
+	}{
+		{"from", "created_at >= %s", false},
+		{"to", "created_at <= %s", true},
+	} {
+		t, err := parseTimeParam(req, timeFilter.param, timeFilter.endOfDay)
 
-	// Ideally we'd have some form of pagination. For simplicity, allocate a
-	// reasonable amount of space, and assume there won't be too many accounts
-	// to return to the client.
-	var accounts []account = make([]account, 0, 64)
+		if err != nil {
+			return nil, err
+		} else if t != nil {
+			where.add(timeFilter.cond, *t)
+		}
+	}
+
+	params.addCursor(&where)
+
+	rows, err := DB.QueryContext(req.Context(),
+		`select id, name, cpf, balance, created_at, timezone, status
+		from accounts where `+where.String()+` `+params.orderAndLimit(),
+		where.args...)
+
+	if err != nil {
+		return nil, err
+	}
+
+	defer rows.Close()
 
-	next_p := rows.Next()
+	var acc account
+	var accounts []account = make([]account, 0, params.limit+1)
 
-	for next_p {
+	for rows.Next() {
 		err = rows.Scan(&acc.ID, &acc.Name, &acc.CPF,
-			&acc.Balance, &acc.CreatedAt)
+			&acc.Balance, &acc.CreatedAt, &acc.Timezone, &acc.Status)
 
 		if err != nil {
 			logger.Printf("error when querying accounts")
-			respondWithError(rw, err)
-			return
+			return nil, err
 		}
 
 		accounts = append(accounts, acc)
-
-		next_p = rows.Next()
 	}
 
 	if err = rows.Err(); err != nil {
 		logger.Printf("error when querying accounts")
-		respondWithError(rw, err)
-		return
+		return nil, err
 	}
 
-	var jsonResponse []byte
-	jsonResponse, err = json.Marshal(accounts)
+	var page accountPage
 
-	if err != nil {
-		logger.Printf("error when marshalling accounts")
-		respondWithError(rw, err)
-		return
+	if params.limit > 0 && len(accounts) > params.limit {
+		last := &accounts[params.limit-1]
+		page.NextCursor = params.nextCursor(last.ID,
+			accountSortValue(last, params.sort))
+		accounts = accounts[:params.limit]
 	}
 
-	setJSONEncoding(rw)
+	page.Accounts = accounts
 
-	_, err = rw.Write(jsonResponse)
+	return &page, nil
+}
 
-	if err == nil {
-		_, err = rw.Write([]byte("\n"))
-	}
+// Handler for getting a list of accounts for GET requests at /accounts, see
+// listAccounts. Without limit or cursor, responds with every account as an
+// array, see wantsPage.
+func getAccounts(rw http.ResponseWriter, req *http.Request) {
+	paged := wantsPage(req)
+	page, err := listAccounts(req, !paged)
 
 	if err != nil {
-		logger.Printf("Could not write response: %v", err)
+		respondWithError(rw, err)
+		return
 	}
-}
 
-// Route requests to /accounts depending on the method (GET or POST)
-func handleAccounts(rw http.ResponseWriter, req *http.Request) {
-
-	if req.URL.Path != "/accounts" {
-		respondWithError(rw, invalidURLError)
+	if !paged {
+		respondWithJSON(rw, http.StatusOK, page.Accounts)
 		return
 	}
 
-	if req.Method == http.MethodPost {
-		createAccount(rw, req)
-	} else if req.Method == http.MethodGet {
-		getAccounts(rw, req)
-	} else {
-		respondWithError(rw, invalidMethodError)
-	}
+	respondWithJSON(rw, http.StatusOK, page)
 }
 
-// Regex to match account balance requests.
-var balanceURLRegex *regexp.Regexp = regexp.MustCompile(
-	`^/accounts/([0-9]+)/balance$`)
+// The balance of the account with id, which can't be closed.
+func accountBalance(ctx context.Context, id int) (*accountBalanceResponse,
+	error) {
 
-// Handles GET requests at /accounts/<id>/balance
-func getAccountBalance(rw http.ResponseWriter, req *http.Request) {
-	var err error
+	logger.Printf("Getting balance for account %d", id)
 
-	matches := balanceURLRegex.FindStringSubmatch(req.URL.Path)
+	row := DB.QueryRowContext(ctx,
+		`select balance, overdraft_limit, status from accounts
+		where id = $1`, id)
 
-	if matches == nil || len(matches) != 2 {
-		respondWithError(rw, invalidURLError)
-		return
+	var balanceResp accountBalanceResponse
+	err := row.Scan(&balanceResp.Balance, &balanceResp.OverdraftLimit,
+		&balanceResp.Status)
+
+	if err == sql.ErrNoRows {
+		return nil, noAccountError
+	} else if err != nil {
+		return nil, err
 	}
 
-	if req.Method != http.MethodGet {
-		respondWithError(rw, invalidMethodError)
-		return
+	if balanceResp.Status == "closed" {
+		return nil, accountClosedError
 	}
 
-	// Our db uses ints for the ids, so max 32 bits. The regex already
-	// disallows negative numbers.
-	id64, err := strconv.ParseInt(matches[1], 0, 32)
+	balanceResp.fillOverdraft()
 
-	id := int(id64)
+	return &balanceResp, nil
+}
 
-	if errors.Is(err, strconv.ErrRange) {
-		respondWithError(rw, idTooLargeError)
-		return
-	} else if err != nil {
-		// Shouldn't happen since we validated the int from the regex
-		logger.Printf("Could not convert url int (???)")
+// Handler for GET at /accounts/{id}/balance.
+func getAccountBalance(rw http.ResponseWriter, req *http.Request) {
+	id, err := pathID(req, "id")
+
+	if err != nil {
 		respondWithError(rw, err)
 		return
 	}
 
-	logger.Printf("Getting balance for account %d", id)
-
-	row := DB.QueryRow("select balance from accounts where id = $1", id)
-
-	var balance money
-	err = row.Scan(&balance)
+	balanceResp, err := accountBalance(req.Context(), id)
 
-	if err == sql.ErrNoRows {
-		respondWithError(rw, noAccountError)
-		return
-	} else if err != nil {
+	if err != nil {
 		respondWithError(rw, err)
 		return
 	}
 
 	var jsonResponse []byte
-	jsonResponse, err = json.Marshal(
-		&accountBalanceResponse{Balance: balance})
+
+	jsonResponse, err = json.Marshal(balanceResp)
 
 	if err != nil {
 		logger.Printf("error when marshalling accounts")
@@ -40,4 +40,12 @@ func TestAccountValidation(t *testing.T) {
 	if badAccReq.validate() != pwTooLongError {
 		t.Error(badAccReq)
 	}
+
+	badAccReq = accReq
+
+	badAccReq.Timezone = "Mars/Olympus_Mons"
+
+	if badAccReq.validate() != timezoneInvalidError {
+		t.Error(badAccReq)
+	}
 }
@@ -0,0 +1,639 @@
+package server
+
+import (
+	"bytes"
+	"context"
+	"database/sql"
+	"encoding/csv"
+	"encoding/json"
+	"errors"
+	"math"
+	"mime"
+	"net/http"
+	"strconv"
+	"time"
+)
+
+// One transfer of a batch. Fields exported for JSON unmarshalling.
+type batchItemRequest struct {
+	DestinationID int   `json:"account_destination_id"`
+	Amount        money `json:"amount"`
+}
+
+// JSON that the client sends to POST /transfers/batch. CSV uploads send the
+// atomic flag as a query parameter instead.
+type batchRequest struct {
+	Atomic    bool               `json:"atomic"`
+	Transfers []batchItemRequest `json:"transfers"`
+}
+
+// The outcome of one item of a batch.
+type batchItem struct {
+	Index         int   `json:"index"`
+	DestinationID int   `json:"account_destination_id"`
+	Amount        money `json:"amount"`
+	// completed, pending, rejected, failed or rolled_back
+	Status     string `json:"status"`
+	Error      string `json:"error,omitempty"`
+	TransferID *int   `json:"transfer_id,omitempty"`
+	PendingID  *int   `json:"pending_id,omitempty"`
+}
+
+// Transfer batch entity, with its items.
+type transferBatch struct {
+	ID       int  `json:"id"`
+	OriginID int  `json:"account_origin_id"`
+	Atomic   bool `json:"atomic"`
+	// processing, completed, partial or failed
+	Status    string      `json:"status"`
+	Total     money       `json:"total"`
+	Error     string      `json:"error,omitempty"`
+	CreatedAt time.Time   `json:"created_at"`
+	Items     []batchItem `json:"items"`
+	// Set for split payments, see split.go
+	Split bool `json:"split,omitempty"`
+
+	// Copied to every transfer of a split payment. Not stored with the
+	// batch.
+	description string
+	reference   string
+	metadata    transferMetadata
+}
+
+// Payroll batches can be large, but we don't want to hold a transaction
+// open for too long in atomic mode.
+const maxBatchItems = 1000
+
+// Around 64 bytes per JSON item, with room to spare.
+const maxBatchLen = 64 * 1024
+
+// Parse a CSV batch. The first line must be the header
+// "account_destination_id,amount", and the amounts are written as in JSON,
+// e.g. 34.72.
+func parseBatchCSV(data []byte) ([]batchItemRequest, error) {
+	reader := csv.NewReader(bytes.NewReader(data))
+	reader.FieldsPerRecord = 2
+	reader.TrimLeadingSpace = true
+
+	records, err := reader.ReadAll()
+
+	if err != nil || len(records) == 0 ||
+		records[0][0] != "account_destination_id" ||
+		records[0][1] != "amount" {
+		return nil, cantParseCSVError
+	}
+
+	items := make([]batchItemRequest, 0, len(records)-1)
+
+	for i, record := range records[1:] {
+		var item batchItemRequest
+
+		destID, err := strconv.ParseInt(record[0], 10, 32)
+
+		if err != nil {
+			return nil, newBatchItemError(i, badDestinationIdError)
+		}
+
+		item.DestinationID = int(destID)
+
+		err = item.Amount.UnmarshalJSON([]byte(record[1]))
+
+		var publicError *publicJSONError
+		if errors.As(err, &publicError) {
+			return nil, newBatchItemError(i, publicError)
+		} else if err != nil {
+			return nil, newBatchItemError(i, invalidAmountError)
+		}
+
+		items = append(items, item)
+	}
+
+	return items, nil
+}
+
+// Validate the batch as a whole, before any transfer is made, and return its
+// total.
+func validateBatch(items []batchItemRequest) (money, error) {
+	if len(items) == 0 {
+		return 0, emptyBatchError
+	}
+
+	if len(items) > maxBatchItems {
+		return 0, batchTooLargeError
+	}
+
+	var total int64
+
+	for i, item := range items {
+		if item.Amount == 0 {
+			return 0, newBatchItemError(i, zeroAmountError)
+		} else if item.Amount < 0 {
+			return 0, newBatchItemError(i, invalidAmountError)
+		}
+
+		// Account ids start at 1, see doTransfer.
+		if item.DestinationID <= 0 {
+			return 0, newBatchItemError(i, badDestinationIdError)
+		}
+
+		total += int64(item.Amount)
+	}
+
+	if total > math.MaxInt32 {
+		return 0, amountTooLargeError
+	}
+
+	return money(total), nil
+}
+
+// Record an item of the batch with batchID.
+func insertBatchItem(e execer, batchID int, item *batchItem) error {
+	var itemErr interface{}
+
+	if item.Error != "" {
+		itemErr = item.Error
+	}
+
+	_, err := e.Exec(
+		`insert into transfer_batch_items (batch_id, item_index,
+		destination_id, amount, status, error, transfer_id, pending_id)
+		values ($1, $2, $3, $4, $5, $6, $7, $8)`,
+		batchID, item.Index, item.DestinationID, item.Amount, item.Status,
+		itemErr, item.TransferID, item.PendingID)
+
+	return err
+}
+
+// Insert the batch row and set the batch id and creation time.
+func insertBatchRow(q queryRower, batch *transferBatch) error {
+	var batchErr interface{}
+
+	if batch.Error != "" {
+		batchErr = batch.Error
+	}
+
+	row := q.QueryRow(
+		`insert into transfer_batches (origin_id, atomic, status, total,
+		error, created_at, split)
+		values ($1, $2, $3, $4, $5, current_timestamp at time zone 'UTC', $6)
+		returning id, created_at`,
+		batch.OriginID, batch.Atomic, batch.Status, batch.Total, batchErr,
+		batch.Split)
+
+	return row.Scan(&batch.ID, &batch.CreatedAt)
+}
+
+// Make all the transfers of the batch inside tx. The funds are checked once
+// for the whole batch before any transfer is made. Returns the index of the
+// item that failed, or -1 if the whole batch failed before any item.
+//
+// Items can't go to review, since the batch would only be partly made. One
+// that would fails the batch.
+func atomicBatchInTx(tx *sql.Tx, batch *transferBatch) (int, error) {
+	batch.Status = "completed"
+
+	err := insertBatchRow(tx, batch)
+
+	if err != nil {
+		return -1, err
+	}
+
+	var balance, overdraftLimit money
+
+	row := tx.QueryRow(
+		`select balance, overdraft_limit from accounts where id = $1
+		for update`, batch.OriginID)
+
+	err = row.Scan(&balance, &overdraftLimit)
+
+	if err == sql.ErrNoRows {
+		return -1, noOrigAccountError
+	} else if err != nil {
+		return -1, err
+	}
+
+	if int64(balance)+int64(overdraftLimit) < int64(batch.Total) {
+		return -1, insufficientFundsError
+	}
+
+	for i := range batch.Items {
+		item := &batch.Items[i]
+
+		transf, pending, err := transferInTx(tx,
+			&TransferAttempt{
+				OriginID:      batch.OriginID,
+				DestinationID: item.DestinationID,
+				Amount:        item.Amount,
+				BatchID:       batch.ID,
+				Description:   batch.description,
+				Reference:     batch.reference,
+				Metadata:      batch.metadata},
+			true)
+
+		if err == nil && pending != nil {
+			if batch.Split {
+				err = splitLegReviewError
+			} else {
+				err = batchItemReviewError
+			}
+		}
+
+		if err != nil {
+			return i, err
+		}
+
+		item.Status = "completed"
+		item.TransferID = &transf.ID
+
+		err = insertBatchItem(tx, batch.ID, item)
+
+		if err != nil {
+			return i, err
+		}
+	}
+
+	return -1, nil
+}
+
+// Make the batch in a single transaction, so either all items commit or none
+// do. If the batch fails, it's recorded as failed, with the item that made it
+// fail, if any, and the others rolled back.
+func insertAtomicBatch(ctx context.Context, batch *transferBatch) error {
+	tx, err := DB.BeginTx(ctx, &defaultTxOptions)
+
+	if err != nil {
+		logger.Print("Error starting tx to insert batch")
+		return err
+	}
+
+	failedIndex, err := atomicBatchInTx(tx, batch)
+
+	if err == nil {
+		err = tx.Commit()
+
+		if err != nil {
+			logger.Print("Error commiting tx")
+			return err
+		}
+
+		for _, item := range batch.Items {
+			countTransfer("completed", item.Amount)
+		}
+
+		return nil
+	}
+
+	rollbackTx(tx)
+
+	if failedIndex >= 0 {
+		countTransfer(transferResult(nil, err),
+			batch.Items[failedIndex].Amount)
+	}
+
+	var deniedErr *riskDeniedError
+	if errors.As(err, &deniedErr) {
+		item := &batch.Items[failedIndex]
+		recordRiskDecision(DB,
+			&TransferAttempt{
+				OriginID:      batch.OriginID,
+				DestinationID: item.DestinationID,
+				Amount:        item.Amount},
+			RiskDeny, deniedErr.rule, nil, nil)
+	}
+
+	if !errors.As(err, new(*publicJSONError)) {
+		logger.Printf("Atomic batch failed: %v", err)
+	}
+
+	batch.Status = "failed"
+	batch.Error = publicErrorMessage(err)
+
+	for i := range batch.Items {
+		item := &batch.Items[i]
+		item.TransferID = nil
+		item.PendingID = nil
+
+		if i == failedIndex {
+			item.Status = "failed"
+			item.Error = batch.Error
+		} else {
+			item.Status = "rolled_back"
+		}
+	}
+
+	tx, err = DB.BeginTx(ctx, &defaultTxOptions)
+
+	if err != nil {
+		logger.Print("Error starting tx to record failed batch")
+		return err
+	}
+
+	err = insertBatchRow(tx, batch)
+
+	for i := 0; err == nil && i < len(batch.Items); i++ {
+		err = insertBatchItem(tx, batch.ID, &batch.Items[i])
+	}
+
+	if err != nil {
+		rollbackTx(tx)
+		return err
+	}
+
+	err = tx.Commit()
+
+	if err != nil {
+		logger.Print("Error commiting tx")
+	}
+
+	return err
+}
+
+// Make each transfer of the batch in its own transaction, recording the
+// outcome of each item whether it fails or not.
+//
+// The batch is recorded as processing first, outside of any transaction. If
+// recording an item fails, the batch stops there and its status is set from
+// the items recorded so far, see finishBestEffortBatch. A batch the server
+// crashed in the middle of stays processing, see the README for how to
+// settle it.
+func insertBestEffortBatch(ctx context.Context, batch *transferBatch) error {
+	batch.Status = "processing"
+
+	err := insertBatchRow(DB, batch)
+
+	if err != nil {
+		return err
+	}
+
+	// Each item commits on its own, so a retry after a failure could pay
+	// the items that went through again
+	keepIdempotencyKey(ctx)
+
+	done := 0
+	failures := 0
+
+	for i := range batch.Items {
+		item := &batch.Items[i]
+
+		_, _, err = insertTransferWith(ctx,
+			&TransferAttempt{
+				OriginID:      batch.OriginID,
+				DestinationID: item.DestinationID,
+				Amount:        item.Amount,
+				BatchID:       batch.ID},
+			func(tx *sql.Tx, transf *transfer,
+				pending *pendingTransfer) error {
+
+				if transf != nil {
+					item.Status = "completed"
+					item.TransferID = &transf.ID
+				} else {
+					item.Status = "pending"
+					item.PendingID = &pending.ID
+				}
+
+				return insertBatchItem(tx, batch.ID, item)
+			})
+
+		if err == nil {
+			done++
+			continue
+		}
+
+		if !errors.As(err, new(*publicJSONError)) {
+			logger.Printf("Batch %d item %d failed: %v", batch.ID, i, err)
+		}
+
+		item.Status = "failed"
+		item.Error = publicErrorMessage(err)
+		item.TransferID = nil
+		item.PendingID = nil
+
+		err = insertBatchItem(DB, batch.ID, item)
+
+		if err != nil {
+			return finishBestEffortBatch(batch, done, failures, err)
+		}
+
+		failures++
+	}
+
+	return finishBestEffortBatch(batch, done, failures, nil)
+}
+
+// Set the status of a best effort batch from how many of its items went
+// through, completed or pending, and how many failed: completed if it got to
+// the end without failures, failed if no item went through, and partial
+// otherwise. stopErr is what stopped the batch before its end, if anything,
+// and is returned, so the batch is failed or partial then.
+func finishBestEffortBatch(batch *transferBatch, done int, failures int,
+	stopErr error) error {
+
+	var batchErr interface{}
+
+	switch {
+	case failures == 0 && stopErr == nil:
+		batch.Status = "completed"
+	case done == 0:
+		batch.Status = "failed"
+	default:
+		batch.Status = "partial"
+	}
+
+	if stopErr != nil {
+		logger.Printf("Batch %d stopped: %v", batch.ID, stopErr)
+		batch.Error = publicErrorMessage(stopErr)
+		batchErr = batch.Error
+	}
+
+	_, err := DB.Exec(
+		`update transfer_batches set status = $1, error = $2 where id = $3`,
+		batch.Status, batchErr, batch.ID)
+
+	if stopErr == nil {
+		return err
+	}
+
+	if err != nil {
+		logger.Printf("Could not set the status of batch %d: %v", batch.ID,
+			err)
+	}
+
+	return stopErr
+}
+
+// Handler for POST at /transfers/batch. Accepts either JSON or, with a
+// text/csv content type, a CSV upload.
+func createTransferBatch(rw http.ResponseWriter, req *http.Request) {
+	id := accountID(req)
+
+	var batchReq batchRequest
+
+	data, err := readFromReq(req, maxBatchLen)
+
+	if err != nil {
+		respondWithError(rw, err)
+		return
+	}
+
+	mediaType, _, _ := mime.ParseMediaType(req.Header.Get("Content-Type"))
+
+	if mediaType == "text/csv" {
+		if atomic := req.URL.Query().Get("atomic"); atomic != "" {
+			batchReq.Atomic, err = strconv.ParseBool(atomic)
+
+			if err != nil {
+				respondWithError(rw, badAtomicFlagError)
+				return
+			}
+		}
+
+		batchReq.Transfers, err = parseBatchCSV(data)
+
+		if err != nil {
+			respondWithError(rw, err)
+			return
+		}
+	} else {
+		err = json.Unmarshal(data, &batchReq)
+
+		var publicError *publicJSONError
+		if errors.As(err, &publicError) {
+			respondWithError(rw, publicError)
+			return
+		} else if err != nil {
+			respondWithError(rw, cantParseJSONError)
+			return
+		}
+	}
+
+	total, err := validateBatch(batchReq.Transfers)
+
+	if err != nil {
+		respondWithError(rw, err)
+		return
+	}
+
+	batch := transferBatch{
+		OriginID: id,
+		Atomic:   batchReq.Atomic,
+		Total:    total,
+		Items:    make([]batchItem, len(batchReq.Transfers)),
+	}
+
+	for i, itemReq := range batchReq.Transfers {
+		batch.Items[i] = batchItem{
+			Index:         i,
+			DestinationID: itemReq.DestinationID,
+			Amount:        itemReq.Amount,
+		}
+	}
+
+	if batch.Atomic {
+		err = insertAtomicBatch(req.Context(), &batch)
+	} else {
+		err = insertBestEffortBatch(req.Context(), &batch)
+	}
+
+	if err != nil {
+		respondWithError(rw, err)
+		return
+	}
+
+	logger.Printf("Batch %d from account %d: %s", batch.ID, id, batch.Status)
+
+	respondWithJSON(rw, http.StatusCreated, &batch)
+}
+
+// Handler for GET at /transfers/batch/<id>. Only the account that sent the
+// batch can see it.
+func getTransferBatch(rw http.ResponseWriter, req *http.Request) {
+	id := accountID(req)
+	batchID, err := pathID(req, "id")
+
+	if err != nil {
+		respondWithError(rw, err)
+		return
+	}
+
+	var batch transferBatch
+	var batchErr sql.NullString
+
+	row := DB.QueryRow(
+		`select id, origin_id, atomic, status, total, error, created_at, split
+		from transfer_batches where id = $1 and origin_id = $2`, batchID, id)
+
+	err = row.Scan(&batch.ID, &batch.OriginID, &batch.Atomic, &batch.Status,
+		&batch.Total, &batchErr, &batch.CreatedAt, &batch.Split)
+
+	if err == sql.ErrNoRows {
+		respondWithError(rw, noBatchError)
+		return
+	} else if err != nil {
+		respondWithError(rw, err)
+		return
+	}
+
+	batch.Error = batchErr.String
+
+	// Items parked for review may have been approved or rejected since, so
+	// we report them as the pending transfer is now.
+	rows, err := DB.Query(
+		`select i.item_index, i.destination_id, i.amount, i.status, i.error,
+		coalesce(i.transfer_id, p.transfer_id), i.pending_id, p.status
+		from transfer_batch_items i
+		left join pending_transfers p on p.id = i.pending_id
+		where i.batch_id = $1 order by i.item_index`, batchID)
+
+	if err != nil {
+		respondWithError(rw, err)
+		return
+	}
+
+	defer rows.Close()
+
+	batch.Items = make([]batchItem, 0, 64)
+
+	for rows.Next() {
+		var item batchItem
+		var itemErr, pendingStatus sql.NullString
+		var transferID, pendingID sql.NullInt32
+
+		err = rows.Scan(&item.Index, &item.DestinationID, &item.Amount,
+			&item.Status, &itemErr, &transferID, &pendingID, &pendingStatus)
+
+		if err != nil {
+			logger.Printf("error when querying batch items")
+			respondWithError(rw, err)
+			return
+		}
+
+		item.Error = itemErr.String
+
+		if transferID.Valid {
+			transfID := int(transferID.Int32)
+			item.TransferID = &transfID
+		}
+
+		if pendingID.Valid {
+			pendID := int(pendingID.Int32)
+			item.PendingID = &pendID
+		}
+
+		if pendingStatus.String == "approved" {
+			item.Status = "completed"
+		} else if pendingStatus.String == "rejected" {
+			item.Status = "rejected"
+		}
+
+		batch.Items = append(batch.Items, item)
+	}
+
+	if err = rows.Err(); err != nil {
+		logger.Printf("error when querying batch items")
+		respondWithError(rw, err)
+		return
+	}
+
+	respondWithJSON(rw, http.StatusOK, &batch)
+}
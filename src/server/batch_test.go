@@ -0,0 +1,77 @@
+package server
+
+import (
+	"errors"
+	"testing"
+)
+
+func TestParseBatchCSV(t *testing.T) {
+	items, err := parseBatchCSV([]byte(
+		"account_destination_id,amount\n2,34.72\n3, 0.50\n"))
+
+	if err != nil {
+		t.Log(err)
+		t.FailNow()
+	}
+
+	if len(items) != 2 ||
+		items[0].DestinationID != 2 || items[0].Amount != 3472 ||
+		items[1].DestinationID != 3 || items[1].Amount != 50 {
+		t.Error(items)
+	}
+
+	var badCSVs = []struct {
+		csv string
+		err string
+	}{
+		{"2,34.72\n", cantParseCSVError.errMsg},
+		{"account_destination_id,amount\n2,34.72,1\n",
+			cantParseCSVError.errMsg},
+		{"account_destination_id,amount\nfoo,34.72\n", batchItemErrorMsg},
+		{"account_destination_id,amount\n2,34.7\n", batchItemErrorMsg},
+		{"", cantParseCSVError.errMsg},
+	}
+
+	for _, badCSV := range badCSVs {
+		_, err = parseBatchCSV([]byte(badCSV.csv))
+
+		var publicError *publicJSONError
+		if !errors.As(err, &publicError) || publicError.errMsg != badCSV.err {
+			t.Error(badCSV.csv, err)
+		}
+	}
+}
+
+func TestValidateBatch(t *testing.T) {
+	total, err := validateBatch([]batchItemRequest{
+		{DestinationID: 2, Amount: 3472},
+		{DestinationID: 3, Amount: 50},
+	})
+
+	if err != nil || total != 3522 {
+		t.Error(total, err)
+	}
+
+	var badBatches = []struct {
+		items []batchItemRequest
+		err   string
+	}{
+		{[]batchItemRequest{}, emptyBatchError.errMsg},
+		{make([]batchItemRequest, maxBatchItems+1), batchTooLargeError.errMsg},
+		{[]batchItemRequest{{DestinationID: 2}}, batchItemErrorMsg},
+		{[]batchItemRequest{{Amount: 10}}, batchItemErrorMsg},
+		{[]batchItemRequest{
+			{DestinationID: 2, Amount: 2000000000},
+			{DestinationID: 3, Amount: 2000000000}},
+			amountTooLargeError.errMsg},
+	}
+
+	for _, badBatch := range badBatches {
+		_, err = validateBatch(badBatch.items)
+
+		var publicError *publicJSONError
+		if !errors.As(err, &publicError) || publicError.errMsg != badBatch.err {
+			t.Error(len(badBatch.items), err)
+		}
+	}
+}
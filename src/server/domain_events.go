@@ -0,0 +1,348 @@
+package server
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"net/http"
+	"time"
+)
+
+// Something that happened in the bank, as kept in the domain_events outbox
+// and handed to the publishers. Data depends on the type, see the Event
+// constants.
+type DomainEvent struct {
+	ID   int64  `json:"id"`
+	Type string `json:"type"`
+	// The account the event is about, 0 if none
+	AccountID int             `json:"account_id,omitempty"`
+	Data      json.RawMessage `json:"data"`
+	CreatedAt time.Time       `json:"created_at"`
+}
+
+// The types of the domain events, and what their data is.
+const (
+	// The account, as POST /accounts responds
+	EventAccountCreated = "AccountCreated"
+	// The status change, as POST /admin/accounts/<id>/freeze responds
+	EventAccountFrozen   = "AccountFrozen"
+	EventAccountUnfrozen = "AccountUnfrozen"
+	EventAccountClosed   = "AccountClosed"
+	// The transfer, including fee, interest and payout transfers
+	EventTransferCompleted = "TransferCompleted"
+	// The pending transfer, when the risk rules park it and when an admin
+	// rejects it. An approved one completes as a new transfer.
+	EventTransferPendingReview = "TransferPendingReview"
+	EventTransferRejected      = "TransferRejected"
+	// {"account_id": 1}, or with "reason", the error code, when failed
+	EventLoginSucceeded = "LoginSucceeded"
+	EventLoginFailed    = "LoginFailed"
+)
+
+var statusDomainEvents = map[string]string{
+	"frozen": EventAccountFrozen,
+	"active": EventAccountUnfrozen,
+	"closed": EventAccountClosed,
+}
+
+// Data of the login events.
+type loginEvent struct {
+	AccountID int    `json:"account_id"`
+	Reason    string `json:"reason,omitempty"`
+}
+
+// Receives the domain events from the outbox, in commit order, in batches.
+// If Publish fails, or the server stops before the offset is saved, the
+// same events are published again, so consumers must ignore the ids they
+// have seen.
+type EventPublisher interface {
+	Publish(ctx context.Context, events []DomainEvent) error
+}
+
+// A publisher and the name its offset is kept under, in event_consumers.
+type eventConsumer struct {
+	name      string
+	publisher EventPublisher
+}
+
+var eventConsumers []eventConsumer
+
+// Publish the domain events to publisher, keeping how far it got under
+// name. A new name starts from the first event. Call this before Run.
+func AddEventPublisher(name string, publisher EventPublisher) {
+	eventConsumers = append(eventConsumers, eventConsumer{name, publisher})
+}
+
+// How often the relay looks for new events, and how many it publishes at a
+// time.
+const eventRelayInterval = time.Second
+const eventRelayBatchLen = 100
+
+// Channel that signals when the event relay finishes
+var eventRelayFinished = make(chan interface{})
+
+// Write an event of eventType about the account with id, 0 for none, to the
+// outbox. Pass the tx of the change, so the event is written if and only if
+// the change commits.
+func recordDomainEvent(e execer, eventType string, id int,
+	data interface{}) error {
+
+	jsonBytes, err := json.Marshal(data)
+
+	if err != nil {
+		return err
+	}
+
+	var accountID interface{}
+
+	if id != 0 {
+		accountID = id
+	}
+
+	_, err = e.Exec(
+		`insert into domain_events (type, account_id, data, created_at)
+		values ($1, $2, $3, current_timestamp at time zone 'UTC')`,
+		eventType, accountID, string(jsonBytes))
+
+	return err
+}
+
+// Record the TransferCompleted event and queue the webhook events of the
+// transfer with id, inside tx. Every insert into transfers calls this.
+func recordTransferEvents(tx *sql.Tx, id int) error {
+	var transf transfer
+
+	row := tx.QueryRow(
+		`select `+transferColumns+` from transfers where id = $1`, id)
+
+	err := scanTransfer(row, &transf)
+
+	if err != nil {
+		return err
+	}
+
+	err = recordDomainEvent(tx, EventTransferCompleted, transf.OriginID,
+		&transf)
+
+	if err != nil {
+		return err
+	}
+
+	err = queueWebhookEvent(tx, transf.OriginID, "transfer.sent", &transf)
+
+	if err != nil {
+		return err
+	}
+
+	return queueWebhookEvent(tx, transf.DestinationID, "transfer.received",
+		&transf)
+}
+
+// Publish the events after the consumer's offset, up to eventRelayBatchLen,
+// and move the offset past them. Returns how many were published.
+//
+// Only the events of transactions older than every one still running are
+// read, ordered by transaction and then id. A transaction that's still
+// running can only be after them in that order, so none is skipped even if
+// it commits later with a smaller id.
+func relayDomainEvents(ctx context.Context, consumer *eventConsumer) (int,
+	error) {
+
+	tx, err := DB.BeginTx(ctx, &defaultTxOptions)
+
+	if err != nil {
+		logger.Print("Error starting tx to relay events")
+		return 0, err
+	}
+
+	_, err = tx.Exec(
+		`insert into event_consumers (name, updated_at)
+		values ($1, current_timestamp at time zone 'UTC')
+		on conflict do nothing`, consumer.name)
+
+	if err != nil {
+		rollbackTx(tx)
+		return 0, err
+	}
+
+	// Only one server publishes to a consumer at a time
+	var lastTxID, lastEventID int64
+
+	err = tx.QueryRow(
+		`select last_tx_id, last_event_id from event_consumers
+		where name = $1 for update skip locked`,
+		consumer.name).Scan(&lastTxID, &lastEventID)
+
+	if err == sql.ErrNoRows {
+		rollbackTx(tx)
+		return 0, nil
+	} else if err != nil {
+		rollbackTx(tx)
+		return 0, err
+	}
+
+	rows, err := tx.Query(
+		`select id, tx_id, type, account_id, data, created_at
+		from domain_events
+		where tx_id < pg_snapshot_xmin(pg_current_snapshot())::text::bigint
+		and (tx_id, id) > ($1, $2)
+		order by tx_id, id limit $3`,
+		lastTxID, lastEventID, eventRelayBatchLen)
+
+	if err != nil {
+		rollbackTx(tx)
+		return 0, err
+	}
+
+	events, lastTxID, err := scanDomainEvents(rows, lastTxID)
+
+	if err != nil || len(events) == 0 {
+		rollbackTx(tx)
+		return 0, err
+	}
+
+	err = consumer.publisher.Publish(ctx, events)
+
+	if err != nil {
+		rollbackTx(tx)
+		return 0, err
+	}
+
+	_, err = tx.Exec(
+		`update event_consumers
+		set last_tx_id = $1, last_event_id = $2,
+		updated_at = current_timestamp at time zone 'UTC'
+		where name = $3`,
+		lastTxID, events[len(events)-1].ID, consumer.name)
+
+	if err != nil {
+		rollbackTx(tx)
+		return 0, err
+	}
+
+	err = tx.Commit()
+
+	if err != nil {
+		logger.Print("Error commiting tx")
+		return 0, err
+	}
+
+	return len(events), nil
+}
+
+// Scan the events selected by relayDomainEvents and close rows. Also returns
+// the tx_id of the last one, or lastTxID if there's none.
+func scanDomainEvents(rows *sql.Rows, lastTxID int64) ([]DomainEvent, int64,
+	error) {
+
+	defer rows.Close()
+
+	var events []DomainEvent
+
+	for rows.Next() {
+		var event DomainEvent
+		var accountID sql.NullInt32
+		var data []byte
+
+		err := rows.Scan(&event.ID, &lastTxID, &event.Type, &accountID,
+			&data, &event.CreatedAt)
+
+		if err != nil {
+			return nil, 0, err
+		}
+
+		event.AccountID = int(accountID.Int32)
+		event.Data = json.RawMessage(data)
+		events = append(events, event)
+	}
+
+	return events, lastTxID, rows.Err()
+}
+
+// Publish the new domain events to every publisher every eventRelayInterval.
+// Call this in a goroutine. Cancel the context to stop the goroutine.
+func eventRelayJob(ctx context.Context) {
+	defer close(eventRelayFinished)
+
+	ticker := time.NewTicker(eventRelayInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			logger.Print("Event relay exiting...")
+			return
+		case <-ticker.C:
+		}
+
+		for i := range eventConsumers {
+			consumer := &eventConsumers[i]
+
+			// Keep going while there are full batches
+			for ctx.Err() == nil {
+				published, err := relayDomainEvents(ctx, consumer)
+
+				if err != nil {
+					logger.Printf("Error publishing events to %s: %v",
+						consumer.name, err)
+				}
+
+				if err != nil || published < eventRelayBatchLen {
+					break
+				}
+			}
+		}
+	}
+}
+
+// How far a publisher got, for GET /admin/event-consumers.
+type eventConsumerStatus struct {
+	Name        string `json:"name"`
+	LastEventID int64  `json:"last_event_id"`
+	// Events not published yet
+	Lag       int       `json:"lag"`
+	UpdatedAt time.Time `json:"updated_at"`
+}
+
+// Handler for GET at /admin/event-consumers. Lists the publishers of the
+// domain events with their offsets, including ones no server publishes to
+// anymore.
+func getEventConsumers(rw http.ResponseWriter, req *http.Request) {
+	rows, err := DB.QueryContext(req.Context(),
+		`select name, last_event_id, updated_at,
+		(select count(*) from domain_events
+			where (tx_id, id) > (last_tx_id, last_event_id))
+		from event_consumers order by name`)
+
+	if err != nil {
+		respondWithError(rw, err)
+		return
+	}
+
+	defer rows.Close()
+
+	consumers := make([]eventConsumerStatus, 0, len(eventConsumers))
+
+	for rows.Next() {
+		var consumer eventConsumerStatus
+
+		err = rows.Scan(&consumer.Name, &consumer.LastEventID,
+			&consumer.UpdatedAt, &consumer.Lag)
+
+		if err != nil {
+			logger.Printf("error when querying event consumers")
+			respondWithError(rw, err)
+			return
+		}
+
+		consumers = append(consumers, consumer)
+	}
+
+	if err = rows.Err(); err != nil {
+		logger.Printf("error when querying event consumers")
+		respondWithError(rw, err)
+		return
+	}
+
+	respondWithJSON(rw, http.StatusOK, consumers)
+}
@@ -1,75 +1,331 @@
 package server
 
 import (
-	"fmt"
+	"errors"
 	"net/http"
 )
 
-var jsonErrFmt = `{"error": "%s"}` + "\n"
-
-// An error that contains a JSON message safe to show to the client.
+// An error that is safe to show to the client. respondWithError sends it in
+// the error envelope, see errorEnvelope.
 type publicJSONError struct {
-	errJSON string
-	errMsg  string // useful for testing
+	// Stable and machine-readable, so clients don't have to match messages
+	code    string
+	errMsg  string
 	status  int
+	details map[string]interface{}
 }
 
 func (err *publicJSONError) Error() string {
 	return err.errMsg
 }
 
-// Buold a public error. errMsg should be a simple error message, not in JSON,
-// this function handles creating the JSON for it.
-func newPublicError(status int, errMsg string) *publicJSONError {
-	return &publicJSONError{
-		fmt.Sprintf(jsonErrFmt, errMsg),
-		errMsg,
-		status}
+// Build a public error. code should be snake_case and never change once
+// clients may rely on it. errMsg should be a simple error message for people.
+func newPublicError(status int, code string, errMsg string) *publicJSONError {
+	return &publicJSONError{code: code, errMsg: errMsg, status: status}
+}
+
+// The JSON every error response has. Error repeats the message, for clients
+// from before the envelope had the other fields.
+type errorEnvelope struct {
+	Error     string                 `json:"error"`
+	Code      string                 `json:"code"`
+	Message   string                 `json:"message"`
+	Details   map[string]interface{} `json:"details,omitempty"`
+	RequestID string                 `json:"request_id,omitempty"`
+}
+
+func (err *publicJSONError) envelope(requestID string) *errorEnvelope {
+	return &errorEnvelope{
+		Error:     err.errMsg,
+		Code:      err.code,
+		Message:   err.errMsg,
+		Details:   err.details,
+		RequestID: requestID,
+	}
+}
+
+// The message of the public error in err's chain, or a generic message if
+// there is none, as respondWithError would show it to the client.
+func publicErrorMessage(err error) string {
+	var publicError *publicJSONError
+
+	if errors.As(err, &publicError) {
+		return publicError.errMsg
+	}
+
+	return internalError.errMsg
 }
 
 // Generic errors
-var invalidURLError = newPublicError(http.StatusNotFound, "invalid url")
+var invalidURLError = newPublicError(http.StatusNotFound,
+	"not_found", "invalid url")
+var internalError = newPublicError(http.StatusInternalServerError,
+	"internal_error", "internal server error")
 var invalidMethodError = newPublicError(http.StatusMethodNotAllowed,
-	"bad method for url")
+	"method_not_allowed", "bad method for url")
 var cantParseJSONError = newPublicError(http.StatusBadRequest,
-	"can't parse request JSON")
+	"invalid_json", "can't parse request JSON")
 var requestTooLongError = newPublicError(http.StatusRequestEntityTooLarge,
-	"request too long")
-var emptyRequestError = newPublicError(http.StatusBadRequest, "empty request")
+	"request_too_large", "request too long")
+var emptyRequestError = newPublicError(http.StatusBadRequest,
+	"empty_request", "empty request")
+
+const badParamMsg = "invalid query parameter"
+
+// Build the error for a query parameter that can't be parsed, telling the
+// client which one.
+func newBadParamError(param string) *publicJSONError {
+	return &publicJSONError{
+		code:    "invalid_param",
+		errMsg:  badParamMsg,
+		status:  http.StatusBadRequest,
+		details: map[string]interface{}{"param": param},
+	}
+}
+
+var badCursorError = newPublicError(http.StatusBadRequest,
+	"invalid_cursor", "invalid cursor")
 
 // Account errors
-var nameTooLongError = newPublicError(http.StatusBadRequest, "name too long")
-var pwTooLongError = newPublicError(http.StatusBadRequest, "password too long")
-var cpfInvalidError = newPublicError(http.StatusBadRequest, "bad CPF format")
+var nameTooLongError = newPublicError(http.StatusBadRequest,
+	"name_too_long", "name too long")
+var nameEmptyError = newPublicError(http.StatusBadRequest,
+	"name_empty", "empty name")
+var pwTooLongError = newPublicError(http.StatusBadRequest,
+	"password_too_long", "password too long")
+var pwEmptyError = newPublicError(http.StatusBadRequest,
+	"password_empty", "empty password")
+var cpfInvalidError = newPublicError(http.StatusBadRequest,
+	"invalid_cpf", "bad CPF format")
 var accExistsError = newPublicError(http.StatusBadRequest,
-	"account already exists")
+	"account_exists", "account already exists")
 var idTooLargeError = newPublicError(http.StatusBadRequest,
-	"id too large")
+	"id_too_large", "id too large")
 var noAccountError = newPublicError(http.StatusNotFound,
-	"account does not exist")
+	"account_not_found", "account does not exist")
+var badStatementPeriodError = newPublicError(http.StatusBadRequest,
+	"invalid_statement_period", "invalid statement period")
+var timezoneInvalidError = newPublicError(http.StatusBadRequest,
+	"invalid_timezone", "invalid timezone")
+var accountFrozenError = newPublicError(http.StatusForbidden,
+	"account_frozen", "account frozen")
+var accountClosedError = newPublicError(http.StatusGone,
+	"account_closed", "account closed")
+var destinationClosedError = newPublicError(http.StatusGone,
+	"destination_closed", "destination account closed")
+var closeBalanceError = newPublicError(http.StatusBadRequest,
+	"balance_not_zero", "balance must be zero, or a payout destination given")
+var closeOverdraftError = newPublicError(http.StatusBadRequest,
+	"overdraft_owed", "account still owes its overdraft")
+var accountBusyError = newPublicError(http.StatusConflict,
+	"account_busy", "account has pending transfers or held escrows")
+var accountNotActiveError = newPublicError(http.StatusConflict,
+	"account_not_active", "account is not active")
+var accountNotFrozenError = newPublicError(http.StatusConflict,
+	"account_not_frozen", "account is not frozen")
+var reasonInvalidError = newPublicError(http.StatusBadRequest,
+	"invalid_reason", "reason must have between 1 and 140 characters")
 
 // Login errors
 var wrongPasswordError = newPublicError(http.StatusBadRequest,
-	"wrong password")
+	"wrong_password", "wrong password")
 var tryAgainError = newPublicError(http.StatusConflict,
-	"please try again")
+	"try_again", "please try again")
 var unauthorizedError = newPublicError(http.StatusUnauthorized,
-	"unauthorized")
+	"unauthorized", "unauthorized")
 var noTokenError = newPublicError(http.StatusBadRequest,
-	"missing token")
+	"missing_token", "missing token")
+var forbiddenError = newPublicError(http.StatusForbidden,
+	"forbidden", "forbidden")
+var resetCodeInvalidError = newPublicError(http.StatusBadRequest,
+	"invalid_reset_code", "invalid or expired reset code")
 
 // Transfer errors
 var invalidAmountError = newPublicError(http.StatusBadRequest,
-	"invalid amount")
+	"invalid_amount", "invalid amount")
 var amountTooLargeError = newPublicError(http.StatusBadRequest,
-	"amount too large")
+	"amount_too_large", "amount too large")
 var zeroAmountError = newPublicError(http.StatusBadRequest,
-	"zero amount")
+	"zero_amount", "zero amount")
 var badDestinationIdError = newPublicError(http.StatusBadRequest,
-	"invalid destination id")
+	"invalid_destination", "invalid destination id")
+var sameAccountError = newPublicError(http.StatusBadRequest,
+	"same_account", "can't transfer to the same account")
 var noOrigAccountError = newPublicError(http.StatusNotFound,
-	"origin account does not exist")
+	"origin_not_found", "origin account does not exist")
 var noDestAccountError = newPublicError(http.StatusNotFound,
-	"destination account does not exist")
+	"destination_not_found", "destination account does not exist")
 var insufficientFundsError = newPublicError(http.StatusBadRequest,
-	"insufficient funds")
+	"insufficient_funds", "insufficient funds")
+var overdraftInUseError = newPublicError(http.StatusConflict,
+	"overdraft_in_use", "overdraft limit below what the account owes")
+var descriptionTooLongError = newPublicError(http.StatusBadRequest,
+	"description_too_long", "description too long")
+var referenceTooLongError = newPublicError(http.StatusBadRequest,
+	"reference_too_long", "reference too long")
+var metadataTooLargeError = newPublicError(http.StatusBadRequest,
+	"metadata_too_large", "too many metadata keys")
+var metadataInvalidError = newPublicError(http.StatusBadRequest,
+	"invalid_metadata", "invalid metadata key or value")
+var transferDeniedError = newPublicError(http.StatusForbidden,
+	"transfer_denied", "transfer denied")
+var noPendingTransferError = newPublicError(http.StatusNotFound,
+	"pending_transfer_not_found", "pending transfer does not exist")
+var twoDestinationsError = newPublicError(http.StatusBadRequest,
+	"two_destinations", "give either a destination id or a destination key")
+
+// Idempotency errors
+var idempotencyKeyInvalidError = newPublicError(http.StatusBadRequest,
+	"invalid_idempotency_key", "invalid idempotency key")
+var idempotencyKeyReusedError = newPublicError(
+	http.StatusUnprocessableEntity, "idempotency_key_reused",
+	"idempotency key already used for a different request")
+var idempotencyKeyInProgressError = newPublicError(http.StatusConflict,
+	"idempotency_key_in_progress",
+	"a request with this idempotency key is still in progress")
+
+// Event stream errors
+var lastEventIDInvalidError = newPublicError(http.StatusBadRequest,
+	"invalid_last_event_id", "invalid Last-Event-ID header")
+var streamingUnsupportedError = newPublicError(http.StatusNotImplemented,
+	"streaming_unsupported", "the connection can't stream events")
+
+// Key errors
+var keyTypeInvalidError = newPublicError(http.StatusBadRequest,
+	"invalid_key_type", "invalid key type")
+var keyInvalidError = newPublicError(http.StatusBadRequest,
+	"invalid_key", "invalid key for its type")
+var keyNotOwnCPFError = newPublicError(http.StatusBadRequest,
+	"key_not_own_cpf", "CPF key must be the account's CPF")
+var keyExistsError = newPublicError(http.StatusConflict,
+	"key_exists", "key already registered")
+var tooManyKeysError = newPublicError(http.StatusBadRequest,
+	"too_many_keys", "too many keys for this account")
+var noKeyError = newPublicError(http.StatusNotFound,
+	"key_not_found", "key does not exist")
+
+// Webhook errors
+var webhookURLInvalidError = newPublicError(http.StatusBadRequest,
+	"invalid_webhook_url", "webhook URL must be an absolute https URL")
+var webhookEventsInvalidError = newPublicError(http.StatusBadRequest,
+	"invalid_webhook_events", "webhook events must be known event types")
+var tooManyWebhooksError = newPublicError(http.StatusBadRequest,
+	"too_many_webhooks", "too many webhooks for this account")
+var noWebhookError = newPublicError(http.StatusNotFound,
+	"webhook_not_found", "webhook does not exist")
+var noWebhookDeliveryError = newPublicError(http.StatusNotFound,
+	"webhook_delivery_not_found", "webhook delivery does not exist")
+var webhookDeliveryNotDeadError = newPublicError(http.StatusConflict,
+	"webhook_delivery_not_dead",
+	"only deliveries that ran out of attempts can be retried")
+
+// Payment request errors
+var badExpiryError = newPublicError(http.StatusBadRequest,
+	"invalid_expiry", "invalid expiry")
+var noPaymentRequestError = newPublicError(http.StatusNotFound,
+	"payment_request_not_found", "payment request does not exist")
+var badPayloadError = newPublicError(http.StatusBadRequest,
+	"invalid_payload", "invalid payment payload")
+var paymentRequestPaidError = newPublicError(http.StatusConflict,
+	"payment_request_paid", "payment request already paid")
+var paymentRequestExpiredError = newPublicError(http.StatusGone,
+	"payment_request_expired", "payment request expired")
+var paymentRequestCancelledError = newPublicError(http.StatusGone,
+	"payment_request_cancelled", "payment request cancelled")
+var paymentRequestNotOpenError = newPublicError(http.StatusConflict,
+	"payment_request_not_open", "payment request is no longer open")
+
+// Escrow errors
+var badDeadlineError = newPublicError(http.StatusBadRequest,
+	"invalid_deadline", "invalid deadline")
+var badDefaultActionError = newPublicError(http.StatusBadRequest,
+	"invalid_default_action", "default action must be release or refund")
+var noEscrowError = newPublicError(http.StatusNotFound,
+	"escrow_not_found", "escrow does not exist")
+var escrowResolvedError = newPublicError(http.StatusConflict,
+	"escrow_resolved", "escrow already resolved")
+var escrowReviewError = newPublicError(http.StatusConflict,
+	"escrow_needs_review", "escrow needs review, send it as a transfer")
+
+// Batch errors
+const batchItemErrorMsg = "invalid batch item"
+
+var emptyBatchError = newPublicError(http.StatusBadRequest,
+	"empty_batch", "empty batch")
+var batchTooLargeError = newPublicError(http.StatusRequestEntityTooLarge,
+	"batch_too_large", "too many transfers in batch")
+var cantParseCSVError = newPublicError(http.StatusBadRequest,
+	"invalid_csv", "can't parse request CSV")
+var badAtomicFlagError = newPublicError(http.StatusBadRequest,
+	"invalid_atomic_flag", "invalid atomic flag")
+var noBatchError = newPublicError(http.StatusNotFound,
+	"batch_not_found", "batch does not exist")
+var batchItemReviewError = newPublicError(http.StatusConflict,
+	"batch_item_needs_review",
+	"batch item needs review, send it outside an atomic batch")
+
+// Build the error for an invalid item of a batch, telling the client in the
+// details which item (starting at 0) and what's wrong with it.
+func newBatchItemError(index int, itemErr *publicJSONError) *publicJSONError {
+	return &publicJSONError{
+		code:   "invalid_batch_item",
+		errMsg: batchItemErrorMsg,
+		status: itemErr.status,
+		details: map[string]interface{}{
+			"item":        index,
+			"reason":      itemErr.errMsg,
+			"reason_code": itemErr.code,
+		},
+	}
+}
+
+// Split payment errors
+const splitLegErrorMsg = "invalid split leg"
+
+var tooManySplitLegsError = newPublicError(http.StatusBadRequest,
+	"too_many_split_legs", "too many split legs")
+var splitLegAmountError = newPublicError(http.StatusBadRequest,
+	"invalid_split_leg_amount",
+	"split leg needs either an amount or a percentage")
+var splitSumError = newPublicError(http.StatusBadRequest,
+	"split_sum_mismatch", "split legs don't add up to the amount")
+var splitLegReviewError = newPublicError(http.StatusConflict,
+	"split_leg_needs_review",
+	"split leg needs review, send it as a single transfer")
+
+// Build the error for an invalid leg of a split payment, like
+// newBatchItemError.
+func newSplitLegError(index int, legErr *publicJSONError) *publicJSONError {
+	return &publicJSONError{
+		code:   "invalid_split_leg",
+		errMsg: splitLegErrorMsg,
+		status: legErr.status,
+		details: map[string]interface{}{
+			"leg":         index,
+			"reason":      legErr.errMsg,
+			"reason_code": legErr.code,
+		},
+	}
+}
+
+// Limit errors
+const limitExceededMsg = "transfer limit exceeded"
+
+var limitRaiseError = newPublicError(http.StatusBadRequest,
+	"limit_raise_not_allowed", "limits can only be lowered")
+
+// Build the error for a transfer that would go over one of the account's
+// limits. The details tell the client which limit was hit and how much is
+// still allowed under it.
+func newLimitExceededError(limit string, remaining money) *publicJSONError {
+	return &publicJSONError{
+		code:   "limit_exceeded",
+		errMsg: limitExceededMsg,
+		status: http.StatusBadRequest,
+		details: map[string]interface{}{
+			"limit":     limit,
+			"remaining": remaining,
+		},
+	}
+}
@@ -0,0 +1,67 @@
+package server
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+// The code in an error response, or "" if it isn't one.
+func responseErrorCode(body []byte) string {
+	var env errorEnvelope
+
+	if json.Unmarshal(body, &env) != nil {
+		return ""
+	}
+
+	return env.Code
+}
+
+func TestRespondWithError(t *testing.T) {
+	var values = []struct {
+		err     error
+		status  int
+		code    string
+		message string
+		details string
+	}{
+		{insufficientFundsError, http.StatusBadRequest, "insufficient_funds",
+			"insufficient funds", ""},
+		{fmt.Errorf("wrapped: %w", noAccountError), http.StatusNotFound,
+			"account_not_found", "account does not exist", ""},
+		{errors.New("db down"), http.StatusInternalServerError,
+			"internal_error", "internal server error", ""},
+		{newBadParamError("limit"), http.StatusBadRequest, "invalid_param",
+			badParamMsg, `{"param":"limit"}`},
+		{newBatchItemError(3, zeroAmountError), http.StatusBadRequest,
+			"invalid_batch_item", batchItemErrorMsg,
+			`{"item":3,"reason":"zero amount","reason_code":"zero_amount"}`},
+		{newLimitExceededError("daily", 1050), http.StatusBadRequest,
+			"limit_exceeded", limitExceededMsg,
+			`{"limit":"daily","remaining":10.50}`},
+	}
+
+	for _, value := range values {
+		rec := httptest.NewRecorder()
+		rec.Header().Set(requestIDHeader, "req-1")
+
+		respondWithError(rec, value.err)
+
+		var env struct {
+			errorEnvelope
+			Details json.RawMessage `json:"details"`
+		}
+
+		err := json.Unmarshal(rec.Body.Bytes(), &env)
+
+		if err != nil || rec.Code != value.status ||
+			env.Code != value.code || env.Message != value.message ||
+			env.Error != value.message || env.RequestID != "req-1" ||
+			string(env.Details) != value.details {
+			t.Error(value.err, rec.Code, rec.Body.String(), err)
+		}
+	}
+}
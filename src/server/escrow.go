@@ -0,0 +1,675 @@
+package server
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"strconv"
+	"time"
+	"unicode/utf8"
+)
+
+// JSON that the payer sends to open an escrow.
+type escrowCreateRequest struct {
+	PayeeID int `json:"payee_id"`
+	// A key registered by the payee, instead of its id
+	PayeeKey    string    `json:"payee_key,omitempty"`
+	Amount      money     `json:"amount"`
+	Description string    `json:"description,omitempty"`
+	Deadline    time.Time `json:"deadline"`
+	// release or refund, defaults to refund
+	DefaultAction string `json:"default_action,omitempty"`
+}
+
+// Escrow entity. Fields exported for JSON marshalling.
+type escrow struct {
+	ID          int    `json:"id"`
+	PayerID     int    `json:"payer_id"`
+	PayeeID     int    `json:"payee_id"`
+	Amount      money  `json:"amount"`
+	Description string `json:"description,omitempty"`
+	// held, released or refunded
+	Status        string    `json:"status"`
+	Deadline      time.Time `json:"deadline"`
+	DefaultAction string    `json:"default_action"`
+	// confirm, cancel or empty if the party didn't decide yet
+	PayerDecision        string     `json:"payer_decision,omitempty"`
+	PayeeDecision        string     `json:"payee_decision,omitempty"`
+	FundingTransferID    int        `json:"funding_transfer_id"`
+	ResolutionTransferID *int       `json:"resolution_transfer_id,omitempty"`
+	CreatedAt            time.Time  `json:"created_at"`
+	ResolvedAt           *time.Time `json:"resolved_at,omitempty"`
+}
+
+type escrowPage struct {
+	Escrows    []escrow `json:"escrows"`
+	NextCursor string   `json:"next_cursor,omitempty"`
+}
+
+const maxEscrowDeadline = 90 * 24 * time.Hour
+
+// How often the escrow job looks for escrows past their deadline.
+const escrowJobInterval = time.Minute
+
+// Channel that signals when the escrow job finishes
+var escrowJobFinished = make(chan interface{})
+
+// Check if the escrow creation request from the client is valid, and fill
+// in the default action.
+func (createReq *escrowCreateRequest) validate(now time.Time) error {
+	if createReq.Amount == 0 {
+		return zeroAmountError
+	} else if createReq.Amount < 0 {
+		return invalidAmountError
+	}
+
+	if createReq.PayeeID != 0 && createReq.PayeeKey != "" {
+		return twoDestinationsError
+	} else if createReq.PayeeID <= 0 && createReq.PayeeKey == "" {
+		return badDestinationIdError
+	}
+
+	if utf8.RuneCountInString(createReq.Description) > maxDescriptionLen {
+		return descriptionTooLongError
+	}
+
+	if !createReq.Deadline.After(now) ||
+		createReq.Deadline.Sub(now) > maxEscrowDeadline {
+		return badDeadlineError
+	}
+
+	switch createReq.DefaultAction {
+	case "":
+		createReq.DefaultAction = "refund"
+	case "release", "refund":
+	default:
+		return badDefaultActionError
+	}
+
+	return nil
+}
+
+// What to do with an escrow once both parties decided: release if both
+// confirmed, refund if both cancelled, or nothing yet.
+func escrowOutcome(payerDecision string, payeeDecision string) string {
+	if payerDecision != payeeDecision {
+		return ""
+	}
+
+	switch payerDecision {
+	case "confirm":
+		return "release"
+	case "cancel":
+		return "refund"
+	}
+
+	return ""
+}
+
+const escrowColumns = `id, payer_id, payee_id, amount, description, status,
+	deadline, default_action, coalesce(payer_decision, ''),
+	coalesce(payee_decision, ''), funding_transfer_id, resolution_transfer_id,
+	created_at, resolved_at`
+
+func scanEscrow(row scanner, esc *escrow) error {
+	return row.Scan(&esc.ID, &esc.PayerID, &esc.PayeeID, &esc.Amount,
+		&esc.Description, &esc.Status, &esc.Deadline, &esc.DefaultAction,
+		&esc.PayerDecision, &esc.PayeeDecision, &esc.FundingTransferID,
+		&esc.ResolutionTransferID, &esc.CreatedAt, &esc.ResolvedAt)
+}
+
+// Get the escrow with id. Inside a tx, lock its row if forUpdate is true.
+func getEscrow(q queryRower, id int, forUpdate bool) (*escrow, error) {
+	var esc escrow
+
+	query := `select ` + escrowColumns + ` from escrows where id = $1`
+
+	if forUpdate {
+		query += ` for update`
+	}
+
+	err := scanEscrow(q.QueryRow(query, id), &esc)
+
+	if err == sql.ErrNoRows {
+		return nil, noEscrowError
+	} else if err != nil {
+		return nil, err
+	}
+
+	return &esc, nil
+}
+
+// Move the escrow's money out of the escrow account, to the payee if action
+// is release or back to the payer if it's refund, and mark it resolved. The
+// escrow's row must be locked by tx.
+func resolveEscrow(tx *sql.Tx, esc *escrow, action string) error {
+	destID, status := esc.PayeeID, "released"
+
+	if action == "refund" {
+		destID, status = esc.PayerID, "refunded"
+	}
+
+	transferID, err := systemTransfer(tx, "escrow", destID, esc.Amount,
+		fmt.Sprintf("escrow %d %s", esc.ID, status), true)
+
+	if err != nil {
+		return err
+	}
+
+	now := time.Now().UTC()
+
+	_, err = tx.Exec(
+		`update escrows set status = $1, resolution_transfer_id = $2,
+		resolved_at = $3 where id = $4`, status, transferID, now, esc.ID)
+
+	if err != nil {
+		return err
+	}
+
+	esc.Status = status
+	esc.ResolutionTransferID = &transferID
+	esc.ResolvedAt = &now
+
+	return nil
+}
+
+// Handler for POST at /escrows. The amount moves from the payer to the
+// escrow account right away, paying the usual fee and counting towards the
+// payer's limits. The risk rules are evaluated then, as for a transfer from
+// the payer to the payee, since the money can reach the payee at the
+// deadline without anyone else deciding. An escrow the rules would review
+// isn't opened, see escrowReviewError.
+func createEscrow(rw http.ResponseWriter, req *http.Request) {
+	id := accountID(req)
+
+	var createReq escrowCreateRequest
+
+	data, err := readFromReq(req, 1024)
+
+	if err != nil {
+		respondWithError(rw, err)
+		return
+	}
+
+	err = json.Unmarshal(data, &createReq)
+
+	var publicError *publicJSONError
+	if errors.As(err, &publicError) {
+		respondWithError(rw, publicError)
+		return
+	} else if err != nil {
+		respondWithError(rw, cantParseJSONError)
+		return
+	}
+
+	now := time.Now().UTC()
+
+	if err = createReq.validate(now); err != nil {
+		respondWithError(rw, err)
+		return
+	}
+
+	if createReq.PayeeKey != "" {
+		createReq.PayeeID, err = getAccountByKey(DB, createReq.PayeeKey)
+
+		if err != nil {
+			respondWithError(rw, err)
+			return
+		}
+	}
+
+	if createReq.PayeeID == id {
+		respondWithError(rw, sameAccountError)
+		return
+	}
+
+	tx, err := DB.BeginTx(req.Context(), &defaultTxOptions)
+
+	if err != nil {
+		logger.Print("Error starting tx to create escrow")
+		respondWithError(rw, err)
+		return
+	}
+
+	// Lock the escrow account before the payer's, in the same order as
+	// systemTransfer, so funding and resolving can't deadlock.
+	var escrowAccountID int
+
+	err = tx.QueryRow(
+		`select id from accounts where escrow for update`).Scan(
+		&escrowAccountID)
+
+	if err == sql.ErrNoRows {
+		err = errors.New("no escrow account")
+	}
+
+	if err != nil {
+		rollbackTx(tx)
+		respondWithError(rw, err)
+		return
+	}
+
+	var payeeExists bool
+
+	err = tx.QueryRow(`select exists (select 1 from accounts where id = $1)`,
+		createReq.PayeeID).Scan(&payeeExists)
+
+	if err == nil && !payeeExists {
+		err = noDestAccountError
+	}
+
+	if err != nil {
+		rollbackTx(tx)
+		respondWithError(rw, err)
+		return
+	}
+
+	var escrowID int
+
+	err = tx.QueryRow(
+		`insert into escrows (payer_id, payee_id, amount, description, status,
+		deadline, default_action, created_at)
+		values ($1, $2, $3, $4, 'held', $5, $6, $7) returning id`,
+		id, createReq.PayeeID, createReq.Amount, createReq.Description,
+		createReq.Deadline.UTC(), createReq.DefaultAction, now).Scan(&escrowID)
+
+	if err != nil {
+		rollbackTx(tx)
+		respondWithError(rw, err)
+		return
+	}
+
+	metadata := transferMetadata{"escrow_id": strconv.Itoa(escrowID)}
+
+	// The rules see the payer sending to the payee. They run before the
+	// funding transfer, which the velocity rule would count otherwise.
+	payeeAttempt := TransferAttempt{
+		OriginID:      id,
+		DestinationID: createReq.PayeeID,
+		Amount:        createReq.Amount,
+		Description:   createReq.Description,
+		Metadata:      metadata,
+	}
+
+	pending, err := evaluateTransferRisk(tx, &payeeAttempt)
+
+	var reviewRule string
+
+	if err == nil && pending != nil {
+		reviewRule = pending.Rule
+		err = escrowReviewError
+	}
+
+	var transf *transfer
+
+	if err == nil {
+		transf, _, err = transferInTx(tx, &TransferAttempt{
+			OriginID:      id,
+			DestinationID: escrowAccountID,
+			Amount:        createReq.Amount,
+			Description:   createReq.Description,
+			Metadata:      metadata,
+		}, false)
+	}
+
+	if err == nil {
+		_, err = tx.Exec(
+			`update escrows set funding_transfer_id = $1 where id = $2`,
+			transf.ID, escrowID)
+	}
+
+	if err == nil {
+		err = recordRiskDecision(tx, &payeeAttempt, RiskAllow, "",
+			&transf.ID, nil)
+	}
+
+	if err != nil {
+		rollbackTx(tx)
+
+		// Recorded outside of the rolled back tx, like insertTransfer does.
+		// No pending transfer is kept for a review, the escrow isn't opened.
+		var deniedErr *riskDeniedError
+		if errors.As(err, &deniedErr) {
+			recordRiskDecision(DB, &payeeAttempt, RiskDeny, deniedErr.rule,
+				nil, nil)
+		} else if reviewRule != "" {
+			recordRiskDecision(DB, &payeeAttempt, RiskReview, reviewRule,
+				nil, nil)
+		}
+
+		countTransfer(transferResult(nil, err), createReq.Amount)
+		respondWithError(rw, err)
+		return
+	}
+
+	esc, err := getEscrow(tx, escrowID, false)
+
+	if err != nil {
+		rollbackTx(tx)
+		countTransfer(transferResult(nil, err), createReq.Amount)
+		respondWithError(rw, err)
+		return
+	}
+
+	err = tx.Commit()
+
+	if err != nil {
+		logger.Print("Error commiting tx")
+		countTransfer(transferResult(nil, err), createReq.Amount)
+		respondWithError(rw, err)
+		return
+	}
+
+	countTransfer("completed", createReq.Amount)
+	logger.Printf("Account %d opened escrow %d", id, escrowID)
+	respondWithJSON(rw, http.StatusCreated, esc)
+}
+
+// Handler for GET at /escrows. Lists the escrows where the logged in account
+// is the payer or the payee, newest first by default. Can be filtered by
+// status.
+func getEscrows(rw http.ResponseWriter, req *http.Request) {
+	id := accountID(req)
+
+	params, err := parsePageParams(req, map[string]string{"id": "integer"},
+		"id")
+
+	if err != nil {
+		respondWithError(rw, err)
+		return
+	}
+
+	if req.URL.Query().Get("order") == "" {
+		params.desc = true
+	}
+
+	var where whereBuilder
+	where.add("(payer_id = %[1]s or payee_id = %[1]s)", id)
+
+	if status := req.URL.Query().Get("status"); status != "" {
+		if status != "held" && status != "released" && status != "refunded" {
+			respondWithError(rw, newBadParamError("status"))
+			return
+		}
+
+		where.add("status = %[1]s", status)
+	}
+
+	params.addCursor(&where)
+
+	rows, err := DB.QueryContext(req.Context(),
+		`select `+escrowColumns+` from escrows where `+where.String()+` `+
+			params.orderAndLimit(), where.args...)
+
+	if err != nil {
+		respondWithError(rw, err)
+		return
+	}
+
+	defer rows.Close()
+
+	escrows := make([]escrow, 0, params.limit+1)
+
+	for rows.Next() {
+		var esc escrow
+
+		err = scanEscrow(rows, &esc)
+
+		if err != nil {
+			logger.Printf("error when querying escrows")
+			respondWithError(rw, err)
+			return
+		}
+
+		escrows = append(escrows, esc)
+	}
+
+	if err = rows.Err(); err != nil {
+		logger.Printf("error when querying escrows")
+		respondWithError(rw, err)
+		return
+	}
+
+	var page escrowPage
+
+	if len(escrows) > params.limit {
+		page.NextCursor = params.nextCursor(escrows[params.limit-1].ID, "")
+		escrows = escrows[:params.limit]
+	}
+
+	page.Escrows = escrows
+
+	respondWithJSON(rw, http.StatusOK, &page)
+}
+
+// Handler for POST at /escrows/<id>/confirm and /escrows/<id>/cancel. Records
+// the decision of the logged in party, who can change their mind until the
+// escrow is resolved. Once both parties made the same decision the money
+// moves, in the same tx.
+func decideEscrow(rw http.ResponseWriter, req *http.Request,
+	decision string) {
+
+	id := accountID(req)
+	escrowID, err := pathID(req, "id")
+
+	if err != nil {
+		respondWithError(rw, err)
+		return
+	}
+
+	tx, err := DB.BeginTx(req.Context(), &defaultTxOptions)
+
+	if err != nil {
+		logger.Print("Error starting tx to decide escrow")
+		respondWithError(rw, err)
+		return
+	}
+
+	esc, err := getEscrow(tx, escrowID, true)
+
+	if err == nil && esc.PayerID != id && esc.PayeeID != id {
+		err = forbiddenError
+	} else if err == nil && esc.Status != "held" {
+		err = escrowResolvedError
+	}
+
+	if err != nil {
+		rollbackTx(tx)
+		respondWithError(rw, err)
+		return
+	}
+
+	column := "payee_decision"
+
+	if esc.PayerID == id {
+		column = "payer_decision"
+		esc.PayerDecision = decision
+	} else {
+		esc.PayeeDecision = decision
+	}
+
+	var action string
+
+	// Too late to decide, the default applies. It's committed anyway, so
+	// that the escrow doesn't wait for the job.
+	pastDeadline := !time.Now().Before(esc.Deadline)
+
+	if pastDeadline {
+		action = esc.DefaultAction
+	} else {
+		_, err = tx.Exec(`update escrows set `+column+` = $1 where id = $2`,
+			decision, escrowID)
+		action = escrowOutcome(esc.PayerDecision, esc.PayeeDecision)
+	}
+
+	if err == nil && action != "" {
+		err = resolveEscrow(tx, esc, action)
+	}
+
+	if err != nil {
+		rollbackTx(tx)
+		respondWithError(rw, err)
+		return
+	}
+
+	err = tx.Commit()
+
+	if err != nil {
+		logger.Print("Error commiting tx")
+		respondWithError(rw, err)
+		return
+	}
+
+	if pastDeadline {
+		logger.Printf("Escrow %d %s at its deadline", escrowID, esc.Status)
+		respondWithError(rw, escrowResolvedError)
+		return
+	}
+
+	logger.Printf("Account %d decided to %s escrow %d", id, decision,
+		escrowID)
+	respondWithJSON(rw, http.StatusOK, esc)
+}
+
+// Apply the default action of every held escrow past its deadline. Errors on
+// one escrow don't stop the others, the first one is returned.
+func resolveDueEscrows(ctx context.Context) (int, error) {
+	rows, err := DB.QueryContext(ctx,
+		`select id from escrows where status = 'held' and deadline <= $1
+		order by deadline`, time.Now().UTC())
+
+	if err != nil {
+		return 0, err
+	}
+
+	var ids []int
+
+	for rows.Next() {
+		var id int
+
+		if err = rows.Scan(&id); err != nil {
+			rows.Close()
+			return 0, err
+		}
+
+		ids = append(ids, id)
+	}
+
+	rows.Close()
+
+	if err = rows.Err(); err != nil {
+		return 0, err
+	}
+
+	var resolved int
+	var firstErr error
+
+	for _, id := range ids {
+		err = resolveDueEscrow(ctx, id)
+
+		if err == nil {
+			resolved++
+			continue
+		}
+
+		logger.Printf("Resolving escrow %d failed: %v", id, err)
+
+		if firstErr == nil {
+			firstErr = err
+		}
+	}
+
+	return resolved, firstErr
+}
+
+// Apply the default action of the escrow with id, unless a party resolved it
+// since it was selected.
+func resolveDueEscrow(ctx context.Context, id int) error {
+	tx, err := DB.BeginTx(ctx, &defaultTxOptions)
+
+	if err != nil {
+		logger.Print("Error starting tx to resolve escrow")
+		return err
+	}
+
+	esc, err := getEscrow(tx, id, true)
+
+	if err != nil || esc.Status != "held" {
+		rollbackTx(tx)
+		return err
+	}
+
+	err = resolveEscrow(tx, esc, esc.DefaultAction)
+
+	if err != nil {
+		rollbackTx(tx)
+		return err
+	}
+
+	err = tx.Commit()
+
+	if err != nil {
+		logger.Print("Error commiting tx")
+		return err
+	}
+
+	logger.Printf("Escrow %d %s at its deadline", id, esc.Status)
+
+	return nil
+}
+
+// Resolve the escrows past their deadline every escrowJobInterval. Call this
+// in a goroutine. Cancel the context to stop the goroutine.
+func escrowJob(ctx context.Context) {
+	defer close(escrowJobFinished)
+
+	ticker := time.NewTicker(escrowJobInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			logger.Print("Escrow job exiting...")
+			return
+		case <-ticker.C:
+		}
+
+		resolveDueEscrows(ctx)
+	}
+}
+
+func confirmEscrow(rw http.ResponseWriter, req *http.Request) {
+	decideEscrow(rw, req, "confirm")
+}
+
+func cancelEscrow(rw http.ResponseWriter, req *http.Request) {
+	decideEscrow(rw, req, "cancel")
+}
+
+// Handler for GET at /escrows/<id>. Only the payer and the payee can see an
+// escrow.
+func getEscrowByID(rw http.ResponseWriter, req *http.Request) {
+	id := accountID(req)
+	escrowID, err := pathID(req, "id")
+
+	if err != nil {
+		respondWithError(rw, err)
+		return
+	}
+
+	esc, err := getEscrow(DB, escrowID, false)
+
+	if err == nil && esc.PayerID != id && esc.PayeeID != id {
+		err = forbiddenError
+	}
+
+	if err != nil {
+		respondWithError(rw, err)
+		return
+	}
+
+	respondWithJSON(rw, http.StatusOK, esc)
+}
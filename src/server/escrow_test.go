@@ -0,0 +1,74 @@
+package server
+
+import (
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestEscrowValidation(t *testing.T) {
+	now := time.Date(2021, time.September, 6, 12, 0, 0, 0, time.UTC)
+
+	var createReq = escrowCreateRequest{
+		PayeeID:     2,
+		Amount:      3472,
+		Description: "Used bike",
+		Deadline:    now.Add(7 * 24 * time.Hour),
+	}
+
+	if createReq.validate(now) != nil || createReq.DefaultAction != "refund" {
+		t.Error(createReq)
+	}
+
+	var badCreateReqs = []struct {
+		modify func(*escrowCreateRequest)
+		err    *publicJSONError
+	}{
+		{func(req *escrowCreateRequest) { req.Amount = 0 }, zeroAmountError},
+		{func(req *escrowCreateRequest) { req.Amount = -1 },
+			invalidAmountError},
+		{func(req *escrowCreateRequest) { req.PayeeID = 0 },
+			badDestinationIdError},
+		{func(req *escrowCreateRequest) { req.PayeeKey = "a@b.com" },
+			twoDestinationsError},
+		{func(req *escrowCreateRequest) {
+			req.Description = strings.Repeat("d", maxDescriptionLen+1)
+		}, descriptionTooLongError},
+		{func(req *escrowCreateRequest) { req.Deadline = now },
+			badDeadlineError},
+		{func(req *escrowCreateRequest) {
+			req.Deadline = now.Add(maxEscrowDeadline + time.Second)
+		}, badDeadlineError},
+		{func(req *escrowCreateRequest) { req.DefaultAction = "keep" },
+			badDefaultActionError},
+	}
+
+	for _, badCreateReq := range badCreateReqs {
+		badReq := createReq
+		badCreateReq.modify(&badReq)
+
+		if badReq.validate(now) != badCreateReq.err {
+			t.Error(badReq)
+		}
+	}
+}
+
+func TestEscrowOutcome(t *testing.T) {
+	var outcomes = []struct {
+		payer   string
+		payee   string
+		outcome string
+	}{
+		{"", "", ""},
+		{"confirm", "", ""},
+		{"confirm", "cancel", ""},
+		{"confirm", "confirm", "release"},
+		{"cancel", "cancel", "refund"},
+	}
+
+	for _, outcome := range outcomes {
+		if escrowOutcome(outcome.payer, outcome.payee) != outcome.outcome {
+			t.Error(outcome)
+		}
+	}
+}
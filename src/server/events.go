@@ -0,0 +1,452 @@
+package server
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/jackc/pgx/v4"
+)
+
+// How many transfer ids a subscriber can have waiting. A stream that falls
+// further behind is ended, and the client resumes it with Last-Event-ID.
+const eventBufferLen = 64
+
+// How often a stream sends a comment, to keep proxies from closing it, and
+// checks that its login is still valid.
+const eventHeartbeatInterval = 15 * time.Second
+
+// Longest wait before listening again after the connection failed.
+const maxListenBackoff = 30 * time.Second
+
+// Channel that signals when the event listener finishes
+var eventListenerFinished = make(chan interface{})
+
+// The ids of the transfers of an account, as they commit. lagged is closed
+// when ids were dropped, or may have been.
+type eventSubscriber struct {
+	accountID int
+	transfers chan int
+	lagged    chan interface{}
+	lagOnce   sync.Once
+}
+
+func (sub *eventSubscriber) lag() {
+	sub.lagOnce.Do(func() { close(sub.lagged) })
+}
+
+// Sends the transfers the listener hears about to the streams of the
+// accounts involved.
+type eventHub struct {
+	subscribers map[int]map[*eventSubscriber]bool
+	closed      bool
+	mu          sync.Mutex
+}
+
+func newEventHub() *eventHub {
+	return &eventHub{subscribers: make(map[int]map[*eventSubscriber]bool)}
+}
+
+var events = newEventHub()
+
+// Start receiving the transfers of the account with id. If the hub is
+// closed, the subscriber is lagged already.
+func (hub *eventHub) subscribe(id int) *eventSubscriber {
+	sub := &eventSubscriber{accountID: id,
+		transfers: make(chan int, eventBufferLen),
+		lagged:    make(chan interface{})}
+
+	hub.mu.Lock()
+	defer hub.mu.Unlock()
+
+	if hub.closed {
+		sub.lag()
+		return sub
+	}
+
+	if hub.subscribers[id] == nil {
+		hub.subscribers[id] = make(map[*eventSubscriber]bool)
+	}
+
+	hub.subscribers[id][sub] = true
+
+	return sub
+}
+
+func (hub *eventHub) unsubscribe(sub *eventSubscriber) {
+	hub.mu.Lock()
+	defer hub.mu.Unlock()
+
+	delete(hub.subscribers[sub.accountID], sub)
+
+	if len(hub.subscribers[sub.accountID]) == 0 {
+		delete(hub.subscribers, sub.accountID)
+	}
+}
+
+// Send the transfer with transferID to the subscribers of its accounts,
+// lagging the ones that can't keep up.
+func (hub *eventHub) publish(transferID int, originID int,
+	destinationID int) {
+
+	hub.mu.Lock()
+	defer hub.mu.Unlock()
+
+	ids := []int{originID}
+
+	if destinationID != originID {
+		ids = append(ids, destinationID)
+	}
+
+	for _, id := range ids {
+		for sub := range hub.subscribers[id] {
+			select {
+			case sub.transfers <- transferID:
+			default:
+				sub.lag()
+			}
+		}
+	}
+}
+
+// Lag every subscriber, when notifications may have been missed.
+func (hub *eventHub) lagAll() {
+	hub.mu.Lock()
+	defer hub.mu.Unlock()
+
+	for _, subs := range hub.subscribers {
+		for sub := range subs {
+			sub.lag()
+		}
+	}
+}
+
+// Lag every subscriber, now and to come, when the server stops.
+func (hub *eventHub) close() {
+	hub.lagAll()
+
+	hub.mu.Lock()
+	hub.closed = true
+	hub.mu.Unlock()
+}
+
+// Payload of the notifications on the transfers channel, see the
+// transfers_notify trigger.
+type transferNotification struct {
+	ID            int `json:"id"`
+	OriginID      int `json:"origin_id"`
+	DestinationID int `json:"destination_id"`
+}
+
+// Listen for the transfers committed by any server and publish them to
+// events, until ctx is done. Postgres doesn't keep notifications for a
+// connection that's gone, so the streams are lagged each time it's lost.
+func eventListener(ctx context.Context) {
+	defer close(eventListenerFinished)
+	defer events.close()
+
+	backoff := time.Second
+
+	for {
+		listening, err := listenForTransfers(ctx)
+
+		if ctx.Err() != nil {
+			logger.Print("Event listener exiting...")
+			return
+		}
+
+		logger.Printf("Error listening for transfers: %v", err)
+		events.lagAll()
+
+		if listening {
+			backoff = time.Second
+		}
+
+		timer := time.NewTimer(backoff)
+
+		select {
+		case <-ctx.Done():
+			timer.Stop()
+			logger.Print("Event listener exiting...")
+			return
+		case <-timer.C:
+		}
+
+		if backoff *= 2; backoff > maxListenBackoff {
+			backoff = maxListenBackoff
+		}
+	}
+}
+
+// Connect, listen on the transfers channel and publish its notifications
+// until the connection fails or ctx is done. listening tells if it got as
+// far as listening.
+func listenForTransfers(ctx context.Context) (listening bool, err error) {
+	conn, err := pgx.ConnectConfig(ctx, dbConfig)
+
+	if err != nil {
+		return false, err
+	}
+
+	defer conn.Close(context.Background())
+
+	_, err = conn.Exec(ctx, "listen transfers")
+
+	if err != nil {
+		return false, err
+	}
+
+	for {
+		notification, err := conn.WaitForNotification(ctx)
+
+		if err != nil {
+			return true, err
+		}
+
+		var transferNotif transferNotification
+		err = json.Unmarshal([]byte(notification.Payload), &transferNotif)
+
+		if err != nil {
+			logger.Printf("Bad transfer notification %q: %v",
+				notification.Payload, err)
+			continue
+		}
+
+		events.publish(transferNotif.ID, transferNotif.OriginID,
+			transferNotif.DestinationID)
+	}
+}
+
+// Data of a transfer event. direction is in or out, for the account of the
+// stream.
+type transferEvent struct {
+	Direction string    `json:"direction"`
+	Transfer  *transfer `json:"transfer"`
+}
+
+func newTransferEvent(id int, transf *transfer) *transferEvent {
+	direction := "in"
+
+	if transf.OriginID == id {
+		direction = "out"
+	}
+
+	return &transferEvent{Direction: direction, Transfer: transf}
+}
+
+// Write an event in the text/event-stream format. An id of 0 is left out,
+// so the client keeps the last one.
+func writeEvent(w io.Writer, id int, name string, data interface{}) error {
+	dataBytes, err := json.Marshal(data)
+
+	if err != nil {
+		return err
+	}
+
+	if id != 0 {
+		_, err = fmt.Fprintf(w, "id: %d\n", id)
+
+		if err != nil {
+			return err
+		}
+	}
+
+	_, err = fmt.Fprintf(w, "event: %s\ndata: %s\n\n", name, dataBytes)
+
+	return err
+}
+
+// The Last-Event-ID header, the id of the last transfer the client got, or
+// -1 if there's none.
+func lastEventID(req *http.Request) (int, error) {
+	header := req.Header.Get("Last-Event-ID")
+
+	if header == "" {
+		return -1, nil
+	}
+
+	id, err := strconv.Atoi(header)
+
+	if err != nil || id < 0 {
+		return 0, lastEventIDInvalidError
+	}
+
+	return id, nil
+}
+
+// Write the transfers of the account with id after the one with lastID, in
+// order. Returns the id of the last one written, or lastID.
+func replayTransfers(ctx context.Context, w io.Writer, id int,
+	lastID int) (int, error) {
+
+	rows, err := DB.QueryContext(ctx,
+		`select `+transferColumns+` from transfers
+		where (origin_id = $1 or destination_id = $1) and id > $2
+		order by id`, id, lastID)
+
+	if err != nil {
+		return lastID, err
+	}
+
+	defer rows.Close()
+
+	for rows.Next() {
+		var transf transfer
+		err = scanTransfer(rows, &transf)
+
+		if err != nil {
+			return lastID, err
+		}
+
+		err = writeEvent(w, transf.ID, "transfer",
+			newTransferEvent(id, &transf))
+
+		if err != nil {
+			return lastID, err
+		}
+
+		lastID = transf.ID
+	}
+
+	return lastID, rows.Err()
+}
+
+// Handler for GET at /events. Streams the transfers of the logged-in
+// account as they commit, each followed by the new balance, as Server-Sent
+// Events. The current balance comes first. A client that reconnects with
+// Last-Event-ID gets the transfers it missed before that.
+func streamEvents(rw http.ResponseWriter, req *http.Request) {
+	id := accountID(req)
+	ctx := req.Context()
+	lastID, err := lastEventID(req)
+
+	if err != nil {
+		respondWithError(rw, err)
+		return
+	}
+
+	flusher, ok := rw.(http.Flusher)
+
+	if !ok {
+		respondWithError(rw, streamingUnsupportedError)
+		return
+	}
+
+	// Subscribe before the replay and the balance, so no transfer falls
+	// between them and the live ones
+	sub := events.subscribe(id)
+	defer events.unsubscribe(sub)
+
+	balance, err := accountBalance(ctx, id)
+
+	if err != nil {
+		respondWithError(rw, err)
+		return
+	}
+
+	header := rw.Header()
+	header.Set("Content-Type", "text/event-stream")
+	header.Set("Cache-Control", "no-cache")
+	header.Set("X-Accel-Buffering", "no")
+	rw.WriteHeader(http.StatusOK)
+
+	if lastID >= 0 {
+		lastID, err = replayTransfers(ctx, rw, id, lastID)
+
+		if err != nil {
+			logger.Printf("Error replaying events: %v", err)
+			return
+		}
+
+		if balance, err = accountBalance(ctx, id); err != nil {
+			logger.Printf("Error getting balance for events: %v", err)
+			return
+		}
+	}
+
+	if err = writeEvent(rw, 0, "balance", balance); err != nil {
+		return
+	}
+
+	flusher.Flush()
+
+	heartbeat := time.NewTicker(eventHeartbeatInterval)
+	defer heartbeat.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-sub.lagged:
+			return
+		case <-heartbeat.C:
+			// Keep the login alive while the stream is open
+			_, err = getUserByToken(authToken(req), true)
+
+			if err != nil {
+				return
+			}
+
+			if _, err = io.WriteString(rw, ": ping\n\n"); err != nil {
+				return
+			}
+		case transferID := <-sub.transfers:
+			// Already sent in the replay
+			if transferID <= lastID {
+				continue
+			}
+
+			err = streamTransfer(ctx, rw, id, transferID)
+
+			if err != nil {
+				logger.Printf("Error streaming transfer %d: %v", transferID,
+					err)
+				return
+			}
+
+			lastID = transferID
+		}
+
+		flusher.Flush()
+	}
+}
+
+// Write the event for the transfer with transferID, followed by the balance
+// of the account with id.
+func streamTransfer(ctx context.Context, w io.Writer, id int,
+	transferID int) error {
+
+	var transf transfer
+
+	row := DB.QueryRowContext(ctx,
+		`select `+transferColumns+` from transfers where id = $1`,
+		transferID)
+
+	err := scanTransfer(row, &transf)
+
+	if err == sql.ErrNoRows {
+		return nil
+	} else if err != nil {
+		return err
+	}
+
+	err = writeEvent(w, transf.ID, "transfer", newTransferEvent(id, &transf))
+
+	if err != nil {
+		return err
+	}
+
+	balance, err := accountBalance(ctx, id)
+
+	if err != nil {
+		return err
+	}
+
+	return writeEvent(w, 0, "balance", balance)
+}
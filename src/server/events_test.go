@@ -0,0 +1,160 @@
+package server
+
+import (
+	"bytes"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+func TestEventHub(t *testing.T) {
+	hub := newEventHub()
+	origin := hub.subscribe(1)
+	destination := hub.subscribe(2)
+	other := hub.subscribe(3)
+
+	hub.publish(10, 1, 2)
+
+	for _, sub := range []*eventSubscriber{origin, destination} {
+		select {
+		case id := <-sub.transfers:
+			if id != 10 {
+				t.Error(sub.accountID, id)
+			}
+		default:
+			t.Error("no transfer for", sub.accountID)
+		}
+	}
+
+	if len(other.transfers) != 0 {
+		t.Error("transfer for account 3")
+	}
+
+	// A subscriber that can't keep up is lagged, the others aren't
+	for i := 0; i <= eventBufferLen; i++ {
+		hub.publish(100+i, 1, 4)
+	}
+
+	select {
+	case <-origin.lagged:
+	default:
+		t.Error("origin not lagged")
+	}
+
+	select {
+	case <-destination.lagged:
+		t.Error("destination lagged")
+	default:
+	}
+
+	hub.unsubscribe(origin)
+	hub.unsubscribe(origin)
+
+	if _, ok := hub.subscribers[1]; ok {
+		t.Error("account 1 still subscribed")
+	}
+
+	hub.close()
+
+	for _, sub := range []*eventSubscriber{destination, other,
+		hub.subscribe(5)} {
+
+		select {
+		case <-sub.lagged:
+		default:
+			t.Error("not lagged after close", sub.accountID)
+		}
+	}
+}
+
+func TestWriteEvent(t *testing.T) {
+	var buf bytes.Buffer
+	transf := transfer{ID: 42, OriginID: 1, DestinationID: 2, Amount: 150}
+
+	err := writeEvent(&buf, transf.ID, "transfer",
+		newTransferEvent(2, &transf))
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	err = writeEvent(&buf, 0, "balance",
+		&accountBalanceResponse{Balance: 150})
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	lines := bytes.Split(buf.Bytes(), []byte("\n"))
+
+	if len(lines) != 8 || string(lines[0]) != "id: 42" ||
+		string(lines[1]) != "event: transfer" || len(lines[3]) != 0 ||
+		string(lines[4]) != "event: balance" || len(lines[6]) != 0 {
+
+		t.Fatalf("%q", buf.String())
+	}
+
+	var event struct {
+		Direction string
+		Transfer  struct{ ID int }
+	}
+
+	err = json.Unmarshal(bytes.TrimPrefix(lines[2], []byte("data: ")),
+		&event)
+
+	if err != nil || event.Direction != "in" || event.Transfer.ID != 42 {
+		t.Error(string(lines[2]), err)
+	}
+
+	if newTransferEvent(1, &transf).Direction != "out" {
+		t.Error("direction for the origin")
+	}
+}
+
+func TestLastEventID(t *testing.T) {
+	var values = []struct {
+		header string
+		id     int
+		err    error
+	}{
+		{"", -1, nil},
+		{"0", 0, nil},
+		{"123", 123, nil},
+		{"-1", 0, lastEventIDInvalidError},
+		{"abc", 0, lastEventIDInvalidError},
+	}
+
+	for _, value := range values {
+		req := httptest.NewRequest(http.MethodGet, "/events", nil)
+
+		if value.header != "" {
+			req.Header.Set("Last-Event-ID", value.header)
+		}
+
+		id, err := lastEventID(req)
+
+		if id != value.id || err != value.err {
+			t.Error(value.header, id, err)
+		}
+	}
+
+	users.mu.Lock()
+	users.entries["events-test-token"] = userEntry{1, time.Now()}
+	users.mu.Unlock()
+
+	defer logoutAccount(1, "")
+
+	req := httptest.NewRequest(http.MethodGet, "/events", nil)
+	req.Header.Set("Authorization", "events-test-token")
+	req.Header.Set("Last-Event-ID", "abc")
+	rec := httptest.NewRecorder()
+	routes().ServeHTTP(rec, req)
+
+	if rec.Code != http.StatusBadRequest ||
+		!bytes.Contains(rec.Body.Bytes(), []byte("invalid_last_event_id")) {
+
+		t.Error(rec.Code, rec.Body.String())
+	}
+}
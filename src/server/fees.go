@@ -0,0 +1,256 @@
+package server
+
+import (
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"math"
+	"math/big"
+	"net/http"
+	"time"
+)
+
+// What a transfer costs the sender, for the accounts of a tier. The fee is
+// the flat part plus the percentage of the amount, kept between Min and Max.
+type feeSchedule struct {
+	Flat money
+	// Percentage of the amount, in hundredths of a percent
+	PercentBps int
+	// Bounds for the fee, 0 for none
+	Min money
+	Max money
+	// Transfers each calendar month, in the account's time zone, that pay no
+	// fee
+	FreePerMonth int
+}
+
+// The price of a transfer, for POST /transfers/quote.
+type transferQuote struct {
+	DestinationID int   `json:"account_destination_id"`
+	Amount        money `json:"amount"`
+	Fee           money `json:"fee"`
+	// What leaves the account, amount plus fee
+	Total money `json:"total"`
+}
+
+// Get the schedule for tier. Tiers without one pay no fees.
+func getFeeSchedule(q queryRower, tier string) (feeSchedule, error) {
+	var schedule feeSchedule
+
+	row := q.QueryRow(
+		`select flat, percent_bps, min_fee, max_fee, free_per_month
+		from fee_schedules where tier = $1`, tier)
+
+	err := row.Scan(&schedule.Flat, &schedule.PercentBps, &schedule.Min,
+		&schedule.Max, &schedule.FreePerMonth)
+
+	if err == sql.ErrNoRows {
+		return feeSchedule{}, nil
+	}
+
+	return schedule, err
+}
+
+// The fee for amount, not counting free transfers. The percentage is
+// rounded half up to the cent.
+func (schedule *feeSchedule) fee(amount money) money {
+	fee := int64(schedule.Flat) +
+		(int64(amount)*int64(schedule.PercentBps)+5000)/10000
+
+	if fee < int64(schedule.Min) {
+		fee = int64(schedule.Min)
+	}
+
+	if schedule.Max > 0 && fee > int64(schedule.Max) {
+		fee = int64(schedule.Max)
+	}
+
+	// The flat part can be as large as any amount. Anything that doesn't fit
+	// can't be paid anyway.
+	if fee > math.MaxInt32 {
+		fee = math.MaxInt32
+	}
+
+	return money(fee)
+}
+
+// The fee the account with id pays to send amount. The house account pays
+// no fees.
+func transferFee(q queryRower, id int, amount money) (money, error) {
+	var tier string
+	var house bool
+
+	row := q.QueryRow(`select tier, house from accounts where id = $1`, id)
+	err := row.Scan(&tier, &house)
+
+	if err == sql.ErrNoRows {
+		return 0, noOrigAccountError
+	} else if err != nil || house {
+		return 0, err
+	}
+
+	schedule, err := getFeeSchedule(q, tier)
+
+	if err != nil {
+		return 0, err
+	}
+
+	fee := schedule.fee(amount)
+
+	if fee == 0 || schedule.FreePerMonth == 0 {
+		return fee, nil
+	}
+
+	loc, err := accountLocation(q, id)
+
+	if err != nil {
+		return 0, err
+	}
+
+	var count int
+
+	row = q.QueryRow(
+		`select count(*) from transfers
+		where origin_id = $1 and created_at >= $2 and fee_for is null`,
+		id, monthStart(time.Now(), loc).UTC())
+
+	err = row.Scan(&count)
+
+	if err != nil {
+		return 0, err
+	}
+
+	if count < schedule.FreePerMonth {
+		return 0, nil
+	}
+
+	return fee, nil
+}
+
+// Credit fee to the house account, recording it as a transfer from origID
+// for the transfer with transferID. The fee must already be debited from the
+// origin. The house balance is updated in the same transaction as the
+// transfer, so it always matches the house's transfers.
+func chargeFee(tx *sql.Tx, origID int, transferID int, fee money) error {
+	var houseID int
+	var houseBalance money
+
+	row := tx.QueryRow(
+		`select id, balance from accounts where house for update`)
+	err := row.Scan(&houseID, &houseBalance)
+
+	if err == sql.ErrNoRows {
+		return errors.New("no house account to credit fees to")
+	} else if err != nil {
+		return err
+	}
+
+	newBalance := big.NewInt(int64(houseBalance))
+	newBalance.Add(newBalance, big.NewInt(int64(fee)))
+
+	if newBalance.BitLen() > 31 {
+		return fmt.Errorf("house account balance would overflow")
+	}
+
+	_, err = tx.Exec(`update accounts set balance = $1 where id = $2`,
+		newBalance.Int64(), houseID)
+
+	if err != nil {
+		return err
+	}
+
+	var feeTransferID int
+
+	err = tx.QueryRow(
+		`insert into transfers (origin_id, destination_id, amount, created_at,
+		description, fee_for)
+		values ($1, $2, $3, current_timestamp at time zone 'UTC', $4, $5)
+		returning id`,
+		origID, houseID, fee, fmt.Sprintf("fee for transfer %d", transferID),
+		transferID).Scan(&feeTransferID)
+
+	if err != nil {
+		return err
+	}
+
+	return recordTransferEvents(tx, feeTransferID)
+}
+
+// Handler for POST at /transfers/quote. Takes the same JSON as POST
+// /transfers and tells the fee, without making the transfer. For split
+// payments, the fee is the sum of the legs' fees.
+func quoteTransfer(rw http.ResponseWriter, req *http.Request) {
+	id := accountID(req)
+
+	data, err := readFromReq(req, 4096)
+
+	if err != nil {
+		respondWithError(rw, err)
+		return
+	}
+
+	var transferReq transferRequest
+
+	err = json.Unmarshal(data, &transferReq)
+
+	var publicError *publicJSONError
+	if errors.As(err, &publicError) {
+		respondWithError(rw, publicError)
+		return
+	} else if err != nil {
+		respondWithError(rw, cantParseJSONError)
+		return
+	}
+
+	err = transferReq.validate()
+
+	if err == nil {
+		err = transferReq.resolveDestination(DB)
+	}
+
+	if err != nil {
+		respondWithError(rw, err)
+		return
+	}
+
+	amounts := []money{transferReq.Amount}
+
+	if len(transferReq.Splits) > 0 {
+		amounts, err = splitAmounts(transferReq.Amount, transferReq.Splits)
+
+		if err != nil {
+			respondWithError(rw, err)
+			return
+		}
+	}
+
+	// Each leg of a split pays its own fee. With free transfers left, each
+	// leg is quoted as if it were the next one, so it's an estimate.
+	var fee int64
+
+	for _, amount := range amounts {
+		legFee, err := transferFee(DB, id, amount)
+
+		if err != nil {
+			respondWithError(rw, err)
+			return
+		}
+
+		fee += int64(legFee)
+	}
+
+	total := int64(transferReq.Amount) + fee
+
+	if total > math.MaxInt32 {
+		respondWithError(rw, amountTooLargeError)
+		return
+	}
+
+	respondWithJSON(rw, http.StatusOK, &transferQuote{
+		DestinationID: transferReq.DestinationID,
+		Amount:        transferReq.Amount,
+		Fee:           money(fee),
+		Total:         money(total),
+	})
+}
@@ -0,0 +1,31 @@
+package server
+
+import (
+	"testing"
+)
+
+func TestFeeSchedule(t *testing.T) {
+	var tests = []struct {
+		schedule feeSchedule
+		amount   money
+		fee      money
+	}{
+		{feeSchedule{}, 100000, 0},
+		{feeSchedule{Flat: 150}, 100000, 150},
+		// 1.5% of 34.72 is 0.5208
+		{feeSchedule{PercentBps: 150}, 3472, 52},
+		// 0.5% of 1.00 is half a cent, rounded up
+		{feeSchedule{PercentBps: 50}, 100, 1},
+		{feeSchedule{Flat: 100, PercentBps: 100}, 10000, 200},
+		{feeSchedule{PercentBps: 100, Min: 50}, 1000, 50},
+		{feeSchedule{PercentBps: 100, Max: 500}, 100000, 500},
+		{feeSchedule{Flat: 2147483647, PercentBps: 10000}, 2147483647,
+			2147483647},
+	}
+
+	for _, test := range tests {
+		if fee := test.schedule.fee(test.amount); fee != test.fee {
+			t.Error(test.schedule, test.amount, fee)
+		}
+	}
+}
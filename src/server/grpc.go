@@ -0,0 +1,661 @@
+package server
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"math"
+	"net/http"
+	"net/url"
+	"runtime/debug"
+	"strconv"
+	"strings"
+	"time"
+
+	"google.golang.org/genproto/googleapis/rpc/errdetails"
+	spb "google.golang.org/genproto/googleapis/rpc/status"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/status"
+	"google.golang.org/protobuf/proto"
+	"google.golang.org/protobuf/types/known/timestamppb"
+
+	"pedro-bank/bankpb"
+)
+
+// The gRPC API, see bankpb/bank.proto. It's served on the same TLS listener
+// as the JSON API, see withGRPC, and calls the same functions as its
+// handlers.
+type bankService struct {
+	bankpb.UnimplementedBankServer
+}
+
+// Methods that need a login, by full name.
+var grpcAuthMethods = map[string]bool{
+	"/pedrobank.v1.Bank/Transfer":      true,
+	"/pedrobank.v1.Bank/ListTransfers": true,
+}
+
+// Domain of the ErrorInfo details of the gRPC errors.
+const grpcErrorDomain = "pedrobank"
+
+// The metadata keys, which gRPC wants in lower case.
+var (
+	grpcRequestIDKey     = strings.ToLower(requestIDHeader)
+	grpcIdempotencyKey   = strings.ToLower(idempotencyKeyHeader)
+	grpcIdempotentReplay = strings.ToLower(idempotentReplayHeader)
+)
+
+const grpcAuthorizationKey = "authorization"
+
+// Content type of the responses stored for idempotency keys by Transfer.
+const grpcIdempotentContentType = "application/grpc+proto"
+
+func newGRPCServer() *grpc.Server {
+	server := grpc.NewServer(grpc.ChainUnaryInterceptor(grpcWithRequestID,
+		grpcWithLogging, grpcWithRecovery, grpcWithAuth))
+	bankpb.RegisterBankServer(server, &bankService{})
+
+	return server
+}
+
+// Send gRPC requests, which are HTTP/2 with an application/grpc content
+// type, to grpcServer, and the others to next.
+func withGRPC(grpcServer http.Handler, next http.Handler) http.Handler {
+	return http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {
+		if req.ProtoMajor == 2 && strings.HasPrefix(
+			req.Header.Get("Content-Type"), "application/grpc") {
+
+			grpcServer.ServeHTTP(rw, req)
+			return
+		}
+
+		next.ServeHTTP(rw, req)
+	})
+}
+
+// The first value of key in the metadata of the call.
+func incomingMetadata(ctx context.Context, key string) string {
+	md, _ := metadata.FromIncomingContext(ctx)
+
+	if values := md.Get(key); len(values) > 0 {
+		return values[0]
+	}
+
+	return ""
+}
+
+// Like withRequestID. The id is kept in the context, and sent in the
+// response's header metadata.
+func grpcWithRequestID(ctx context.Context, req interface{},
+	info *grpc.UnaryServerInfo, handler grpc.UnaryHandler) (interface{},
+	error) {
+
+	id := incomingMetadata(ctx, grpcRequestIDKey)
+
+	if !requestIDRegex.MatchString(id) {
+		id = newRequestID()
+	}
+
+	grpc.SetHeader(ctx, metadata.Pairs(grpcRequestIDKey, id))
+
+	return handler(context.WithValue(ctx, requestIDKey, id), req)
+}
+
+// The id of the gRPC call, see grpcWithRequestID.
+func grpcRequestID(ctx context.Context) string {
+	id, _ := ctx.Value(requestIDKey).(string)
+	return id
+}
+
+// Like withLogging.
+func grpcWithLogging(ctx context.Context, req interface{},
+	info *grpc.UnaryServerInfo, handler grpc.UnaryHandler) (interface{},
+	error) {
+
+	start := time.Now()
+	resp, err := handler(ctx, req)
+
+	logger.Printf("GRPC %s %s %s %s", info.FullMethod, status.Code(err),
+		time.Since(start).Round(time.Microsecond), grpcRequestID(ctx))
+
+	return resp, err
+}
+
+// Like withRecovery.
+func grpcWithRecovery(ctx context.Context, req interface{},
+	info *grpc.UnaryServerInfo, handler grpc.UnaryHandler) (resp interface{},
+	err error) {
+
+	defer func() {
+		if val := recover(); val != nil {
+			logger.Printf("Panic in %s, request %s: %v\n%s", info.FullMethod,
+				grpcRequestID(ctx), val, debug.Stack())
+			err = grpcError(ctx, fmt.Errorf("panic: %v", val))
+		}
+	}()
+
+	return handler(ctx, req)
+}
+
+// Like withAuth, for the methods in grpcAuthMethods. The token is in the
+// authorization metadata.
+func grpcWithAuth(ctx context.Context, req interface{},
+	info *grpc.UnaryServerInfo, handler grpc.UnaryHandler) (interface{},
+	error) {
+
+	if !grpcAuthMethods[info.FullMethod] {
+		return handler(ctx, req)
+	}
+
+	token := incomingMetadata(ctx, grpcAuthorizationKey)
+
+	if token == "" {
+		return nil, grpcError(ctx, noTokenError)
+	}
+
+	id, err := getUserByToken(token, true)
+
+	if err != nil {
+		return nil, grpcError(ctx, err)
+	}
+
+	ctx = context.WithValue(ctx, accountIDKey, id)
+	ctx = context.WithValue(ctx, tokenKey, token)
+
+	return handler(ctx, req)
+}
+
+// gRPC codes for the HTTP statuses of the public errors.
+var grpcCodes = map[int]codes.Code{
+	http.StatusBadRequest:            codes.InvalidArgument,
+	http.StatusUnauthorized:          codes.Unauthenticated,
+	http.StatusForbidden:             codes.PermissionDenied,
+	http.StatusNotFound:              codes.NotFound,
+	http.StatusMethodNotAllowed:      codes.Unimplemented,
+	http.StatusConflict:              codes.FailedPrecondition,
+	http.StatusGone:                  codes.FailedPrecondition,
+	http.StatusRequestEntityTooLarge: codes.ResourceExhausted,
+	http.StatusUnprocessableEntity:   codes.FailedPrecondition,
+}
+
+// gRPC codes of public errors that their HTTP status doesn't tell.
+var grpcCodesByErrorCode = map[string]codes.Code{
+	"account_exists":              codes.AlreadyExists,
+	"key_exists":                  codes.AlreadyExists,
+	"wrong_password":              codes.Unauthenticated,
+	"insufficient_funds":          codes.FailedPrecondition,
+	"limit_exceeded":              codes.FailedPrecondition,
+	"try_again":                   codes.Aborted,
+	"idempotency_key_in_progress": codes.Aborted,
+}
+
+// The gRPC status error for err, like respondWithError: public errors keep
+// their message, and their code and details go in an ErrorInfo. Others are
+// logged, and become internal errors.
+func grpcError(ctx context.Context, err error) error {
+	requestID := grpcRequestID(ctx)
+
+	var publicError *publicJSONError
+
+	if !errors.As(err, &publicError) {
+		logger.Printf("Request %s: %v", requestID, err)
+		countTxConflict(err)
+		publicError = internalError
+	}
+
+	code, ok := grpcCodesByErrorCode[publicError.code]
+
+	if !ok {
+		code, ok = grpcCodes[publicError.status]
+	}
+
+	if !ok {
+		code = codes.Internal
+	}
+
+	info := errdetails.ErrorInfo{
+		Reason:   publicError.code,
+		Domain:   grpcErrorDomain,
+		Metadata: make(map[string]string, len(publicError.details)+1),
+	}
+
+	for key, value := range publicError.details {
+		info.Metadata[key] = fmt.Sprint(value)
+	}
+
+	if requestID != "" {
+		info.Metadata["request_id"] = requestID
+	}
+
+	st, detailsErr := status.New(code, publicError.errMsg).WithDetails(&info)
+
+	// Only if the ErrorInfo can't be marshalled, which it always can
+	if detailsErr != nil {
+		return status.Error(code, publicError.errMsg)
+	}
+
+	return st.Err()
+}
+
+// A request with query as its URL's query, to parse it like the JSON API's
+// query parameters.
+func queryRequest(ctx context.Context, query url.Values) *http.Request {
+	req := &http.Request{
+		Method: http.MethodGet,
+		URL:    &url.URL{RawQuery: query.Encode()},
+		Header: make(http.Header),
+	}
+
+	return req.WithContext(ctx)
+}
+
+// Add the pagination of page to query.
+func addPageQuery(query url.Values, page *bankpb.PageRequest) {
+	if page.GetLimit() != 0 {
+		query.Set("limit", strconv.Itoa(int(page.GetLimit())))
+	}
+
+	for param, value := range map[string]string{
+		"cursor": page.GetCursor(),
+		"sort":   page.GetSort(),
+		"order":  page.GetOrder(),
+	} {
+		if value != "" {
+			query.Set(param, value)
+		}
+	}
+}
+
+// The amount in cents as money, if it fits.
+func centsToMoney(cents int64) (money, error) {
+	if cents > math.MaxInt32 || cents < math.MinInt32 {
+		return 0, amountTooLargeError
+	}
+
+	return money(cents), nil
+}
+
+func timestampOrNil(t time.Time) *timestamppb.Timestamp {
+	if t.IsZero() {
+		return nil
+	}
+
+	return timestamppb.New(t)
+}
+
+func intOrZero(val *int) int32 {
+	if val == nil {
+		return 0
+	}
+
+	return int32(*val)
+}
+
+func toPBAccount(acc *account) *bankpb.Account {
+	return &bankpb.Account{
+		Id:           int32(acc.ID),
+		Name:         acc.Name,
+		Cpf:          acc.CPF,
+		BalanceCents: int64(acc.Balance),
+		CreatedAt:    timestampOrNil(acc.CreatedAt),
+		Timezone:     acc.Timezone,
+		Status:       acc.Status,
+	}
+}
+
+func toPBTransfer(transf *transfer) *bankpb.Transfer {
+	return &bankpb.Transfer{
+		Id:            int32(transf.ID),
+		OriginId:      int32(transf.OriginID),
+		DestinationId: int32(transf.DestinationID),
+		AmountCents:   int64(transf.Amount),
+		CreatedAt:     timestampOrNil(transf.CreatedAt),
+		BatchId:       intOrZero(transf.BatchID),
+		Description:   transf.Description,
+		Reference:     transf.Reference,
+		Metadata:      transf.Metadata,
+		FeeCents:      int64(transf.Fee),
+		FeeFor:        intOrZero(transf.FeeFor),
+	}
+}
+
+func toPBPendingTransfer(pending *pendingTransfer) *bankpb.PendingTransfer {
+	return &bankpb.PendingTransfer{
+		Id:            int32(pending.ID),
+		OriginId:      int32(pending.OriginID),
+		DestinationId: int32(pending.DestinationID),
+		AmountCents:   int64(pending.Amount),
+		Status:        pending.Status,
+		Rule:          pending.Rule,
+		CreatedAt:     timestampOrNil(pending.CreatedAt),
+		Description:   pending.Description,
+		Reference:     pending.Reference,
+		Metadata:      pending.Metadata,
+	}
+}
+
+func (s *bankService) CreateAccount(ctx context.Context,
+	req *bankpb.CreateAccountRequest) (*bankpb.Account, error) {
+
+	accountReq := accountCreateRequest{
+		Name:     req.GetName(),
+		CPF:      req.GetCpf(),
+		Secret:   req.GetSecret(),
+		Timezone: req.GetTimezone(),
+	}
+
+	if err := accountReq.validate(); err != nil {
+		return nil, grpcError(ctx, err)
+	}
+
+	acc, err := insertAccount(ctx, &accountReq)
+
+	if err != nil {
+		return nil, grpcError(ctx, err)
+	}
+
+	return toPBAccount(acc), nil
+}
+
+func (s *bankService) ListAccounts(ctx context.Context,
+	req *bankpb.ListAccountsRequest) (*bankpb.AccountPage, error) {
+
+	query := url.Values{}
+	addPageQuery(query, req.GetPage())
+
+	page, err := listAccounts(queryRequest(ctx, query), false)
+
+	if err != nil {
+		return nil, grpcError(ctx, err)
+	}
+
+	resp := bankpb.AccountPage{
+		Accounts:   make([]*bankpb.Account, len(page.Accounts)),
+		NextCursor: page.NextCursor,
+	}
+
+	for i := range page.Accounts {
+		resp.Accounts[i] = toPBAccount(&page.Accounts[i])
+	}
+
+	return &resp, nil
+}
+
+func (s *bankService) Login(ctx context.Context,
+	req *bankpb.LoginRequest) (*bankpb.LoginResponse, error) {
+
+	token, err := loginAccount(ctx, req.GetCpf(), req.GetSecret())
+
+	if err != nil {
+		return nil, grpcError(ctx, err)
+	}
+
+	return &bankpb.LoginResponse{Token: token}, nil
+}
+
+func (s *bankService) GetBalance(ctx context.Context,
+	req *bankpb.GetBalanceRequest) (*bankpb.Balance, error) {
+
+	balanceResp, err := accountBalance(ctx, int(req.GetAccountId()))
+
+	if err != nil {
+		return nil, grpcError(ctx, err)
+	}
+
+	return &bankpb.Balance{
+		BalanceCents:        int64(balanceResp.Balance),
+		Status:              balanceResp.Status,
+		OverdraftLimitCents: int64(balanceResp.OverdraftLimit),
+		OverdraftUsedCents:  int64(balanceResp.OverdraftUsed),
+		AvailableCents:      int64(balanceResp.Available),
+	}, nil
+}
+
+// The hash of a call, like hashRequest.
+func hashGRPCRequest(method string, req proto.Message) (string, error) {
+	data, err := proto.MarshalOptions{Deterministic: true}.Marshal(req)
+
+	if err != nil {
+		return "", err
+	}
+
+	hash := sha256.New()
+	hash.Write([]byte("GRPC " + method + "\n"))
+	hash.Write(data)
+
+	return hex.EncodeToString(hash.Sum(nil)), nil
+}
+
+// Transfer, with an idempotency key if the call has one, like
+// withIdempotency. Like the JSON API, the response is stored unless the
+// transfer failed with an internal error: failed calls are replayed with
+// their status, see replayGRPCTransfer.
+func (s *bankService) Transfer(ctx context.Context,
+	req *bankpb.TransferRequest) (*bankpb.TransferResponse, error) {
+
+	key := incomingMetadata(ctx, grpcIdempotencyKey)
+
+	if key == "" {
+		resp, err := s.transfer(ctx, req)
+
+		if err != nil {
+			return nil, grpcError(ctx, err)
+		}
+
+		return resp, nil
+	}
+
+	if !idempotencyKeyRegex.MatchString(key) {
+		return nil, grpcError(ctx, idempotencyKeyInvalidError)
+	}
+
+	id, _ := ctx.Value(accountIDKey).(int)
+	requestHash, err := hashGRPCRequest("Transfer", req)
+
+	if err != nil {
+		return nil, grpcError(ctx, err)
+	}
+
+	stored, err := claimIdempotencyKey(ctx, id, key, requestHash)
+
+	if err != nil {
+		return nil, grpcError(ctx, err)
+	}
+
+	if stored != nil {
+		return replayGRPCTransfer(ctx, requestHash, stored)
+	}
+
+	// The HTTP status of the result, and the result as stored, see
+	// replayGRPCTransfer. A 0 status forgets the key.
+	savedStatus := 0
+	var body []byte
+
+	// Deferred so the key is forgotten if the transfer panics.
+	defer func() {
+		saveIdempotentResponse(id, key, savedStatus,
+			grpcIdempotentContentType, body, false)
+	}()
+
+	resp, err := s.transfer(ctx, req)
+
+	if err != nil {
+		grpcErr := grpcError(ctx, err)
+
+		var publicError *publicJSONError
+
+		if errors.As(err, &publicError) {
+			body, err = proto.Marshal(status.Convert(grpcErr).Proto())
+
+			if err == nil {
+				savedStatus = publicError.status
+			}
+		}
+
+		return nil, grpcErr
+	}
+
+	body, err = proto.Marshal(resp)
+
+	if err != nil {
+		return nil, grpcError(ctx, err)
+	}
+
+	savedStatus = http.StatusOK
+
+	return resp, nil
+}
+
+// Respond to a call with the result stored for its idempotency key: the
+// TransferResponse for a successful transfer, or else the google.rpc.Status
+// of the error it failed with.
+func replayGRPCTransfer(ctx context.Context, requestHash string,
+	stored *idempotentResponse) (*bankpb.TransferResponse, error) {
+
+	if stored.requestHash != requestHash {
+		return nil, grpcError(ctx, idempotencyKeyReusedError)
+	}
+
+	if !stored.status.Valid {
+		return nil, grpcError(ctx, idempotencyKeyInProgressError)
+	}
+
+	grpc.SetHeader(ctx, metadata.Pairs(grpcIdempotentReplay, "true"))
+
+	// The hash has the method, so it's a result stored by Transfer
+	if stored.status.Int32 != http.StatusOK {
+		var st spb.Status
+
+		if err := proto.Unmarshal(stored.body, &st); err != nil {
+			return nil, grpcError(ctx, err)
+		}
+
+		return nil, status.FromProto(&st).Err()
+	}
+
+	var resp bankpb.TransferResponse
+
+	if err := proto.Unmarshal(stored.body, &resp); err != nil {
+		return nil, grpcError(ctx, err)
+	}
+
+	return &resp, nil
+}
+
+func (s *bankService) transfer(ctx context.Context,
+	req *bankpb.TransferRequest) (*bankpb.TransferResponse, error) {
+
+	amount, err := centsToMoney(req.GetAmountCents())
+
+	if err != nil {
+		return nil, err
+	}
+
+	transferReq := transferRequest{
+		DestinationID:  int(req.GetDestinationId()),
+		DestinationKey: req.GetDestinationKey(),
+		Amount:         amount,
+		Description:    req.GetDescription(),
+		Reference:      req.GetReference(),
+	}
+
+	if len(req.GetMetadata()) > 0 {
+		transferReq.Metadata = req.GetMetadata()
+	}
+
+	if err = transferReq.validate(); err != nil {
+		return nil, err
+	}
+
+	id, _ := ctx.Value(accountIDKey).(int)
+
+	transf, pending, err := makeTransfer(ctx, id, &transferReq)
+
+	if err != nil {
+		return nil, err
+	}
+
+	if pending != nil {
+		return &bankpb.TransferResponse{
+			Result: &bankpb.TransferResponse_Pending{
+				Pending: toPBPendingTransfer(pending)}}, nil
+	}
+
+	return &bankpb.TransferResponse{
+		Result: &bankpb.TransferResponse_Transfer{
+			Transfer: toPBTransfer(transf)}}, nil
+}
+
+func (s *bankService) ListTransfers(ctx context.Context,
+	req *bankpb.ListTransfersRequest) (*bankpb.TransferPage, error) {
+
+	query := url.Values{}
+	addPageQuery(query, req.GetPage())
+
+	for param, value := range map[string]string{
+		"direction":   req.GetDirection(),
+		"reference":   req.GetReference(),
+		"description": req.GetDescription(),
+	} {
+		if value != "" {
+			query.Set(param, value)
+		}
+	}
+
+	if req.GetCounterparty() != 0 {
+		query.Set("counterparty", strconv.Itoa(int(req.GetCounterparty())))
+	}
+
+	for param, cents := range map[string]int64{
+		"min_amount": req.GetMinAmountCents(),
+		"max_amount": req.GetMaxAmountCents(),
+	} {
+		if cents == 0 {
+			continue
+		}
+
+		amount, err := centsToMoney(cents)
+
+		if err != nil {
+			return nil, grpcError(ctx, newBadParamError(param))
+		}
+
+		query.Set(param, amount.String())
+	}
+
+	for param, t := range map[string]*timestamppb.Timestamp{
+		"from": req.GetFrom(),
+		"to":   req.GetTo(),
+	} {
+		if t != nil {
+			query.Set(param, t.AsTime().Format(time.RFC3339Nano))
+		}
+	}
+
+	for key, value := range req.GetMetadata() {
+		query.Set("metadata."+key, value)
+	}
+
+	id, _ := ctx.Value(accountIDKey).(int)
+
+	page, err := listTransfers(queryRequest(ctx, query), id, false)
+
+	if err != nil {
+		return nil, grpcError(ctx, err)
+	}
+
+	resp := bankpb.TransferPage{
+		Transfers:  make([]*bankpb.Transfer, len(page.Transfers)),
+		NextCursor: page.NextCursor,
+	}
+
+	for i := range page.Transfers {
+		resp.Transfers[i] = toPBTransfer(&page.Transfers[i])
+	}
+
+	return &resp, nil
+}
@@ -0,0 +1,239 @@
+package server
+
+import (
+	"context"
+	"crypto/x509"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"google.golang.org/genproto/googleapis/rpc/errdetails"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/credentials"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/status"
+
+	"pedro-bank/bankpb"
+)
+
+// A client of the gRPC API on a TLS test server, which also serves the
+// JSON API like Run does.
+func newGRPCTestClient(t *testing.T) (bankpb.BankClient, *httptest.Server) {
+	server := httptest.NewUnstartedServer(withGRPC(newGRPCServer(),
+		routes()))
+	server.EnableHTTP2 = true
+	server.StartTLS()
+	t.Cleanup(server.Close)
+
+	certs := x509.NewCertPool()
+	certs.AddCert(server.Certificate())
+
+	conn, err := grpc.Dial(strings.TrimPrefix(server.URL, "https://"),
+		grpc.WithTransportCredentials(
+			credentials.NewClientTLSFromCert(certs, "")))
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	t.Cleanup(func() { conn.Close() })
+
+	return bankpb.NewBankClient(conn), server
+}
+
+// The gRPC code and the ErrorInfo of err.
+func grpcErrorInfo(err error) (codes.Code, *errdetails.ErrorInfo) {
+	st := status.Convert(err)
+
+	for _, detail := range st.Details() {
+		if info, ok := detail.(*errdetails.ErrorInfo); ok {
+			return st.Code(), info
+		}
+	}
+
+	return st.Code(), nil
+}
+
+func TestGRPCError(t *testing.T) {
+	ctx := context.WithValue(context.Background(), requestIDKey, "req-1")
+
+	var errorTests = []struct {
+		err    error
+		code   codes.Code
+		reason string
+		msg    string
+	}{
+		{cpfInvalidError, codes.InvalidArgument, "invalid_cpf",
+			"bad CPF format"},
+		{newBadParamError("limit"), codes.InvalidArgument, "invalid_param",
+			badParamMsg},
+		{accExistsError, codes.AlreadyExists, "account_exists", ""},
+		{tryAgainError, codes.Aborted, "try_again", ""},
+		{insufficientFundsError, codes.FailedPrecondition,
+			"insufficient_funds", ""},
+		{idempotencyKeyReusedError, codes.FailedPrecondition,
+			"idempotency_key_reused", ""},
+		{fmt.Errorf("login: %w", noAccountError), codes.NotFound,
+			"account_not_found", ""},
+		{errors.New("connection refused"), codes.Internal, "internal_error",
+			"internal server error"},
+	}
+
+	for _, errorTest := range errorTests {
+		err := grpcError(ctx, errorTest.err)
+		code, info := grpcErrorInfo(err)
+
+		if code != errorTest.code || info == nil ||
+			info.Reason != errorTest.reason ||
+			info.Domain != grpcErrorDomain ||
+			info.Metadata["request_id"] != "req-1" {
+
+			t.Error(errorTest.err, err, info)
+			continue
+		}
+
+		if errorTest.msg != "" && status.Convert(err).Message() !=
+			errorTest.msg {
+
+			t.Error(errorTest.err, status.Convert(err).Message())
+		}
+	}
+
+	_, info := grpcErrorInfo(grpcError(ctx, newBadParamError("limit")))
+
+	if info.Metadata["param"] != "limit" {
+		t.Error(info)
+	}
+}
+
+// Calls that fail before getting to the DB.
+func TestGRPCRequests(t *testing.T) {
+	bank, server := newGRPCTestClient(t)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	var header metadata.MD
+
+	_, err := bank.CreateAccount(
+		metadata.AppendToOutgoingContext(ctx, "x-request-id", "client-1"),
+		&bankpb.CreateAccountRequest{Name: "Ana", Cpf: "123", Secret: "x"},
+		grpc.Header(&header))
+
+	code, info := grpcErrorInfo(err)
+
+	if code != codes.InvalidArgument || info == nil ||
+		info.Reason != "invalid_cpf" ||
+		info.Metadata["request_id"] != "client-1" ||
+		len(header.Get("x-request-id")) != 1 ||
+		header.Get("x-request-id")[0] != "client-1" {
+
+		t.Error(err, info, header)
+	}
+
+	_, err = bank.Login(ctx, &bankpb.LoginRequest{Cpf: "nope"})
+
+	if code, info = grpcErrorInfo(err); code != codes.InvalidArgument ||
+		info.Reason != "invalid_cpf" {
+
+		t.Error(err)
+	}
+
+	// Transfers need a login
+	_, err = bank.Transfer(ctx, &bankpb.TransferRequest{AmountCents: 100,
+		Destination: &bankpb.TransferRequest_DestinationId{
+			DestinationId: 2}})
+
+	if code, info = grpcErrorInfo(err); code != codes.InvalidArgument ||
+		info.Reason != "missing_token" {
+
+		t.Error(err)
+	}
+
+	authCtx := metadata.AppendToOutgoingContext(ctx, "authorization",
+		"not-a-token")
+
+	_, err = bank.ListTransfers(authCtx, &bankpb.ListTransfersRequest{})
+
+	if code, _ = grpcErrorInfo(err); code != codes.Unauthenticated {
+		t.Error(err)
+	}
+
+	users.mu.Lock()
+	users.entries["grpc-test-token"] = userEntry{1, time.Now()}
+	users.mu.Unlock()
+
+	defer logoutAccount(1, "")
+
+	authCtx = metadata.AppendToOutgoingContext(ctx, "authorization",
+		"grpc-test-token")
+
+	var requests = []struct {
+		req    *bankpb.TransferRequest
+		key    string
+		reason string
+	}{
+		{&bankpb.TransferRequest{}, "", "zero_amount"},
+		{&bankpb.TransferRequest{AmountCents: 100}, "", "invalid_destination"},
+		{&bankpb.TransferRequest{AmountCents: 1 << 40,
+			Destination: &bankpb.TransferRequest_DestinationId{
+				DestinationId: 2}}, "", "amount_too_large"},
+		{&bankpb.TransferRequest{AmountCents: 100,
+			Destination: &bankpb.TransferRequest_DestinationId{
+				DestinationId: 2},
+			Metadata: map[string]string{"": "empty"}}, "",
+			"invalid_metadata"},
+		{&bankpb.TransferRequest{AmountCents: 100,
+			Destination: &bankpb.TransferRequest_DestinationId{
+				DestinationId: 2}}, "bad key!", "invalid_idempotency_key"},
+	}
+
+	for _, request := range requests {
+		callCtx := authCtx
+
+		if request.key != "" {
+			callCtx = metadata.AppendToOutgoingContext(callCtx,
+				"idempotency-key", request.key)
+		}
+
+		_, err = bank.Transfer(callCtx, request.req)
+
+		if code, info = grpcErrorInfo(err); code != codes.InvalidArgument ||
+			info.Reason != request.reason {
+
+			t.Error(request.req, err)
+		}
+	}
+
+	_, err = bank.ListTransfers(authCtx, &bankpb.ListTransfersRequest{
+		Direction: "sideways"})
+
+	if code, info = grpcErrorInfo(err); code != codes.InvalidArgument ||
+		info.Metadata["param"] != "direction" {
+
+		t.Error(err)
+	}
+
+	_, err = bank.ListAccounts(ctx, &bankpb.ListAccountsRequest{
+		Page: &bankpb.PageRequest{Limit: 500}})
+
+	if code, info = grpcErrorInfo(err); code != codes.InvalidArgument ||
+		info.Metadata["param"] != "limit" {
+
+		t.Error(err)
+	}
+
+	// The JSON API is still served on the same port
+	resp, err := server.Client().Get(server.URL + "/ping")
+
+	if err != nil || resp.StatusCode != http.StatusOK {
+		t.Error(resp, err)
+	} else {
+		resp.Body.Close()
+	}
+}
@@ -0,0 +1,242 @@
+package server
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"database/sql"
+	"encoding/hex"
+	"io"
+	"net/http"
+	"regexp"
+	"time"
+)
+
+// Header that clients set on requests that move money, so that they can
+// retry them when they don't know if the first one went through. A retry
+// with the same key gets the response of the first request, and moves no
+// money again.
+const idempotencyKeyHeader = "Idempotency-Key"
+
+// Set on responses that were replayed for a retry.
+const idempotentReplayHeader = "Idempotent-Replayed"
+
+// How long a key is remembered. After that it can be used again.
+const idempotencyKeyTTL = 24 * time.Hour
+
+var idempotencyKeyRegex *regexp.Regexp = regexp.MustCompile(
+	`^[A-Za-z0-9._:-]{1,64}$`)
+
+// A response stored for an idempotency key. status is invalid while the
+// first request is still being handled.
+type idempotentResponse struct {
+	requestHash string
+	status      sql.NullInt32
+	contentType string
+	body        []byte
+}
+
+// Records the response of a handler, to store it for withIdempotency.
+type responseRecorder struct {
+	statusRecorder
+	body bytes.Buffer
+}
+
+func (rr *responseRecorder) Write(data []byte) (int, error) {
+	rr.body.Write(data)
+	return rr.statusRecorder.Write(data)
+}
+
+// The hash of what identifies a request, to tell retries from different
+// requests sent with the same key.
+func hashRequest(req *http.Request, body []byte) string {
+	hash := sha256.New()
+	hash.Write([]byte(req.Method + " " + req.URL.RequestURI() + "\n"))
+	hash.Write(body)
+
+	return hex.EncodeToString(hash.Sum(nil))
+}
+
+// Store the key for the account, unless it's already there. Returns the
+// response stored for the key if it was.
+func claimIdempotencyKey(ctx context.Context, id int, key string,
+	requestHash string) (*idempotentResponse, error) {
+
+	now := time.Now().UTC()
+
+	_, err := DB.ExecContext(ctx,
+		`delete from idempotency_keys
+		where account_id = $1 and key = $2 and created_at < $3`,
+		id, key, now.Add(-idempotencyKeyTTL))
+
+	if err != nil {
+		return nil, err
+	}
+
+	result, err := DB.ExecContext(ctx,
+		`insert into idempotency_keys (account_id, key, request_hash,
+		created_at) values ($1, $2, $3, $4) on conflict do nothing`,
+		id, key, requestHash, now)
+
+	if err != nil {
+		return nil, err
+	}
+
+	inserted, err := result.RowsAffected()
+
+	if err != nil {
+		return nil, err
+	} else if inserted == 1 {
+		return nil, nil
+	}
+
+	var stored idempotentResponse
+
+	err = DB.QueryRowContext(ctx,
+		`select request_hash, status, content_type, body
+		from idempotency_keys where account_id = $1 and key = $2`,
+		id, key).Scan(&stored.requestHash, &stored.status,
+		&stored.contentType, &stored.body)
+
+	// Deleted since the insert, because the first request failed
+	if err == sql.ErrNoRows {
+		return nil, tryAgainError
+	} else if err != nil {
+		return nil, err
+	}
+
+	return &stored, nil
+}
+
+// Filled in by withIdempotency, for keepIdempotencyKey.
+type idempotencyState struct {
+	keep bool
+}
+
+// Tell withIdempotency not to forget the key of ctx's request if the handler
+// fails. Handlers that move money in more than one transaction, like best
+// effort batches, call it before the first one: after that, a failure may
+// have moved some of the money, and a retry can't be allowed to move it
+// again.
+func keepIdempotencyKey(ctx context.Context) {
+	if state, ok := ctx.Value(idempotencyStateKey).(*idempotencyState); ok {
+		state.keep = true
+	}
+}
+
+// Store the response for the key. Server errors, and handlers that panicked
+// without responding, with a 0 status, aren't stored: the key is forgotten so
+// that the client can retry. With keep, see keepIdempotencyKey, server errors
+// are stored too, and after a panic the key stays in progress until it
+// expires.
+func saveIdempotentResponse(id int, key string, status int,
+	contentType string, body []byte, keep bool) {
+
+	var err error
+
+	if status == 0 && keep {
+		logger.Printf("Keeping idempotency key %s of account %d in progress "+
+			"after a panic", key, id)
+		return
+	}
+
+	if (status >= http.StatusInternalServerError && !keep) || status == 0 {
+		_, err = DB.Exec(
+			`delete from idempotency_keys where account_id = $1 and key = $2`,
+			id, key)
+	} else {
+		_, err = DB.Exec(
+			`update idempotency_keys set status = $1, content_type = $2,
+			body = $3 where account_id = $4 and key = $5`, status,
+			contentType, body, id, key)
+	}
+
+	if err != nil {
+		logger.Printf("Could not save response for idempotency key %s of "+
+			"account %d: %v", key, id, err)
+	}
+}
+
+// Let clients retry requests with an Idempotency-Key, see
+// idempotencyKeyHeader. Keys are per account, so it must run after
+// withAuth. Requests without a key are handled as usual.
+func withIdempotency(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {
+		key := req.Header.Get(idempotencyKeyHeader)
+
+		if key == "" {
+			next.ServeHTTP(rw, req)
+			return
+		}
+
+		if !idempotencyKeyRegex.MatchString(key) {
+			respondWithError(rw, idempotencyKeyInvalidError)
+			return
+		}
+
+		// Already limited by withBodyLimit
+		body, err := io.ReadAll(req.Body)
+
+		if err != nil {
+			respondWithError(rw, err)
+			return
+		}
+
+		req.Body = io.NopCloser(bytes.NewReader(body))
+		id := accountID(req)
+
+		stored, err := claimIdempotencyKey(req.Context(), id, key,
+			hashRequest(req, body))
+
+		if err != nil {
+			respondWithError(rw, err)
+			return
+		}
+
+		if stored != nil {
+			replayIdempotentResponse(rw, req, body, stored)
+			return
+		}
+
+		recorder := &responseRecorder{
+			statusRecorder: statusRecorder{ResponseWriter: rw}}
+		state := &idempotencyState{}
+
+		// Deferred so the key is forgotten if the handler panics.
+		defer func() {
+			saveIdempotentResponse(id, key, recorder.status,
+				recorder.Header().Get("Content-Type"), recorder.body.Bytes(),
+				state.keep)
+		}()
+
+		ctx := context.WithValue(req.Context(), idempotencyStateKey, state)
+		next.ServeHTTP(recorder, req.WithContext(ctx))
+	})
+}
+
+func replayIdempotentResponse(rw http.ResponseWriter, req *http.Request,
+	body []byte, stored *idempotentResponse) {
+
+	if stored.requestHash != hashRequest(req, body) {
+		respondWithError(rw, idempotencyKeyReusedError)
+		return
+	}
+
+	if !stored.status.Valid {
+		respondWithError(rw, idempotencyKeyInProgressError)
+		return
+	}
+
+	if stored.contentType != "" {
+		rw.Header().Set("Content-Type", stored.contentType)
+	}
+
+	rw.Header().Set(idempotentReplayHeader, "true")
+	rw.WriteHeader(int(stored.status.Int32))
+
+	_, err := rw.Write(stored.body)
+
+	if err != nil {
+		logger.Printf("Could not write response: %v", err)
+	}
+}
@@ -0,0 +1,79 @@
+package server
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func TestWithIdempotency(t *testing.T) {
+	handled := 0
+	handler := withIdempotency(http.HandlerFunc(
+		func(rw http.ResponseWriter, req *http.Request) {
+			handled++
+			rw.WriteHeader(http.StatusCreated)
+		}))
+
+	// Requests without a key don't touch the DB
+	rec := httptest.NewRecorder()
+	handler.ServeHTTP(rec, httptest.NewRequest(http.MethodPost, "/transfers",
+		strings.NewReader("{}")))
+
+	if rec.Code != http.StatusCreated || handled != 1 {
+		t.Error(rec.Code, handled)
+	}
+
+	for _, key := range []string{"has space", strings.Repeat("k", 65)} {
+		req := httptest.NewRequest(http.MethodPost, "/transfers",
+			strings.NewReader("{}"))
+		req.Header.Set(idempotencyKeyHeader, key)
+
+		rec = httptest.NewRecorder()
+		handler.ServeHTTP(rec, req)
+
+		if rec.Code != http.StatusBadRequest || responseErrorCode(
+			rec.Body.Bytes()) != idempotencyKeyInvalidError.code {
+
+			t.Error(key, rec.Code, rec.Body.String())
+		}
+	}
+
+	if handled != 1 {
+		t.Error(handled)
+	}
+}
+
+func TestHashRequest(t *testing.T) {
+	hash := func(method string, path string, body string) string {
+		return hashRequest(httptest.NewRequest(method, path, nil),
+			[]byte(body))
+	}
+
+	base := hash(http.MethodPost, "/transfers", `{"amount": 1.00}`)
+
+	for _, other := range []string{
+		hash(http.MethodPost, "/transfers", `{"amount": 2.00}`),
+		hash(http.MethodPost, "/escrows", `{"amount": 1.00}`),
+		hash(http.MethodPost, "/transfers?x=1", `{"amount": 1.00}`),
+		hash(http.MethodPut, "/transfers", `{"amount": 1.00}`),
+	} {
+		if other == base {
+			t.Error("same hash for a different request")
+		}
+	}
+}
+
+func TestKeepIdempotencyKey(t *testing.T) {
+	// Without withIdempotency there's nothing to keep
+	keepIdempotencyKey(context.Background())
+
+	state := &idempotencyState{}
+	keepIdempotencyKey(context.WithValue(context.Background(),
+		idempotencyStateKey, state))
+
+	if !state.keep {
+		t.Error("key not kept")
+	}
+}
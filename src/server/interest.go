@@ -0,0 +1,576 @@
+package server
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"math/big"
+	"net/http"
+	"time"
+)
+
+// Accrued interest is kept in millionths of a cent, so that the daily
+// fractions add up to the right amount by the end of the month.
+const microsPerCent = 1000000
+
+// How often the interest job wakes up. Each run goes over every date since
+// the first one it didn't finish, see interestJobStart, and at least the last
+// interestJobDays days, since a day ends at different times in different time
+// zones.
+const interestJobInterval = time.Hour
+const interestJobDays = 2
+
+// Channel that signals when the interest job finishes
+var interestJobFinished = make(chan interface{})
+
+// What a run of the interest job did for a date.
+type interestRun struct {
+	Date string `json:"date"`
+	// Accounts that got interest for the date, including the ones that
+	// already had it from an earlier run
+	Accrued int `json:"accrued"`
+	// Accounts whose day hadn't ended yet in their time zone
+	Pending int `json:"pending"`
+	// Months of interest credited, on the last day of the month, or later
+	// for months that had a day accrued late
+	Posted int `json:"posted"`
+	// Accounts charged overdraft interest for the date
+	Charged int `json:"charged"`
+}
+
+// Interest for one day on balance, in millionths of a cent. Uses a 365 day
+// year. The result fits an int64 for any balance and rate up to 1000%.
+func dailyInterestMicros(balance money, annualBps int) int64 {
+	if balance <= 0 {
+		return 0
+	}
+
+	return int64(balance) * int64(annualBps) * 100 / 365
+}
+
+// Split accrued interest into whole cents to post and the rest to carry.
+func splitMicros(micros int64) (money, int64) {
+	return money(micros / microsPerCent), micros % microsPerCent
+}
+
+// Midnight at the start of the day after date, in loc.
+func endOfDay(date time.Time, loc *time.Location) time.Time {
+	return time.Date(date.Year(), date.Month(), date.Day()+1, 0, 0, 0, 0, loc)
+}
+
+func isLastDayOfMonth(date time.Time) bool {
+	return date.AddDate(0, 0, 1).Day() == 1
+}
+
+// Record the interest for the account with id for date. Returns false if
+// the day hasn't ended yet in the account's time zone. Running it again for
+// the same date does nothing.
+func accrueAccountInterest(ctx context.Context, id int, annualBps int,
+	date time.Time) (bool, error) {
+
+	tx, err := DB.BeginTx(ctx, &defaultTxOptions)
+
+	if err != nil {
+		logger.Print("Error starting tx to accrue interest")
+		return false, err
+	}
+
+	loc, err := accountLocation(tx, id)
+
+	if err != nil {
+		rollbackTx(tx)
+		return false, err
+	}
+
+	eod := endOfDay(date, loc)
+
+	if eod.After(time.Now()) {
+		rollbackTx(tx)
+		return false, nil
+	}
+
+	var createdAt time.Time
+
+	err = tx.QueryRow("select created_at from accounts where id = $1",
+		id).Scan(&createdAt)
+
+	if err != nil {
+		rollbackTx(tx)
+		return false, err
+	}
+
+	// Nothing to earn before the account existed. created_at is UTC
+	// without a time zone.
+	if !createdAt.Before(eod.UTC()) {
+		rollbackTx(tx)
+		return true, nil
+	}
+
+	balance, err := balanceAt(tx, id, eod.Add(-time.Microsecond))
+
+	if err != nil {
+		rollbackTx(tx)
+		return false, err
+	}
+
+	_, err = tx.Exec(
+		`insert into interest_accruals
+		(account_id, date, balance, annual_bps, micros)
+		values ($1, $2::date, $3, $4, $5)
+		on conflict (account_id, date) do nothing`,
+		id, date.Format("2006-01-02"), balance, annualBps,
+		dailyInterestMicros(balance, annualBps))
+
+	if err != nil {
+		rollbackTx(tx)
+		return false, err
+	}
+
+	err = tx.Commit()
+
+	if err != nil {
+		logger.Print("Error commiting tx")
+		return false, err
+	}
+
+	return true, nil
+}
+
+// Move amount between one of the bank's own accounts and the account with
+// id, as an ordinary transfer: from the system account if fromSystem is true,
+// to it otherwise. system is the accounts column that flags it, house or
+// escrow. The limits of the account with id don't apply, these are the bank's
+// own movements, but the system account can't go negative. Returns the
+// transfer id.
+func systemTransfer(tx *sql.Tx, system string, id int, amount money,
+	description string, fromSystem bool) (int, error) {
+
+	var systemID int
+	var systemBalance, balance money
+
+	// Always lock the system account first, so two of these can't deadlock.
+	err := tx.QueryRow(
+		`select id, balance from accounts where `+system+` for update`).Scan(
+		&systemID, &systemBalance)
+
+	if err == sql.ErrNoRows {
+		return 0, fmt.Errorf("no %s account", system)
+	} else if err != nil {
+		return 0, err
+	}
+
+	err = tx.QueryRow(
+		`select balance from accounts where id = $1 for update`,
+		id).Scan(&balance)
+
+	if err != nil {
+		return 0, err
+	}
+
+	origID, destID := id, systemID
+	newSystemBalance := big.NewInt(int64(systemBalance))
+	newBalance := big.NewInt(int64(balance))
+
+	if fromSystem {
+		origID, destID = systemID, id
+		newSystemBalance.Sub(newSystemBalance, big.NewInt(int64(amount)))
+		newBalance.Add(newBalance, big.NewInt(int64(amount)))
+	} else {
+		newSystemBalance.Add(newSystemBalance, big.NewInt(int64(amount)))
+		newBalance.Sub(newBalance, big.NewInt(int64(amount)))
+	}
+
+	if newSystemBalance.Sign() < 0 {
+		return 0, fmt.Errorf("%s account can't cover the transfer", system)
+	}
+
+	if newSystemBalance.BitLen() > 31 || newBalance.BitLen() > 31 {
+		return 0, amountTooLargeError
+	}
+
+	_, err = tx.Exec(`update accounts set balance = $1 where id = $2`,
+		newSystemBalance.Int64(), systemID)
+
+	if err != nil {
+		return 0, err
+	}
+
+	_, err = tx.Exec(`update accounts set balance = $1 where id = $2`,
+		newBalance.Int64(), id)
+
+	if err != nil {
+		return 0, err
+	}
+
+	var transferID int
+
+	err = tx.QueryRow(
+		`insert into transfers (origin_id, destination_id, amount, created_at,
+		description)
+		values ($1, $2, $3, current_timestamp at time zone 'UTC', $4)
+		returning id`,
+		origID, destID, amount, description).Scan(&transferID)
+
+	if err != nil {
+		return 0, err
+	}
+
+	return transferID, recordTransferEvents(tx, transferID)
+}
+
+// Credit the account with id with the interest accrued during the month
+// starting at month. Returns false if it was already posted, or if a day of
+// the month since the account's first accrual has no interest yet, since a
+// month is only posted once.
+func postAccountInterest(ctx context.Context, id int,
+	month time.Time) (bool, error) {
+
+	monthStr := month.Format("2006-01-02")
+
+	tx, err := DB.BeginTx(ctx, &defaultTxOptions)
+
+	if err != nil {
+		logger.Print("Error starting tx to post interest")
+		return false, err
+	}
+
+	var days, monthDays int
+
+	err = tx.QueryRow(
+		`select count(*) filter (where date >= $2::date),
+		coalesce(($2::date + interval '1 month')::date -
+			greatest($2::date, min(date)), 0)
+		from interest_accruals
+		where account_id = $1 and date < $2::date + interval '1 month'`,
+		id, monthStr).Scan(&days, &monthDays)
+
+	if err != nil || days < monthDays {
+		rollbackTx(tx)
+		return false, err
+	}
+
+	var accrued int64
+
+	err = tx.QueryRow(
+		`select coalesce(sum(micros), 0) from interest_accruals
+		where account_id = $1 and date >= $2::date
+		and date < $2::date + interval '1 month'`,
+		id, monthStr).Scan(&accrued)
+
+	if err != nil {
+		rollbackTx(tx)
+		return false, err
+	}
+
+	var carry int64
+
+	err = tx.QueryRow(
+		`select carry_micros from interest_postings
+		where account_id = $1 and month < $2::date
+		order by month desc limit 1`, id, monthStr).Scan(&carry)
+
+	if err != nil && err != sql.ErrNoRows {
+		rollbackTx(tx)
+		return false, err
+	}
+
+	amount, carry := splitMicros(accrued + carry)
+
+	// Claim the month first, so a concurrent run can't post it too.
+	result, err := tx.Exec(
+		`insert into interest_postings
+		(account_id, month, accrued_micros, carry_micros, amount, created_at)
+		values ($1, $2::date, $3, $4, $5, $6)
+		on conflict (account_id, month) do nothing`,
+		id, monthStr, accrued, carry, amount, time.Now().UTC())
+
+	if err != nil {
+		rollbackTx(tx)
+		return false, err
+	}
+
+	if inserted, err := result.RowsAffected(); err != nil || inserted == 0 {
+		rollbackTx(tx)
+		return false, err
+	}
+
+	if amount > 0 {
+		transferID, err := systemTransfer(tx, "house", id, amount,
+			fmt.Sprintf("interest for %s", month.Format("2006-01")), true)
+
+		if err == nil {
+			_, err = tx.Exec(
+				`update interest_postings set transfer_id = $1
+				where account_id = $2 and month = $3::date`,
+				transferID, id, monthStr)
+		}
+
+		if err != nil {
+			rollbackTx(tx)
+			return false, err
+		}
+	}
+
+	err = tx.Commit()
+
+	if err != nil {
+		logger.Print("Error commiting tx")
+		return false, err
+	}
+
+	return true, nil
+}
+
+// Post the interest of the months of the account with id that have accruals
+// but no posting, oldest first, stopping at the first one that can't be
+// posted yet. Each month carries to the next, so they're posted in order.
+// Returns how many were posted.
+func postAccountMonths(ctx context.Context, id int) (int, error) {
+	rows, err := DB.QueryContext(ctx,
+		`select distinct date_trunc('month', a.date)::date
+		from interest_accruals a
+		where a.account_id = $1 and not exists (
+			select 1 from interest_postings p
+			where p.account_id = a.account_id
+			and p.month = date_trunc('month', a.date)::date)
+		order by 1`, id)
+
+	if err != nil {
+		return 0, err
+	}
+
+	var months []time.Time
+
+	for rows.Next() {
+		var month time.Time
+
+		if err = rows.Scan(&month); err != nil {
+			rows.Close()
+			return 0, err
+		}
+
+		months = append(months, month)
+	}
+
+	rows.Close()
+
+	if err = rows.Err(); err != nil {
+		return 0, err
+	}
+
+	posted := 0
+
+	for _, month := range months {
+		ok, err := postAccountInterest(ctx, id, month)
+
+		if err != nil || !ok {
+			return posted, err
+		}
+
+		posted++
+	}
+
+	return posted, nil
+}
+
+// Accrue the interest for date for every account with a rate, post the
+// months that are complete if date is the last day of its month or in a
+// month that's over, and charge the
+// overdraft interest of the accounts below zero. Safe to run any
+// number of times for the same date. Errors on one account don't stop the
+// others, the first one is returned.
+func runInterest(ctx context.Context, date time.Time) (*interestRun, error) {
+	run := interestRun{Date: date.Format("2006-01-02")}
+
+	rows, err := DB.QueryContext(ctx,
+		`select a.id, r.annual_bps, r.overdraft_bps from accounts a
+		join interest_rates r on r.tier = a.tier
+		where not a.house and not a.escrow and a.status <> 'closed'
+		order by a.id`)
+
+	if err != nil {
+		return nil, err
+	}
+
+	type accountRate struct {
+		id           int
+		annualBps    int
+		overdraftBps int
+	}
+
+	var accounts []accountRate
+
+	for rows.Next() {
+		var acc accountRate
+
+		err = rows.Scan(&acc.id, &acc.annualBps, &acc.overdraftBps)
+
+		if err != nil {
+			rows.Close()
+			return nil, err
+		}
+
+		accounts = append(accounts, acc)
+	}
+
+	rows.Close()
+
+	if err = rows.Err(); err != nil {
+		return nil, err
+	}
+
+	var firstErr error
+	month := time.Date(date.Year(), date.Month(), 1, 0, 0, 0, 0, time.UTC)
+	monthOver := !time.Now().Before(month.AddDate(0, 1, 0))
+
+	for _, acc := range accounts {
+		accrued, err := accrueAccountInterest(ctx, acc.id, acc.annualBps,
+			date)
+
+		if err == nil && !accrued {
+			run.Pending++
+			continue
+		}
+
+		if err == nil {
+			run.Accrued++
+
+			if acc.overdraftBps > 0 {
+				var charged bool
+				charged, err = chargeOverdraftInterest(ctx, acc.id,
+					acc.overdraftBps, date)
+
+				if charged {
+					run.Charged++
+				}
+			}
+
+			if err == nil && (isLastDayOfMonth(date) || monthOver) {
+				var posted int
+				posted, err = postAccountMonths(ctx, acc.id)
+				run.Posted += posted
+			}
+		}
+
+		if err != nil {
+			logger.Printf("Interest for account %d on %s failed: %v",
+				acc.id, run.Date, err)
+
+			if firstErr == nil {
+				firstErr = err
+			}
+		}
+	}
+
+	return &run, firstErr
+}
+
+// The first date the interest job has to run for: the first one missing in
+// interest_runs since the job first ran, or interestJobDays before today if
+// that's earlier or the job never ran.
+func interestJobStart(ctx context.Context, today time.Time) (time.Time,
+	error) {
+
+	start := today.AddDate(0, 0, -interestJobDays)
+
+	var missing sql.NullTime
+
+	err := DB.QueryRowContext(ctx,
+		`select min(d) from generate_series(
+			(select min(date) from interest_runs), $1::date, interval '1 day') d
+		where d::date not in (select date from interest_runs)`,
+		start.Format("2006-01-02")).Scan(&missing)
+
+	if err != nil {
+		return start, err
+	}
+
+	if missing.Valid && missing.Time.Before(start) {
+		start = time.Date(missing.Time.Year(), missing.Time.Month(),
+			missing.Time.Day(), 0, 0, 0, 0, time.UTC)
+	}
+
+	return start, nil
+}
+
+// Run the interest for every date from interestJobStart to yesterday, every
+// interestJobInterval. Call this in a goroutine. Cancel the context to stop
+// the goroutine.
+func interestJob(ctx context.Context) {
+	defer close(interestJobFinished)
+
+	timer := time.NewTimer(0)
+	defer timer.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			logger.Print("Interest job exiting...")
+			return
+		case <-timer.C:
+		}
+
+		now := time.Now().UTC()
+		today := time.Date(now.Year(), now.Month(), now.Day(), 0, 0, 0, 0,
+			time.UTC)
+
+		start, err := interestJobStart(ctx, today)
+
+		if err != nil {
+			logger.Printf("Error finding the interest dates: %v", err)
+		}
+
+		for date := start; date.Before(today); date = date.AddDate(0, 0, 1) {
+			if ctx.Err() != nil {
+				break
+			}
+
+			run, err := runInterest(ctx, date)
+
+			if err != nil {
+				continue
+			}
+
+			logger.Printf("Interest for %s: %d accrued, %d pending, "+
+				"%d posted, %d charged", run.Date, run.Accrued,
+				run.Pending, run.Posted, run.Charged)
+
+			// Run it again next time until every account is done
+			if run.Pending > 0 {
+				continue
+			}
+
+			_, err = DB.ExecContext(ctx,
+				`insert into interest_runs (date, created_at)
+				values ($1::date, current_timestamp at time zone 'UTC')
+				on conflict do nothing`, run.Date)
+
+			if err != nil {
+				logger.Printf("Error recording interest run: %v", err)
+			}
+		}
+
+		timer.Reset(interestJobInterval)
+	}
+}
+
+// Handler for POST at /admin/interest?date=YYYY-MM-DD. Runs the interest
+// for a date, to fix it by hand. The job doesn't count it as done, and runs
+// it again if it's one it missed.
+func runInterestForDate(rw http.ResponseWriter, req *http.Request) {
+	date, err := time.Parse("2006-01-02", req.URL.Query().Get("date"))
+
+	if err != nil {
+		respondWithError(rw, newBadParamError("date"))
+		return
+	}
+
+	run, err := runInterest(req.Context(), date)
+
+	if err != nil {
+		respondWithError(rw, err)
+		return
+	}
+
+	respondWithJSON(rw, http.StatusOK, run)
+}
@@ -0,0 +1,53 @@
+package server
+
+import (
+	"testing"
+	"time"
+)
+
+func TestDailyInterest(t *testing.T) {
+	// 10% a year on 2334.72 is 0.6396... a day
+	if micros := dailyInterestMicros(233472, 1000); micros != 63964931 {
+		t.Error(micros)
+	}
+
+	if micros := dailyInterestMicros(0, 1000); micros != 0 {
+		t.Error(micros)
+	}
+
+	if micros := dailyInterestMicros(-100, 1000); micros != 0 {
+		t.Error(micros)
+	}
+
+	// The fractions of 31 days add up to more cents than 31 rounded days
+	amount, carry := splitMicros(31 * 63964931)
+
+	if amount != 1982 || carry != 912861 {
+		t.Error(amount, carry)
+	}
+}
+
+func TestInterestDates(t *testing.T) {
+	loc, err := time.LoadLocation("America/Sao_Paulo")
+
+	if err != nil {
+		t.Log(err)
+		t.FailNow()
+	}
+
+	date := time.Date(2021, time.August, 31, 0, 0, 0, 0, time.UTC)
+
+	if eod := endOfDay(date, loc); !eod.Equal(
+		time.Date(2021, time.September, 1, 3, 0, 0, 0, time.UTC)) {
+		t.Error(eod)
+	}
+
+	if !isLastDayOfMonth(date) || isLastDayOfMonth(date.AddDate(0, 0, -1)) {
+		t.Fail()
+	}
+
+	if !isLastDayOfMonth(time.Date(2024, time.February, 29, 0, 0, 0, 0,
+		time.UTC)) {
+		t.Fail()
+	}
+}
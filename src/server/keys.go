@@ -0,0 +1,410 @@
+package server
+
+import (
+	"crypto/rand"
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"regexp"
+	"strings"
+	"time"
+)
+
+// A key registered by an account, that can be used instead of the account id
+// as the destination of a transfer. Fields exported for JSON marshalling.
+type transferKey struct {
+	Key       string    `json:"key"`
+	Type      string    `json:"type"`
+	CreatedAt time.Time `json:"created_at"`
+}
+
+// JSON that the client sends to register a key. For CPF keys the key can be
+// left out, for random keys it must be, the server generates it.
+type keyCreateRequest struct {
+	Type string `json:"type"`
+	Key  string `json:"key"`
+}
+
+// What anyone logged in can see about a key, so that the sender can confirm
+// who they are paying before the transfer.
+type keyLookupResponse struct {
+	Key  string `json:"key"`
+	Type string `json:"type"`
+	Name string `json:"name"`
+	CPF  string `json:"cpf"`
+}
+
+const maxKeysPerAccount = 5
+
+// Same as the column, the longest email the PIX directory accepts.
+const maxKeyLen = 77
+
+var emailKeyRegex *regexp.Regexp = regexp.MustCompile(
+	`^[a-z0-9._%+-]+@[a-z0-9.-]+\.[a-z]{2,}$`)
+
+// E.164, e.g. +5511987654321
+var phoneKeyRegex *regexp.Regexp = regexp.MustCompile(`^\+[1-9][0-9]{7,14}$`)
+
+var randomKeyRegex *regexp.Regexp = regexp.MustCompile(
+	`^[0-9a-f]{8}-[0-9a-f]{4}-[0-9a-f]{4}-[0-9a-f]{4}-[0-9a-f]{12}$`)
+
+// Normalize key to how it is stored, so that e.g. the same email with
+// different cases is the same key. Fails if key isn't valid for keyType.
+func normalizeKey(keyType string, key string) (string, error) {
+	key = strings.TrimSpace(key)
+
+	switch keyType {
+	case "cpf":
+		if !cpfRegex.MatchString(key) {
+			return "", keyInvalidError
+		}
+	case "email":
+		key = strings.ToLower(key)
+
+		if len(key) > maxKeyLen || !emailKeyRegex.MatchString(key) {
+			return "", keyInvalidError
+		}
+	case "phone":
+		key = strings.NewReplacer(" ", "", "-", "", "(", "", ")", "").
+			Replace(key)
+
+		if !phoneKeyRegex.MatchString(key) {
+			return "", keyInvalidError
+		}
+	case "random":
+		key = strings.ToLower(key)
+
+		if !randomKeyRegex.MatchString(key) {
+			return "", keyInvalidError
+		}
+	default:
+		return "", keyTypeInvalidError
+	}
+
+	return key, nil
+}
+
+// Guess the type of a key from its format. The formats don't overlap, so
+// clients don't need to say which type of key they are paying to.
+func guessKeyType(key string) string {
+	key = strings.TrimSpace(key)
+
+	if cpfRegex.MatchString(key) {
+		return "cpf"
+	} else if strings.Contains(key, "@") {
+		return "email"
+	} else if strings.HasPrefix(key, "+") {
+		return "phone"
+	}
+
+	return "random"
+}
+
+// Generate a random (version 4) UUID for a random key.
+func generateRandomKey() (string, error) {
+	var b [16]byte
+
+	_, err := rand.Read(b[:])
+
+	if err != nil {
+		return "", err
+	}
+
+	b[6] = b[6]&0x0f | 0x40
+	b[8] = b[8]&0x3f | 0x80
+
+	return fmt.Sprintf("%x-%x-%x-%x-%x", b[0:4], b[4:6], b[6:8], b[8:10],
+		b[10:16]), nil
+}
+
+// Keep the first letter of each word of the name, e.g. "J*** D**".
+func maskName(name string) string {
+	words := strings.Fields(name)
+
+	for i, word := range words {
+		runes := []rune(word)
+		words[i] = string(runes[0]) + strings.Repeat("*", len(runes)-1)
+	}
+
+	return strings.Join(words, " ")
+}
+
+// Keep only the middle digits of the CPF, e.g. "***.321-**".
+func maskCPF(cpf string) string {
+	if !cpfRegex.MatchString(cpf) {
+		return ""
+	}
+
+	return "***." + cpf[4:7] + "-**"
+}
+
+// Get the id of the account that registered key.
+func getAccountByKey(q queryRower, key string) (int, error) {
+	key, err := normalizeKey(guessKeyType(key), key)
+
+	if err != nil {
+		// It can't have been registered
+		return 0, noKeyError
+	}
+
+	var id int
+
+	err = q.QueryRow("select account_id from transfer_keys where key = $1",
+		key).Scan(&id)
+
+	if err == sql.ErrNoRows {
+		return 0, noKeyError
+	}
+
+	return id, err
+}
+
+// Handler for GET at /keys. Lists the keys of the logged in account.
+func getKeys(rw http.ResponseWriter, req *http.Request) {
+	id := accountID(req)
+
+	rows, err := DB.QueryContext(req.Context(),
+		`select key, type, created_at from transfer_keys
+		where account_id = $1 order by created_at, key`, id)
+
+	if err != nil {
+		respondWithError(rw, err)
+		return
+	}
+
+	defer rows.Close()
+
+	keys := make([]transferKey, 0, maxKeysPerAccount)
+
+	for rows.Next() {
+		var key transferKey
+
+		err = rows.Scan(&key.Key, &key.Type, &key.CreatedAt)
+
+		if err != nil {
+			logger.Printf("error when querying keys")
+			respondWithError(rw, err)
+			return
+		}
+
+		keys = append(keys, key)
+	}
+
+	if err = rows.Err(); err != nil {
+		logger.Printf("error when querying keys")
+		respondWithError(rw, err)
+		return
+	}
+
+	respondWithJSON(rw, http.StatusOK, keys)
+}
+
+// Handler for POST at /keys. Registers a new key for the logged in account.
+func createKey(rw http.ResponseWriter, req *http.Request) {
+	id := accountID(req)
+
+	var keyReq keyCreateRequest
+
+	data, err := readFromReq(req, 256)
+
+	if err != nil {
+		respondWithError(rw, err)
+		return
+	}
+
+	err = json.Unmarshal(data, &keyReq)
+
+	if err != nil {
+		respondWithError(rw, cantParseJSONError)
+		return
+	}
+
+	tx, err := DB.BeginTx(req.Context(), &defaultTxOptions)
+
+	if err != nil {
+		logger.Print("Error starting tx to create key")
+		respondWithError(rw, err)
+		return
+	}
+
+	// Locking the account serializes key registrations for it, so two
+	// concurrent requests can't both pass the count check.
+	var cpf string
+	err = tx.QueryRow("select cpf from accounts where id = $1 for update",
+		id).Scan(&cpf)
+
+	if err == sql.ErrNoRows {
+		rollbackTx(tx)
+		respondWithError(rw, noAccountError)
+		return
+	} else if err != nil {
+		rollbackTx(tx)
+		respondWithError(rw, err)
+		return
+	}
+
+	key := transferKey{Type: keyReq.Type, CreatedAt: time.Now().UTC()}
+
+	switch keyReq.Type {
+	case "cpf":
+		key.Key = cpf
+
+		if keyReq.Key != "" && strings.TrimSpace(keyReq.Key) != cpf {
+			err = keyNotOwnCPFError
+		}
+	case "random":
+		if keyReq.Key != "" {
+			err = keyInvalidError
+		} else {
+			key.Key, err = generateRandomKey()
+		}
+	default:
+		key.Key, err = normalizeKey(keyReq.Type, keyReq.Key)
+	}
+
+	if err != nil {
+		rollbackTx(tx)
+		respondWithError(rw, err)
+		return
+	}
+
+	var count int
+	err = tx.QueryRow(
+		"select count(*) from transfer_keys where account_id = $1",
+		id).Scan(&count)
+
+	if err != nil {
+		rollbackTx(tx)
+		respondWithError(rw, err)
+		return
+	}
+
+	if count >= maxKeysPerAccount {
+		rollbackTx(tx)
+		respondWithError(rw, tooManyKeysError)
+		return
+	}
+
+	result, err := tx.Exec(
+		`insert into transfer_keys (key, type, account_id, created_at)
+		values ($1, $2, $3, $4) on conflict (key) do nothing`,
+		key.Key, key.Type, id, key.CreatedAt)
+
+	if err != nil {
+		rollbackTx(tx)
+		respondWithError(rw, err)
+		return
+	}
+
+	inserted, err := result.RowsAffected()
+
+	if err != nil {
+		rollbackTx(tx)
+		respondWithError(rw, err)
+		return
+	}
+
+	if inserted == 0 {
+		rollbackTx(tx)
+		respondWithError(rw, keyExistsError)
+		return
+	}
+
+	err = tx.Commit()
+
+	if err != nil {
+		logger.Print("Error commiting tx")
+		respondWithError(rw, err)
+		return
+	}
+
+	logger.Printf("Registered %s key for account %d", key.Type, id)
+	respondWithJSON(rw, http.StatusCreated, &key)
+}
+
+// Handler for GET at /keys/<key>. Shows the masked owner of the key.
+func lookupKey(rw http.ResponseWriter, req *http.Request) {
+	key := pathParam(req, "key")
+	key, err := normalizeKey(guessKeyType(key), key)
+
+	if err != nil {
+		respondWithError(rw, noKeyError)
+		return
+	}
+
+	var resp keyLookupResponse
+	var name, cpf string
+
+	err = DB.QueryRow(
+		`select k.key, k.type, a.name, a.cpf
+		from transfer_keys k join accounts a on a.id = k.account_id
+		where k.key = $1`, key).Scan(&resp.Key, &resp.Type, &name, &cpf)
+
+	if err == sql.ErrNoRows {
+		respondWithError(rw, noKeyError)
+		return
+	} else if err != nil {
+		respondWithError(rw, err)
+		return
+	}
+
+	resp.Name = maskName(name)
+	resp.CPF = maskCPF(cpf)
+
+	respondWithJSON(rw, http.StatusOK, &resp)
+}
+
+// Handler for DELETE at /keys/<key>. Only the owner can remove a key.
+func deleteKey(rw http.ResponseWriter, req *http.Request) {
+	id := accountID(req)
+	key := pathParam(req, "key")
+	key, err := normalizeKey(guessKeyType(key), key)
+
+	if err != nil {
+		respondWithError(rw, noKeyError)
+		return
+	}
+
+	result, err := DB.ExecContext(req.Context(),
+		"delete from transfer_keys where key = $1 and account_id = $2",
+		key, id)
+
+	if err != nil {
+		respondWithError(rw, err)
+		return
+	}
+
+	deleted, err := result.RowsAffected()
+
+	if err != nil {
+		respondWithError(rw, err)
+		return
+	}
+
+	// Someone else's key looks the same as a missing one to the client.
+	if deleted == 0 {
+		respondWithError(rw, noKeyError)
+		return
+	}
+
+	logger.Printf("Removed key for account %d", id)
+	rw.WriteHeader(http.StatusNoContent)
+}
+
+// Resolve the destination of a transfer request given by key, if any.
+func (transferReq *transferRequest) resolveDestination(q queryRower) error {
+	if transferReq.DestinationKey == "" {
+		return nil
+	}
+
+	id, err := getAccountByKey(q, transferReq.DestinationKey)
+
+	if err != nil {
+		return err
+	}
+
+	transferReq.DestinationID = id
+
+	return nil
+}
@@ -0,0 +1,75 @@
+package server
+
+import (
+	"testing"
+)
+
+func TestNormalizeKey(t *testing.T) {
+	var validKeys = []struct {
+		key        string
+		keyType    string
+		normalized string
+	}{
+		{"221.321-12", "cpf", "221.321-12"},
+		{" John.Doe@Example.com ", "email", "john.doe@example.com"},
+		{"+55 (11) 98765-4321", "phone", "+5511987654321"},
+		{"0F8FAD5B-D9CB-469F-A165-70867728950E", "random",
+			"0f8fad5b-d9cb-469f-a165-70867728950e"},
+	}
+
+	for _, valid := range validKeys {
+		if keyType := guessKeyType(valid.key); keyType != valid.keyType {
+			t.Error(valid.key, keyType)
+		}
+
+		normalized, err := normalizeKey(valid.keyType, valid.key)
+
+		if err != nil || normalized != valid.normalized {
+			t.Error(valid.key, normalized, err)
+		}
+	}
+
+	var invalidKeys = []struct {
+		key     string
+		keyType string
+		err     *publicJSONError
+	}{
+		{"22132112", "cpf", keyInvalidError},
+		{"john.doe@", "email", keyInvalidError},
+		{"11987654321", "phone", keyInvalidError},
+		{"+5511", "phone", keyInvalidError},
+		{"not-a-uuid", "random", keyInvalidError},
+		{"john.doe@example.com", "nickname", keyTypeInvalidError},
+	}
+
+	for _, invalid := range invalidKeys {
+		_, err := normalizeKey(invalid.keyType, invalid.key)
+
+		if err != invalid.err {
+			t.Error(invalid.key, err)
+		}
+	}
+}
+
+func TestRandomKey(t *testing.T) {
+	key, err := generateRandomKey()
+
+	if err != nil {
+		t.Log(err)
+		t.FailNow()
+	}
+
+	if !randomKeyRegex.MatchString(key) || key[14] != '4' {
+		t.Error(key)
+	}
+}
+
+func TestMaskKeyOwner(t *testing.T) {
+	if name := maskName("João  da Silva"); name != "J*** d* S****" {
+		t.Error(name)
+	}
+
+	if cpf := maskCPF("221.321-12"); cpf != "***.321-**" {
+		t.Error(cpf)
+	}
+}
@@ -0,0 +1,315 @@
+package server
+
+import (
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"time"
+)
+
+// Limits on outgoing transfers for an account. Fields exported for JSON
+// marshalling.
+type transferLimits struct {
+	// Maximum amount for a single transfer
+	PerTransfer money `json:"per_transfer"`
+	// Maximum total sent since midnight, in the account's time zone
+	Daily money `json:"daily"`
+	// Maximum total sent since the first day of the month
+	Monthly money `json:"monthly"`
+	// Maximum total sent during the night, see nightStartHour
+	Nighttime money `json:"nighttime"`
+}
+
+// JSON that the client sends to change its limits. Fields that are missing
+// from the JSON are left as they are.
+type limitsUpdateRequest struct {
+	PerTransfer *money `json:"per_transfer"`
+	Daily       *money `json:"daily"`
+	Monthly     *money `json:"monthly"`
+	Nighttime   *money `json:"nighttime"`
+}
+
+// Limits for accounts without a row in account_limits. Users can lower their
+// own limits, but never above these.
+var defaultLimits = transferLimits{
+	PerTransfer: 500000,  // 5000.00
+	Daily:       1000000, // 10000.00
+	Monthly:     5000000, // 50000.00
+	Nighttime:   100000,  // 1000.00
+}
+
+// The night goes from nightStartHour until nightEndHour of the next day, in
+// the account's time zone.
+const nightStartHour = 20
+const nightEndHour = 6
+
+// Either *sql.DB or *sql.Tx, so the same queries can be used inside and
+// outside a transaction.
+type queryRower interface {
+	QueryRow(query string, args ...interface{}) *sql.Row
+}
+
+// Get the limits for the account with id, or the defaults if the account
+// never changed them.
+func getLimits(q queryRower, id int) (transferLimits, error) {
+	var limits transferLimits
+
+	row := q.QueryRow(
+		`select per_transfer, daily, monthly, nighttime
+		from account_limits where account_id = $1`, id)
+
+	err := row.Scan(&limits.PerTransfer, &limits.Daily, &limits.Monthly,
+		&limits.Nighttime)
+
+	if err == sql.ErrNoRows {
+		return defaultLimits, nil
+	} else if err != nil {
+		return limits, err
+	}
+
+	return limits, nil
+}
+
+// The time zone of the account with id.
+func accountLocation(q queryRower, id int) (*time.Location, error) {
+	var timezone string
+	row := q.QueryRow(`select timezone from accounts where id = $1`, id)
+	err := row.Scan(&timezone)
+
+	if err != nil {
+		return nil, err
+	}
+
+	loc, err := time.LoadLocation(timezone)
+
+	if err != nil {
+		return nil, fmt.Errorf("account %d has a bad timezone: %w", id, err)
+	}
+
+	return loc, nil
+}
+
+// Midnight of the day of now, in loc.
+func dayStart(now time.Time, loc *time.Location) time.Time {
+	local := now.In(loc)
+	return time.Date(local.Year(), local.Month(), local.Day(), 0, 0, 0, 0, loc)
+}
+
+// Midnight of the first day of the month of now, in loc.
+func monthStart(now time.Time, loc *time.Location) time.Time {
+	local := now.In(loc)
+	return time.Date(local.Year(), local.Month(), 1, 0, 0, 0, 0, loc)
+}
+
+// If now is during the night in loc, return when the night started and true.
+// Otherwise return false.
+func nightStart(now time.Time, loc *time.Location) (time.Time, bool) {
+	local := now.In(loc)
+	hour := local.Hour()
+
+	if hour >= nightStartHour {
+		return time.Date(local.Year(), local.Month(), local.Day(),
+			nightStartHour, 0, 0, 0, loc), true
+	} else if hour < nightEndHour {
+		// time.Date normalizes day 0 to the last day of the previous month
+		return time.Date(local.Year(), local.Month(), local.Day()-1,
+			nightStartHour, 0, 0, 0, loc), true
+	}
+
+	return time.Time{}, false
+}
+
+// A limit on the total sent since a point in time.
+type limitPeriod struct {
+	name  string
+	since time.Time
+	limit money
+}
+
+// Total sent by the account with id since the given time. Fees don't count.
+func sentSince(tx *sql.Tx, id int, since time.Time) (int64, error) {
+	var total int64
+
+	// created_at is stored in UTC without a time zone, so we compare it
+	// against the UTC wall clock.
+	row := tx.QueryRow(
+		`select coalesce(sum(amount), 0) from transfers
+		where origin_id = $1 and created_at >= $2 and fee_for is null`,
+		id, since.UTC())
+
+	err := row.Scan(&total)
+
+	return total, err
+}
+
+// Check whether the account with id can send amount without going over any
+// of its limits. Run this inside the transfer transaction, after locking the
+// origin account row, so that concurrent transfers from the same account
+// can't both pass the check.
+//
+// Returns a public error with the remaining allowance if a limit would be
+// exceeded.
+func checkTransferLimits(tx *sql.Tx, id int, amount money) error {
+	limits, err := getLimits(tx, id)
+
+	if err != nil {
+		return err
+	}
+
+	if amount > limits.PerTransfer {
+		return newLimitExceededError("per_transfer", limits.PerTransfer)
+	}
+
+	loc, err := accountLocation(tx, id)
+
+	if err != nil {
+		return err
+	}
+
+	now := time.Now()
+
+	var periods = []limitPeriod{
+		{"daily", dayStart(now, loc), limits.Daily},
+		{"monthly", monthStart(now, loc), limits.Monthly},
+	}
+
+	if since, night := nightStart(now, loc); night {
+		periods = append(periods,
+			limitPeriod{"nighttime", since, limits.Nighttime})
+	}
+
+	for _, period := range periods {
+		sent, err := sentSince(tx, id, period.since)
+
+		if err != nil {
+			return err
+		}
+
+		if sent+int64(amount) > int64(period.limit) {
+			remaining := int64(period.limit) - sent
+
+			if remaining < 0 {
+				remaining = 0
+			}
+
+			return newLimitExceededError(period.name, money(remaining))
+		}
+	}
+
+	return nil
+}
+
+// Handler for GET at /limits.
+func getAccountLimits(rw http.ResponseWriter, req *http.Request) {
+	id := accountID(req)
+
+	limits, err := getLimits(DB, id)
+
+	if err != nil {
+		respondWithError(rw, err)
+		return
+	}
+
+	respondWithJSON(rw, http.StatusOK, &limits)
+}
+
+// Handler for POST at /limits. Lowers the limits given in the request. Trying
+// to raise any of them fails the whole request.
+func updateAccountLimits(rw http.ResponseWriter, req *http.Request) {
+	id := accountID(req)
+
+	var updateReq limitsUpdateRequest
+
+	data, err := readFromReq(req, 256)
+
+	if err != nil {
+		respondWithError(rw, err)
+		return
+	}
+
+	err = json.Unmarshal(data, &updateReq)
+
+	var publicError *publicJSONError
+	if errors.As(err, &publicError) {
+		respondWithError(rw, publicError)
+		return
+	} else if err != nil {
+		respondWithError(rw, cantParseJSONError)
+		return
+	}
+
+	tx, err := DB.BeginTx(req.Context(), &defaultTxOptions)
+
+	if err != nil {
+		logger.Print("Error starting tx to update limits")
+		respondWithError(rw, err)
+		return
+	}
+
+	limits, err := getLimits(tx, id)
+
+	if err != nil {
+		rollbackTx(tx)
+		respondWithError(rw, err)
+		return
+	}
+
+	var updates = []struct {
+		newLimit *money
+		limit    *money
+	}{
+		{updateReq.PerTransfer, &limits.PerTransfer},
+		{updateReq.Daily, &limits.Daily},
+		{updateReq.Monthly, &limits.Monthly},
+		{updateReq.Nighttime, &limits.Nighttime},
+	}
+
+	for _, update := range updates {
+		if update.newLimit == nil {
+			continue
+		}
+
+		if *update.newLimit < 0 {
+			rollbackTx(tx)
+			respondWithError(rw, invalidAmountError)
+			return
+		}
+
+		if *update.newLimit > *update.limit {
+			rollbackTx(tx)
+			respondWithError(rw, limitRaiseError)
+			return
+		}
+
+		*update.limit = *update.newLimit
+	}
+
+	_, err = tx.Exec(
+		`insert into account_limits
+		(account_id, per_transfer, daily, monthly, nighttime)
+		values ($1, $2, $3, $4, $5)
+		on conflict (account_id) do update set
+		per_transfer = excluded.per_transfer, daily = excluded.daily,
+		monthly = excluded.monthly, nighttime = excluded.nighttime`,
+		id, limits.PerTransfer, limits.Daily, limits.Monthly,
+		limits.Nighttime)
+
+	if err != nil {
+		rollbackTx(tx)
+		respondWithError(rw, err)
+		return
+	}
+
+	err = tx.Commit()
+
+	if err != nil {
+		logger.Print("Error commiting tx")
+		respondWithError(rw, err)
+		return
+	}
+
+	logger.Printf("Updated limits for account %d", id)
+	respondWithJSON(rw, http.StatusOK, &limits)
+}
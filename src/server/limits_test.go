@@ -0,0 +1,53 @@
+package server
+
+import (
+	"testing"
+	"time"
+)
+
+func TestLimitPeriods(t *testing.T) {
+	loc, err := time.LoadLocation("America/Sao_Paulo")
+
+	if err != nil {
+		t.Log(err)
+		t.FailNow()
+	}
+
+	// 01:30 on March 1st in Sao Paulo (UTC-3)
+	now := time.Date(2021, time.March, 1, 4, 30, 0, 0, time.UTC)
+
+	if !dayStart(now, loc).Equal(
+		time.Date(2021, time.March, 1, 3, 0, 0, 0, time.UTC)) {
+		t.Error(dayStart(now, loc))
+	}
+
+	if !monthStart(now, loc).Equal(
+		time.Date(2021, time.March, 1, 3, 0, 0, 0, time.UTC)) {
+		t.Error(monthStart(now, loc))
+	}
+
+	// The night started on the last day of February
+	since, night := nightStart(now, loc)
+
+	if !night || !since.Equal(
+		time.Date(2021, time.February, 28, 23, 0, 0, 0, time.UTC)) {
+		t.Error(since, night)
+	}
+
+	// 23:59 on February 28th in UTC is still 20:59 in Sao Paulo
+	now = time.Date(2021, time.February, 28, 23, 59, 0, 0, time.UTC)
+	since, night = nightStart(now, loc)
+
+	if !night || !since.Equal(
+		time.Date(2021, time.February, 28, 23, 0, 0, 0, time.UTC)) {
+		t.Error(since, night)
+	}
+
+	// Noon is not night
+	now = time.Date(2021, time.March, 1, 15, 0, 0, 0, time.UTC)
+	_, night = nightStart(now, loc)
+
+	if night {
+		t.Error(now)
+	}
+}
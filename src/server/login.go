@@ -51,70 +51,47 @@ func generateToken() (string, error) {
 	return fmt.Sprintf("%x", token[0:8]), nil
 }
 
-// Handler for POST at /login. Retrieves the account using the CPF in the
-// request, checks if the request password matches the account secret,
-// and if so inserts a new logged-in user to our in-memory map of logged-in
-// users, and returns the token.
-func login(rw http.ResponseWriter, req *http.Request) {
-
-	if req.URL.Path != "/login" {
-		respondWithError(rw, invalidURLError)
-		return
-	}
-
-	if req.Method != http.MethodPost {
-		respondWithError(rw, invalidMethodError)
-		return
-	}
-
-	var loginReq loginRequest
-	var data, err = readFromReq(req, 128)
-
-	if err != nil {
-		respondWithError(rw, err)
-		return
-	}
+// The hex-encoded sha256 of secret, as kept in accounts.secret.
+func hashSecret(secret string) string {
+	return fmt.Sprintf("%x", sha256.Sum256([]byte(secret)))
+}
 
-	err = json.Unmarshal(data, &loginReq)
+// Log in to the account with cpf if secret is its secret, inserting a new
+// logged-in user to our in-memory map of logged-in users. Returns the token.
+func loginAccount(ctx context.Context, cpf string, secret string) (string,
+	error) {
 
-	if err != nil {
-		respondWithError(rw, cantParseJSONError)
-		return
-	}
-
-	if !cpfRegex.MatchString(loginReq.CPF) {
-		respondWithError(rw, cpfInvalidError)
-		return
+	if !cpfRegex.MatchString(cpf) {
+		return "", cpfInvalidError
 	}
 
 	var acc account
 
-	row := DB.QueryRow(
-		"select id, secret from accounts where cpf = $1", loginReq.CPF)
+	row := DB.QueryRowContext(ctx,
+		"select id, secret, status from accounts where cpf = $1", cpf)
 
-	err = row.Scan(&acc.ID, &acc.secret)
+	err := row.Scan(&acc.ID, &acc.secret, &acc.Status)
 
 	if err == sql.ErrNoRows {
-		respondWithError(rw, noAccountError)
-		return
+		failedLogins.add(1, noAccountError.code)
+		return "", noAccountError
 	} else if err != nil {
-		respondWithError(rw, err)
-		return
+		return "", err
 	}
 
-	hashedSecret := fmt.Sprintf("%x", sha256.Sum256([]byte(loginReq.Secret)))
+	if hashSecret(secret) != acc.secret {
+		return "", loginFailed(acc.ID, wrongPasswordError)
+	}
 
-	if hashedSecret != acc.secret {
-		respondWithError(rw, wrongPasswordError)
-		return
+	// Frozen accounts can still log in, to see their balance.
+	if acc.Status == "closed" {
+		return "", loginFailed(acc.ID, accountClosedError)
 	}
 
-	var token string
-	token, err = generateToken()
+	token, err := generateToken()
 
 	if err != nil {
-		respondWithError(rw, err)
-		return
+		return "", err
 	}
 
 	users.mu.Lock()
@@ -128,52 +105,82 @@ func login(rw http.ResponseWriter, req *http.Request) {
 	// so that the user knows to try again. If we added the user, a previously
 	// logged in user would have access to this user!
 	if present {
-		respondWithError(rw, tryAgainError)
-		return
+		return "", tryAgainError
 	}
 
-	rw.WriteHeader(http.StatusCreated)
-	setJSONEncoding(rw)
-
-	_, err = rw.Write([]byte(fmt.Sprintf("{\"token\":\"%s\"}\n", token)))
+	err = recordDomainEvent(DB, EventLoginSucceeded, acc.ID,
+		&loginEvent{AccountID: acc.ID})
 
 	if err != nil {
-		logger.Printf("Could not write response: %v", err)
+		users.mu.Lock()
+		delete(users.entries, token)
+		users.mu.Unlock()
+
+		return "", err
 	}
+
+	return token, nil
 }
 
-// Simple handler for a user to get his own id from his authorization token.
-// Mainly for testing.
-func getId(rw http.ResponseWriter, req *http.Request) {
+// Count and record the LoginFailed event of the account with id and return
+// reason, or the error recording it.
+func loginFailed(id int, reason *publicJSONError) error {
+	failedLogins.add(1, reason.code)
 
-	if req.URL.Path != "/id" {
-		respondWithError(rw, invalidURLError)
-		return
+	err := recordDomainEvent(DB, EventLoginFailed, id,
+		&loginEvent{AccountID: id, Reason: reason.code})
+
+	if err != nil {
+		return err
 	}
 
-	if req.Method != http.MethodGet {
-		respondWithError(rw, invalidMethodError)
+	return reason
+}
+
+// Handler for POST at /login. Logs in with the CPF and secret in the
+// request, see loginAccount, and returns the token.
+func login(rw http.ResponseWriter, req *http.Request) {
+	var loginReq loginRequest
+	var data, err = readFromReq(req, 128)
+
+	if err != nil {
+		respondWithError(rw, err)
 		return
 	}
 
-	token := req.Header.Get("Authorization")
+	err = json.Unmarshal(data, &loginReq)
 
-	if token == "" {
-		respondWithError(rw, noTokenError)
+	if err != nil {
+		respondWithError(rw, cantParseJSONError)
 		return
 	}
 
-	id, err := getUserByToken(token, false)
+	token, err := loginAccount(req.Context(), loginReq.CPF, loginReq.Secret)
 
 	if err != nil {
 		respondWithError(rw, err)
 		return
 	}
 
+	rw.WriteHeader(http.StatusCreated)
+	setJSONEncoding(rw)
+
+	_, err = rw.Write([]byte(fmt.Sprintf("{\"token\":\"%s\"}\n", token)))
+
+	if err != nil {
+		logger.Printf("Could not write response: %v", err)
+	}
+}
+
+// Simple handler for a user to get his own id from his authorization token.
+// Mainly for testing.
+func getId(rw http.ResponseWriter, req *http.Request) {
+	id := accountID(req)
+
 	rw.WriteHeader(http.StatusOK)
 	setJSONEncoding(rw)
 
-	_, err = rw.Write([]byte(fmt.Sprintf("{\"id\":%d}\n", id)))
+	_, err := rw.Write([]byte(fmt.Sprintf("{\"id\":%d}\n", id)))
 
 	if err != nil {
 		logger.Printf("Could not write response: %v", err)
@@ -210,6 +217,42 @@ func getUserByToken(token string, refresh bool) (int, error) {
 	}
 }
 
+// Like getUserByToken, but the user must also be an admin. There is no
+// route to make an admin, it has to be done directly in the DB by setting
+// accounts.admin.
+func getAdminByToken(token string) (int, error) {
+	id, err := getUserByToken(token, true)
+
+	if err != nil {
+		return 0, err
+	}
+
+	var admin bool
+
+	row := DB.QueryRow("select admin from accounts where id = $1", id)
+	err = row.Scan(&admin)
+
+	if err == sql.ErrNoRows || (err == nil && !admin) {
+		return 0, forbiddenError
+	} else if err != nil {
+		return 0, err
+	}
+
+	return id, nil
+}
+
+// Log out every login of the account with id, e.g. when it's closed, except
+// for keepToken, if not empty.
+func logoutAccount(id int, keepToken string) {
+	users.mu.Lock()
+	for token, entry := range users.entries {
+		if entry.id == id && token != keepToken {
+			delete(users.entries, token)
+		}
+	}
+	users.mu.Unlock()
+}
+
 // Periodically clean up expired logins. Call this in a goroutine. Cancel the
 // context to stop the goroutine.
 func loginClean(ctx context.Context) {
@@ -0,0 +1,412 @@
+package server
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"math"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/jackc/pgconn"
+)
+
+// The metrics are kept in memory, for this server only, and written in the
+// Prometheus text format at /metrics.
+
+// A counter with labels. Each combination of label values seen has its own
+// value.
+type counterVec struct {
+	name   string
+	help   string
+	labels []string
+	values map[string]*counterValue
+	mu     sync.Mutex
+}
+
+type counterValue struct {
+	labelValues []string
+	value       float64
+}
+
+func newCounterVec(name string, help string, labels ...string) *counterVec {
+	return &counterVec{name: name, help: help, labels: labels,
+		values: make(map[string]*counterValue)}
+}
+
+// Add value to the counter of labelValues, in the order of the labels.
+func (c *counterVec) add(value float64, labelValues ...string) {
+	key := strings.Join(labelValues, "\xff")
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	counter, ok := c.values[key]
+
+	if !ok {
+		counter = &counterValue{labelValues: labelValues}
+		c.values[key] = counter
+	}
+
+	counter.value += value
+}
+
+func (c *counterVec) write(w io.Writer) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	writeMetricHeader(w, c.name, c.help, "counter")
+
+	keys := make([]string, 0, len(c.values))
+
+	for key := range c.values {
+		keys = append(keys, key)
+	}
+
+	sort.Strings(keys)
+
+	for _, key := range keys {
+		counter := c.values[key]
+		fmt.Fprintf(w, "%s%s %s\n", c.name,
+			formatLabels(c.labels, counter.labelValues),
+			formatMetricValue(counter.value))
+	}
+}
+
+// A histogram with labels. buckets are the upper bounds, in increasing
+// order, without +Inf.
+type histogramVec struct {
+	name    string
+	help    string
+	labels  []string
+	buckets []float64
+	values  map[string]*histogramValue
+	mu      sync.Mutex
+}
+
+type histogramValue struct {
+	labelValues []string
+	// How many observations fell in each bucket, not counting the ones
+	// before it. The last is the +Inf bucket.
+	counts []uint64
+	sum    float64
+}
+
+func newHistogramVec(name string, help string, buckets []float64,
+	labels ...string) *histogramVec {
+
+	return &histogramVec{name: name, help: help, labels: labels,
+		buckets: buckets, values: make(map[string]*histogramValue)}
+}
+
+// Observe value in the histogram of labelValues, in the order of the labels.
+func (h *histogramVec) observe(value float64, labelValues ...string) {
+	key := strings.Join(labelValues, "\xff")
+	bucket := sort.SearchFloat64s(h.buckets, value)
+
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	histogram, ok := h.values[key]
+
+	if !ok {
+		histogram = &histogramValue{labelValues: labelValues,
+			counts: make([]uint64, len(h.buckets)+1)}
+		h.values[key] = histogram
+	}
+
+	histogram.counts[bucket]++
+	histogram.sum += value
+}
+
+func (h *histogramVec) write(w io.Writer) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	writeMetricHeader(w, h.name, h.help, "histogram")
+
+	keys := make([]string, 0, len(h.values))
+
+	for key := range h.values {
+		keys = append(keys, key)
+	}
+
+	sort.Strings(keys)
+
+	bucketLabels := append(append([]string(nil), h.labels...), "le")
+
+	for _, key := range keys {
+		histogram := h.values[key]
+		bucketValues := append(append([]string(nil),
+			histogram.labelValues...), "")
+
+		var count uint64
+
+		for i, bucketCount := range histogram.counts {
+			count += bucketCount
+
+			if i < len(h.buckets) {
+				bucketValues[len(bucketValues)-1] = formatMetricValue(
+					h.buckets[i])
+			} else {
+				bucketValues[len(bucketValues)-1] = "+Inf"
+			}
+
+			fmt.Fprintf(w, "%s_bucket%s %d\n", h.name,
+				formatLabels(bucketLabels, bucketValues), count)
+		}
+
+		labels := formatLabels(h.labels, histogram.labelValues)
+		fmt.Fprintf(w, "%s_sum%s %s\n", h.name, labels,
+			formatMetricValue(histogram.sum))
+		fmt.Fprintf(w, "%s_count%s %d\n", h.name, labels, count)
+	}
+}
+
+func writeMetricHeader(w io.Writer, name string, help string,
+	metricType string) {
+
+	fmt.Fprintf(w, "# HELP %s %s\n# TYPE %s %s\n", name, help, name,
+		metricType)
+}
+
+// Write a metric without labels, read when /metrics is scraped.
+func writeMetric(w io.Writer, name string, help string, metricType string,
+	value float64) {
+
+	writeMetricHeader(w, name, help, metricType)
+	fmt.Fprintf(w, "%s %s\n", name, formatMetricValue(value))
+}
+
+var labelValueReplacer = strings.NewReplacer(`\`, `\\`, `"`, `\"`,
+	"\n", `\n`)
+
+// The labels as {name="value",...}, or nothing if there are none.
+func formatLabels(names []string, values []string) string {
+	if len(names) == 0 {
+		return ""
+	}
+
+	pairs := make([]string, len(names))
+
+	for i, name := range names {
+		pairs[i] = name + `="` + labelValueReplacer.Replace(values[i]) + `"`
+	}
+
+	return "{" + strings.Join(pairs, ",") + "}"
+}
+
+func formatMetricValue(value float64) string {
+	if math.IsInf(value, 1) {
+		return "+Inf"
+	}
+
+	return strconv.FormatFloat(value, 'g', -1, 64)
+}
+
+// Upper bounds of the request durations, in seconds.
+var durationBuckets = []float64{0.005, 0.01, 0.025, 0.05, 0.1, 0.25, 0.5, 1,
+	2.5, 5, 10}
+
+// Upper bounds of the transfer amounts, in reais.
+var amountBuckets = []float64{1, 10, 100, 1000, 10000, 100000}
+
+var httpRequests = newCounterVec("pedrobank_http_requests_total",
+	"HTTP requests handled, by route and status.",
+	"method", "route", "status")
+
+var httpDurations = newHistogramVec("pedrobank_http_request_duration_seconds",
+	"How long the HTTP requests took, by route and status.", durationBuckets,
+	"method", "route", "status")
+
+var transfersTotal = newCounterVec("pedrobank_transfers_total",
+	"Transfers asked for, by result: completed, pending_review, denied or "+
+		"failed.", "result")
+
+var transferAmounts = newHistogramVec("pedrobank_transfer_amount_reais",
+	"Amounts of the completed transfers.", amountBuckets)
+
+var failedLogins = newCounterVec("pedrobank_failed_logins_total",
+	"Logins refused, by the code of the error.", "reason")
+
+var txConflicts = newCounterVec("pedrobank_tx_conflicts_total",
+	"Transactions that failed on a concurrent one, sent back to the client "+
+		"to retry, by SQLSTATE.", "code")
+
+var txRetries = newCounterVec("pedrobank_tx_retries_total",
+	"Transfer transactions that failed on a concurrent one and the server "+
+		"tried again, by SQLSTATE.", "code")
+
+// Route label of the requests no route matched, so that random paths don't
+// each get their own metrics.
+const unmatchedRoute = "unmatched"
+
+// Method label of the requests with methods no route has, for the same
+// reason.
+const otherMethod = "OTHER"
+
+var routedMethods = map[string]bool{http.MethodGet: true,
+	http.MethodPost: true, http.MethodPatch: true, http.MethodDelete: true,
+	http.MethodOptions: true}
+
+// Filled in by the router with the pattern of the route that matched, for
+// withMetrics.
+type matchedRoute struct {
+	pattern string
+}
+
+// Count every request and how long it took, by the pattern of its route.
+func withMetrics(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {
+		start := time.Now()
+		recorder := &statusRecorder{ResponseWriter: rw}
+		matched := &matchedRoute{pattern: unmatchedRoute}
+
+		ctx := context.WithValue(req.Context(), matchedRouteKey, matched)
+		next.ServeHTTP(recorder, req.WithContext(ctx))
+
+		status := recorder.status
+
+		// The server sends 200 for handlers that write nothing
+		if status == 0 {
+			status = http.StatusOK
+		}
+
+		method := req.Method
+
+		if !routedMethods[method] {
+			method = otherMethod
+		}
+
+		labels := []string{method, matched.pattern, strconv.Itoa(status)}
+		httpRequests.add(1, labels...)
+		httpDurations.observe(time.Since(start).Seconds(), labels...)
+	})
+}
+
+// Tell withMetrics which route matched req.
+func setMatchedRoute(req *http.Request, pattern string) {
+	if matched, ok := req.Context().Value(
+		matchedRouteKey).(*matchedRoute); ok {
+
+		matched.pattern = pattern
+	}
+}
+
+// The result of a transfer attempt, for transfersTotal.
+func transferResult(pending *pendingTransfer, err error) string {
+	var deniedErr *riskDeniedError
+
+	switch {
+	case errors.As(err, &deniedErr):
+		return "denied"
+	case err != nil:
+		return "failed"
+	case pending != nil:
+		return "pending_review"
+	default:
+		return "completed"
+	}
+}
+
+// Count a transfer of amount that ended with result.
+func countTransfer(result string, amount money) {
+	transfersTotal.add(1, result)
+
+	if result == "completed" {
+		transferAmounts.observe(float64(amount) / 100)
+	}
+}
+
+// The SQLSTATE of err if it's a transaction conflict, or else "": a
+// serialization failure, which Repeatable Read gives when a row changed
+// since the transaction started, or a deadlock. Trying the transaction again
+// can work.
+func txConflictCode(err error) string {
+	var pgErr *pgconn.PgError
+
+	if errors.As(err, &pgErr) && (pgErr.Code == "40001" ||
+		pgErr.Code == "40P01") {
+
+		return pgErr.Code
+	}
+
+	return ""
+}
+
+// Count the error if it's a transaction conflict sent back to the client.
+// Transfers are retried by the server first, see insertTransferWith, so for
+// them it means the retries ran out.
+func countTxConflict(err error) {
+	if code := txConflictCode(err); code != "" {
+		txConflicts.add(1, code)
+	}
+}
+
+// Handler for GET at /metrics. Writes the metrics in the Prometheus text
+// format.
+func getMetrics(rw http.ResponseWriter, req *http.Request) {
+	var buf bytes.Buffer
+
+	httpRequests.write(&buf)
+	httpDurations.write(&buf)
+	transfersTotal.write(&buf)
+	transferAmounts.write(&buf)
+	failedLogins.write(&buf)
+	txConflicts.write(&buf)
+	txRetries.write(&buf)
+
+	// The expired logins stay in the map until loginClean removes them
+	now := time.Now()
+	sessions := 0
+
+	users.mu.Lock()
+	for _, entry := range users.entries {
+		if !entry.loginTime.Add(loginTimeout).Before(now) {
+			sessions++
+		}
+	}
+	users.mu.Unlock()
+
+	writeMetric(&buf, "pedrobank_active_sessions",
+		"Logins that haven't expired.", "gauge", float64(sessions))
+
+	stats := DB.Stats()
+
+	writeMetric(&buf, "pedrobank_db_open_connections",
+		"Connections to the database, in use or idle.", "gauge",
+		float64(stats.OpenConnections))
+	writeMetric(&buf, "pedrobank_db_in_use_connections",
+		"Connections to the database in use.", "gauge",
+		float64(stats.InUse))
+	writeMetric(&buf, "pedrobank_db_idle_connections",
+		"Idle connections to the database.", "gauge", float64(stats.Idle))
+	writeMetric(&buf, "pedrobank_db_max_open_connections",
+		"Most connections the pool opens, 0 for no limit.", "gauge",
+		float64(stats.MaxOpenConnections))
+	writeMetric(&buf, "pedrobank_db_waits_total",
+		"Times a connection had to be waited for.", "counter",
+		float64(stats.WaitCount))
+	writeMetric(&buf, "pedrobank_db_wait_seconds_total",
+		"Time spent waiting for connections.", "counter",
+		stats.WaitDuration.Seconds())
+	writeMetric(&buf, "pedrobank_db_closed_idle_connections_total",
+		"Connections closed for going over the idle limits.", "counter",
+		float64(stats.MaxIdleClosed+stats.MaxIdleTimeClosed))
+	writeMetric(&buf, "pedrobank_db_closed_lifetime_connections_total",
+		"Connections closed for going over their lifetime.", "counter",
+		float64(stats.MaxLifetimeClosed))
+
+	rw.Header().Set("Content-Type", "text/plain; version=0.0.4; charset=utf-8")
+	rw.WriteHeader(http.StatusOK)
+
+	if _, err := rw.Write(buf.Bytes()); err != nil {
+		logger.Printf("Could not write response: %v", err)
+	}
+}
@@ -0,0 +1,203 @@
+package server
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"strings"
+	"testing"
+
+	"github.com/jackc/pgconn"
+)
+
+func TestCounterVec(t *testing.T) {
+	counter := newCounterVec("test_total", "A test.", "a", "b")
+	counter.add(1, "x", "y")
+	counter.add(2, "x", "y")
+	counter.add(0.5, `q"uo\te`, "new\nline")
+
+	var buf bytes.Buffer
+	counter.write(&buf)
+
+	expected := "# HELP test_total A test.\n# TYPE test_total counter\n" +
+		"test_total{a=\"q\\\"uo\\\\te\",b=\"new\\nline\"} 0.5\n" +
+		"test_total{a=\"x\",b=\"y\"} 3\n"
+
+	if buf.String() != expected {
+		t.Errorf("%q", buf.String())
+	}
+}
+
+func TestHistogramVec(t *testing.T) {
+	histogram := newHistogramVec("test_seconds", "A test.",
+		[]float64{0.1, 1}, "route")
+
+	for _, value := range []float64{0.05, 0.1, 0.5, 2} {
+		histogram.observe(value, "/a")
+	}
+
+	var buf bytes.Buffer
+	histogram.write(&buf)
+
+	expected := "# HELP test_seconds A test.\n" +
+		"# TYPE test_seconds histogram\n" +
+		"test_seconds_bucket{route=\"/a\",le=\"0.1\"} 2\n" +
+		"test_seconds_bucket{route=\"/a\",le=\"1\"} 3\n" +
+		"test_seconds_bucket{route=\"/a\",le=\"+Inf\"} 4\n" +
+		"test_seconds_sum{route=\"/a\"} 2.65\n" +
+		"test_seconds_count{route=\"/a\"} 4\n"
+
+	if buf.String() != expected {
+		t.Errorf("%q", buf.String())
+	}
+
+	// Without labels
+	histogram = newHistogramVec("test_amount", "A test.", []float64{1})
+	histogram.observe(3)
+	buf.Reset()
+	histogram.write(&buf)
+
+	if !strings.Contains(buf.String(), `test_amount_bucket{le="+Inf"} 1`) ||
+		!strings.Contains(buf.String(), "test_amount_count 1\n") {
+
+		t.Errorf("%q", buf.String())
+	}
+}
+
+// The value of the sample line for name and labels in the metrics, or "" if
+// there's none.
+func sampleValue(metrics string, sample string) string {
+	for _, line := range strings.Split(metrics, "\n") {
+		if strings.HasPrefix(line, sample+" ") {
+			return strings.TrimPrefix(line, sample+" ")
+		}
+	}
+
+	return ""
+}
+
+func TestWithMetrics(t *testing.T) {
+	var samples = []struct {
+		sample string
+		added  int
+	}{
+		{`pedrobank_http_requests_total{method="GET",route="/ping",` +
+			`status="200"}`, 2},
+		{`pedrobank_http_requests_total{method="GET",` +
+			`route="/transfers/batch/{id:[0-9]+}",status="400"}`, 1},
+		{`pedrobank_http_requests_total{method="GET",route="unmatched",` +
+			`status="404"}`, 1},
+		{`pedrobank_http_requests_total{method="DELETE",route="/ping",` +
+			`status="405"}`, 1},
+		{`pedrobank_http_requests_total{method="OTHER",route="/ping",` +
+			`status="405"}`, 1},
+		{`pedrobank_http_request_duration_seconds_count{method="GET",` +
+			`route="/ping",status="200"}`, 2},
+	}
+
+	metrics := func() string {
+		var buf bytes.Buffer
+		httpRequests.write(&buf)
+		httpDurations.write(&buf)
+
+		return buf.String()
+	}
+
+	// Other tests may have counted some already
+	before := metrics()
+	rt := routes()
+
+	for _, path := range []string{"/ping", "/ping", "/transfers/batch/12",
+		"/no/such/path"} {
+
+		rt.ServeHTTP(httptest.NewRecorder(),
+			httptest.NewRequest(http.MethodGet, path, nil))
+	}
+
+	for _, method := range []string{http.MethodDelete, "MADEUP"} {
+		rt.ServeHTTP(httptest.NewRecorder(),
+			httptest.NewRequest(method, "/ping", nil))
+	}
+
+	after := metrics()
+
+	for _, value := range samples {
+		count, _ := strconv.Atoi(sampleValue(before, value.sample))
+
+		if got := sampleValue(after, value.sample); got !=
+			strconv.Itoa(count+value.added) {
+
+			t.Error(value.sample, count, got)
+		}
+	}
+}
+
+func TestTransferResult(t *testing.T) {
+	var values = []struct {
+		pending *pendingTransfer
+		err     error
+		result  string
+	}{
+		{nil, nil, "completed"},
+		{&pendingTransfer{ID: 1}, nil, "pending_review"},
+		{nil, &riskDeniedError{"velocity"}, "denied"},
+		{nil, fmt.Errorf("batch: %w", &riskDeniedError{"velocity"}),
+			"denied"},
+		{nil, insufficientFundsError, "failed"},
+	}
+
+	for _, value := range values {
+		if result := transferResult(value.pending, value.err); result !=
+			value.result {
+
+			t.Error(value.err, result)
+		}
+	}
+}
+
+func TestCountTxConflict(t *testing.T) {
+	const sample = `pedrobank_tx_conflicts_total{code="40001"}`
+
+	conflicts := func() string {
+		var buf bytes.Buffer
+		txConflicts.write(&buf)
+
+		return buf.String()
+	}
+
+	// Other tests may have counted some already
+	before, _ := strconv.Atoi(sampleValue(conflicts(), sample))
+
+	countTxConflict(fmt.Errorf("commit: %w",
+		&pgconn.PgError{Code: "40001"}))
+	countTxConflict(&pgconn.PgError{Code: "23505"})
+	countTxConflict(errors.New("other"))
+
+	metrics := conflicts()
+
+	if sampleValue(metrics, sample) != strconv.Itoa(before+1) ||
+		strings.Contains(metrics, "23505") {
+
+		t.Errorf("%q", metrics)
+	}
+}
+
+func TestTxConflictCode(t *testing.T) {
+	for err, code := range map[error]string{
+		fmt.Errorf("commit: %w", &pgconn.PgError{Code: "40001"}): "40001",
+		&pgconn.PgError{Code: "40P01"}:                           "40P01",
+		&pgconn.PgError{Code: "23505"}:                           "",
+		errors.New("other"):                                      "",
+	} {
+		if txConflictCode(err) != code {
+			t.Error(err, txConflictCode(err))
+		}
+	}
+
+	if txConflictCode(nil) != "" {
+		t.Error("nil is a conflict")
+	}
+}
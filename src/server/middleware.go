@@ -0,0 +1,269 @@
+package server
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"net/http"
+	"regexp"
+	"runtime/debug"
+	"strings"
+	"time"
+)
+
+// Records the status a handler responded with, for withLogging and
+// withMetrics.
+type statusRecorder struct {
+	http.ResponseWriter
+	status int
+}
+
+func (sr *statusRecorder) WriteHeader(status int) {
+	if sr.status == 0 {
+		sr.status = status
+	}
+
+	sr.ResponseWriter.WriteHeader(status)
+}
+
+func (sr *statusRecorder) Write(data []byte) (int, error) {
+	if sr.status == 0 {
+		sr.status = http.StatusOK
+	}
+
+	return sr.ResponseWriter.Write(data)
+}
+
+// Lets handlers that stream, like streamEvents, flush through the
+// middleware.
+func (sr *statusRecorder) Flush() {
+	if flusher, ok := sr.ResponseWriter.(http.Flusher); ok {
+		flusher.Flush()
+	}
+}
+
+// Header with the id of each request, sent back in every response and in the
+// error envelope.
+const requestIDHeader = "X-Request-ID"
+
+// Ids that clients can pick themselves, for requests they already track.
+var requestIDRegex *regexp.Regexp = regexp.MustCompile(
+	`^[A-Za-z0-9._-]{1,64}$`)
+
+func newRequestID() string {
+	var id [8]byte
+
+	if _, err := rand.Read(id[:]); err != nil {
+		logger.Printf("Could not generate request id: %v", err)
+	}
+
+	return hex.EncodeToString(id[:])
+}
+
+// Give each request an id, taken from the request's header if it's a good
+// one, and set it in the response's header before anything else runs.
+func withRequestID(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {
+		id := req.Header.Get(requestIDHeader)
+
+		if !requestIDRegex.MatchString(id) {
+			id = newRequestID()
+		}
+
+		rw.Header().Set(requestIDHeader, id)
+		next.ServeHTTP(rw, req)
+	})
+}
+
+// Log every request with its status and how long it took.
+func withLogging(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {
+		start := time.Now()
+		recorder := &statusRecorder{ResponseWriter: rw}
+
+		next.ServeHTTP(recorder, req)
+
+		logger.Printf("%s %s %d %s %s", req.Method, req.URL.Path,
+			recorder.status, time.Since(start).Round(time.Microsecond),
+			rw.Header().Get(requestIDHeader))
+	})
+}
+
+// Respond with an internal error if the handler panics, instead of dropping
+// the connection, and log the stack.
+func withRecovery(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {
+		defer func() {
+			if val := recover(); val != nil {
+				// The server uses this one to abort a response on purpose.
+				if val == http.ErrAbortHandler {
+					panic(val)
+				}
+
+				logger.Printf("Panic in %s %s, request %s: %v\n%s",
+					req.Method, req.URL.Path, rw.Header().Get(requestIDHeader),
+					val, debug.Stack())
+				respondWithError(rw, fmt.Errorf("panic: %v", val))
+			}
+		}()
+
+		next.ServeHTTP(rw, req)
+	})
+}
+
+// A request body that fails with requestTooLongError after maxLen bytes.
+type limitedBody struct {
+	io.ReadCloser
+	left int64
+}
+
+func (lb *limitedBody) Read(data []byte) (int, error) {
+	if lb.left <= 0 {
+		var one [1]byte
+		n, err := lb.ReadCloser.Read(one[:])
+
+		if n > 0 {
+			return 0, requestTooLongError
+		}
+
+		return 0, err
+	}
+
+	if int64(len(data)) > lb.left {
+		data = data[:lb.left]
+	}
+
+	n, err := lb.ReadCloser.Read(data)
+	lb.left -= int64(n)
+
+	return n, err
+}
+
+// Refuse request bodies longer than maxLen. Handlers still read with their
+// own, usually smaller, limit in readFromReq.
+func withBodyLimit(maxLen int64) middleware {
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(
+			func(rw http.ResponseWriter, req *http.Request) {
+				if req.ContentLength > maxLen {
+					respondWithError(rw, requestTooLongError)
+					return
+				}
+
+				req.Body = &limitedBody{ReadCloser: req.Body, left: maxLen}
+				next.ServeHTTP(rw, req)
+			})
+	}
+}
+
+// Let browsers on the origins call the API. Answers the preflight requests
+// itself, so they don't need routes.
+func withCORS(origins []string) middleware {
+	allowed := make(map[string]bool, len(origins))
+
+	for _, origin := range origins {
+		allowed[origin] = true
+	}
+
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(
+			func(rw http.ResponseWriter, req *http.Request) {
+				origin := req.Header.Get("Origin")
+
+				if origin == "" || (!allowed[origin] && !allowed["*"]) {
+					next.ServeHTTP(rw, req)
+					return
+				}
+
+				header := rw.Header()
+				header.Set("Access-Control-Allow-Origin", origin)
+				header.Add("Vary", "Origin")
+
+				if req.Method != http.MethodOptions ||
+					req.Header.Get("Access-Control-Request-Method") == "" {
+					next.ServeHTTP(rw, req)
+					return
+				}
+
+				header.Set("Access-Control-Allow-Methods", strings.Join(
+					[]string{http.MethodGet, http.MethodPost,
+						http.MethodPatch, http.MethodDelete}, ", "))
+				header.Set("Access-Control-Allow-Headers", "Authorization, "+
+					"Content-Type, Idempotency-Key, Last-Event-ID")
+				header.Set("Access-Control-Max-Age", "600")
+				rw.WriteHeader(http.StatusNoContent)
+			})
+	}
+}
+
+// Only let requests with the token of a logged in account through, see
+// accountID. Each request refreshes the login, see getUserByToken.
+var withAuth = authMiddleware(true)
+
+// Like withAuth, but without refreshing the login, for requests that only
+// check the token.
+var withAuthNoRefresh = authMiddleware(false)
+
+func authMiddleware(refresh bool) middleware {
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(rw http.ResponseWriter,
+			req *http.Request) {
+
+			token := req.Header.Get("Authorization")
+
+			if token == "" {
+				respondWithError(rw, noTokenError)
+				return
+			}
+
+			id, err := getUserByToken(token, refresh)
+
+			if err != nil {
+				respondWithError(rw, err)
+				return
+			}
+
+			ctx := context.WithValue(req.Context(), accountIDKey, id)
+			ctx = context.WithValue(ctx, tokenKey, token)
+			next.ServeHTTP(rw, req.WithContext(ctx))
+		})
+	}
+}
+
+// Like withAuth, but the account must also be an admin.
+func withAdmin(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {
+		token := req.Header.Get("Authorization")
+
+		if token == "" {
+			respondWithError(rw, noTokenError)
+			return
+		}
+
+		id, err := getAdminByToken(token)
+
+		if err != nil {
+			respondWithError(rw, err)
+			return
+		}
+
+		ctx := context.WithValue(req.Context(), accountIDKey, id)
+		ctx = context.WithValue(ctx, tokenKey, token)
+		next.ServeHTTP(rw, req.WithContext(ctx))
+	})
+}
+
+// The id of the account logged in, for routes behind withAuth or withAdmin.
+func accountID(req *http.Request) int {
+	id, _ := req.Context().Value(accountIDKey).(int)
+	return id
+}
+
+// The token the account logged in with, for routes behind withAuth or
+// withAdmin.
+func authToken(req *http.Request) string {
+	token, _ := req.Context().Value(tokenKey).(string)
+	return token
+}
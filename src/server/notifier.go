@@ -0,0 +1,63 @@
+package server
+
+import (
+	"fmt"
+	"os"
+	"sync"
+	"time"
+)
+
+// Delivers messages to account owners, such as password reset codes. The
+// bank has no email or phone numbers yet, so the implementations here only
+// keep the messages locally. A real one would send them.
+type Notifier interface {
+	Notify(accountID int, message string) error
+}
+
+// Writes the messages to the server log.
+type logNotifier struct{}
+
+func (logNotifier) Notify(accountID int, message string) error {
+	logger.Printf("Message for account %d: %s", accountID, message)
+	return nil
+}
+
+// Appends the messages to a file, one per line.
+type fileNotifier struct {
+	path string
+	mu   sync.Mutex
+}
+
+// Build a Notifier that appends to the file at path, creating it if needed.
+func NewFileNotifier(path string) Notifier {
+	return &fileNotifier{path: path}
+}
+
+func (fn *fileNotifier) Notify(accountID int, message string) error {
+	fn.mu.Lock()
+	defer fn.mu.Unlock()
+
+	file, err := os.OpenFile(fn.path, os.O_APPEND|os.O_CREATE|os.O_WRONLY,
+		0600)
+
+	if err != nil {
+		return err
+	}
+
+	_, err = fmt.Fprintf(file, "%s account=%d %s\n",
+		time.Now().UTC().Format(time.RFC3339), accountID, message)
+
+	if closeErr := file.Close(); err == nil {
+		err = closeErr
+	}
+
+	return err
+}
+
+// The notifier in use. Logs by default.
+var notifier Notifier = logNotifier{}
+
+// Use n to deliver messages to account owners. Call before Run.
+func SetNotifier(n Notifier) {
+	notifier = n
+}
@@ -0,0 +1,25 @@
+package server
+
+import (
+	// For go:embed
+	_ "embed"
+	"net/http"
+)
+
+// The OpenAPI 3 document of the API. Keep it in sync with routes() and the
+// JSON types, TestOpenAPIRoutes and the tests that validate responses
+// against it fail otherwise.
+//
+//go:embed openapi.json
+var openAPISpec []byte
+
+// Handler for GET at /openapi.json.
+func getOpenAPISpec(rw http.ResponseWriter, req *http.Request) {
+	setJSONEncoding(rw)
+
+	_, err := rw.Write(openAPISpec)
+
+	if err != nil {
+		logger.Printf("Could not write response: %v", err)
+	}
+}
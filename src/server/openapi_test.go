@@ -0,0 +1,625 @@
+package server
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"mime"
+	"net/http"
+	"net/http/httptest"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+)
+
+// The parts of an OpenAPI document that the tests check responses with.
+type openAPIDoc struct {
+	Paths      map[string]map[string]openAPIOperation `json:"paths"`
+	Components struct {
+		Schemas   map[string]*openAPISchema  `json:"schemas"`
+		Responses map[string]openAPIResponse `json:"responses"`
+	} `json:"components"`
+}
+
+type openAPIOperation struct {
+	Responses map[string]openAPIResponse `json:"responses"`
+}
+
+type openAPIResponse struct {
+	Ref     string `json:"$ref"`
+	Content map[string]struct {
+		Schema *openAPISchema `json:"schema"`
+	} `json:"content"`
+}
+
+type openAPISchema struct {
+	Ref        string                    `json:"$ref"`
+	Type       string                    `json:"type"`
+	Format     string                    `json:"format"`
+	Pattern    string                    `json:"pattern"`
+	Enum       []interface{}             `json:"enum"`
+	Required   []string                  `json:"required"`
+	Properties map[string]*openAPISchema `json:"properties"`
+	// Either a boolean or a schema
+	AdditionalProperties json.RawMessage  `json:"additionalProperties"`
+	Items                *openAPISchema   `json:"items"`
+	OneOf                []*openAPISchema `json:"oneOf"`
+}
+
+func loadOpenAPIDoc() (*openAPIDoc, error) {
+	var doc openAPIDoc
+
+	err := json.Unmarshal(openAPISpec, &doc)
+
+	if err != nil {
+		return nil, err
+	}
+
+	return &doc, nil
+}
+
+// The path of the document that path matches, and its operation for
+// method. Paths are matched like the router matches routes.
+func (doc *openAPIDoc) operation(method string,
+	path string) (string, *openAPIOperation, error) {
+
+	parts := splitPath(path)
+	var best *route
+
+	for pattern := range doc.Paths {
+		r := &route{pattern: pattern, segments: parsePattern(pattern)}
+
+		if r.match(parts) == nil {
+			continue
+		}
+
+		if best == nil || r.moreSpecific(best) {
+			best = r
+		}
+	}
+
+	if best == nil {
+		return "", nil, fmt.Errorf("no path for %s", path)
+	}
+
+	op, ok := doc.Paths[best.pattern][strings.ToLower(method)]
+
+	if !ok {
+		return "", nil, fmt.Errorf("no %s for %s", method, best.pattern)
+	}
+
+	return best.pattern, &op, nil
+}
+
+// Check that a response is documented for its status, and that its body
+// has the documented media type and schema.
+func (doc *openAPIDoc) validateResponse(method string, path string,
+	status int, header http.Header, body []byte) error {
+
+	pattern, op, err := doc.operation(method, path)
+
+	if err != nil {
+		return err
+	}
+
+	resp, ok := op.Responses[strconv.Itoa(status)]
+
+	if !ok {
+		resp, ok = op.Responses["default"]
+	}
+
+	if !ok {
+		return fmt.Errorf("%s %s: status %d not documented", method,
+			pattern, status)
+	}
+
+	if resp.Ref != "" {
+		resp = doc.Components.Responses[strings.TrimPrefix(resp.Ref,
+			"#/components/responses/")]
+	}
+
+	if len(resp.Content) == 0 {
+		return nil
+	}
+
+	mediaType, _, _ := mime.ParseMediaType(header.Get("Content-Type"))
+	content, ok := resp.Content[mediaType]
+
+	if !ok {
+		return fmt.Errorf("%s %s %d: media type %q not documented", method,
+			pattern, status, mediaType)
+	}
+
+	if mediaType != "application/json" {
+		return nil
+	}
+
+	decoder := json.NewDecoder(bytes.NewReader(body))
+	// Keeps numbers as they were written, to check money's decimals.
+	decoder.UseNumber()
+
+	var value interface{}
+
+	if err = decoder.Decode(&value); err != nil {
+		return fmt.Errorf("%s %s %d: %v", method, pattern, status, err)
+	}
+
+	err = doc.validate(content.Schema, value, "body")
+
+	if err != nil {
+		return fmt.Errorf("%s %s %d: %v", method, pattern, status, err)
+	}
+
+	return nil
+}
+
+// Check value, decoded with UseNumber, against schema. where is the place
+// of value in the body, for the error.
+func (doc *openAPIDoc) validate(schema *openAPISchema, value interface{},
+	where string) error {
+
+	if schema.Ref != "" {
+		name := strings.TrimPrefix(schema.Ref, "#/components/schemas/")
+		schema = doc.Components.Schemas[name]
+
+		if schema == nil {
+			return fmt.Errorf("%s: no schema %s", where, name)
+		}
+	}
+
+	if len(schema.OneOf) > 0 {
+		matches := 0
+
+		for _, option := range schema.OneOf {
+			if doc.validate(option, value, where) == nil {
+				matches++
+			}
+		}
+
+		if matches != 1 {
+			return fmt.Errorf("%s: matches %d schemas of oneOf", where,
+				matches)
+		}
+
+		return nil
+	}
+
+	var err error
+
+	switch schema.Type {
+	case "object":
+		err = doc.validateObject(schema, value, where)
+	case "array":
+		items, ok := value.([]interface{})
+
+		if !ok {
+			return fmt.Errorf("%s: not an array", where)
+		}
+
+		for i, item := range items {
+			err = doc.validate(schema.Items, item, fmt.Sprintf("%s[%d]",
+				where, i))
+
+			if err != nil {
+				return err
+			}
+		}
+	case "string":
+		err = validateString(schema, value, where)
+	case "integer":
+		num, ok := value.(json.Number)
+
+		if !ok {
+			return fmt.Errorf("%s: not an integer", where)
+		}
+
+		if _, err = num.Int64(); err != nil {
+			return fmt.Errorf("%s: not an integer", where)
+		}
+	case "number":
+		num, ok := value.(json.Number)
+
+		if !ok {
+			return fmt.Errorf("%s: not a number", where)
+		}
+
+		if schema.Format == "money" && !moneyRegex.MatchString(num.String()) {
+			return fmt.Errorf("%s: %s doesn't have two decimals", where, num)
+		}
+	case "boolean":
+		if _, ok := value.(bool); !ok {
+			return fmt.Errorf("%s: not a boolean", where)
+		}
+	}
+
+	if err != nil {
+		return err
+	}
+
+	if len(schema.Enum) > 0 {
+		for _, allowed := range schema.Enum {
+			if fmt.Sprint(allowed) == fmt.Sprint(value) {
+				return nil
+			}
+		}
+
+		return fmt.Errorf("%s: %v not in enum", where, value)
+	}
+
+	return nil
+}
+
+func (doc *openAPIDoc) validateObject(schema *openAPISchema,
+	value interface{}, where string) error {
+
+	object, ok := value.(map[string]interface{})
+
+	if !ok {
+		return fmt.Errorf("%s: not an object", where)
+	}
+
+	for _, name := range schema.Required {
+		if _, ok := object[name]; !ok {
+			return fmt.Errorf("%s: missing %s", where, name)
+		}
+	}
+
+	var additional *openAPISchema
+
+	if len(schema.AdditionalProperties) > 0 &&
+		schema.AdditionalProperties[0] == '{' {
+
+		additional = &openAPISchema{}
+
+		err := json.Unmarshal(schema.AdditionalProperties, additional)
+
+		if err != nil {
+			return err
+		}
+	}
+
+	for name, propValue := range object {
+		propSchema, ok := schema.Properties[name]
+
+		if !ok && additional != nil {
+			propSchema = additional
+		} else if !ok {
+			if string(schema.AdditionalProperties) == "false" {
+				return fmt.Errorf("%s: %s not documented", where, name)
+			}
+
+			continue
+		}
+
+		err := doc.validate(propSchema, propValue, where+"."+name)
+
+		if err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+func validateString(schema *openAPISchema, value interface{},
+	where string) error {
+
+	str, ok := value.(string)
+
+	if !ok {
+		return fmt.Errorf("%s: not a string", where)
+	}
+
+	if schema.Pattern != "" && !regexp.MustCompile(schema.Pattern).
+		MatchString(str) {
+
+		return fmt.Errorf("%s: %q doesn't match %s", where, str,
+			schema.Pattern)
+	}
+
+	var err error
+
+	switch schema.Format {
+	case "date-time":
+		_, err = time.Parse(time.RFC3339, str)
+	case "date":
+		_, err = time.Parse("2006-01-02", str)
+	}
+
+	if err != nil {
+		return fmt.Errorf("%s: %q is not a %s", where, str, schema.Format)
+	}
+
+	return nil
+}
+
+// Every route is documented, and everything documented is routed.
+func TestOpenAPIRoutes(t *testing.T) {
+	doc, err := loadOpenAPIDoc()
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	routed := make(map[string]bool)
+
+	for _, r := range routes().routes {
+		// The document has the parameters without their regexes.
+		segments := make([]string, len(r.segments))
+
+		for i, segment := range r.segments {
+			segments[i] = segment.literal
+
+			if segment.param != "" {
+				segments[i] = "{" + segment.param + "}"
+			}
+		}
+
+		path := "/" + strings.Join(segments, "/")
+		method := strings.ToLower(r.method)
+		routed[method+" "+path] = true
+
+		if _, ok := doc.Paths[path][method]; !ok {
+			t.Errorf("%s %s not documented", r.method, path)
+		}
+	}
+
+	var documented []string
+
+	for path, ops := range doc.Paths {
+		for method := range ops {
+			documented = append(documented, method+" "+path)
+		}
+	}
+
+	sort.Strings(documented)
+
+	for _, op := range documented {
+		if !routed[op] {
+			t.Errorf("%s documented but not routed", op)
+		}
+	}
+}
+
+// Every reference in the document points to something in it.
+func TestOpenAPIRefs(t *testing.T) {
+	var doc map[string]interface{}
+
+	if err := json.Unmarshal(openAPISpec, &doc); err != nil {
+		t.Fatal(err)
+	}
+
+	var check func(value interface{})
+
+	check = func(value interface{}) {
+		switch value := value.(type) {
+		case map[string]interface{}:
+			if ref, ok := value["$ref"].(string); ok {
+				var target interface{} = doc
+
+				for _, part := range strings.Split(
+					strings.TrimPrefix(ref, "#/"), "/") {
+
+					object, _ := target.(map[string]interface{})
+					target = object[part]
+				}
+
+				if target == nil {
+					t.Error("bad ref", ref)
+				}
+			}
+
+			for _, v := range value {
+				check(v)
+			}
+		case []interface{}:
+			for _, v := range value {
+				check(v)
+			}
+		}
+	}
+
+	check(doc)
+}
+
+// The JSON of the types the handlers respond with, with every field set,
+// matches the schemas.
+func TestOpenAPISchemas(t *testing.T) {
+	doc, err := loadOpenAPIDoc()
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	now := time.Now()
+	one := 1
+	acc := account{ID: 1, Name: "Ana", CPF: "123.456-78", Balance: -1050,
+		CreatedAt: now, Timezone: defaultTimezone, Status: "active"}
+	transf := transfer{ID: 1, OriginID: 1, DestinationID: 2, Amount: 1000,
+		CreatedAt: now, BatchID: &one, Description: "rent",
+		Reference: "inv-1", Metadata: transferMetadata{"a": "b"}, Fee: 50,
+		FeeFor: &one}
+	pending := pendingTransfer{ID: 1, OriginID: 1, DestinationID: 2,
+		Amount: 1000, Status: "approved", Rule: "velocity", CreatedAt: now,
+		TransferID: &one, Description: "rent", Reference: "inv-1",
+		Metadata: transferMetadata{"a": "b"}}
+	batch := transferBatch{ID: 1, OriginID: 1, Atomic: true,
+		Status: "partial", Total: 2000, Error: "insufficient funds",
+		CreatedAt: now, Split: true, Items: []batchItem{{Index: 0,
+			DestinationID: 2, Amount: 1000, Status: "completed",
+			Error: "x", TransferID: &one, PendingID: &one}}}
+	payReq := paymentRequest{ID: 1, AccountID: 1, Name: "Ana", Amount: 1000,
+		Description: "lunch", MultiUse: true, Status: "open", Payments: 1,
+		ExpiresAt: now, CreatedAt: now, Payload: "PEDROBANK:1:abc"}
+	esc := escrow{ID: 1, PayerID: 1, PayeeID: 2, Amount: 1000,
+		Description: "car", Status: "released", Deadline: now,
+		DefaultAction: "refund", PayerDecision: "confirm",
+		PayeeDecision: "cancel", FundingTransferID: 1,
+		ResolutionTransferID: &one, CreatedAt: now, ResolvedAt: &now}
+
+	var values = []struct {
+		schema string
+		value  interface{}
+	}{
+		{"Account", &acc},
+		{"AccountPage", &accountPage{Accounts: []account{acc},
+			NextCursor: "abc"}},
+		{"Balance", &accountBalanceResponse{Balance: 100, Status: "frozen",
+			OverdraftLimit: 1000, OverdraftUsed: 0, Available: 1100}},
+		{"Statement", &statement{AccountID: 1, From: now, To: now,
+			OpeningBalance: 0, ClosingBalance: 1000,
+			Entries: []statementEntry{{TransferID: 1, Date: now,
+				Type: "credit", Amount: 1000, CounterpartyID: 2,
+				Description: "rent", Reference: "inv-1", Balance: 1000}}}},
+		{"AccountClosure", &accountClosure{Account: acc,
+			PayoutTransferID: &one}},
+		{"Transfer", &transf},
+		{"TransferPage", &transferPage{Transfers: []transfer{transf},
+			NextCursor: "abc"}},
+		{"PendingTransfer", &pending},
+		{"Quote", &transferQuote{DestinationID: 2, Amount: 1000, Fee: 50,
+			Total: 1050}},
+		{"Batch", &batch},
+		{"Limits", &transferLimits{PerTransfer: 1, Daily: 2, Monthly: 3,
+			Nighttime: 4}},
+		{"TransferKey", &transferKey{Key: "a@b.com", Type: "email",
+			CreatedAt: now}},
+		{"KeyLookup", &keyLookupResponse{Key: "a@b.com", Type: "email",
+			Name: "Ana", CPF: "***.456-**"}},
+		{"PaymentRequest", &payReq},
+		{"PaymentRequestPage", &paymentRequestPage{
+			PaymentRequests: []paymentRequest{payReq}, NextCursor: "abc"}},
+		{"Escrow", &esc},
+		{"EscrowPage", &escrowPage{Escrows: []escrow{esc},
+			NextCursor: "abc"}},
+		{"Webhook", &webhook{ID: 1, URL: "https://example.com/hook",
+			Events: webhookEventList{"transfer.received"}, CreatedAt: now,
+			Secret: "abc"}},
+		{"WebhookDeliveryPage", &webhookDeliveryPage{
+			Deliveries: []webhookDelivery{{ID: 1, EventID: 1,
+				EventType: "account.frozen", Status: "pending", Attempts: 1,
+				NextAttemptAt: &now, LastAttemptAt: &now, LastStatus: &one,
+				LastError: "webhook responded 500", DeliveredAt: &now,
+				CreatedAt: now}},
+			NextCursor: "abc"}},
+		{"InterestRun", &interestRun{Date: "2021-01-31", Accrued: 1,
+			Pending: 2, Posted: 3, Charged: 4}},
+		{"StatusChange", &accountStatusChange{AccountID: 1,
+			Status: "frozen", Reason: "fraud", ChangedBy: 2,
+			CreatedAt: now}},
+		{"EventConsumer", &eventConsumerStatus{Name: "file", LastEventID: 1,
+			Lag: 2, UpdatedAt: now}},
+		{"Error", newLimitExceededError("daily", 1050).envelope("req-1")},
+	}
+
+	for _, value := range values {
+		data, err := json.Marshal(value.value)
+
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		decoder := json.NewDecoder(bytes.NewReader(data))
+		decoder.UseNumber()
+
+		var decoded interface{}
+
+		if err = decoder.Decode(&decoded); err != nil {
+			t.Fatal(err)
+		}
+
+		err = doc.validate(&openAPISchema{
+			Ref: "#/components/schemas/" + value.schema}, decoded,
+			value.schema)
+
+		if err != nil {
+			t.Error(err)
+		}
+	}
+
+	// And the checks do fail
+	var bad = []struct {
+		schema string
+		json   string
+	}{
+		{"Limits", `{"per_transfer":1.5,"daily":2.00,"monthly":3.00,` +
+			`"nighttime":4.00}`},
+		{"Limits", `{"daily":2.00,"monthly":3.00,"nighttime":4.00}`},
+		{"TransferKey", `{"key":"k","type":"email","created_at":"now"}`},
+		{"TransferKey", `{"key":"k","type":"other",` +
+			`"created_at":"2021-01-31T00:00:00Z"}`},
+		{"AccountID", `{"id":1,"extra":2}`},
+		{"AccountID", `{"id":"1"}`},
+	}
+
+	for _, value := range bad {
+		decoder := json.NewDecoder(strings.NewReader(value.json))
+		decoder.UseNumber()
+
+		var decoded interface{}
+
+		if err = decoder.Decode(&decoded); err != nil {
+			t.Fatal(err)
+		}
+
+		err = doc.validate(&openAPISchema{
+			Ref: "#/components/schemas/" + value.schema}, decoded,
+			value.schema)
+
+		if err == nil {
+			t.Error("should fail", value.json)
+		}
+	}
+}
+
+// The responses that don't need the DB match the document.
+func TestOpenAPIResponses(t *testing.T) {
+	doc, err := loadOpenAPIDoc()
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	rt := routes()
+
+	var values = []struct {
+		method string
+		path   string
+		status int
+	}{
+		{http.MethodGet, "/openapi.json", http.StatusOK},
+		{http.MethodGet, "/ping", http.StatusOK},
+		{http.MethodGet, "/transfers", http.StatusBadRequest},
+		{http.MethodGet, "/accounts/99999999999/balance",
+			http.StatusBadRequest},
+		{http.MethodGet, "/accounts?limit=0", http.StatusBadRequest},
+	}
+
+	for _, value := range values {
+		rec := httptest.NewRecorder()
+		rt.ServeHTTP(rec, httptest.NewRequest(value.method, value.path, nil))
+
+		if rec.Code != value.status {
+			t.Error(value.method, value.path, rec.Code)
+		}
+
+		err = doc.validateResponse(value.method,
+			strings.Split(value.path, "?")[0], rec.Code, rec.Header(),
+			rec.Body.Bytes())
+
+		if err != nil {
+			t.Error(err)
+		}
+	}
+
+	// Paths that aren't routed aren't documented either
+	err = doc.validateResponse(http.MethodGet, "/nope", http.StatusNotFound,
+		http.Header{}, nil)
+
+	if err == nil {
+		t.Error("should fail")
+	}
+}
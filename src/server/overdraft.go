@@ -0,0 +1,217 @@
+package server
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"time"
+)
+
+// JSON that an admin sends to change an account's overdraft limit.
+type overdraftUpdateRequest struct {
+	Limit *money `json:"limit"`
+}
+
+// Interest for one day on a negative balance, in millionths of a cent. Uses a
+// 365 day year, like dailyInterestMicros.
+func dailyOverdraftMicros(balance money, overdraftBps int) int64 {
+	if balance >= 0 {
+		return 0
+	}
+
+	return -int64(balance) * int64(overdraftBps) * 100 / 365
+}
+
+// Charge the account with id the overdraft interest for date, if it ended
+// the day below zero. Unlike the interest it earns, it's charged every day.
+// Returns true if it was charged now, false if the day hasn't ended yet in
+// the account's time zone, the balance wasn't negative, or it was already
+// charged.
+func chargeOverdraftInterest(ctx context.Context, id int, overdraftBps int,
+	date time.Time) (bool, error) {
+
+	dateStr := date.Format("2006-01-02")
+
+	tx, err := DB.BeginTx(ctx, &defaultTxOptions)
+
+	if err != nil {
+		logger.Print("Error starting tx to charge overdraft interest")
+		return false, err
+	}
+
+	loc, err := accountLocation(tx, id)
+
+	if err != nil {
+		rollbackTx(tx)
+		return false, err
+	}
+
+	eod := endOfDay(date, loc)
+
+	if eod.After(time.Now()) {
+		rollbackTx(tx)
+		return false, nil
+	}
+
+	balance, err := balanceAt(tx, id, eod.Add(-time.Microsecond))
+
+	if err != nil || balance >= 0 {
+		rollbackTx(tx)
+		return false, err
+	}
+
+	var carry int64
+
+	err = tx.QueryRow(
+		`select carry_micros from overdraft_charges
+		where account_id = $1 and date < $2::date
+		order by date desc limit 1`, id, dateStr).Scan(&carry)
+
+	if err != nil && err != sql.ErrNoRows {
+		rollbackTx(tx)
+		return false, err
+	}
+
+	micros := dailyOverdraftMicros(balance, overdraftBps)
+	amount, carry := splitMicros(micros + carry)
+
+	// Claim the date first, so a concurrent run can't charge it too.
+	result, err := tx.Exec(
+		`insert into overdraft_charges
+		(account_id, date, balance, overdraft_bps, micros, carry_micros, amount)
+		values ($1, $2::date, $3, $4, $5, $6, $7)
+		on conflict (account_id, date) do nothing`,
+		id, dateStr, balance, overdraftBps, micros, carry, amount)
+
+	if err != nil {
+		rollbackTx(tx)
+		return false, err
+	}
+
+	if inserted, err := result.RowsAffected(); err != nil || inserted == 0 {
+		rollbackTx(tx)
+		return false, err
+	}
+
+	if amount > 0 {
+		transferID, err := systemTransfer(tx, "house", id, amount,
+			fmt.Sprintf("overdraft interest for %s", dateStr), false)
+
+		if err == nil {
+			_, err = tx.Exec(
+				`update overdraft_charges set transfer_id = $1
+				where account_id = $2 and date = $3::date`,
+				transferID, id, dateStr)
+		}
+
+		if err != nil {
+			rollbackTx(tx)
+			return false, err
+		}
+	}
+
+	err = tx.Commit()
+
+	if err != nil {
+		logger.Print("Error commiting tx")
+		return false, err
+	}
+
+	return true, nil
+}
+
+// Handler for POST at /admin/accounts/<id>/overdraft. Only admins can change
+// an account's overdraft limit. It can't be set below what the account
+// already owes. Responds with the account's balance.
+func updateOverdraftLimit(rw http.ResponseWriter, req *http.Request) {
+	adminID := accountID(req)
+	id, err := pathID(req, "id")
+
+	if err != nil {
+		respondWithError(rw, err)
+		return
+	}
+
+	data, err := readFromReq(req, 1024)
+
+	if err != nil {
+		respondWithError(rw, err)
+		return
+	}
+
+	var updateReq overdraftUpdateRequest
+
+	err = json.Unmarshal(data, &updateReq)
+
+	var publicError *publicJSONError
+	if errors.As(err, &publicError) {
+		respondWithError(rw, publicError)
+		return
+	} else if err != nil || updateReq.Limit == nil {
+		respondWithError(rw, cantParseJSONError)
+		return
+	}
+
+	if *updateReq.Limit < 0 {
+		respondWithError(rw, invalidAmountError)
+		return
+	}
+
+	tx, err := DB.BeginTx(req.Context(), &defaultTxOptions)
+
+	if err != nil {
+		logger.Print("Error starting tx to update overdraft limit")
+		respondWithError(rw, err)
+		return
+	}
+
+	var balanceResp accountBalanceResponse
+
+	err = tx.QueryRow(
+		`select balance, status from accounts where id = $1 for update`,
+		id).Scan(&balanceResp.Balance, &balanceResp.Status)
+
+	if err == sql.ErrNoRows {
+		rollbackTx(tx)
+		respondWithError(rw, noAccountError)
+		return
+	} else if err != nil {
+		rollbackTx(tx)
+		respondWithError(rw, err)
+		return
+	}
+
+	if int64(balanceResp.Balance)+int64(*updateReq.Limit) < 0 {
+		rollbackTx(tx)
+		respondWithError(rw, overdraftInUseError)
+		return
+	}
+
+	_, err = tx.Exec(`update accounts set overdraft_limit = $1 where id = $2`,
+		*updateReq.Limit, id)
+
+	if err != nil {
+		rollbackTx(tx)
+		respondWithError(rw, err)
+		return
+	}
+
+	err = tx.Commit()
+
+	if err != nil {
+		logger.Print("Error commiting tx")
+		respondWithError(rw, err)
+		return
+	}
+
+	logger.Printf("Overdraft limit for account %d set to %s by %d", id,
+		*updateReq.Limit, adminID)
+
+	balanceResp.OverdraftLimit = *updateReq.Limit
+	balanceResp.fillOverdraft()
+
+	respondWithJSON(rw, http.StatusOK, &balanceResp)
+}
@@ -0,0 +1,65 @@
+package server
+
+import (
+	"encoding/json"
+	"testing"
+)
+
+func TestNegativeMoney(t *testing.T) {
+	var values = []struct {
+		json string
+		num  money
+	}{
+		{"-0.50", -50},
+		{"-12.34", -1234},
+		{"-21474836.48", -2147483648},
+	}
+
+	for _, value := range values {
+		var num money
+
+		if err := json.Unmarshal([]byte(value.json), &num); err != nil ||
+			num != value.num {
+			t.Error(value.json, num, err)
+		}
+
+		if data, _ := json.Marshal(value.num); string(data) != value.json {
+			t.Error(value.num, string(data))
+		}
+	}
+
+	var num money
+
+	if json.Unmarshal([]byte("--1.00"), &num) == nil {
+		t.Fail()
+	}
+}
+
+func TestOverdraftBalance(t *testing.T) {
+	balanceResp := accountBalanceResponse{Balance: -30000,
+		OverdraftLimit: 50000}
+	balanceResp.fillOverdraft()
+
+	if balanceResp.OverdraftUsed != 30000 || balanceResp.Available != 20000 {
+		t.Error(balanceResp)
+	}
+
+	balanceResp = accountBalanceResponse{Balance: 2147483647,
+		OverdraftLimit: 100}
+	balanceResp.fillOverdraft()
+
+	if balanceResp.OverdraftUsed != 0 || balanceResp.Available != 2147483647 {
+		t.Error(balanceResp)
+	}
+}
+
+func TestDailyOverdraftInterest(t *testing.T) {
+	// 150% a year on -1000.00 is 4.1095... a day
+	if micros := dailyOverdraftMicros(-100000, 15000); micros != 410958904 {
+		t.Error(micros)
+	}
+
+	if micros := dailyOverdraftMicros(100000, 15000); micros != 0 {
+		t.Error(micros)
+	}
+}
@@ -0,0 +1,281 @@
+package server
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Builds a where clause with numbered placeholders, for queries whose
+// conditions depend on the request.
+type whereBuilder struct {
+	conds []string
+	args  []interface{}
+}
+
+// Add a condition. Each %[1]s, %[2]s, ... in cond is replaced by the
+// placeholder for the corresponding arg.
+func (where *whereBuilder) add(cond string, args ...interface{}) {
+	placeholders := make([]interface{}, len(args))
+
+	for i, arg := range args {
+		where.args = append(where.args, arg)
+		placeholders[i] = fmt.Sprintf("$%d", len(where.args))
+	}
+
+	where.conds = append(where.conds, fmt.Sprintf(cond, placeholders...))
+}
+
+func (where *whereBuilder) String() string {
+	if len(where.conds) == 0 {
+		return "true"
+	}
+
+	return strings.Join(where.conds, " and ")
+}
+
+const defaultPageLimit = 50
+const maxPageLimit = 200
+
+// Where the previous page ended. Sent to the client as an opaque string. The
+// sort and order are kept so that a cursor isn't used with a different sort,
+// which would skip or repeat rows.
+type pageCursor struct {
+	Sort  string `json:"s"`
+	Desc  bool   `json:"d"`
+	Value string `json:"v"`
+	ID    int    `json:"i"`
+}
+
+func (cursor *pageCursor) encode() string {
+	// Can't fail, it's all strings, bools and ints.
+	jsonBytes, _ := json.Marshal(cursor)
+	return base64.RawURLEncoding.EncodeToString(jsonBytes)
+}
+
+// Decode a cursor for the sort column sort, of SQL type sortType, in the
+// order desc. The value is checked against the type here, or the cast in the
+// query would fail with a DB error.
+func decodeCursor(encoded string, sort string, sortType string,
+	desc bool) (*pageCursor, error) {
+
+	var cursor pageCursor
+
+	jsonBytes, err := base64.RawURLEncoding.DecodeString(encoded)
+
+	if err != nil {
+		return nil, badCursorError
+	}
+
+	err = json.Unmarshal(jsonBytes, &cursor)
+
+	if err != nil || cursor.Sort != sort || cursor.Desc != desc {
+		return nil, badCursorError
+	}
+
+	switch {
+	case sort == "id":
+		// Only the id is used
+	case sortType == "integer":
+		_, err = strconv.ParseInt(cursor.Value, 10, 32)
+	case sortType == "timestamp":
+		_, err = time.Parse(cursorTimeLayout, cursor.Value)
+	}
+
+	if err != nil {
+		return nil, badCursorError
+	}
+
+	return &cursor, nil
+}
+
+// Keyset pagination parameters from the query: limit, cursor, sort and order.
+// The rows are always sorted by id after the sort column, so that the order is
+// total and the cursor can point between two rows with the same sort value.
+type pageParams struct {
+	// 0 for every row, in a single page
+	limit int
+	// Column to sort by
+	sort string
+	// SQL type of the sort column, to cast the cursor value
+	sortType string
+	desc     bool
+	cursor   *pageCursor
+}
+
+// Parse the pagination parameters of req. sortTypes maps the columns the
+// client can sort by to their SQL types.
+func parsePageParams(req *http.Request, sortTypes map[string]string,
+	defaultSort string) (*pageParams, error) {
+
+	query := req.URL.Query()
+	params := pageParams{limit: defaultPageLimit, sort: defaultSort}
+
+	if limit := query.Get("limit"); limit != "" {
+		val, err := strconv.Atoi(limit)
+
+		if err != nil || val <= 0 || val > maxPageLimit {
+			return nil, newBadParamError("limit")
+		}
+
+		params.limit = val
+	}
+
+	if sort := query.Get("sort"); sort != "" {
+		if _, ok := sortTypes[sort]; !ok {
+			return nil, newBadParamError("sort")
+		}
+
+		params.sort = sort
+	}
+
+	params.sortType = sortTypes[params.sort]
+
+	switch query.Get("order") {
+	case "", "asc":
+	case "desc":
+		params.desc = true
+	default:
+		return nil, newBadParamError("order")
+	}
+
+	if encoded := query.Get("cursor"); encoded != "" {
+		cursor, err := decodeCursor(encoded, params.sort, params.sortType,
+			params.desc)
+
+		if err != nil {
+			return nil, err
+		}
+
+		params.cursor = cursor
+	}
+
+	return &params, nil
+}
+
+// Add the condition to start after the cursor, if any.
+func (params *pageParams) addCursor(where *whereBuilder) {
+	if params.cursor == nil {
+		return
+	}
+
+	op := ">"
+
+	if params.desc {
+		op = "<"
+	}
+
+	if params.sort == "id" {
+		where.add("id "+op+" %[1]s", params.cursor.ID)
+	} else {
+		where.add(fmt.Sprintf("(%s, id) %s (%%[1]s::%s, %%[2]s)",
+			params.sort, op, params.sortType),
+			params.cursor.Value, params.cursor.ID)
+	}
+}
+
+// The order by and limit clauses. One more row than the limit is fetched, to
+// know if there is a next page.
+func (params *pageParams) orderAndLimit() string {
+	order := "asc"
+
+	if params.desc {
+		order = "desc"
+	}
+
+	limit := ""
+
+	if params.limit > 0 {
+		limit = fmt.Sprintf(" limit %d", params.limit+1)
+	}
+
+	if params.sort == "id" {
+		return fmt.Sprintf("order by id %s%s", order, limit)
+	}
+
+	return fmt.Sprintf("order by %s %s, id %s%s", params.sort, order, order,
+		limit)
+}
+
+// Whether the client asked for a page, with limit or cursor. The lists that
+// existed before pagination respond with every row as a bare array
+// otherwise, so that older clients keep working.
+func wantsPage(req *http.Request) bool {
+	query := req.URL.Query()
+	return query.Get("limit") != "" || query.Get("cursor") != ""
+}
+
+// The cursor for the page after the one ending with the row with lastID and
+// lastValue in the sort column.
+func (params *pageParams) nextCursor(lastID int, lastValue string) string {
+	cursor := pageCursor{
+		Sort:  params.sort,
+		Desc:  params.desc,
+		Value: lastValue,
+		ID:    lastID,
+	}
+
+	return cursor.encode()
+}
+
+// Format a timestamp for a cursor value. The DB keeps microseconds, and
+// ignores the time zone when casting to a timestamp without one, so we use
+// the UTC wall clock.
+func cursorTime(t time.Time) string {
+	return t.UTC().Format(cursorTimeLayout)
+}
+
+const cursorTimeLayout = "2006-01-02T15:04:05.999999"
+
+// Parse a time from the query. Either RFC 3339 or just a date, in UTC. If
+// endOfDay is true, a date means the end of that day, so that a "to" date
+// includes the whole day.
+func parseTimeParam(req *http.Request, param string,
+	endOfDay bool) (*time.Time, error) {
+
+	value := req.URL.Query().Get(param)
+
+	if value == "" {
+		return nil, nil
+	}
+
+	t, err := time.Parse(time.RFC3339, value)
+
+	if err == nil {
+		t = t.UTC()
+		return &t, nil
+	}
+
+	t, err = time.Parse("2006-01-02", value)
+
+	if err != nil {
+		return nil, newBadParamError(param)
+	}
+
+	if endOfDay {
+		t = t.AddDate(0, 0, 1).Add(-time.Microsecond)
+	}
+
+	return &t, nil
+}
+
+// Parse an amount from the query, written as in JSON, e.g. 34.72.
+func parseMoneyParam(req *http.Request, param string) (*money, error) {
+	value := req.URL.Query().Get(param)
+
+	if value == "" {
+		return nil, nil
+	}
+
+	var amount money
+
+	if amount.UnmarshalJSON([]byte(value)) != nil {
+		return nil, newBadParamError(param)
+	}
+
+	return &amount, nil
+}
@@ -0,0 +1,139 @@
+package server
+
+import (
+	"net/http"
+	"testing"
+	"time"
+)
+
+func TestWhereBuilder(t *testing.T) {
+	var where whereBuilder
+
+	if where.String() != "true" {
+		t.Error(where.String())
+	}
+
+	where.add("(origin_id = %[1]s or destination_id = %[1]s)", 1)
+	where.add("(amount, id) > (%[1]s::integer, %[2]s)", "200", 4)
+
+	expected := "(origin_id = $1 or destination_id = $1) and " +
+		"(amount, id) > ($2::integer, $3)"
+
+	if where.String() != expected || len(where.args) != 3 {
+		t.Error(where.String(), where.args)
+	}
+}
+
+func TestPageParams(t *testing.T) {
+	req, _ := http.NewRequest(http.MethodGet,
+		"/transfers?limit=10&sort=amount&order=desc", nil)
+
+	params, err := parsePageParams(req, transferSortTypes, "id")
+
+	if err != nil || params.limit != 10 || params.sort != "amount" ||
+		params.sortType != "integer" || !params.desc ||
+		params.cursor != nil {
+		t.Log(err)
+		t.FailNow()
+	}
+
+	// The next page cursor round trips
+	req, _ = http.NewRequest(http.MethodGet,
+		"/transfers?limit=10&sort=amount&order=desc&cursor="+
+			params.nextCursor(42, "1234"), nil)
+
+	params, err = parsePageParams(req, transferSortTypes, "id")
+
+	if err != nil || params.cursor == nil || params.cursor.ID != 42 ||
+		params.cursor.Value != "1234" {
+		t.Log(err)
+		t.FailNow()
+	}
+
+	var where whereBuilder
+	params.addCursor(&where)
+
+	if where.String() != "(amount, id) < ($1::integer, $2)" {
+		t.Error(where.String())
+	}
+
+	if params.orderAndLimit() != "order by amount desc, id desc limit 11" {
+		t.Error(params.orderAndLimit())
+	}
+
+	// A cursor can't be used with a different sort
+	req, _ = http.NewRequest(http.MethodGet,
+		"/transfers?sort=amount&cursor="+params.nextCursor(42, "1234"), nil)
+
+	_, err = parsePageParams(req, transferSortTypes, "id")
+
+	if err != badCursorError {
+		t.Error(err)
+	}
+
+	// Nor with a value the sort column can't hold
+	var badCursors = []struct {
+		query  string
+		cursor pageCursor
+	}{
+		{"sort=amount", pageCursor{Sort: "amount", Value: "1.5", ID: 1}},
+		{"sort=amount", pageCursor{Sort: "amount", Value: "9999999999"}},
+		{"sort=created_at", pageCursor{Sort: "created_at", Value: "today"}},
+	}
+
+	for _, badCursor := range badCursors {
+		req, _ = http.NewRequest(http.MethodGet, "/transfers?"+
+			badCursor.query+"&cursor="+badCursor.cursor.encode(), nil)
+
+		if _, err = parsePageParams(req, transferSortTypes,
+			"id"); err != badCursorError {
+
+			t.Error(badCursor.cursor, err)
+		}
+	}
+
+	req, _ = http.NewRequest(http.MethodGet, "/transfers?cursor=what", nil)
+
+	if _, err = parsePageParams(req, transferSortTypes,
+		"id"); err != badCursorError {
+
+		t.Error(err)
+	}
+
+	// A timestamp cursor is fine
+	cursor := pageCursor{Sort: "created_at",
+		Value: cursorTime(time.Now()), ID: 3}
+	req, _ = http.NewRequest(http.MethodGet,
+		"/transfers?sort=created_at&cursor="+cursor.encode(), nil)
+
+	if _, err = parsePageParams(req, transferSortTypes, "id"); err != nil {
+		t.Error(err)
+	}
+}
+
+func TestWantsPage(t *testing.T) {
+	var values = []struct {
+		query string
+		page  bool
+	}{
+		{"", false},
+		{"?sort=amount&direction=sent", false},
+		{"?limit=10", true},
+		{"?cursor=abc", true},
+	}
+
+	for _, value := range values {
+		req, _ := http.NewRequest(http.MethodGet, "/transfers"+value.query,
+			nil)
+
+		if wantsPage(req) != value.page {
+			t.Error(value.query)
+		}
+	}
+
+	params := pageParams{sort: "amount", desc: true}
+
+	if params.orderAndLimit() != "order by amount desc, id desc" {
+		t.Error(params.orderAndLimit())
+	}
+}
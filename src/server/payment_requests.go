@@ -0,0 +1,617 @@
+package server
+
+import (
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+	"unicode/utf8"
+)
+
+// JSON that the client sends to create a payment request.
+type paymentRequestCreateRequest struct {
+	Amount      money  `json:"amount"`
+	Description string `json:"description,omitempty"`
+	// Defaults to defaultPaymentRequestExpiry from now
+	ExpiresAt *time.Time `json:"expires_at,omitempty"`
+	MultiUse  bool       `json:"multi_use"`
+}
+
+// Payment request entity. Fields exported for JSON marshalling.
+type paymentRequest struct {
+	ID int `json:"id"`
+	// The account that gets paid, and its name
+	AccountID   int       `json:"account_id"`
+	Name        string    `json:"name"`
+	Amount      money     `json:"amount"`
+	Description string    `json:"description,omitempty"`
+	MultiUse    bool      `json:"multi_use"`
+	Status      string    `json:"status"`
+	Payments    int       `json:"payments"`
+	ExpiresAt   time.Time `json:"expires_at"`
+	CreatedAt   time.Time `json:"created_at"`
+	Payload     string    `json:"payload"`
+}
+
+// JSON that the payer sends to pay a request.
+type paymentRequestPayRequest struct {
+	Payload string `json:"payload"`
+}
+
+type paymentRequestPage struct {
+	PaymentRequests []paymentRequest `json:"payment_requests"`
+	NextCursor      string           `json:"next_cursor,omitempty"`
+}
+
+const defaultPaymentRequestExpiry = 24 * time.Hour
+const maxPaymentRequestExpiry = 90 * 24 * time.Hour
+
+// The payload follows the EMV QR code layout that PIX uses: a list of
+// fields, each a two digit id, a two digit length and the value, ending with
+// a CRC16 of everything before it.
+const (
+	payloadFormatID   = "00"
+	payloadInitID     = "01"
+	payloadAccountID  = "26"
+	payloadCategoryID = "52"
+	payloadCurrencyID = "53"
+	payloadAmountID   = "54"
+	payloadCountryID  = "58"
+	payloadNameID     = "59"
+	payloadCRCID      = "63"
+
+	// Sub-fields of payloadAccountID
+	payloadGUIID     = "00"
+	payloadRequestID = "01"
+
+	payloadGUI = "br.com.pedrobank"
+	// ISO 4217 code for BRL
+	payloadCurrency = "986"
+	// EMV limit for the merchant name
+	payloadMaxNameLen = 25
+)
+
+// CRC16/CCITT-FALSE, the checksum used by EMV QR codes.
+func crc16(data []byte) uint16 {
+	crc := uint16(0xffff)
+
+	for _, b := range data {
+		crc ^= uint16(b) << 8
+
+		for i := 0; i < 8; i++ {
+			if crc&0x8000 != 0 {
+				crc = crc<<1 ^ 0x1021
+			} else {
+				crc <<= 1
+			}
+		}
+	}
+
+	return crc
+}
+
+func payloadField(id string, value string) string {
+	return fmt.Sprintf("%s%02d%s", id, len(value), value)
+}
+
+// Cut s to at most max bytes, without splitting a character.
+func truncateString(s string, max int) string {
+	for len(s) > max {
+		_, size := utf8.DecodeLastRuneInString(s)
+		s = s[:len(s)-size]
+	}
+
+	return s
+}
+
+// Build the payload for a payment request.
+func encodePayload(payReq *paymentRequest) string {
+	// 12 means the payload can only be used once, 11 many times
+	initMethod := "12"
+
+	if payReq.MultiUse {
+		initMethod = "11"
+	}
+
+	payload := payloadField(payloadFormatID, "01") +
+		payloadField(payloadInitID, initMethod) +
+		payloadField(payloadAccountID,
+			payloadField(payloadGUIID, payloadGUI)+
+				payloadField(payloadRequestID, strconv.Itoa(payReq.ID))) +
+		payloadField(payloadCategoryID, "0000") +
+		payloadField(payloadCurrencyID, payloadCurrency) +
+		payloadField(payloadAmountID, payReq.Amount.String()) +
+		payloadField(payloadCountryID, "BR") +
+		payloadField(payloadNameID,
+			truncateString(payReq.Name, payloadMaxNameLen)) +
+		payloadCRCID + "04"
+
+	return payload + fmt.Sprintf("%04X", crc16([]byte(payload)))
+}
+
+// Split a payload, or the value of a field with sub-fields, into its fields.
+func parsePayloadFields(payload string) (map[string]string, error) {
+	fields := make(map[string]string)
+
+	for len(payload) > 0 {
+		if len(payload) < 4 {
+			return nil, badPayloadError
+		}
+
+		// Atoi would also take a sign, and a negative length panics below
+		if !isDigit(payload[2]) || !isDigit(payload[3]) {
+			return nil, badPayloadError
+		}
+
+		length := int(payload[2]-'0')*10 + int(payload[3]-'0')
+
+		if len(payload) < 4+length {
+			return nil, badPayloadError
+		}
+
+		fields[payload[:2]] = payload[4 : 4+length]
+		payload = payload[4+length:]
+	}
+
+	return fields, nil
+}
+
+func isDigit(c byte) bool {
+	return c >= '0' && c <= '9'
+}
+
+// Check the payload's CRC and get the payment request id and amount from it.
+func decodePayload(payload string) (int, money, error) {
+	payload = strings.TrimSpace(payload)
+
+	// The CRC field is always the last 8 characters
+	if len(payload) < 8 || payload[len(payload)-8:len(payload)-4] !=
+		payloadCRCID+"04" {
+		return 0, 0, badPayloadError
+	}
+
+	crc, err := strconv.ParseUint(payload[len(payload)-4:], 16, 16)
+
+	if err != nil ||
+		uint16(crc) != crc16([]byte(payload[:len(payload)-4])) {
+		return 0, 0, badPayloadError
+	}
+
+	fields, err := parsePayloadFields(payload)
+
+	if err != nil {
+		return 0, 0, err
+	}
+
+	accountFields, err := parsePayloadFields(fields[payloadAccountID])
+
+	if err != nil || accountFields[payloadGUIID] != payloadGUI {
+		return 0, 0, badPayloadError
+	}
+
+	id, err := strconv.Atoi(accountFields[payloadRequestID])
+
+	if err != nil {
+		return 0, 0, badPayloadError
+	}
+
+	var amount money
+
+	if amount.UnmarshalJSON([]byte(fields[payloadAmountID])) != nil {
+		return 0, 0, badPayloadError
+	}
+
+	return id, amount, nil
+}
+
+// A payment counts unless it went to review and was rejected.
+const paymentRequestColumns = `r.id, r.account_id,
+	(select name from accounts where id = r.account_id), r.amount,
+	r.description, r.multi_use, r.status, r.expires_at, r.created_at,
+	(select count(*) from payment_request_payments p
+	left join pending_transfers pt on pt.id = p.pending_id
+	where p.request_id = r.id
+	and (p.transfer_id is not null or pt.status <> 'rejected'))`
+
+// Scan a row selected with paymentRequestColumns, and work out its status
+// and payload.
+func scanPaymentRequest(row scanner, payReq *paymentRequest) error {
+	err := row.Scan(&payReq.ID, &payReq.AccountID, &payReq.Name,
+		&payReq.Amount, &payReq.Description, &payReq.MultiUse, &payReq.Status,
+		&payReq.ExpiresAt, &payReq.CreatedAt, &payReq.Payments)
+
+	if err != nil {
+		return err
+	}
+
+	if payReq.Status == "open" {
+		if !payReq.MultiUse && payReq.Payments > 0 {
+			payReq.Status = "paid"
+		} else if time.Now().After(payReq.ExpiresAt) {
+			payReq.Status = "expired"
+		}
+	}
+
+	payReq.Payload = encodePayload(payReq)
+
+	return nil
+}
+
+// Get the payment request with id.
+func getPaymentRequest(q queryRower, id int) (*paymentRequest, error) {
+	var payReq paymentRequest
+
+	err := scanPaymentRequest(q.QueryRow(
+		`select `+paymentRequestColumns+` from payment_requests r
+		where id = $1`, id), &payReq)
+
+	if err == sql.ErrNoRows {
+		return nil, noPaymentRequestError
+	} else if err != nil {
+		return nil, err
+	}
+
+	return &payReq, nil
+}
+
+// The error for paying a request with the given status, if it can't be paid.
+func paymentRequestStatusError(status string) error {
+	switch status {
+	case "paid":
+		return paymentRequestPaidError
+	case "expired":
+		return paymentRequestExpiredError
+	case "cancelled":
+		return paymentRequestCancelledError
+	}
+
+	return nil
+}
+
+// Handler for POST at /payment-requests.
+func createPaymentRequest(rw http.ResponseWriter, req *http.Request) {
+	id := accountID(req)
+
+	var createReq paymentRequestCreateRequest
+
+	data, err := readFromReq(req, 512)
+
+	if err != nil {
+		respondWithError(rw, err)
+		return
+	}
+
+	err = json.Unmarshal(data, &createReq)
+
+	var publicError *publicJSONError
+	if errors.As(err, &publicError) {
+		respondWithError(rw, publicError)
+		return
+	} else if err != nil {
+		respondWithError(rw, cantParseJSONError)
+		return
+	}
+
+	if createReq.Amount == 0 {
+		respondWithError(rw, zeroAmountError)
+		return
+	} else if createReq.Amount < 0 {
+		respondWithError(rw, invalidAmountError)
+		return
+	}
+
+	if utf8.RuneCountInString(createReq.Description) > maxDescriptionLen {
+		respondWithError(rw, descriptionTooLongError)
+		return
+	}
+
+	now := time.Now().UTC()
+	expiresAt := now.Add(defaultPaymentRequestExpiry)
+
+	if createReq.ExpiresAt != nil {
+		expiresAt = createReq.ExpiresAt.UTC()
+
+		if !expiresAt.After(now) ||
+			expiresAt.Sub(now) > maxPaymentRequestExpiry {
+			respondWithError(rw, badExpiryError)
+			return
+		}
+	}
+
+	var requestID int
+
+	err = DB.QueryRowContext(req.Context(),
+		`insert into payment_requests (account_id, amount, description,
+		multi_use, expires_at, created_at)
+		values ($1, $2, $3, $4, $5, $6) returning id`,
+		id, createReq.Amount, createReq.Description, createReq.MultiUse,
+		expiresAt, now).Scan(&requestID)
+
+	if err != nil {
+		respondWithError(rw, err)
+		return
+	}
+
+	payReq, err := getPaymentRequest(DB, requestID)
+
+	if err != nil {
+		respondWithError(rw, err)
+		return
+	}
+
+	logger.Printf("Created payment request %d for account %d", requestID, id)
+	respondWithJSON(rw, http.StatusCreated, payReq)
+}
+
+// Handler for GET at /payment-requests. Lists the requests created by the
+// logged in account, newest first by default.
+func getPaymentRequests(rw http.ResponseWriter, req *http.Request) {
+	id := accountID(req)
+
+	params, err := parsePageParams(req, map[string]string{"id": "integer"},
+		"id")
+
+	if err != nil {
+		respondWithError(rw, err)
+		return
+	}
+
+	if req.URL.Query().Get("order") == "" {
+		params.desc = true
+	}
+
+	var where whereBuilder
+	where.add("account_id = %[1]s", id)
+	params.addCursor(&where)
+
+	rows, err := DB.QueryContext(req.Context(),
+		`select `+paymentRequestColumns+` from payment_requests r where `+
+			where.String()+` `+params.orderAndLimit(), where.args...)
+
+	if err != nil {
+		respondWithError(rw, err)
+		return
+	}
+
+	defer rows.Close()
+
+	payReqs := make([]paymentRequest, 0, params.limit+1)
+
+	for rows.Next() {
+		var payReq paymentRequest
+
+		err = scanPaymentRequest(rows, &payReq)
+
+		if err != nil {
+			logger.Printf("error when querying payment requests")
+			respondWithError(rw, err)
+			return
+		}
+
+		payReqs = append(payReqs, payReq)
+	}
+
+	if err = rows.Err(); err != nil {
+		logger.Printf("error when querying payment requests")
+		respondWithError(rw, err)
+		return
+	}
+
+	var page paymentRequestPage
+
+	if len(payReqs) > params.limit {
+		page.NextCursor = params.nextCursor(payReqs[params.limit-1].ID, "")
+		payReqs = payReqs[:params.limit]
+	}
+
+	page.PaymentRequests = payReqs
+
+	respondWithJSON(rw, http.StatusOK, &page)
+}
+
+// Handler for POST at /payment-requests/<id>/pay. The payer sends the
+// payload they were given, which must match the request, so that they pay
+// what they were shown.
+func payPaymentRequest(rw http.ResponseWriter, req *http.Request) {
+	id := accountID(req)
+	requestID, err := pathID(req, "id")
+
+	if err != nil {
+		respondWithError(rw, err)
+		return
+	}
+
+	var payBody paymentRequestPayRequest
+
+	data, err := readFromReq(req, 512)
+
+	if err != nil {
+		respondWithError(rw, err)
+		return
+	}
+
+	err = json.Unmarshal(data, &payBody)
+
+	if err != nil {
+		respondWithError(rw, cantParseJSONError)
+		return
+	}
+
+	payloadID, payloadAmount, err := decodePayload(payBody.Payload)
+
+	if err != nil {
+		respondWithError(rw, err)
+		return
+	}
+
+	payReq, err := getPaymentRequest(DB, requestID)
+
+	if err != nil {
+		respondWithError(rw, err)
+		return
+	}
+
+	if payloadID != payReq.ID || payloadAmount != payReq.Amount {
+		respondWithError(rw, badPayloadError)
+		return
+	}
+
+	if err = paymentRequestStatusError(payReq.Status); err != nil {
+		respondWithError(rw, err)
+		return
+	}
+
+	attempt := TransferAttempt{
+		OriginID:      id,
+		DestinationID: payReq.AccountID,
+		Amount:        payReq.Amount,
+		Description:   payReq.Description,
+		Metadata: transferMetadata{
+			"payment_request_id": strconv.Itoa(payReq.ID)},
+	}
+
+	// Checked again inside the transfer tx, the request may have been paid
+	// or cancelled since we read it.
+	recordPayment := func(tx *sql.Tx, transf *transfer,
+		pending *pendingTransfer) error {
+
+		now := time.Now().UTC()
+
+		// Updating the row makes concurrent payments of the same request
+		// conflict, instead of both reading it as unpaid.
+		result, err := tx.Exec(
+			`update payment_requests set last_paid_at = $2
+			where id = $1 and status = 'open'`, payReq.ID, now)
+
+		if err != nil {
+			return err
+		}
+
+		if updated, err := result.RowsAffected(); err != nil {
+			return err
+		} else if updated == 0 {
+			return paymentRequestCancelledError
+		}
+
+		current, err := getPaymentRequest(tx, payReq.ID)
+
+		if err != nil {
+			return err
+		}
+
+		if err = paymentRequestStatusError(current.Status); err != nil {
+			return err
+		}
+
+		var transferID, pendingID *int
+
+		if transf != nil {
+			transferID = &transf.ID
+		} else {
+			pendingID = &pending.ID
+		}
+
+		_, err = tx.Exec(
+			`insert into payment_request_payments
+			(request_id, payer_id, transfer_id, pending_id, created_at)
+			values ($1, $2, $3, $4, $5)`,
+			payReq.ID, id, transferID, pendingID, now)
+
+		return err
+	}
+
+	transf, pending, err := insertTransferWith(req.Context(), &attempt,
+		recordPayment)
+
+	if err != nil {
+		respondWithError(rw, err)
+		return
+	}
+
+	logger.Printf("Account %d paid payment request %d", id, payReq.ID)
+
+	// The request counts as paid while the transfer waits for review, and
+	// opens again if it's rejected.
+	if pending != nil {
+		respondWithJSON(rw, http.StatusAccepted, pending)
+		return
+	}
+
+	respondWithJSON(rw, http.StatusCreated, transf)
+}
+
+// Handler for POST at /payment-requests/<id>/cancel. Only the account that
+// created the request can cancel it, and only while it can still be paid.
+func cancelPaymentRequest(rw http.ResponseWriter, req *http.Request) {
+	id := accountID(req)
+	requestID, err := pathID(req, "id")
+
+	if err != nil {
+		respondWithError(rw, err)
+		return
+	}
+
+	payReq, err := getPaymentRequest(DB, requestID)
+
+	if err != nil {
+		respondWithError(rw, err)
+		return
+	}
+
+	if payReq.AccountID != id {
+		respondWithError(rw, forbiddenError)
+		return
+	}
+
+	if err = paymentRequestStatusError(payReq.Status); err != nil {
+		respondWithError(rw, err)
+		return
+	}
+
+	// It may have been paid, or have expired, since we read it
+	result, err := DB.ExecContext(req.Context(),
+		`update payment_requests set status = 'cancelled'
+		where id = $1 and status = 'open'`, requestID)
+
+	if err != nil {
+		respondWithError(rw, err)
+		return
+	}
+
+	if updated, err := result.RowsAffected(); err != nil {
+		respondWithError(rw, err)
+		return
+	} else if updated == 0 {
+		respondWithError(rw, paymentRequestNotOpenError)
+		return
+	}
+
+	payReq.Status = "cancelled"
+
+	logger.Printf("Cancelled payment request %d", requestID)
+	respondWithJSON(rw, http.StatusOK, payReq)
+}
+
+// Handler for GET at /payment-requests/<id>. Anyone logged in can see a
+// request, to check it before paying.
+func getPaymentRequestByID(rw http.ResponseWriter, req *http.Request) {
+	requestID, err := pathID(req, "id")
+
+	if err != nil {
+		respondWithError(rw, err)
+		return
+	}
+
+	payReq, err := getPaymentRequest(DB, requestID)
+
+	if err != nil {
+		respondWithError(rw, err)
+		return
+	}
+
+	respondWithJSON(rw, http.StatusOK, payReq)
+}
@@ -0,0 +1,95 @@
+package server
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestCRC16(t *testing.T) {
+	// Check value of CRC16/CCITT-FALSE
+	if crc := crc16([]byte("123456789")); crc != 0x29b1 {
+		t.Errorf("%04x", crc)
+	}
+}
+
+func TestPayload(t *testing.T) {
+	payReq := paymentRequest{ID: 42, Amount: 3472,
+		Name: "Padaria São João da Esquina Ltda"}
+
+	payload := encodePayload(&payReq)
+
+	if !strings.HasPrefix(payload, "000201010212") {
+		t.Error(payload)
+	}
+
+	id, amount, err := decodePayload(payload)
+
+	if err != nil || id != 42 || amount != 3472 {
+		t.Error(payload, id, amount, err)
+	}
+
+	fields, err := parsePayloadFields(payload)
+
+	if err != nil || len(fields[payloadNameID]) > payloadMaxNameLen ||
+		fields[payloadCurrencyID] != "986" ||
+		fields[payloadAmountID] != "34.72" {
+		t.Error(fields, err)
+	}
+
+	payReq.MultiUse = true
+
+	if !strings.HasPrefix(encodePayload(&payReq), "000201010211") {
+		t.Error(encodePayload(&payReq))
+	}
+
+	// Changing the amount breaks the CRC
+	tampered := strings.Replace(payload, "34.72", "04.72", 1)
+
+	var badPayloads = []string{
+		tampered,
+		payload[:len(payload)-1],
+		"",
+		"6304ABCD",
+	}
+
+	for _, badPayload := range badPayloads {
+		_, _, err = decodePayload(badPayload)
+
+		if err != badPayloadError {
+			t.Error(badPayload, err)
+		}
+	}
+}
+
+func TestParsePayloadFields(t *testing.T) {
+	fields, err := parsePayloadFields("0002010104abcd")
+
+	if err != nil || fields["00"] != "01" || fields["01"] != "abcd" {
+		t.Error(fields, err)
+	}
+
+	var badPayloads = []string{
+		"00-1abc",
+		"00+1a",
+		"00 1a",
+		"000x",
+		"0003ab",
+		"000",
+	}
+
+	for _, badPayload := range badPayloads {
+		if _, err = parsePayloadFields(badPayload); err != badPayloadError {
+			t.Error(badPayload, err)
+		}
+	}
+}
+
+func TestTruncateString(t *testing.T) {
+	if s := truncateString("São", 2); s != "S" {
+		t.Error(s)
+	}
+
+	if s := truncateString("São", 3); s != "Sã" {
+		t.Error(s)
+	}
+}
@@ -0,0 +1,162 @@
+package server
+
+import (
+	"database/sql"
+	"encoding/json"
+	"net/http"
+)
+
+// JSON that the client sends to PATCH /accounts/me. Fields left out aren't
+// changed.
+type profileUpdateRequest struct {
+	Name *string `json:"name"`
+}
+
+// JSON that the client sends to change the password.
+type passwordChangeRequest struct {
+	OldSecret string `json:"old_secret"`
+	NewSecret string `json:"new_secret"`
+}
+
+func validateName(name string) error {
+	if name == "" {
+		return nameEmptyError
+	}
+
+	if len(name) > 32 {
+		return nameTooLongError
+	}
+
+	return nil
+}
+
+func validateSecret(secret string) error {
+	if secret == "" {
+		return pwEmptyError
+	}
+
+	if len(secret) > 32 {
+		return pwTooLongError
+	}
+
+	return nil
+}
+
+// Handler for PATCH at /accounts/me. Responds with the updated account.
+func updateProfile(rw http.ResponseWriter, req *http.Request) {
+	id := accountID(req)
+
+	data, err := readFromReq(req, 256)
+
+	if err != nil {
+		respondWithError(rw, err)
+		return
+	}
+
+	var updateReq profileUpdateRequest
+
+	err = json.Unmarshal(data, &updateReq)
+
+	if err != nil {
+		respondWithError(rw, cantParseJSONError)
+		return
+	}
+
+	if updateReq.Name != nil {
+		if err = validateName(*updateReq.Name); err != nil {
+			respondWithError(rw, err)
+			return
+		}
+	}
+
+	var acc account
+
+	err = DB.QueryRowContext(req.Context(),
+		`update accounts set name = coalesce($1, name) where id = $2
+		returning id, name, cpf, balance, created_at, timezone, status`,
+		updateReq.Name, id).Scan(&acc.ID, &acc.Name, &acc.CPF, &acc.Balance,
+		&acc.CreatedAt, &acc.Timezone, &acc.Status)
+
+	if err == sql.ErrNoRows {
+		respondWithError(rw, noAccountError)
+		return
+	} else if err != nil {
+		respondWithError(rw, err)
+		return
+	}
+
+	logger.Printf("Updated profile of account %d", id)
+	respondWithJSON(rw, http.StatusOK, &acc)
+}
+
+// Handler for POST at /accounts/me/password. The old password must be given
+// again, so a stolen token isn't enough to take over the account. Every
+// other login of the account is logged out.
+func changePassword(rw http.ResponseWriter, req *http.Request) {
+	id := accountID(req)
+
+	data, err := readFromReq(req, 256)
+
+	if err != nil {
+		respondWithError(rw, err)
+		return
+	}
+
+	var changeReq passwordChangeRequest
+
+	err = json.Unmarshal(data, &changeReq)
+
+	if err != nil {
+		respondWithError(rw, cantParseJSONError)
+		return
+	}
+
+	if err = validateSecret(changeReq.NewSecret); err != nil {
+		respondWithError(rw, err)
+		return
+	}
+
+	tx, err := DB.BeginTx(req.Context(), &defaultTxOptions)
+
+	if err != nil {
+		logger.Print("Error starting tx to change password")
+		respondWithError(rw, err)
+		return
+	}
+
+	var secret string
+
+	err = tx.QueryRow(
+		`select secret from accounts where id = $1 for update`,
+		id).Scan(&secret)
+
+	if err == sql.ErrNoRows {
+		err = noAccountError
+	} else if err == nil && hashSecret(changeReq.OldSecret) != secret {
+		err = wrongPasswordError
+	}
+
+	if err == nil {
+		_, err = tx.Exec(`update accounts set secret = $1 where id = $2`,
+			hashSecret(changeReq.NewSecret), id)
+	}
+
+	if err != nil {
+		rollbackTx(tx)
+		respondWithError(rw, err)
+		return
+	}
+
+	err = tx.Commit()
+
+	if err != nil {
+		logger.Print("Error commiting tx")
+		respondWithError(rw, err)
+		return
+	}
+
+	logoutAccount(id, authToken(req))
+
+	logger.Printf("Changed password of account %d", id)
+	rw.WriteHeader(http.StatusNoContent)
+}
@@ -0,0 +1,59 @@
+package server
+
+import (
+	"os"
+	"path/filepath"
+	"regexp"
+	"strings"
+	"testing"
+)
+
+func TestValidateProfile(t *testing.T) {
+	if validateName("") != nameEmptyError ||
+		validateName(strings.Repeat("a", 33)) != nameTooLongError ||
+		validateName("Jane Doe") != nil {
+		t.Error("bad name validation")
+	}
+
+	if validateSecret("") != pwEmptyError ||
+		validateSecret(strings.Repeat("a", 33)) != pwTooLongError ||
+		validateSecret("toto") != nil {
+		t.Error("bad password validation")
+	}
+}
+
+func TestGenerateResetCode(t *testing.T) {
+	codeRegex := regexp.MustCompile(`^[0-9]{6}$`)
+
+	for i := 0; i < 100; i++ {
+		code, err := generateResetCode()
+
+		if err != nil || !codeRegex.MatchString(code) {
+			t.Fatal(code, err)
+		}
+	}
+}
+
+func TestFileNotifier(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "messages")
+	fn := NewFileNotifier(path)
+
+	for _, message := range []string{"first", "second"} {
+		if err := fn.Notify(7, message); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	data, err := os.ReadFile(path)
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	lines := strings.Split(strings.TrimSpace(string(data)), "\n")
+
+	if len(lines) != 2 || !strings.HasSuffix(lines[0], " account=7 first") ||
+		!strings.HasSuffix(lines[1], " account=7 second") {
+		t.Error(string(data))
+	}
+}
@@ -0,0 +1,489 @@
+package server
+
+import (
+	"bufio"
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Handles a domain event published to an EventBus. If it fails, the whole
+// batch is published again, to every handler.
+type EventHandler func(ctx context.Context, event DomainEvent) error
+
+type busSubscription struct {
+	handler EventHandler
+	// Empty for every type
+	types map[string]bool
+}
+
+// An EventPublisher that calls handlers in the server process, for code
+// that embeds the server.
+type EventBus struct {
+	subscriptions []busSubscription
+	mu            sync.RWMutex
+}
+
+func NewEventBus() *EventBus {
+	return &EventBus{}
+}
+
+// Call handler with the events of types, or of every type if none is given.
+func (bus *EventBus) Subscribe(handler EventHandler, types ...string) {
+	sub := busSubscription{handler: handler,
+		types: make(map[string]bool, len(types))}
+
+	for _, eventType := range types {
+		sub.types[eventType] = true
+	}
+
+	bus.mu.Lock()
+	bus.subscriptions = append(bus.subscriptions, sub)
+	bus.mu.Unlock()
+}
+
+// Call the handlers with events in order, stopping at the first error.
+func (bus *EventBus) Publish(ctx context.Context, events []DomainEvent) error {
+	bus.mu.RLock()
+	defer bus.mu.RUnlock()
+
+	for _, event := range events {
+		for _, sub := range bus.subscriptions {
+			if len(sub.types) > 0 && !sub.types[event.Type] {
+				continue
+			}
+
+			if err := sub.handler(ctx, event); err != nil {
+				return err
+			}
+		}
+	}
+
+	return nil
+}
+
+// Appends the events to a file as JSON, one per line.
+type fileEventPublisher struct {
+	path string
+	mu   sync.Mutex
+}
+
+// Build an EventPublisher that appends to the file at path, creating it if
+// needed. A batch is synced to disk before its offset is saved.
+func NewFileEventPublisher(path string) EventPublisher {
+	return &fileEventPublisher{path: path}
+}
+
+func (fp *fileEventPublisher) Publish(ctx context.Context,
+	events []DomainEvent) error {
+
+	fp.mu.Lock()
+	defer fp.mu.Unlock()
+
+	file, err := os.OpenFile(fp.path, os.O_APPEND|os.O_CREATE|os.O_WRONLY,
+		0600)
+
+	if err != nil {
+		return err
+	}
+
+	writer := bufio.NewWriter(file)
+	encoder := json.NewEncoder(writer)
+
+	for i := range events {
+		if err = encoder.Encode(&events[i]); err != nil {
+			break
+		}
+	}
+
+	if err == nil {
+		err = writer.Flush()
+	}
+
+	if err == nil {
+		err = file.Sync()
+	}
+
+	if closeErr := file.Close(); err == nil {
+		err = closeErr
+	}
+
+	return err
+}
+
+// A message for a broker like NATS or Kafka. Key decides the partition where
+// the broker has them, and ID lets it drop the messages sent again.
+type BrokerMessage struct {
+	Topic string
+	Key   string
+	ID    string
+	Value []byte
+}
+
+// Sends messages to a broker. It should return only once the broker has
+// them.
+type MessageProducer interface {
+	Produce(ctx context.Context, messages []BrokerMessage) error
+}
+
+// Sends each event as a message to the topic of its type.
+type brokerEventPublisher struct {
+	producer    MessageProducer
+	topicPrefix string
+}
+
+// Build an EventPublisher that sends each event to producer as JSON, with
+// topic topicPrefix.<type>, the account id as key and the event id as id.
+// The events of an account keep their order on brokers with partitions.
+func NewBrokerEventPublisher(producer MessageProducer,
+	topicPrefix string) EventPublisher {
+
+	return &brokerEventPublisher{producer, topicPrefix}
+}
+
+func (bp *brokerEventPublisher) Publish(ctx context.Context,
+	events []DomainEvent) error {
+
+	messages := make([]BrokerMessage, 0, len(events))
+
+	for i := range events {
+		value, err := json.Marshal(&events[i])
+
+		if err != nil {
+			return err
+		}
+
+		message := BrokerMessage{Topic: events[i].Type,
+			ID: strconv.FormatInt(events[i].ID, 10), Value: value}
+
+		if bp.topicPrefix != "" {
+			message.Topic = bp.topicPrefix + "." + message.Topic
+		}
+
+		if events[i].AccountID != 0 {
+			message.Key = strconv.Itoa(events[i].AccountID)
+		}
+
+		messages = append(messages, message)
+	}
+
+	return bp.producer.Produce(ctx, messages)
+}
+
+// How long a NATS server has to answer, when the context has no deadline.
+const natsTimeout = 10 * time.Second
+
+// Publishes to NATS JetStream with the NATS text protocol, so the subjects
+// must be in a stream. Each message is published with a reply subject in an
+// inbox of the connection, and a batch is only done when JetStream acked
+// every message, which means it stored them. NATS has no keys, so they're
+// left out. Servers with headers get the id as Nats-Msg-Id, which JetStream
+// uses to drop messages it already has.
+type natsProducer struct {
+	addr    string
+	conn    net.Conn
+	reader  *bufio.Reader
+	headers bool
+	// Prefix of the reply subjects, _INBOX.<random>, and the number of the
+	// next one
+	inbox     string
+	nextReply int64
+	mu        sync.Mutex
+}
+
+// The fields of the server's INFO we use.
+type natsInfo struct {
+	Headers      bool `json:"headers"`
+	TLSRequired  bool `json:"tls_required"`
+	AuthRequired bool `json:"auth_required"`
+}
+
+// What JetStream answers a publish with: the stream and sequence the message
+// was stored at, or an error.
+type natsPubAck struct {
+	Stream    string `json:"stream"`
+	Seq       uint64 `json:"seq"`
+	Duplicate bool   `json:"duplicate"`
+	Error     *struct {
+		Code        int    `json:"code"`
+		Description string `json:"description"`
+	} `json:"error"`
+}
+
+// Build a MessageProducer that publishes to JetStream on the NATS server at
+// addr, like localhost:4222. It connects on the first Produce, and again
+// after an error.
+func NewNATSProducer(addr string) MessageProducer {
+	return &natsProducer{addr: addr}
+}
+
+func (np *natsProducer) Produce(ctx context.Context,
+	messages []BrokerMessage) error {
+
+	np.mu.Lock()
+	defer np.mu.Unlock()
+
+	err := np.produce(ctx, messages)
+
+	if err != nil && np.conn != nil {
+		np.conn.Close()
+		np.conn = nil
+	}
+
+	return err
+}
+
+func (np *natsProducer) produce(ctx context.Context,
+	messages []BrokerMessage) error {
+
+	if np.conn == nil {
+		if err := np.connect(ctx); err != nil {
+			return err
+		}
+	}
+
+	deadline, ok := ctx.Deadline()
+
+	if !ok {
+		deadline = time.Now().Add(natsTimeout)
+	}
+
+	if err := np.conn.SetDeadline(deadline); err != nil {
+		return err
+	}
+
+	// Message i is published with reply number firstReply + i
+	firstReply := np.nextReply
+	np.nextReply += int64(len(messages))
+
+	writer := bufio.NewWriter(np.conn)
+
+	for i, message := range messages {
+		reply := np.inbox + "." + strconv.FormatInt(firstReply+int64(i), 10)
+
+		if np.headers && message.ID != "" {
+			header := "NATS/1.0\r\nNats-Msg-Id: " + message.ID + "\r\n\r\n"
+
+			fmt.Fprintf(writer, "HPUB %s %s %d %d\r\n%s", message.Topic,
+				reply, len(header), len(header)+len(message.Value), header)
+		} else {
+			fmt.Fprintf(writer, "PUB %s %s %d\r\n", message.Topic, reply,
+				len(message.Value))
+		}
+
+		writer.Write(message.Value)
+		writer.WriteString("\r\n")
+	}
+
+	if err := writer.Flush(); err != nil {
+		return err
+	}
+
+	acked := make([]bool, len(messages))
+	pending := len(messages)
+
+	for pending > 0 {
+		line, err := np.readLine()
+
+		if err != nil {
+			return err
+		}
+
+		switch {
+		case line == "PING":
+			if _, err = np.conn.Write([]byte("PONG\r\n")); err != nil {
+				return err
+			}
+		case strings.HasPrefix(line, "-ERR"):
+			return fmt.Errorf("nats: %s", strings.TrimPrefix(line, "-ERR "))
+		case strings.HasPrefix(line, "MSG "),
+			strings.HasPrefix(line, "HMSG "):
+
+			reply, header, payload, err := np.readMessage(line)
+
+			if err != nil {
+				return err
+			}
+
+			i := reply - firstReply
+
+			// Not an answer to this batch
+			if i < 0 || i >= int64(len(messages)) || acked[i] {
+				continue
+			}
+
+			if err = checkNATSAck(header, payload); err != nil {
+				return fmt.Errorf("nats: publishing to %s: %v",
+					messages[i].Topic, err)
+			}
+
+			acked[i] = true
+			pending--
+		}
+	}
+
+	return nil
+}
+
+// Read the rest of the MSG or HMSG of line, an answer to a publish. Returns
+// the number of its reply subject, -1 if it isn't one of ours, its header
+// and its payload.
+func (np *natsProducer) readMessage(line string) (int64, string, []byte,
+	error) {
+
+	// MSG <subject> <sid> [reply-to] <size>, and HMSG has
+	// <header size> before the size
+	fields := strings.Fields(line)
+	minFields := 4
+	headerLen := 0
+
+	if fields[0] == "HMSG" {
+		minFields = 5
+	}
+
+	if len(fields) < minFields {
+		return 0, "", nil, fmt.Errorf("nats: bad message %q", line)
+	}
+
+	size, err := strconv.Atoi(fields[len(fields)-1])
+
+	if err == nil && fields[0] == "HMSG" {
+		headerLen, err = strconv.Atoi(fields[len(fields)-2])
+	}
+
+	if err != nil || size < 0 || headerLen < 0 || headerLen > size {
+		return 0, "", nil, fmt.Errorf("nats: bad message %q", line)
+	}
+
+	data := make([]byte, size+2)
+
+	if _, err = io.ReadFull(np.reader, data); err != nil {
+		return 0, "", nil, err
+	}
+
+	reply := int64(-1)
+	subject := fields[1]
+
+	if strings.HasPrefix(subject, np.inbox+".") {
+		n, err := strconv.ParseInt(subject[len(np.inbox)+1:], 10, 64)
+
+		if err == nil {
+			reply = n
+		}
+	}
+
+	return reply, string(data[:headerLen]), data[headerLen:size], nil
+}
+
+// Check the answer to a publish is an ack of JetStream. A header with a
+// status, like 503 when no stream has the subject, is an error too.
+func checkNATSAck(header string, payload []byte) error {
+	if header != "" {
+		statusLine := strings.SplitN(header, "\r\n", 2)[0]
+		status := strings.TrimSpace(strings.TrimPrefix(statusLine,
+			"NATS/1.0"))
+
+		if strings.HasPrefix(status, "503") {
+			return errors.New("no stream has the subject")
+		} else if status != "" {
+			return fmt.Errorf("status %s", status)
+		}
+	}
+
+	var ack natsPubAck
+
+	if err := json.Unmarshal(payload, &ack); err != nil {
+		return fmt.Errorf("bad ack %q", payload)
+	}
+
+	if ack.Error != nil {
+		return fmt.Errorf("%s (%d)", ack.Error.Description, ack.Error.Code)
+	}
+
+	if ack.Stream == "" {
+		return fmt.Errorf("bad ack %q", payload)
+	}
+
+	return nil
+}
+
+// Connect, greet the server and subscribe to the inbox of the acks.
+func (np *natsProducer) connect(ctx context.Context) error {
+	var dialer net.Dialer
+
+	conn, err := dialer.DialContext(ctx, "tcp", np.addr)
+
+	if err != nil {
+		return err
+	}
+
+	np.conn = conn
+	np.reader = bufio.NewReader(conn)
+
+	if err = conn.SetDeadline(time.Now().Add(natsTimeout)); err != nil {
+		return err
+	}
+
+	line, err := np.readLine()
+
+	if err != nil {
+		return err
+	}
+
+	if !strings.HasPrefix(line, "INFO ") {
+		return fmt.Errorf("nats: expected INFO, got %q", line)
+	}
+
+	var info natsInfo
+
+	err = json.Unmarshal([]byte(strings.TrimPrefix(line, "INFO ")), &info)
+
+	if err != nil {
+		return err
+	}
+
+	if info.TLSRequired || info.AuthRequired {
+		return errors.New("nats: TLS and authentication aren't supported")
+	}
+
+	np.headers = info.Headers
+
+	var inboxID [8]byte
+
+	if _, err = rand.Read(inboxID[:]); err != nil {
+		return err
+	}
+
+	np.inbox = "_INBOX." + hex.EncodeToString(inboxID[:])
+
+	// With no_responders, a publish to a subject no stream has is answered
+	// with a 503 instead of waiting for the timeout. It needs headers.
+	_, err = fmt.Fprintf(conn,
+		`CONNECT {"verbose":false,"pedantic":false,"name":"pedro-bank",`+
+			`"lang":"go","version":"1.0.0","headers":%t,`+
+			`"no_responders":%t}`+"\r\nSUB %s.* 1\r\n",
+		np.headers, np.headers, np.inbox)
+
+	return err
+}
+
+// Read a line of the protocol, without the CRLF.
+func (np *natsProducer) readLine() (string, error) {
+	line, err := np.reader.ReadString('\n')
+
+	if err != nil {
+		return "", err
+	}
+
+	return strings.TrimRight(line, "\r\n"), nil
+}
@@ -0,0 +1,379 @@
+package server
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+)
+
+var testDomainEvents = []DomainEvent{
+	{ID: 1, Type: EventAccountCreated, AccountID: 1,
+		Data: json.RawMessage(`{"id":1}`), CreatedAt: time.Now().UTC()},
+	{ID: 2, Type: EventLoginSucceeded, AccountID: 1,
+		Data: json.RawMessage(`{"account_id":1}`), CreatedAt: time.Now().UTC()},
+	{ID: 3, Type: EventTransferCompleted,
+		Data: json.RawMessage(`{"id":5}`), CreatedAt: time.Now().UTC()},
+}
+
+func TestEventBus(t *testing.T) {
+	bus := NewEventBus()
+	var all, logins []int64
+
+	bus.Subscribe(func(ctx context.Context, event DomainEvent) error {
+		all = append(all, event.ID)
+		return nil
+	})
+
+	bus.Subscribe(func(ctx context.Context, event DomainEvent) error {
+		logins = append(logins, event.ID)
+		return nil
+	}, EventLoginSucceeded, EventLoginFailed)
+
+	err := bus.Publish(context.Background(), testDomainEvents)
+
+	if err != nil || fmt.Sprint(all) != "[1 2 3]" ||
+		fmt.Sprint(logins) != "[2]" {
+
+		t.Fatal(all, logins, err)
+	}
+
+	// A failing handler fails the batch
+	failure := errors.New("failed")
+
+	bus.Subscribe(func(ctx context.Context, event DomainEvent) error {
+		return failure
+	}, EventTransferCompleted)
+
+	all = nil
+
+	err = bus.Publish(context.Background(), testDomainEvents)
+
+	if err != failure || fmt.Sprint(all) != "[1 2 3]" {
+		t.Error(all, err)
+	}
+}
+
+func TestFileEventPublisher(t *testing.T) {
+	dir, err := os.MkdirTemp("", "events")
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	defer os.RemoveAll(dir)
+
+	path := filepath.Join(dir, "events.jsonl")
+	publisher := NewFileEventPublisher(path)
+
+	for i := range testDomainEvents {
+		err = publisher.Publish(context.Background(),
+			testDomainEvents[i:i+1])
+
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	data, err := os.ReadFile(path)
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	lines := strings.Split(strings.TrimSuffix(string(data), "\n"), "\n")
+
+	if len(lines) != len(testDomainEvents) {
+		t.Fatalf("%q", data)
+	}
+
+	for i, line := range lines {
+		var event DomainEvent
+
+		err = json.Unmarshal([]byte(line), &event)
+
+		if err != nil || event.ID != testDomainEvents[i].ID ||
+			event.Type != testDomainEvents[i].Type ||
+			string(event.Data) != string(testDomainEvents[i].Data) {
+
+			t.Error(line, err)
+		}
+	}
+
+	// The transfer event has no account
+	if strings.Contains(lines[2], "account_id") {
+		t.Error(lines[2])
+	}
+}
+
+// Keeps the messages it's given.
+type recordingProducer struct {
+	messages []BrokerMessage
+}
+
+func (rp *recordingProducer) Produce(ctx context.Context,
+	messages []BrokerMessage) error {
+
+	rp.messages = append(rp.messages, messages...)
+	return nil
+}
+
+func TestBrokerEventPublisher(t *testing.T) {
+	producer := &recordingProducer{}
+	publisher := NewBrokerEventPublisher(producer, "bank")
+
+	err := publisher.Publish(context.Background(), testDomainEvents)
+
+	if err != nil || len(producer.messages) != len(testDomainEvents) {
+		t.Fatal(producer.messages, err)
+	}
+
+	message := producer.messages[0]
+
+	if message.Topic != "bank.AccountCreated" || message.Key != "1" ||
+		message.ID != "1" {
+
+		t.Error(message)
+	}
+
+	var event DomainEvent
+
+	if err = json.Unmarshal(message.Value, &event); err != nil ||
+		event.ID != 1 || event.AccountID != 1 {
+
+		t.Error(string(message.Value), err)
+	}
+
+	if producer.messages[2].Key != "" {
+		t.Error("key for no account", producer.messages[2])
+	}
+
+	producer.messages = nil
+	publisher = NewBrokerEventPublisher(producer, "")
+	publisher.Publish(context.Background(), testDomainEvents[1:2])
+
+	if producer.messages[0].Topic != EventLoginSucceeded {
+		t.Error(producer.messages[0])
+	}
+}
+
+// A message a fake NATS server got.
+type natsMessage struct {
+	subject string
+	id      string
+	payload string
+}
+
+// Serve one connection of the NATS protocol on listener, like JetStream:
+// each message is acked to its reply subject, and sent to received. With
+// headers, it takes HPUB. With errAt, it answers the messages after that
+// many with a JetStream error. Subjects under nostream. get the 503 of no
+// responders.
+func serveFakeNATS(t *testing.T, listener net.Listener, headers bool,
+	errAt int, received chan<- natsMessage) {
+
+	conn, err := listener.Accept()
+
+	if err != nil {
+		return
+	}
+
+	defer conn.Close()
+
+	fmt.Fprintf(conn, "INFO {\"server_id\":\"test\",\"headers\":%t}\r\n",
+		headers)
+
+	reader := bufio.NewReader(conn)
+	inbox := ""
+	sid := ""
+	count := 0
+
+	for {
+		line, err := reader.ReadString('\n')
+
+		if err != nil {
+			return
+		}
+
+		fields := strings.Fields(line)
+
+		if len(fields) == 0 {
+			continue
+		}
+
+		switch fields[0] {
+		case "CONNECT":
+			if !strings.Contains(line, fmt.Sprintf(
+				`"headers":%t,"no_responders":%t`, headers, headers)) {
+
+				t.Errorf("bad CONNECT %q", line)
+			}
+		case "SUB":
+			if len(fields) != 3 || !strings.HasPrefix(fields[1], "_INBOX.") ||
+				!strings.HasSuffix(fields[1], ".*") {
+
+				t.Errorf("bad SUB %q", line)
+				return
+			}
+
+			inbox = strings.TrimSuffix(fields[1], "*")
+			sid = fields[2]
+		case "PONG":
+		case "PUB", "HPUB":
+			size, _ := strconv.Atoi(fields[len(fields)-1])
+			data := make([]byte, size+2)
+
+			if _, err = io.ReadFull(reader, data); err != nil {
+				return
+			}
+
+			message := natsMessage{subject: fields[1],
+				payload: string(data[:size])}
+			reply := fields[2]
+
+			if !strings.HasPrefix(reply, inbox) || inbox == "" {
+				t.Errorf("no inbox reply in %q", line)
+				return
+			}
+
+			if fields[0] == "HPUB" {
+				headerLen, _ := strconv.Atoi(fields[3])
+				header := message.payload[:headerLen]
+				message.payload = message.payload[headerLen:]
+
+				for _, headerLine := range strings.Split(header, "\r\n") {
+					if strings.HasPrefix(headerLine, "Nats-Msg-Id: ") {
+						message.id = strings.TrimPrefix(headerLine,
+							"Nats-Msg-Id: ")
+					}
+				}
+			}
+
+			count++
+
+			// Check the producer answers the server's pings too
+			io.WriteString(conn, "PING\r\n")
+
+			if strings.HasPrefix(message.subject, "nostream.") {
+				fmt.Fprintf(conn, "HMSG %s %s 16 16\r\nNATS/1.0 503\r\n\r\n"+
+					"\r\n", reply, sid)
+				continue
+			}
+
+			ack := fmt.Sprintf(`{"stream":"BANK","seq":%d}`, count)
+
+			if errAt > 0 && count > errAt {
+				ack = `{"error":{"code":400,"err_code":10054,` +
+					`"description":"maximum payload exceeded"}}`
+			} else {
+				received <- message
+			}
+
+			fmt.Fprintf(conn, "MSG %s %s %d\r\n%s\r\n", reply, sid,
+				len(ack), ack)
+		default:
+			t.Errorf("unexpected %q", line)
+			return
+		}
+	}
+}
+
+func TestNATSProducer(t *testing.T) {
+	messages := []BrokerMessage{
+		{Topic: "bank.AccountCreated", Key: "1", ID: "1",
+			Value: []byte(`{"id":1}`)},
+		{Topic: "bank.TransferCompleted", ID: "2",
+			Value: []byte(`{"id":2}`)},
+	}
+
+	for _, headers := range []bool{true, false} {
+		listener, err := net.Listen("tcp", "127.0.0.1:0")
+
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		received := make(chan natsMessage, 10)
+		go serveFakeNATS(t, listener, headers, 0, received)
+
+		producer := NewNATSProducer(listener.Addr().String())
+		ctx, cancel := context.WithTimeout(context.Background(),
+			5*time.Second)
+
+		err = producer.Produce(ctx, messages)
+		cancel()
+		listener.Close()
+
+		if err != nil {
+			t.Fatal(headers, err)
+		}
+
+		if len(received) != len(messages) {
+			t.Fatal(headers, len(received))
+		}
+
+		for _, message := range messages {
+			got := <-received
+			id := ""
+
+			if headers {
+				id = message.ID
+			}
+
+			if got.subject != message.Topic || got.id != id ||
+				got.payload != string(message.Value) {
+
+				t.Error(headers, got)
+			}
+		}
+	}
+
+	// The error of the server fails the batch, and the next one connects
+	// again
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	defer listener.Close()
+
+	received := make(chan natsMessage, 10)
+	go serveFakeNATS(t, listener, true, 1, received)
+
+	producer := NewNATSProducer(listener.Addr().String())
+	err = producer.Produce(context.Background(), messages)
+
+	if err == nil || !strings.Contains(err.Error(), "maximum payload") {
+		t.Fatal(err)
+	}
+
+	go serveFakeNATS(t, listener, true, 0, received)
+
+	if err = producer.Produce(context.Background(), messages[1:]); err != nil {
+		t.Error(err)
+	}
+
+	if len(received) != 2 {
+		t.Error(len(received))
+	}
+
+	// A subject no stream has isn't published
+	go serveFakeNATS(t, listener, true, 0, received)
+
+	err = producer.Produce(context.Background(), []BrokerMessage{
+		{Topic: "nostream.AccountCreated", ID: "3", Value: []byte("{}")}})
+
+	if err == nil || !strings.Contains(err.Error(), "no stream") {
+		t.Error(err)
+	}
+}
@@ -1,39 +1,57 @@
 package server
 
 import (
+	"bufio"
 	"bytes"
+	"context"
 	"crypto/tls"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"io"
 	"net/http"
+	"net/http/httptest"
 	"os"
+	"pedro-bank/bankpb"
+	bankclient "pedro-bank/client"
+	"regexp"
+	"strconv"
 	"strings"
+	"sync"
 	"testing"
 	"time"
+
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/credentials"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/protobuf/types/known/timestamppb"
 )
 
 type jsonError struct {
-	Err string `json:"error"`
+	Err       string `json:"error"`
+	Code      string `json:"code"`
+	Message   string `json:"message"`
+	RequestID string `json:"request_id"`
 }
 
 type tokenResponse struct {
 	Token string `json:"token"`
 }
 
-const url = "https://localhost:8080"
+const serverURL = "https://localhost:8080"
 
 func get(path string) (*http.Response, error) {
-	return client.Get(url + path)
+	return client.Get(serverURL + path)
 }
 
 func postJSONString(path string, jsonString string) (*http.Response, error) {
-	return client.Post(url+path, "application/json",
+	return client.Post(serverURL+path, "application/json",
 		strings.NewReader(jsonString))
 }
 
 func postJSONBytes(path string, jsonBytes []byte) (*http.Response, error) {
-	return client.Post(url+path, "application/json",
+	return client.Post(serverURL+path, "application/json",
 		bytes.NewReader(jsonBytes))
 }
 
@@ -61,6 +79,126 @@ func getResponseBytes(resp *http.Response) ([]byte, error) {
 	}
 }
 
+// Do a request with the Authorization header set to token. body can be nil.
+func doWithToken(method string, path string, token string,
+	body []byte) (*http.Response, error) {
+
+	var bodyReader io.Reader
+
+	if body != nil {
+		bodyReader = bytes.NewReader(body)
+	}
+
+	req, err := http.NewRequest(method, serverURL+path, bodyReader)
+
+	if err != nil {
+		return nil, err
+	}
+
+	req.Header.Set("Authorization", token)
+
+	return client.Do(req)
+}
+
+// Create an account and return it as the server sent it back.
+func createTestAccount(accReq accountCreateRequest) (*account, error) {
+	var acc account
+
+	jsonBytes, err := json.Marshal(&accReq)
+
+	if err != nil {
+		return nil, err
+	}
+
+	resp, err := postJSONBytes("/accounts", jsonBytes)
+
+	if err != nil {
+		return nil, err
+	}
+
+	respBytes, err := getResponseBytes(resp)
+
+	if err != nil {
+		return nil, err
+	}
+
+	if resp.StatusCode != http.StatusCreated {
+		return nil, fmt.Errorf("got %d: %s", resp.StatusCode, respBytes)
+	}
+
+	err = json.Unmarshal(respBytes, &acc)
+
+	if err != nil {
+		return nil, err
+	}
+
+	return &acc, nil
+}
+
+// Get the balance of the account with id.
+func getBalance(id int) (*accountBalanceResponse, error) {
+	var balanceResp accountBalanceResponse
+
+	resp, err := get(fmt.Sprintf("/accounts/%d/balance", id))
+
+	if err != nil {
+		return nil, err
+	}
+
+	respBytes, err := getResponseBytes(resp)
+
+	if err != nil {
+		return nil, err
+	}
+
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("got %d: %s", resp.StatusCode, respBytes)
+	}
+
+	err = json.Unmarshal(respBytes, &balanceResp)
+
+	if err != nil {
+		return nil, err
+	}
+
+	return &balanceResp, nil
+}
+
+// Log in and return the token.
+func loginAs(cpf string, secret string) (string, error) {
+	var tokJSON tokenResponse
+
+	jsonBytes, err := json.Marshal(&loginRequest{CPF: cpf, Secret: secret})
+
+	if err != nil {
+		return "", err
+	}
+
+	resp, err := postJSONBytes("/login", jsonBytes)
+
+	if err != nil {
+		return "", err
+	}
+
+	respBytes, err := getResponseBytes(resp)
+
+	if err != nil {
+		return "", err
+	}
+
+	if resp.StatusCode != http.StatusCreated {
+		return "", fmt.Errorf("got %d: %s", resp.StatusCode, respBytes)
+	}
+
+	err = json.Unmarshal(respBytes, &tokJSON)
+
+	if err != nil {
+		return "", err
+	}
+
+	return tokJSON.Token, nil
+}
+
 var client http.Client
 
 func TestGetWelcome(t *testing.T) {
@@ -367,7 +505,7 @@ func TestCreateTransfers(t *testing.T) {
 	}
 
 	var req *http.Request
-	req, err = http.NewRequest(http.MethodPost, url+"/transfers",
+	req, err = http.NewRequest(http.MethodPost, serverURL+"/transfers",
 		bytes.NewReader(jsonBytes))
 
 	if err != nil {
@@ -482,7 +620,7 @@ func TestCreateTransfers(t *testing.T) {
 	}
 
 	// Get the list of transfers
-	req, err = http.NewRequest(http.MethodGet, url+"/transfers",
+	req, err = http.NewRequest(http.MethodGet, serverURL+"/transfers",
 		bytes.NewReader(jsonBytes))
 
 	if err != nil {
@@ -537,37 +675,4404 @@ func TestCreateTransfers(t *testing.T) {
 	}
 }
 
-// This is a big test that starts the server and talks to it with http.Client.
-// It deletes stuff in the database to clear it first.
-func TestMain(m *testing.M) {
+func TestTransferLimits(t *testing.T) {
+	var testAccounts = []accountCreateRequest{
+		accountCreateRequest{
+			Name: "John Doe", CPF: "420.321-11", Secret: "toto",
+			Timezone: "Europe/Lisbon"},
+		accountCreateRequest{
+			Name: "Jane Doe", CPF: "421.321-11", Secret: "tata"},
+	}
 
-	// We don't care about authentication for these tests.
-	tlsConfig := &tls.Config{InsecureSkipVerify: true}
-	tr := &http.Transport{TLSClientConfig: tlsConfig}
-	client = http.Client{Transport: tr}
+	var accs [2]*account
 
-	var err = OpenDBPool()
-	defer DB.Close()
+	for i, testAccount := range testAccounts {
+		acc, err := createTestAccount(testAccount)
+
+		if err != nil {
+			t.Log(err)
+			t.FailNow()
+		}
+
+		accs[i] = acc
+	}
+
+	if accs[0].Timezone != "Europe/Lisbon" {
+		t.Error(accs[0].Timezone)
+	}
+
+	if accs[1].Timezone != defaultTimezone {
+		t.Error(accs[1].Timezone)
+	}
+
+	token, err := loginAs(testAccounts[0].CPF, testAccounts[0].Secret)
 
 	if err != nil {
-		fmt.Println("Could not open DB.")
-		os.Exit(1)
+		t.Log(err)
+		t.FailNow()
 	}
 
-	// Clean up the transfers before we test.
-	_, err = DB.Exec("delete from transfers")
+	// Lower the per transfer and daily limits
+	resp, err := doWithToken(http.MethodPost, "/limits", token,
+		[]byte(`{"per_transfer": 100.00, "daily": 150.00}`))
 
 	if err != nil {
-		fmt.Printf("Could not delete accounts: %v\n", err)
-		os.Exit(1)
+		t.Log(err)
+		t.FailNow()
 	}
 
-	// Clean up the accounts before we test.
-	_, err = DB.Exec("delete from accounts")
+	respBytes, err := getResponseBytes(resp)
 
 	if err != nil {
-		fmt.Printf("Could not delete accounts: %v\n", err)
-		os.Exit(1)
+		t.Log(err)
+		t.FailNow()
+	}
+
+	if resp.StatusCode != http.StatusOK {
+		t.Log(resp.StatusCode)
+		t.FailNow()
+	}
+
+	var limits transferLimits
+	err = json.Unmarshal(respBytes, &limits)
+
+	if err != nil {
+		t.Log(err)
+		t.FailNow()
+	}
+
+	if limits.PerTransfer != 10000 || limits.Daily != 15000 ||
+		limits.Monthly != defaultLimits.Monthly {
+		t.Error(limits)
+	}
+
+	// Raising is not allowed
+	resp, err = doWithToken(http.MethodPost, "/limits", token,
+		[]byte(`{"daily": 200.00}`))
+
+	if err != nil {
+		t.Log(err)
+		t.FailNow()
+	}
+
+	resp.Body.Close()
+
+	if resp.StatusCode != limitRaiseError.status {
+		t.Error(resp.StatusCode)
+	}
+
+	var limitErrors = []struct {
+		amount    string
+		limit     string
+		remaining money
+	}{
+		{"120.00", "per_transfer", 10000},
+		{"100.00", "", 0},
+		{"60.00", "daily", 5000},
+	}
+
+	for _, limitError := range limitErrors {
+		resp, err = doWithToken(http.MethodPost, "/transfers", token,
+			[]byte(fmt.Sprintf(
+				`{"account_destination_id": %d, "amount": %s}`,
+				accs[1].ID, limitError.amount)))
+
+		if err != nil {
+			t.Log(err)
+			t.FailNow()
+		}
+
+		respBytes, err = getResponseBytes(resp)
+
+		if err != nil {
+			t.Log(err)
+			t.FailNow()
+		}
+
+		if limitError.limit == "" {
+			if resp.StatusCode != http.StatusCreated {
+				t.Error(resp.StatusCode)
+			}
+
+			continue
+		}
+
+		var limitErr struct {
+			Code    string `json:"code"`
+			Details struct {
+				Limit     string `json:"limit"`
+				Remaining money  `json:"remaining"`
+			} `json:"details"`
+		}
+
+		err = json.Unmarshal(respBytes, &limitErr)
+
+		if err != nil {
+			t.Log(err)
+			t.FailNow()
+		}
+
+		if resp.StatusCode != http.StatusBadRequest ||
+			limitErr.Code != "limit_exceeded" ||
+			limitErr.Details.Limit != limitError.limit ||
+			limitErr.Details.Remaining != limitError.remaining {
+			t.Error(resp.StatusCode, limitErr)
+		}
+	}
+}
+
+func TestRiskReview(t *testing.T) {
+	var testAccounts = []accountCreateRequest{
+		accountCreateRequest{
+			Name: "John Doe", CPF: "520.321-11", Secret: "toto"},
+		accountCreateRequest{
+			Name: "Jane Doe", CPF: "521.321-11", Secret: "tata"},
+		accountCreateRequest{
+			Name: "Admin", CPF: "522.321-11", Secret: "tete"},
+	}
+
+	var accs [3]*account
+	var tokens [3]string
+
+	for i, testAccount := range testAccounts {
+		acc, err := createTestAccount(testAccount)
+
+		if err != nil {
+			t.Log(err)
+			t.FailNow()
+		}
+
+		accs[i] = acc
+
+		// Raise the nighttime limit so the test doesn't depend on the time
+		// it runs.
+		_, err = DB.Exec(
+			`insert into account_limits values ($1, $2, $3, $4, $5)`,
+			acc.ID, defaultLimits.PerTransfer, defaultLimits.Daily,
+			defaultLimits.Monthly, defaultLimits.Daily)
+
+		if err != nil {
+			t.Log(err)
+			t.FailNow()
+		}
+
+		tokens[i], err = loginAs(testAccount.CPF, testAccount.Secret)
+
+		if err != nil {
+			t.Log(err)
+			t.FailNow()
+		}
+	}
+
+	_, err := DB.Exec("update accounts set admin = true where id = $1",
+		accs[2].ID)
+
+	if err != nil {
+		t.Log(err)
+		t.FailNow()
+	}
+
+	// First large transfer to a new destination goes to review
+	pending := make([]pendingTransfer, 2)
+
+	var reviewTransfers = []struct {
+		token  string
+		destID int
+		amount string
+		rule   string
+	}{
+		{tokens[0], accs[1].ID, "1500.00", "new_destination"},
+		{tokens[1], accs[0].ID, "10.00", "round_trip"},
+	}
+
+	for i, reviewTransfer := range reviewTransfers {
+		resp, err := doWithToken(http.MethodPost, "/transfers",
+			reviewTransfer.token, []byte(fmt.Sprintf(
+				`{"account_destination_id": %d, "amount": %s}`,
+				reviewTransfer.destID, reviewTransfer.amount)))
+
+		if err != nil {
+			t.Log(err)
+			t.FailNow()
+		}
+
+		respBytes, err := getResponseBytes(resp)
+
+		if err != nil {
+			t.Log(err)
+			t.FailNow()
+		}
+
+		if resp.StatusCode != http.StatusAccepted {
+			t.Log(resp.StatusCode, string(respBytes))
+			t.FailNow()
+		}
+
+		err = json.Unmarshal(respBytes, &pending[i])
+
+		if err != nil {
+			t.Log(err)
+			t.FailNow()
+		}
+
+		if pending[i].Status != "pending" ||
+			pending[i].Rule != reviewTransfer.rule {
+			t.Error(pending[i])
+		}
+
+		// Approve the first one, so the second is a round trip.
+		if i == 0 {
+			// Only admins can review
+			resp, err = doWithToken(http.MethodPost,
+				fmt.Sprintf("/admin/pending-transfers/%d/approve",
+					pending[i].ID), tokens[0], nil)
+
+			if err != nil {
+				t.Log(err)
+				t.FailNow()
+			}
+
+			resp.Body.Close()
+
+			if resp.StatusCode != forbiddenError.status {
+				t.Error(resp.StatusCode)
+			}
+
+			resp, err = doWithToken(http.MethodPost,
+				fmt.Sprintf("/admin/pending-transfers/%d/approve",
+					pending[i].ID), tokens[2], nil)
+
+			if err != nil {
+				t.Log(err)
+				t.FailNow()
+			}
+
+			respBytes, err = getResponseBytes(resp)
+
+			if err != nil {
+				t.Log(err)
+				t.FailNow()
+			}
+
+			err = json.Unmarshal(respBytes, &pending[i])
+
+			if err != nil {
+				t.Log(err)
+				t.FailNow()
+			}
+
+			if resp.StatusCode != http.StatusOK ||
+				pending[i].Status != "approved" ||
+				pending[i].TransferID == nil {
+				t.Error(resp.StatusCode, pending[i])
+			}
+		}
+	}
+
+	// The second one is waiting for review
+	resp, err := doWithToken(http.MethodGet, "/admin/pending-transfers",
+		tokens[2], nil)
+
+	if err != nil {
+		t.Log(err)
+		t.FailNow()
+	}
+
+	respBytes, err := getResponseBytes(resp)
+
+	if err != nil {
+		t.Log(err)
+		t.FailNow()
+	}
+
+	var pendings []pendingTransfer
+	err = json.Unmarshal(respBytes, &pendings)
+
+	if err != nil {
+		t.Log(err)
+		t.FailNow()
+	}
+
+	if len(pendings) != 1 || pendings[0].ID != pending[1].ID {
+		t.Error(pendings)
+	}
+
+	resp, err = doWithToken(http.MethodPost,
+		fmt.Sprintf("/admin/pending-transfers/%d/reject", pending[1].ID),
+		tokens[2], nil)
+
+	if err != nil {
+		t.Log(err)
+		t.FailNow()
+	}
+
+	resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		t.Error(resp.StatusCode)
+	}
+
+	// Can't review twice
+	resp, err = doWithToken(http.MethodPost,
+		fmt.Sprintf("/admin/pending-transfers/%d/approve", pending[1].ID),
+		tokens[2], nil)
+
+	if err != nil {
+		t.Log(err)
+		t.FailNow()
+	}
+
+	resp.Body.Close()
+
+	if resp.StatusCode != noPendingTransferError.status {
+		t.Error(resp.StatusCode)
+	}
+
+	// The admin's decisions are recorded with the rules'
+	for i, decision := range []string{"approve", "reject"} {
+		var decisions int
+
+		err = DB.QueryRow(
+			`select count(*) from risk_decisions where pending_id = $1
+			and decision = $2 and decided_by = $3 and rule is null
+			and (transfer_id is not null) = ($2 = 'approve')`,
+			pending[i].ID, decision, accs[2].ID).Scan(&decisions)
+
+		if err != nil || decisions != 1 {
+			t.Error(decision, decisions, err)
+		}
+	}
+
+	// Only the approved transfer moved money
+	var balances = []struct {
+		id      int
+		balance money
+	}{
+		{accs[0].ID, accs[0].Balance - 150000},
+		{accs[1].ID, accs[1].Balance + 150000},
+	}
+
+	for _, balance := range balances {
+		var actual money
+
+		err = DB.QueryRow("select balance from accounts where id = $1",
+			balance.id).Scan(&actual)
+
+		if err != nil {
+			t.Log(err)
+			t.FailNow()
+		}
+
+		if actual != balance.balance {
+			t.Error(balance.id, actual)
+		}
+	}
+}
+
+func TestTransferBatches(t *testing.T) {
+	var testAccounts = []accountCreateRequest{
+		accountCreateRequest{
+			Name: "Payer", CPF: "620.321-11", Secret: "toto"},
+		accountCreateRequest{
+			Name: "John Doe", CPF: "621.321-11", Secret: "tata"},
+		accountCreateRequest{
+			Name: "Jane Doe", CPF: "622.321-11", Secret: "tete"},
+	}
+
+	var accs [3]*account
+
+	for i, testAccount := range testAccounts {
+		acc, err := createTestAccount(testAccount)
+
+		if err != nil {
+			t.Log(err)
+			t.FailNow()
+		}
+
+		accs[i] = acc
+	}
+
+	token, err := loginAs(testAccounts[0].CPF, testAccounts[0].Secret)
+
+	if err != nil {
+		t.Log(err)
+		t.FailNow()
+	}
+
+	var batchTests = []struct {
+		contentType string
+		query       string
+		body        string
+		status      string
+		items       []string
+	}{
+		// Best effort, the second destination doesn't exist
+		{"application/json", "",
+			fmt.Sprintf(`{"transfers": [
+			{"account_destination_id": %d, "amount": 10.00},
+			{"account_destination_id": %d, "amount": 10.00},
+			{"account_destination_id": %d, "amount": 20.00}]}`,
+				accs[1].ID, accs[2].ID+1000, accs[2].ID),
+			"partial", []string{"completed", "failed", "completed"}},
+		// Atomic, same thing rolls everything back
+		{"application/json", "",
+			fmt.Sprintf(`{"atomic": true, "transfers": [
+			{"account_destination_id": %d, "amount": 10.00},
+			{"account_destination_id": %d, "amount": 10.00}]}`,
+				accs[1].ID, accs[2].ID+1000),
+			"failed", []string{"rolled_back", "failed"}},
+		// Atomic, more than the balance in total
+		{"text/csv", "?atomic=true",
+			fmt.Sprintf("account_destination_id,amount\n%d,900.00\n"+
+				"%d,900.00\n%d,900.00\n", accs[1].ID, accs[2].ID, accs[1].ID),
+			"failed", []string{"rolled_back", "rolled_back", "rolled_back"}},
+		// Atomic CSV
+		{"text/csv", "?atomic=true",
+			fmt.Sprintf("account_destination_id,amount\n%d,1.00\n%d,2.00\n",
+				accs[1].ID, accs[2].ID),
+			"completed", []string{"completed", "completed"}},
+	}
+
+	for _, batchTest := range batchTests {
+		req, err := http.NewRequest(http.MethodPost,
+			serverURL+"/transfers/batch"+batchTest.query,
+			strings.NewReader(batchTest.body))
+
+		if err != nil {
+			t.Log(err)
+			t.FailNow()
+		}
+
+		req.Header.Set("Authorization", token)
+		req.Header.Set("Content-Type", batchTest.contentType)
+
+		resp, err := client.Do(req)
+
+		if err != nil {
+			t.Log(err)
+			t.FailNow()
+		}
+
+		respBytes, err := getResponseBytes(resp)
+
+		if err != nil {
+			t.Log(err)
+			t.FailNow()
+		}
+
+		if resp.StatusCode != http.StatusCreated {
+			t.Log(resp.StatusCode, string(respBytes))
+			t.FailNow()
+		}
+
+		var batch transferBatch
+		err = json.Unmarshal(respBytes, &batch)
+
+		if err != nil {
+			t.Log(err)
+			t.FailNow()
+		}
+
+		// The status endpoint reports the same
+		resp, err = doWithToken(http.MethodGet,
+			fmt.Sprintf("/transfers/batch/%d", batch.ID), token, nil)
+
+		if err != nil {
+			t.Log(err)
+			t.FailNow()
+		}
+
+		respBytes, err = getResponseBytes(resp)
+
+		if err != nil {
+			t.Log(err)
+			t.FailNow()
+		}
+
+		var batchStatus transferBatch
+		err = json.Unmarshal(respBytes, &batchStatus)
+
+		if err != nil {
+			t.Log(err)
+			t.FailNow()
+		}
+
+		for _, b := range []transferBatch{batch, batchStatus} {
+			if b.Status != batchTest.status ||
+				len(b.Items) != len(batchTest.items) {
+				t.Error(b)
+				continue
+			}
+
+			for i, item := range b.Items {
+				if item.Status != batchTest.items[i] {
+					t.Error(b.ID, i, item)
+				}
+			}
+		}
+	}
+
+	// Only the completed items moved money
+	var balances = []struct {
+		id      int
+		balance money
+	}{
+		{accs[0].ID, accs[0].Balance - 3300},
+		{accs[1].ID, accs[1].Balance + 1100},
+		{accs[2].ID, accs[2].Balance + 2200},
+	}
+
+	for _, balance := range balances {
+		var actual money
+
+		err = DB.QueryRow("select balance from accounts where id = $1",
+			balance.id).Scan(&actual)
+
+		if err != nil {
+			t.Log(err)
+			t.FailNow()
+		}
+
+		if actual != balance.balance {
+			t.Error(balance.id, actual)
+		}
+	}
+
+	// Other accounts can't see the batch
+	otherToken, err := loginAs(testAccounts[1].CPF, testAccounts[1].Secret)
+
+	if err != nil {
+		t.Log(err)
+		t.FailNow()
+	}
+
+	resp, err := doWithToken(http.MethodGet, "/transfers/batch/1",
+		otherToken, nil)
+
+	if err != nil {
+		t.Log(err)
+		t.FailNow()
+	}
+
+	resp.Body.Close()
+
+	if resp.StatusCode != noBatchError.status {
+		t.Error(resp.StatusCode)
+	}
+
+	// Sending money back to John goes to review, which fails an atomic
+	// batch instead of leaving it partly made
+	resp, err = doWithToken(http.MethodPost, "/transfers", otherToken,
+		[]byte(fmt.Sprintf(`{"account_destination_id": %d, "amount": 1.00}`,
+			accs[0].ID)))
+
+	if err != nil {
+		t.Log(err)
+		t.FailNow()
+	}
+
+	resp.Body.Close()
+
+	if resp.StatusCode != http.StatusCreated {
+		t.Log(resp.StatusCode)
+		t.FailNow()
+	}
+
+	resp, err = doWithToken(http.MethodPost, "/transfers/batch", token,
+		[]byte(fmt.Sprintf(`{"atomic": true, "transfers": [
+		{"account_destination_id": %d, "amount": 1.00},
+		{"account_destination_id": %d, "amount": 1.00}]}`,
+			accs[2].ID, accs[1].ID)))
+
+	if err != nil {
+		t.Log(err)
+		t.FailNow()
+	}
+
+	respBytes, err := getResponseBytes(resp)
+
+	if err != nil {
+		t.Log(err)
+		t.FailNow()
+	}
+
+	var batch transferBatch
+	err = json.Unmarshal(respBytes, &batch)
+
+	if err != nil {
+		t.Log(err)
+		t.FailNow()
+	}
+
+	if resp.StatusCode != http.StatusCreated || batch.Status != "failed" ||
+		len(batch.Items) != 2 || batch.Items[0].Status != "rolled_back" ||
+		batch.Items[1].Status != "failed" ||
+		batch.Items[1].PendingID != nil {
+		t.Error(resp.StatusCode, string(respBytes))
+	}
+
+	var pendings int
+
+	err = DB.QueryRow(
+		"select count(*) from pending_transfers where origin_id = $1",
+		accs[0].ID).Scan(&pendings)
+
+	if err != nil || pendings != 0 {
+		t.Error(pendings, err)
+	}
+}
+
+func TestFinishBestEffortBatch(t *testing.T) {
+	acc, err := createTestAccount(accountCreateRequest{
+		Name: "Stopped Batch", CPF: "874.000-01", Secret: "batch"})
+
+	if err != nil {
+		t.Log(err)
+		t.FailNow()
+	}
+
+	stopErr := errors.New("connection reset")
+
+	for _, test := range []struct {
+		done     int
+		failures int
+		stopErr  error
+		status   string
+	}{
+		{2, 0, nil, "completed"},
+		{1, 1, nil, "partial"},
+		{0, 2, nil, "failed"},
+		// Stopped before the end, it's never completed
+		{1, 0, stopErr, "partial"},
+		{0, 1, stopErr, "failed"},
+	} {
+		batch := transferBatch{OriginID: acc.ID, Status: "processing",
+			Total: 200}
+
+		if err = insertBatchRow(DB, &batch); err != nil {
+			t.Log(err)
+			t.FailNow()
+		}
+
+		err = finishBestEffortBatch(&batch, test.done, test.failures,
+			test.stopErr)
+
+		var status string
+		var hasError bool
+
+		scanErr := DB.QueryRow(
+			`select status, error is not null from transfer_batches
+			where id = $1`, batch.ID).Scan(&status, &hasError)
+
+		if err != test.stopErr || scanErr != nil || status != test.status ||
+			hasError != (test.stopErr != nil) {
+
+			t.Error(test, err, scanErr, status, hasError)
+		}
+	}
+}
+
+func TestTransferDetails(t *testing.T) {
+	var testAccounts = []accountCreateRequest{
+		accountCreateRequest{
+			Name: "John Doe", CPF: "720.321-11", Secret: "toto"},
+		accountCreateRequest{
+			Name: "Jane Doe", CPF: "721.321-11", Secret: "tata"},
+	}
+
+	var accs [2]*account
+
+	for i, testAccount := range testAccounts {
+		acc, err := createTestAccount(testAccount)
+
+		if err != nil {
+			t.Log(err)
+			t.FailNow()
+		}
+
+		accs[i] = acc
+	}
+
+	token, err := loginAs(testAccounts[0].CPF, testAccounts[0].Secret)
+
+	if err != nil {
+		t.Log(err)
+		t.FailNow()
+	}
+
+	var transferReqs = []transferRequest{
+		{DestinationID: accs[1].ID, Amount: 1000,
+			Description: "Rent for September", Reference: "RENT-09",
+			Metadata: transferMetadata{"kind": "rent", "month": "09"}},
+		{DestinationID: accs[1].ID, Amount: 2000,
+			Description: "Rent for October", Reference: "RENT-10",
+			Metadata: transferMetadata{"kind": "rent", "month": "10"}},
+		{DestinationID: accs[1].ID, Amount: 500},
+	}
+
+	for _, transferReq := range transferReqs {
+		jsonBytes, err := json.Marshal(&transferReq)
+
+		if err != nil {
+			t.Log(err)
+			t.FailNow()
+		}
+
+		resp, err := doWithToken(http.MethodPost, "/transfers", token,
+			jsonBytes)
+
+		if err != nil {
+			t.Log(err)
+			t.FailNow()
+		}
+
+		respBytes, err := getResponseBytes(resp)
+
+		if err != nil {
+			t.Log(err)
+			t.FailNow()
+		}
+
+		if resp.StatusCode != http.StatusCreated {
+			t.Log(resp.StatusCode, string(respBytes))
+			t.FailNow()
+		}
+
+		var transf transfer
+		err = json.Unmarshal(respBytes, &transf)
+
+		if err != nil {
+			t.Log(err)
+			t.FailNow()
+		}
+
+		if transf.Description != transferReq.Description ||
+			transf.Reference != transferReq.Reference ||
+			len(transf.Metadata) != len(transferReq.Metadata) {
+			t.Error(transf)
+		}
+	}
+
+	var filterTests = []struct {
+		query   string
+		amounts []money
+	}{
+		{"", []money{1000, 2000, 500}},
+		{"?reference=RENT-10", []money{2000}},
+		{"?description=september", []money{1000}},
+		{"?metadata.kind=rent", []money{1000, 2000}},
+		{"?metadata.kind=rent&metadata.month=09", []money{1000}},
+		{"?metadata.kind=salary", []money{}},
+	}
+
+	for _, filterTest := range filterTests {
+		resp, err := doWithToken(http.MethodGet,
+			"/transfers"+filterTest.query, token, nil)
+
+		if err != nil {
+			t.Log(err)
+			t.FailNow()
+		}
+
+		respBytes, err := getResponseBytes(resp)
+
+		if err != nil {
+			t.Log(err)
+			t.FailNow()
+		}
+
+		var transfers []transfer
+		err = json.Unmarshal(respBytes, &transfers)
+
+		if err != nil {
+			t.Log(err)
+			t.FailNow()
+		}
+
+		if len(transfers) != len(filterTest.amounts) {
+			t.Error(filterTest.query, transfers)
+			continue
+		}
+
+		for i, transf := range transfers {
+			if transf.Amount != filterTest.amounts[i] {
+				t.Error(filterTest.query, transfers)
+			}
+		}
+	}
+}
+
+func TestTransferPagination(t *testing.T) {
+	var testAccounts = []accountCreateRequest{
+		accountCreateRequest{
+			Name: "John Doe", CPF: "820.321-11", Secret: "toto"},
+		accountCreateRequest{
+			Name: "Jane Doe", CPF: "821.321-11", Secret: "tata"},
+		accountCreateRequest{
+			Name: "Arseny", CPF: "822.321-11", Secret: "tete"},
+		accountCreateRequest{
+			Name: "Other", CPF: "823.321-11", Secret: "titi"},
+	}
+
+	var accs [4]*account
+	var tokens [4]string
+
+	for i, testAccount := range testAccounts {
+		acc, err := createTestAccount(testAccount)
+
+		if err != nil {
+			t.Log(err)
+			t.FailNow()
+		}
+
+		accs[i] = acc
+
+		tokens[i], err = loginAs(testAccount.CPF, testAccount.Secret)
+
+		if err != nil {
+			t.Log(err)
+			t.FailNow()
+		}
+	}
+
+	// John sends 1.00, 2.00, ... 5.00 alternating between Jane and Arseny,
+	// and receives 6.00 from someone he never sent to, so it's not a round
+	// trip.
+	var transferReqs = []struct {
+		from   int
+		to     int
+		amount money
+	}{
+		{0, 1, 100}, {0, 2, 200}, {0, 1, 300}, {0, 2, 400}, {0, 1, 500},
+		{3, 0, 600},
+	}
+
+	for _, transferReq := range transferReqs {
+		resp, err := doWithToken(http.MethodPost, "/transfers",
+			tokens[transferReq.from], []byte(fmt.Sprintf(
+				`{"account_destination_id": %d, "amount": %s}`,
+				accs[transferReq.to].ID, transferReq.amount)))
+
+		if err != nil {
+			t.Log(err)
+			t.FailNow()
+		}
+
+		respBytes, err := getResponseBytes(resp)
+
+		if err != nil {
+			t.Log(err)
+			t.FailNow()
+		}
+
+		if resp.StatusCode != http.StatusCreated {
+			t.Log(resp.StatusCode, string(respBytes))
+			t.FailNow()
+		}
+	}
+
+	var pageTests = []struct {
+		query   string
+		amounts []money
+	}{
+		{"?limit=2", []money{100, 200, 300, 400, 500, 600}},
+		{"?limit=4&sort=amount&order=desc", []money{600, 500, 400, 300, 200,
+			100}},
+		{"?limit=1&sort=created_at&direction=sent&counterparty=" +
+			fmt.Sprint(accs[1].ID), []money{100, 300, 500}},
+		{"?limit=10&direction=received", []money{600}},
+		{"?limit=10&min_amount=2.00&max_amount=4.00",
+			[]money{200, 300, 400}},
+		{"?limit=10&from=2000-01-01&to=2000-12-31", []money{}},
+	}
+
+	for _, pageTest := range pageTests {
+		var amounts []money
+		query := pageTest.query
+
+		for {
+			resp, err := doWithToken(http.MethodGet, "/transfers"+query,
+				tokens[0], nil)
+
+			if err != nil {
+				t.Log(err)
+				t.FailNow()
+			}
+
+			respBytes, err := getResponseBytes(resp)
+
+			if err != nil {
+				t.Log(err)
+				t.FailNow()
+			}
+
+			if resp.StatusCode != http.StatusOK {
+				t.Log(resp.StatusCode, string(respBytes))
+				t.FailNow()
+			}
+
+			var page transferPage
+			err = json.Unmarshal(respBytes, &page)
+
+			if err != nil {
+				t.Log(err)
+				t.FailNow()
+			}
+
+			for _, transf := range page.Transfers {
+				amounts = append(amounts, transf.Amount)
+			}
+
+			if page.NextCursor == "" {
+				break
+			}
+
+			query = pageTest.query + "&cursor=" + page.NextCursor
+		}
+
+		if fmt.Sprint(amounts) != fmt.Sprint(pageTest.amounts) &&
+			!(len(amounts) == 0 && len(pageTest.amounts) == 0) {
+			t.Error(pageTest.query, amounts)
+		}
+	}
+
+	// Without limit or cursor, every transfer comes as an array
+	resp, err := doWithToken(http.MethodGet,
+		"/transfers?sort=amount&order=desc", tokens[0], nil)
+
+	if err != nil {
+		t.Log(err)
+		t.FailNow()
+	}
+
+	respBytes, err := getResponseBytes(resp)
+
+	if err != nil {
+		t.Log(err)
+		t.FailNow()
+	}
+
+	var transfers []transfer
+	err = json.Unmarshal(respBytes, &transfers)
+
+	if err != nil || len(transfers) != 6 || transfers[0].Amount != 600 ||
+		transfers[5].Amount != 100 {
+		t.Error(string(respBytes), err)
+	}
+
+	// Bad parameters
+	for _, query := range []string{"?limit=0", "?limit=1000", "?sort=cpf",
+		"?order=up", "?direction=up", "?min_amount=1", "?from=yesterday",
+		"?cursor=what"} {
+		resp, err := doWithToken(http.MethodGet, "/transfers"+query,
+			tokens[0], nil)
+
+		if err != nil {
+			t.Log(err)
+			t.FailNow()
+		}
+
+		resp.Body.Close()
+
+		if resp.StatusCode != http.StatusBadRequest {
+			t.Error(query, resp.StatusCode)
+		}
+	}
+}
+
+// This is a big test that starts the server and talks to it with http.Client.
+// It deletes stuff in the database to clear it first.
+func TestAccountStatements(t *testing.T) {
+	var testAccounts = []accountCreateRequest{
+		accountCreateRequest{
+			Name: "John Doe", CPF: "920.321-11", Secret: "toto"},
+		accountCreateRequest{
+			Name: "Jane Doe", CPF: "921.321-11", Secret: "tata"},
+	}
+
+	var accs [2]*account
+	var tokens [2]string
+
+	for i, testAccount := range testAccounts {
+		acc, err := createTestAccount(testAccount)
+
+		if err != nil {
+			t.Log(err)
+			t.FailNow()
+		}
+
+		accs[i] = acc
+
+		tokens[i], err = loginAs(testAccount.CPF, testAccount.Secret)
+
+		if err != nil {
+			t.Log(err)
+			t.FailNow()
+		}
+	}
+
+	var transfers = []struct {
+		from   int
+		to     int
+		amount money
+	}{
+		{0, 1, 1000},
+		{0, 1, 2000},
+		{1, 0, 500},
+	}
+
+	for _, tr := range transfers {
+		jsonBytes, err := json.Marshal(&transferRequest{
+			DestinationID: accs[tr.to].ID, Amount: tr.amount})
+
+		if err != nil {
+			t.Log(err)
+			t.FailNow()
+		}
+
+		resp, err := doWithToken(http.MethodPost, "/transfers",
+			tokens[tr.from], jsonBytes)
+
+		if err != nil {
+			t.Log(err)
+			t.FailNow()
+		}
+
+		resp.Body.Close()
+
+		if resp.StatusCode != http.StatusCreated {
+			t.Log(resp.StatusCode)
+			t.FailNow()
+		}
+	}
+
+	// Transfers to the same account are refused
+	jsonBytes, _ := json.Marshal(&transferRequest{
+		DestinationID: accs[0].ID, Amount: 100})
+	resp, err := doWithToken(http.MethodPost, "/transfers", tokens[0],
+		jsonBytes)
+
+	if err != nil {
+		t.Log(err)
+		t.FailNow()
+	}
+
+	resp.Body.Close()
+
+	if resp.StatusCode != http.StatusBadRequest {
+		t.Error("self transfer", resp.StatusCode)
+	}
+
+	statementPath := fmt.Sprintf("/accounts/%d/statement", accs[0].ID)
+
+	resp, err = doWithToken(http.MethodGet, statementPath, tokens[0], nil)
+
+	if err != nil {
+		t.Log(err)
+		t.FailNow()
+	}
+
+	respBytes, err := getResponseBytes(resp)
+
+	if err != nil {
+		t.Log(err)
+		t.FailNow()
+	}
+
+	if resp.StatusCode != http.StatusOK {
+		t.Log(resp.StatusCode, string(respBytes))
+		t.FailNow()
+	}
+
+	var stmt statement
+	err = json.Unmarshal(respBytes, &stmt)
+
+	if err != nil {
+		t.Log(err)
+		t.FailNow()
+	}
+
+	if stmt.OpeningBalance != 233472 || stmt.ClosingBalance != 231972 {
+		t.Error(stmt.OpeningBalance, stmt.ClosingBalance)
+	}
+
+	var expected = []struct {
+		kind    string
+		amount  money
+		balance money
+	}{
+		{"debit", 1000, 232472},
+		{"debit", 2000, 230472},
+		{"credit", 500, 230972},
+	}
+
+	if len(stmt.Entries) != len(expected) {
+		t.Log(string(respBytes))
+		t.FailNow()
+	}
+
+	for i, exp := range expected {
+		entry := stmt.Entries[i]
+
+		if entry.Type != exp.kind || entry.Amount != exp.amount ||
+			entry.Balance != exp.balance ||
+			entry.CounterpartyID != accs[1].ID {
+			t.Error(i, entry)
+		}
+	}
+
+	// The closing balance ties out with the balance endpoint
+	balanceResp, err := getBalance(accs[0].ID)
+
+	if err != nil {
+		t.Log(err)
+		t.FailNow()
+	}
+
+	if balanceResp.Balance != stmt.ClosingBalance {
+		t.Error(balanceResp.Balance)
+	}
+
+	// A period before any transfer has no entries and the starting balance
+	resp, err = doWithToken(http.MethodGet,
+		statementPath+"?from=2000-01-01&to=2000-01-31", tokens[0], nil)
+
+	if err != nil {
+		t.Log(err)
+		t.FailNow()
+	}
+
+	respBytes, err = getResponseBytes(resp)
+
+	if err != nil {
+		t.Log(err)
+		t.FailNow()
+	}
+
+	stmt = statement{}
+	err = json.Unmarshal(respBytes, &stmt)
+
+	if err != nil || len(stmt.Entries) != 0 ||
+		stmt.OpeningBalance != 233472 || stmt.ClosingBalance != 233472 {
+		t.Error(string(respBytes))
+	}
+
+	// CSV ends with the closing balance
+	resp, err = doWithToken(http.MethodGet, statementPath+"?format=csv",
+		tokens[0], nil)
+
+	if err != nil {
+		t.Log(err)
+		t.FailNow()
+	}
+
+	respString, err := getResponseString(resp)
+
+	if err != nil {
+		t.Log(err)
+		t.FailNow()
+	}
+
+	lines := strings.Split(strings.TrimSpace(respString), "\n")
+
+	if resp.Header.Get("Content-Type") != "text/csv;charset=UTF-8" ||
+		len(lines) != 6 ||
+		!strings.HasSuffix(lines[5], ",closing,,,,,2319.72") {
+		t.Error(respString)
+	}
+
+	// OFX
+	resp, err = doWithToken(http.MethodGet, statementPath+"?format=ofx",
+		tokens[0], nil)
+
+	if err != nil {
+		t.Log(err)
+		t.FailNow()
+	}
+
+	respString, err = getResponseString(resp)
+
+	if err != nil {
+		t.Log(err)
+		t.FailNow()
+	}
+
+	if strings.Count(respString, "<STMTTRN>") != 3 ||
+		!strings.Contains(respString, "<BALAMT>2319.72</BALAMT>") {
+		t.Error(respString)
+	}
+
+	var badRequests = []struct {
+		path   string
+		token  string
+		status int
+	}{
+		// Someone else's statement
+		{statementPath, tokens[1], http.StatusForbidden},
+		{statementPath, "", http.StatusBadRequest},
+		{statementPath + "?format=pdf", tokens[0], http.StatusBadRequest},
+		{statementPath + "?from=2021-02-01&to=2021-01-01", tokens[0],
+			http.StatusBadRequest},
+		{statementPath + "?from=2019-01-01&to=2021-01-01", tokens[0],
+			http.StatusBadRequest},
+	}
+
+	for _, badReq := range badRequests {
+		resp, err := doWithToken(http.MethodGet, badReq.path, badReq.token,
+			nil)
+
+		if err != nil {
+			t.Log(err)
+			t.FailNow()
+		}
+
+		resp.Body.Close()
+
+		if resp.StatusCode != badReq.status {
+			t.Error(badReq.path, resp.StatusCode)
+		}
+	}
+}
+
+func TestTransferKeys(t *testing.T) {
+	var testAccounts = []accountCreateRequest{
+		accountCreateRequest{
+			Name: "John Doe", CPF: "930.321-11", Secret: "toto"},
+		accountCreateRequest{
+			Name: "Jane Doe", CPF: "931.321-11", Secret: "tata"},
+	}
+
+	var accs [2]*account
+	var tokens [2]string
+
+	for i, testAccount := range testAccounts {
+		acc, err := createTestAccount(testAccount)
+
+		if err != nil {
+			t.Log(err)
+			t.FailNow()
+		}
+
+		accs[i] = acc
+
+		tokens[i], err = loginAs(testAccount.CPF, testAccount.Secret)
+
+		if err != nil {
+			t.Log(err)
+			t.FailNow()
+		}
+	}
+
+	// Jane registers her CPF, an email and a random key
+	var keyReqs = []struct {
+		body   string
+		status int
+	}{
+		{`{"type": "cpf"}`, http.StatusCreated},
+		{`{"type": "email", "key": "Jane.Doe@Example.com"}`,
+			http.StatusCreated},
+		{`{"type": "random"}`, http.StatusCreated},
+		// Same email, different case
+		{`{"type": "email", "key": "jane.doe@example.com"}`,
+			http.StatusConflict},
+		{`{"type": "cpf", "key": "930.321-11"}`, http.StatusBadRequest},
+		{`{"type": "phone", "key": "98765-4321"}`, http.StatusBadRequest},
+		{`{"type": "nickname", "key": "jane"}`, http.StatusBadRequest},
+	}
+
+	var randomKey string
+
+	for _, keyReq := range keyReqs {
+		resp, err := doWithToken(http.MethodPost, "/keys", tokens[1],
+			[]byte(keyReq.body))
+
+		if err != nil {
+			t.Log(err)
+			t.FailNow()
+		}
+
+		respBytes, err := getResponseBytes(resp)
+
+		if err != nil {
+			t.Log(err)
+			t.FailNow()
+		}
+
+		if resp.StatusCode != keyReq.status {
+			t.Error(keyReq.body, resp.StatusCode, string(respBytes))
+			continue
+		}
+
+		var key transferKey
+
+		if resp.StatusCode == http.StatusCreated &&
+			json.Unmarshal(respBytes, &key) == nil && key.Type == "random" {
+			randomKey = key.Key
+		}
+	}
+
+	resp, err := doWithToken(http.MethodGet, "/keys", tokens[1], nil)
+
+	if err != nil {
+		t.Log(err)
+		t.FailNow()
+	}
+
+	respBytes, err := getResponseBytes(resp)
+
+	if err != nil {
+		t.Log(err)
+		t.FailNow()
+	}
+
+	var keys []transferKey
+	err = json.Unmarshal(respBytes, &keys)
+
+	if err != nil || len(keys) != 3 {
+		t.Log(string(respBytes))
+		t.FailNow()
+	}
+
+	// John looks the key up before paying
+	resp, err = doWithToken(http.MethodGet, "/keys/JANE.DOE@example.com",
+		tokens[0], nil)
+
+	if err != nil {
+		t.Log(err)
+		t.FailNow()
+	}
+
+	respBytes, err = getResponseBytes(resp)
+
+	if err != nil {
+		t.Log(err)
+		t.FailNow()
+	}
+
+	var lookup keyLookupResponse
+	err = json.Unmarshal(respBytes, &lookup)
+
+	if err != nil || lookup.Name != "J*** D**" ||
+		lookup.CPF != "***.321-**" || lookup.Type != "email" {
+		t.Error(string(respBytes))
+	}
+
+	var transferReqs = []struct {
+		body   string
+		status int
+	}{
+		{`{"destination_key": "jane.doe@example.com", "amount": 10.00}`,
+			http.StatusCreated},
+		{`{"destination_key": "931.321-11", "amount": 10.00}`,
+			http.StatusCreated},
+		{fmt.Sprintf(`{"destination_key": "%s", "amount": 10.00}`,
+			randomKey), http.StatusCreated},
+		{`{"destination_key": "nobody@example.com", "amount": 10.00}`,
+			http.StatusNotFound},
+		{fmt.Sprintf(`{"destination_key": "931.321-11",
+			"account_destination_id": %d, "amount": 10.00}`, accs[1].ID),
+			http.StatusBadRequest},
+	}
+
+	for _, transferReq := range transferReqs {
+		resp, err := doWithToken(http.MethodPost, "/transfers", tokens[0],
+			[]byte(transferReq.body))
+
+		if err != nil {
+			t.Log(err)
+			t.FailNow()
+		}
+
+		respBytes, err := getResponseBytes(resp)
+
+		if err != nil {
+			t.Log(err)
+			t.FailNow()
+		}
+
+		if resp.StatusCode != transferReq.status {
+			t.Error(transferReq.body, resp.StatusCode, string(respBytes))
+			continue
+		}
+
+		var transf transfer
+
+		if resp.StatusCode == http.StatusCreated &&
+			(json.Unmarshal(respBytes, &transf) != nil ||
+				transf.DestinationID != accs[1].ID) {
+			t.Error(string(respBytes))
+		}
+	}
+
+	// Only the owner can remove a key
+	resp, err = doWithToken(http.MethodDelete, "/keys/931.321-11",
+		tokens[0], nil)
+
+	if err != nil {
+		t.Log(err)
+		t.FailNow()
+	}
+
+	resp.Body.Close()
+
+	if resp.StatusCode != http.StatusNotFound {
+		t.Error(resp.StatusCode)
+	}
+
+	resp, err = doWithToken(http.MethodDelete, "/keys/931.321-11",
+		tokens[1], nil)
+
+	if err != nil {
+		t.Log(err)
+		t.FailNow()
+	}
+
+	resp.Body.Close()
+
+	if resp.StatusCode != http.StatusNoContent {
+		t.Error(resp.StatusCode)
+	}
+
+	resp, err = doWithToken(http.MethodGet, "/keys/931.321-11", tokens[0],
+		nil)
+
+	if err != nil {
+		t.Log(err)
+		t.FailNow()
+	}
+
+	resp.Body.Close()
+
+	if resp.StatusCode != http.StatusNotFound {
+		t.Error(resp.StatusCode)
+	}
+}
+
+func TestPaymentRequests(t *testing.T) {
+	var testAccounts = []accountCreateRequest{
+		accountCreateRequest{
+			Name: "Padaria Doe", CPF: "940.321-11", Secret: "toto"},
+		accountCreateRequest{
+			Name: "Jane Doe", CPF: "941.321-11", Secret: "tata"},
+		accountCreateRequest{
+			Name: "John Doe", CPF: "942.321-11", Secret: "titi"},
+	}
+
+	var accs [3]*account
+	var tokens [3]string
+
+	for i, testAccount := range testAccounts {
+		acc, err := createTestAccount(testAccount)
+
+		if err != nil {
+			t.Log(err)
+			t.FailNow()
+		}
+
+		accs[i] = acc
+
+		tokens[i], err = loginAs(testAccount.CPF, testAccount.Secret)
+
+		if err != nil {
+			t.Log(err)
+			t.FailNow()
+		}
+	}
+
+	// Create a request and return it as the server sent it back.
+	createRequest := func(body string) *paymentRequest {
+		resp, err := doWithToken(http.MethodPost, "/payment-requests",
+			tokens[0], []byte(body))
+
+		if err != nil {
+			t.Log(err)
+			t.FailNow()
+		}
+
+		respBytes, err := getResponseBytes(resp)
+
+		if err != nil {
+			t.Log(err)
+			t.FailNow()
+		}
+
+		if resp.StatusCode != http.StatusCreated {
+			t.Log(resp.StatusCode, string(respBytes))
+			t.FailNow()
+		}
+
+		var payReq paymentRequest
+		err = json.Unmarshal(respBytes, &payReq)
+
+		if err != nil {
+			t.Log(err)
+			t.FailNow()
+		}
+
+		return &payReq
+	}
+
+	// Pay the request with the payload and return the status code.
+	pay := func(token string, id int, payload string) int {
+		body, _ := json.Marshal(&paymentRequestPayRequest{Payload: payload})
+		resp, err := doWithToken(http.MethodPost,
+			fmt.Sprintf("/payment-requests/%d/pay", id), token, body)
+
+		if err != nil {
+			t.Log(err)
+			t.FailNow()
+		}
+
+		resp.Body.Close()
+
+		return resp.StatusCode
+	}
+
+	single := createRequest(
+		`{"amount": 12.50, "description": "Pão de queijo"}`)
+
+	if single.Status != "open" || single.AccountID != accs[0].ID ||
+		single.Payload == "" {
+		t.Error(single)
+	}
+
+	// A payload for another request, or tampered with, is refused
+	multi := createRequest(`{"amount": 5.00, "multi_use": true}`)
+
+	if status := pay(tokens[1], single.ID, multi.Payload); status !=
+		http.StatusBadRequest {
+		t.Error("wrong payload", status)
+	}
+
+	if status := pay(tokens[1], single.ID, single.Payload); status !=
+		http.StatusCreated {
+		t.Error("pay single", status)
+	}
+
+	// Single use, so it can't be paid again
+	if status := pay(tokens[2], single.ID, single.Payload); status !=
+		http.StatusConflict {
+		t.Error("pay single twice", status)
+	}
+
+	// Multi use
+	for i := 1; i <= 2; i++ {
+		if status := pay(tokens[i], multi.ID, multi.Payload); status !=
+			http.StatusCreated {
+			t.Error("pay multi", status)
+		}
+	}
+
+	resp, err := doWithToken(http.MethodGet,
+		fmt.Sprintf("/payment-requests/%d", multi.ID), tokens[2], nil)
+
+	if err != nil {
+		t.Log(err)
+		t.FailNow()
+	}
+
+	respBytes, err := getResponseBytes(resp)
+
+	if err != nil {
+		t.Log(err)
+		t.FailNow()
+	}
+
+	var payReq paymentRequest
+	err = json.Unmarshal(respBytes, &payReq)
+
+	if err != nil || payReq.Status != "open" || payReq.Payments != 2 {
+		t.Error(string(respBytes))
+	}
+
+	// The merchant got 12.50 + 2 * 5.00
+	balanceResp, err := getBalance(accs[0].ID)
+
+	if err != nil {
+		t.Log(err)
+		t.FailNow()
+	}
+
+	if balanceResp.Balance != 235722 {
+		t.Error(balanceResp.Balance)
+	}
+
+	// Only the merchant can cancel, and then nobody can pay
+	cancelPath := fmt.Sprintf("/payment-requests/%d/cancel", multi.ID)
+
+	for i, status := range []int{http.StatusForbidden, http.StatusOK} {
+		token := tokens[1]
+
+		if i == 1 {
+			token = tokens[0]
+		}
+
+		resp, err = doWithToken(http.MethodPost, cancelPath, token, nil)
+
+		if err != nil {
+			t.Log(err)
+			t.FailNow()
+		}
+
+		resp.Body.Close()
+
+		if resp.StatusCode != status {
+			t.Error("cancel", i, resp.StatusCode)
+		}
+	}
+
+	if status := pay(tokens[1], multi.ID, multi.Payload); status !=
+		http.StatusGone {
+		t.Error("pay cancelled", status)
+	}
+
+	// The merchant's list, newest first
+	resp, err = doWithToken(http.MethodGet, "/payment-requests", tokens[0],
+		nil)
+
+	if err != nil {
+		t.Log(err)
+		t.FailNow()
+	}
+
+	respBytes, err = getResponseBytes(resp)
+
+	if err != nil {
+		t.Log(err)
+		t.FailNow()
+	}
+
+	var page paymentRequestPage
+	err = json.Unmarshal(respBytes, &page)
+
+	if err != nil || len(page.PaymentRequests) != 2 ||
+		page.PaymentRequests[0].Status != "cancelled" ||
+		page.PaymentRequests[1].Status != "paid" {
+		t.Error(string(respBytes))
+	}
+
+	var badCreates = []string{
+		`{"amount": 0}`,
+		`{"amount": 1.00, "expires_at": "2001-01-01T00:00:00Z"}`,
+	}
+
+	for _, body := range badCreates {
+		resp, err = doWithToken(http.MethodPost, "/payment-requests",
+			tokens[0], []byte(body))
+
+		if err != nil {
+			t.Log(err)
+			t.FailNow()
+		}
+
+		resp.Body.Close()
+
+		if resp.StatusCode != http.StatusBadRequest {
+			t.Error(body, resp.StatusCode)
+		}
+	}
+}
+
+func TestTransferFees(t *testing.T) {
+	var testAccounts = []accountCreateRequest{
+		accountCreateRequest{
+			Name: "John Doe", CPF: "950.321-11", Secret: "toto"},
+		accountCreateRequest{
+			Name: "Jane Doe", CPF: "951.321-11", Secret: "tata"},
+		accountCreateRequest{
+			Name: "PedroBank", CPF: "952.321-11", Secret: "titi"},
+	}
+
+	var accs [3]*account
+
+	for i, testAccount := range testAccounts {
+		acc, err := createTestAccount(testAccount)
+
+		if err != nil {
+			t.Log(err)
+			t.FailNow()
+		}
+
+		accs[i] = acc
+	}
+
+	// 0.50 plus 1%, the first transfer of the month is free
+	var setup = []struct {
+		query string
+		args  []interface{}
+	}{
+		{"update accounts set house = true where id = $1",
+			[]interface{}{accs[2].ID}},
+		{"update accounts set tier = 'fee-test' where id = $1",
+			[]interface{}{accs[0].ID}},
+		{`insert into fee_schedules (tier, flat, percent_bps, free_per_month)
+			values ('fee-test', 50, 100, 1)`, nil},
+	}
+
+	for _, stmt := range setup {
+		_, err := DB.Exec(stmt.query, stmt.args...)
+
+		if err != nil {
+			t.Log(err)
+			t.FailNow()
+		}
+	}
+
+	token, err := loginAs(testAccounts[0].CPF, testAccounts[0].Secret)
+
+	if err != nil {
+		t.Log(err)
+		t.FailNow()
+	}
+
+	var transfers = []struct {
+		amount money
+		fee    money
+	}{
+		{1000, 0},
+		{2000, 70},
+	}
+
+	for _, tr := range transfers {
+		jsonBytes, err := json.Marshal(&transferRequest{
+			DestinationID: accs[1].ID, Amount: tr.amount})
+
+		if err != nil {
+			t.Log(err)
+			t.FailNow()
+		}
+
+		resp, err := doWithToken(http.MethodPost, "/transfers/quote", token,
+			jsonBytes)
+
+		if err != nil {
+			t.Log(err)
+			t.FailNow()
+		}
+
+		respBytes, err := getResponseBytes(resp)
+
+		if err != nil {
+			t.Log(err)
+			t.FailNow()
+		}
+
+		var quote transferQuote
+		err = json.Unmarshal(respBytes, &quote)
+
+		if err != nil || quote.Fee != tr.fee ||
+			quote.Total != tr.amount+tr.fee {
+			t.Error(string(respBytes))
+		}
+
+		resp, err = doWithToken(http.MethodPost, "/transfers", token,
+			jsonBytes)
+
+		if err != nil {
+			t.Log(err)
+			t.FailNow()
+		}
+
+		respBytes, err = getResponseBytes(resp)
+
+		if err != nil {
+			t.Log(err)
+			t.FailNow()
+		}
+
+		var transf transfer
+		err = json.Unmarshal(respBytes, &transf)
+
+		if err != nil || resp.StatusCode != http.StatusCreated ||
+			transf.Fee != tr.fee {
+			t.Error(resp.StatusCode, string(respBytes))
+		}
+	}
+
+	// The fee leaves the payer and lands in the house account
+	var expected = []money{230402, 236472, 233542}
+
+	for i, acc := range accs {
+		balanceResp, err := getBalance(acc.ID)
+
+		if err != nil {
+			t.Log(err)
+			t.FailNow()
+		}
+
+		if balanceResp.Balance != expected[i] {
+			t.Error(i, balanceResp.Balance)
+		}
+	}
+
+	// The statement shows the fee as its own movement and still ties out
+	resp, err := doWithToken(http.MethodGet,
+		fmt.Sprintf("/accounts/%d/statement", accs[0].ID), token, nil)
+
+	if err != nil {
+		t.Log(err)
+		t.FailNow()
+	}
+
+	respBytes, err := getResponseBytes(resp)
+
+	if err != nil {
+		t.Log(err)
+		t.FailNow()
+	}
+
+	var stmt statement
+	err = json.Unmarshal(respBytes, &stmt)
+
+	if err != nil || len(stmt.Entries) != 3 ||
+		stmt.Entries[2].CounterpartyID != accs[2].ID ||
+		stmt.OpeningBalance != 233472 || stmt.ClosingBalance != 230402 {
+		t.Error(string(respBytes))
+	}
+}
+
+func TestInterest(t *testing.T) {
+	var testAccounts = []accountCreateRequest{
+		accountCreateRequest{
+			Name: "John Doe", CPF: "960.321-11", Secret: "toto"},
+		accountCreateRequest{
+			Name: "PedroBank", CPF: "961.321-11", Secret: "titi"},
+	}
+
+	var accs [2]*account
+
+	for i, testAccount := range testAccounts {
+		acc, err := createTestAccount(testAccount)
+
+		if err != nil {
+			t.Log(err)
+			t.FailNow()
+		}
+
+		accs[i] = acc
+	}
+
+	// 10% a year, for an account that exists since before August 2021
+	var setup = []struct {
+		query string
+		args  []interface{}
+	}{
+		{"update accounts set house = (id = $1) where house or id = $1",
+			[]interface{}{accs[1].ID}},
+		{`update accounts set tier = 'interest-test',
+			created_at = '2021-07-31' where id = $1`,
+			[]interface{}{accs[0].ID}},
+		{`insert into interest_rates (tier, annual_bps)
+			values ('interest-test', 1000)`, nil},
+	}
+
+	for _, stmt := range setup {
+		_, err := DB.Exec(stmt.query, stmt.args...)
+
+		if err != nil {
+			t.Log(err)
+			t.FailNow()
+		}
+	}
+
+	for day := 1; day <= 31; day++ {
+		date := time.Date(2021, time.August, day, 0, 0, 0, 0, time.UTC)
+		run, err := runInterest(context.Background(), date)
+
+		if err != nil {
+			t.Log(err)
+			t.FailNow()
+		}
+
+		if run.Accrued != 1 || run.Pending != 0 ||
+			(day == 31) != (run.Posted == 1) {
+			t.Error(day, run)
+		}
+	}
+
+	// Running the last day again doesn't post twice
+	run, err := runInterest(context.Background(),
+		time.Date(2021, time.August, 31, 0, 0, 0, 0, time.UTC))
+
+	if err != nil || run.Accrued != 1 || run.Posted != 0 {
+		t.Error(run, err)
+	}
+
+	// 31 days of 0.6396... is 19.82, paid by the house
+	var expected = []money{235454, 231490}
+
+	for i, acc := range accs {
+		balanceResp, err := getBalance(acc.ID)
+
+		if err != nil {
+			t.Log(err)
+			t.FailNow()
+		}
+
+		if balanceResp.Balance != expected[i] {
+			t.Error(i, balanceResp.Balance)
+		}
+	}
+
+	// The leftover fraction of a cent is carried to September
+	var carry int64
+
+	err = DB.QueryRow(
+		`select carry_micros from interest_postings where account_id = $1`,
+		accs[0].ID).Scan(&carry)
+
+	if err != nil || carry != 912861 {
+		t.Error(carry, err)
+	}
+
+	// A day missed in September holds back its posting until it's run, and
+	// October, complete by then, is only posted after September
+	for _, month := range []time.Month{time.September, time.October} {
+		days := time.Date(2021, month+1, 0, 0, 0, 0, 0, time.UTC).Day()
+
+		for day := 1; day <= days; day++ {
+			if month == time.September && day == 10 {
+				continue
+			}
+
+			date := time.Date(2021, month, day, 0, 0, 0, 0, time.UTC)
+			run, err := runInterest(context.Background(), date)
+
+			if err != nil || run.Accrued != 1 || run.Posted != 0 {
+				t.Error(date, run, err)
+			}
+		}
+	}
+
+	run, err = runInterest(context.Background(),
+		time.Date(2021, time.September, 10, 0, 0, 0, 0, time.UTC))
+
+	if err != nil || run.Accrued != 1 || run.Posted != 2 {
+		t.Error(run, err)
+	}
+
+	var months []string
+
+	rows, err := DB.Query(
+		`select to_char(month, 'YYYY-MM') from interest_postings
+		where account_id = $1 order by created_at, month`, accs[0].ID)
+
+	if err != nil {
+		t.Log(err)
+		t.FailNow()
+	}
+
+	for rows.Next() {
+		var month string
+
+		if err = rows.Scan(&month); err != nil {
+			t.Log(err)
+			t.FailNow()
+		}
+
+		months = append(months, month)
+	}
+
+	rows.Close()
+
+	if fmt.Sprint(months) != "[2021-08 2021-09 2021-10]" {
+		t.Error(months)
+	}
+}
+
+func TestInterestJobStart(t *testing.T) {
+	today := time.Date(2021, time.November, 20, 0, 0, 0, 0, time.UTC)
+	ctx := context.Background()
+
+	// Never ran, only the last few days
+	start, err := interestJobStart(ctx, today)
+
+	if err != nil || !start.Equal(today.AddDate(0, 0, -interestJobDays)) {
+		t.Error(start, err)
+	}
+
+	// Goes back to the first date missing since the first run
+	for _, date := range []string{"2021-11-01", "2021-11-02", "2021-11-04",
+		"2021-11-05"} {
+
+		_, err = DB.Exec(
+			`insert into interest_runs (date, created_at)
+			values ($1::date, current_timestamp at time zone 'UTC')`, date)
+
+		if err != nil {
+			t.Log(err)
+			t.FailNow()
+		}
+	}
+
+	start, err = interestJobStart(ctx, today)
+
+	if err != nil || start.Format("2006-01-02") != "2021-11-03" {
+		t.Error(start, err)
+	}
+
+	_, err = DB.Exec(`delete from interest_runs`)
+
+	if err != nil {
+		t.Error(err)
+	}
+}
+
+func TestOverdraft(t *testing.T) {
+	var testAccounts = []accountCreateRequest{
+		accountCreateRequest{
+			Name: "John Doe", CPF: "970.321-11", Secret: "toto"},
+		accountCreateRequest{
+			Name: "PedroBank", CPF: "971.321-11", Secret: "titi"},
+		accountCreateRequest{
+			Name: "Jane Doe", CPF: "972.321-11", Secret: "tata"},
+	}
+
+	var accs [3]*account
+	var tokens [3]string
+
+	for i, testAccount := range testAccounts {
+		acc, err := createTestAccount(testAccount)
+
+		if err != nil {
+			t.Log(err)
+			t.FailNow()
+		}
+
+		accs[i] = acc
+
+		tokens[i], err = loginAs(testAccount.CPF, testAccount.Secret)
+
+		if err != nil {
+			t.Log(err)
+			t.FailNow()
+		}
+	}
+
+	// 150% a year on negative balances, and nothing on positive ones
+	var setup = []struct {
+		query string
+		args  []interface{}
+	}{
+		{"update accounts set house = (id = $1) where house or id = $1",
+			[]interface{}{accs[1].ID}},
+		{"update accounts set admin = true where id = $1",
+			[]interface{}{accs[2].ID}},
+		{`update accounts set tier = 'overdraft-test',
+			created_at = '2021-07-31' where id = $1`,
+			[]interface{}{accs[0].ID}},
+		{`insert into interest_rates (tier, annual_bps, overdraft_bps)
+			values ('overdraft-test', 0, 15000)`, nil},
+	}
+
+	for _, stmt := range setup {
+		_, err := DB.Exec(stmt.query, stmt.args...)
+
+		if err != nil {
+			t.Log(err)
+			t.FailNow()
+		}
+	}
+
+	path := fmt.Sprintf("/admin/accounts/%d/overdraft", accs[0].ID)
+
+	// Only admins can set the limit, and it can't be negative
+	var badUpdates = []struct {
+		token  string
+		limit  string
+		status int
+	}{
+		{tokens[0], "5000.00", http.StatusForbidden},
+		{tokens[2], "-5000.00", http.StatusBadRequest},
+	}
+
+	for _, update := range badUpdates {
+		resp, err := doWithToken(http.MethodPost, path, update.token,
+			[]byte(fmt.Sprintf(`{"limit": %s}`, update.limit)))
+
+		if err != nil {
+			t.Log(err)
+			t.FailNow()
+		}
+
+		resp.Body.Close()
+
+		if resp.StatusCode != update.status {
+			t.Error(update, resp.StatusCode)
+		}
+	}
+
+	resp, err := doWithToken(http.MethodPost, path, tokens[2],
+		[]byte(`{"limit": 5000.00}`))
+
+	if err != nil {
+		t.Log(err)
+		t.FailNow()
+	}
+
+	respBytes, err := getResponseBytes(resp)
+
+	if err != nil || resp.StatusCode != http.StatusOK {
+		t.Log(resp.StatusCode, string(respBytes), err)
+		t.FailNow()
+	}
+
+	var balanceResp accountBalanceResponse
+	err = json.Unmarshal(respBytes, &balanceResp)
+
+	if err != nil || balanceResp.OverdraftLimit != 500000 ||
+		balanceResp.Available != 733472 {
+		t.Error(string(respBytes), err)
+	}
+
+	// Below zero, but within the limit
+	for i := 0; i < 3; i++ {
+		resp, err = doWithToken(http.MethodPost, "/transfers", tokens[0],
+			[]byte(fmt.Sprintf(
+				`{"account_destination_id": %d, "amount": 1000.00}`,
+				accs[2].ID)))
+
+		if err != nil {
+			t.Log(err)
+			t.FailNow()
+		}
+
+		resp.Body.Close()
+
+		if resp.StatusCode != http.StatusCreated {
+			t.Log(resp.StatusCode)
+			t.FailNow()
+		}
+	}
+
+	balance, err := getBalance(accs[0].ID)
+
+	if err != nil {
+		t.Log(err)
+		t.FailNow()
+	}
+
+	if balance.Balance != -66528 || balance.OverdraftUsed != 66528 ||
+		balance.Available != 433472 {
+		t.Error(balance)
+	}
+
+	// Past the limit
+	resp, err = doWithToken(http.MethodPost, "/transfers", tokens[0],
+		[]byte(fmt.Sprintf(`{"account_destination_id": %d, "amount": 4500.00}`,
+			accs[2].ID)))
+
+	if err != nil {
+		t.Log(err)
+		t.FailNow()
+	}
+
+	respBytes, err = getResponseBytes(resp)
+
+	var jsonErr jsonError
+
+	if err == nil {
+		err = json.Unmarshal(respBytes, &jsonErr)
+	}
+
+	if err != nil || jsonErr.Code != insufficientFundsError.code ||
+		resp.Header.Get(requestIDHeader) != jsonErr.RequestID {
+		t.Error(string(respBytes), err)
+	}
+
+	// The limit can't be lowered below what's owed
+	resp, err = doWithToken(http.MethodPost, path, tokens[2],
+		[]byte(`{"limit": 100.00}`))
+
+	if err != nil {
+		t.Log(err)
+		t.FailNow()
+	}
+
+	resp.Body.Close()
+
+	if resp.StatusCode != http.StatusConflict {
+		t.Error(resp.StatusCode)
+	}
+
+	// Pretend the account went negative on August 1st, 2021
+	_, err = DB.Exec(
+		`update transfers set created_at = '2021-08-01 12:00'
+		where origin_id = $1`, accs[0].ID)
+
+	if err != nil {
+		t.Log(err)
+		t.FailNow()
+	}
+
+	for day := 1; day <= 2; day++ {
+		date := time.Date(2021, time.August, day, 0, 0, 0, 0, time.UTC)
+		run, err := runInterest(context.Background(), date)
+
+		if err != nil || run.Charged != 1 {
+			t.Error(day, run, err)
+		}
+	}
+
+	// Running a day again doesn't charge twice
+	run, err := runInterest(context.Background(),
+		time.Date(2021, time.August, 2, 0, 0, 0, 0, time.UTC))
+
+	if err != nil || run.Charged != 0 {
+		t.Error(run, err)
+	}
+
+	// 2.73 a day, the fractions carried to the next day
+	var expected = []money{-67074, 233472 + 546}
+
+	for i, acc := range accs[:2] {
+		balanceResp, err := getBalance(acc.ID)
+
+		if err != nil {
+			t.Log(err)
+			t.FailNow()
+		}
+
+		if balanceResp.Balance != expected[i] {
+			t.Error(i, balanceResp.Balance)
+		}
+	}
+
+	var carry int64
+
+	err = DB.QueryRow(
+		`select carry_micros from overdraft_charges
+		where account_id = $1 and date = '2021-08-02'`,
+		accs[0].ID).Scan(&carry)
+
+	if err != nil || carry != 805478 {
+		t.Error(carry, err)
+	}
+}
+
+func TestEscrows(t *testing.T) {
+	var testAccounts = []accountCreateRequest{
+		accountCreateRequest{
+			Name: "John Doe", CPF: "980.321-11", Secret: "toto"},
+		accountCreateRequest{
+			Name: "Jane Doe", CPF: "981.321-11", Secret: "tata"},
+		accountCreateRequest{
+			Name: "Escrow", CPF: "982.321-11", Secret: "titi"},
+		accountCreateRequest{
+			Name: "Jim Doe", CPF: "983.321-11", Secret: "tutu"},
+	}
+
+	var accs [4]*account
+	var tokens [4]string
+
+	for i, testAccount := range testAccounts {
+		acc, err := createTestAccount(testAccount)
+
+		if err != nil {
+			t.Log(err)
+			t.FailNow()
+		}
+
+		accs[i] = acc
+
+		tokens[i], err = loginAs(testAccount.CPF, testAccount.Secret)
+
+		if err != nil {
+			t.Log(err)
+			t.FailNow()
+		}
+	}
+
+	_, err := DB.Exec(
+		"update accounts set escrow = (id = $1) where escrow or id = $1",
+		accs[2].ID)
+
+	if err != nil {
+		t.Log(err)
+		t.FailNow()
+	}
+
+	// Do a request and decode the escrow in the response
+	doEscrow := func(method string, path string, token string, body string,
+		status int) *escrow {
+
+		var bodyBytes []byte
+
+		if body != "" {
+			bodyBytes = []byte(body)
+		}
+
+		resp, err := doWithToken(method, path, token, bodyBytes)
+
+		if err != nil {
+			t.Log(err)
+			t.FailNow()
+		}
+
+		respBytes, err := getResponseBytes(resp)
+
+		if err != nil {
+			t.Log(err)
+			t.FailNow()
+		}
+
+		if resp.StatusCode != status {
+			t.Log(method, path, resp.StatusCode, string(respBytes))
+			t.FailNow()
+		}
+
+		var esc escrow
+		json.Unmarshal(respBytes, &esc)
+
+		return &esc
+	}
+
+	deadline := time.Now().Add(time.Hour).UTC().Format(time.RFC3339)
+
+	openEscrow := func(amount string, defaultAction string) *escrow {
+		esc := doEscrow(http.MethodPost, "/escrows", tokens[0],
+			fmt.Sprintf(`{"payee_id": %d, "amount": %s, "deadline": "%s",
+			"default_action": "%s"}`, accs[1].ID, amount, deadline,
+				defaultAction), http.StatusCreated)
+
+		if esc.Status != "held" || esc.PayerID != accs[0].ID ||
+			esc.FundingTransferID == 0 {
+			t.Error(esc)
+		}
+
+		return esc
+	}
+
+	// Released once both parties confirm
+	esc := openEscrow("100.00", "refund")
+	path := fmt.Sprintf("/escrows/%d", esc.ID)
+
+	doEscrow(http.MethodGet, path, tokens[3], "", http.StatusForbidden)
+	doEscrow(http.MethodGet, path, tokens[1], "", http.StatusOK)
+
+	esc = doEscrow(http.MethodPost, path+"/confirm", tokens[0], "",
+		http.StatusOK)
+
+	if esc.Status != "held" || esc.PayerDecision != "confirm" {
+		t.Error(esc)
+	}
+
+	esc = doEscrow(http.MethodPost, path+"/confirm", tokens[1], "",
+		http.StatusOK)
+
+	if esc.Status != "released" || esc.ResolutionTransferID == nil {
+		t.Error(esc)
+	}
+
+	doEscrow(http.MethodPost, path+"/cancel", tokens[1], "",
+		http.StatusConflict)
+
+	// Refunded once both cancel, even if one of them confirmed first
+	esc = openEscrow("50.00", "release")
+	path = fmt.Sprintf("/escrows/%d", esc.ID)
+
+	doEscrow(http.MethodPost, path+"/confirm", tokens[1], "", http.StatusOK)
+	doEscrow(http.MethodPost, path+"/cancel", tokens[0], "", http.StatusOK)
+	esc = doEscrow(http.MethodPost, path+"/cancel", tokens[1], "",
+		http.StatusOK)
+
+	if esc.Status != "refunded" {
+		t.Error(esc)
+	}
+
+	// Released by default at the deadline
+	esc = openEscrow("10.00", "release")
+
+	_, err = DB.Exec(
+		`update escrows set deadline = $1 where id = $2`,
+		time.Now().Add(-time.Minute).UTC(), esc.ID)
+
+	if err != nil {
+		t.Log(err)
+		t.FailNow()
+	}
+
+	resolved, err := resolveDueEscrows(context.Background())
+
+	if err != nil || resolved != 1 {
+		t.Error(resolved, err)
+	}
+
+	esc = doEscrow(http.MethodGet, fmt.Sprintf("/escrows/%d", esc.ID),
+		tokens[0], "", http.StatusOK)
+
+	if esc.Status != "released" {
+		t.Error(esc)
+	}
+
+	// The risk rules see the payer sending to the payee, who is a new
+	// destination above the threshold, so the escrow isn't opened
+	resp, err := doWithToken(http.MethodPost, "/escrows", tokens[0],
+		[]byte(fmt.Sprintf(`{"payee_id": %d, "amount": 1500.00,
+		"deadline": "%s", "default_action": "release"}`, accs[1].ID,
+			deadline)))
+
+	if err != nil {
+		t.Log(err)
+		t.FailNow()
+	}
+
+	respBytes, err := getResponseBytes(resp)
+
+	if err != nil || resp.StatusCode != http.StatusConflict ||
+		responseErrorCode(respBytes) != escrowReviewError.code {
+
+		t.Error(resp.StatusCode, string(respBytes), err)
+	}
+
+	var reviews int
+
+	err = DB.QueryRow(
+		`select count(*) from risk_decisions where origin_id = $1
+		and destination_id = $2 and decision = 'review'
+		and rule = 'new_destination' and pending_id is null`,
+		accs[0].ID, accs[1].ID).Scan(&reviews)
+
+	if err != nil || reviews != 1 {
+		t.Error(reviews, err)
+	}
+
+	// Both parties see all three
+	for _, token := range tokens[:2] {
+		resp, err := doWithToken(http.MethodGet, "/escrows", token, nil)
+
+		if err != nil {
+			t.Log(err)
+			t.FailNow()
+		}
+
+		respBytes, err := getResponseBytes(resp)
+
+		if err != nil {
+			t.Log(err)
+			t.FailNow()
+		}
+
+		var page escrowPage
+		err = json.Unmarshal(respBytes, &page)
+
+		if err != nil || len(page.Escrows) != 3 {
+			t.Error(string(respBytes))
+		}
+	}
+
+	var expected = []money{222472, 244472, 233472}
+
+	for i, acc := range accs[:3] {
+		balance, err := getBalance(acc.ID)
+
+		if err != nil {
+			t.Log(err)
+			t.FailNow()
+		}
+
+		if balance.Balance != expected[i] {
+			t.Error(i, balance.Balance)
+		}
+	}
+}
+
+func TestSplitTransfers(t *testing.T) {
+	var testAccounts = []accountCreateRequest{
+		accountCreateRequest{
+			Name: "John Doe", CPF: "990.321-11", Secret: "toto"},
+		accountCreateRequest{
+			Name: "Jane Doe", CPF: "991.321-11", Secret: "tata"},
+		accountCreateRequest{
+			Name: "Marketplace", CPF: "992.321-11", Secret: "titi"},
+	}
+
+	var accs [3]*account
+
+	for i, testAccount := range testAccounts {
+		acc, err := createTestAccount(testAccount)
+
+		if err != nil {
+			t.Log(err)
+			t.FailNow()
+		}
+
+		accs[i] = acc
+	}
+
+	token, err := loginAs(testAccounts[0].CPF, testAccounts[0].Secret)
+
+	if err != nil {
+		t.Log(err)
+		t.FailNow()
+	}
+
+	// 10% commission, the rest to the seller
+	resp, err := doWithToken(http.MethodPost, "/transfers", token,
+		[]byte(fmt.Sprintf(`{"amount": 99.99, "description": "Order 42",
+		"splits": [{"account_destination_id": %d, "percent_bps": 1000},
+		{"account_destination_id": %d, "percent_bps": 9000}]}`,
+			accs[2].ID, accs[1].ID)))
+
+	if err != nil {
+		t.Log(err)
+		t.FailNow()
+	}
+
+	respBytes, err := getResponseBytes(resp)
+
+	if err != nil || resp.StatusCode != http.StatusCreated {
+		t.Log(resp.StatusCode, string(respBytes), err)
+		t.FailNow()
+	}
+
+	var batch transferBatch
+	err = json.Unmarshal(respBytes, &batch)
+
+	if err != nil || !batch.Split || batch.Status != "completed" ||
+		len(batch.Items) != 2 || batch.Items[0].Amount != 1000 ||
+		batch.Items[1].Amount != 8999 || batch.Items[0].TransferID == nil {
+		t.Log(string(respBytes))
+		t.FailNow()
+	}
+
+	// Each leg is a transfer with the payment's description
+	var description string
+	var batchID int
+
+	err = DB.QueryRow(
+		`select description, batch_id from transfers where id = $1`,
+		*batch.Items[0].TransferID).Scan(&description, &batchID)
+
+	if err != nil || description != "Order 42" || batchID != batch.ID {
+		t.Error(description, batchID, err)
+	}
+
+	// Nothing moves if one leg fails
+	var badSplits = []struct {
+		body   string
+		status int
+	}{
+		{fmt.Sprintf(`{"amount": 5000.00,
+			"splits": [{"account_destination_id": %d, "amount": 10.00},
+			{"account_destination_id": %d, "percent_bps": 10000}]}`,
+			accs[2].ID, accs[1].ID), http.StatusBadRequest},
+		{fmt.Sprintf(`{"amount": 20.00,
+			"splits": [{"account_destination_id": %d, "amount": 10.00},
+			{"account_destination_id": %d, "amount": 10.00}]}`,
+			accs[2].ID, accs[0].ID), http.StatusBadRequest},
+		{fmt.Sprintf(`{"amount": 20.00,
+			"splits": [{"account_destination_id": %d, "amount": 10.00},
+			{"account_destination_id": %d, "amount": 5.00}]}`,
+			accs[2].ID, accs[1].ID), http.StatusBadRequest},
+	}
+
+	for _, badSplit := range badSplits {
+		resp, err = doWithToken(http.MethodPost, "/transfers", token,
+			[]byte(badSplit.body))
+
+		if err != nil {
+			t.Log(err)
+			t.FailNow()
+		}
+
+		resp.Body.Close()
+
+		if resp.StatusCode != badSplit.status {
+			t.Error(badSplit.body, resp.StatusCode)
+		}
+	}
+
+	var expected = []money{223473, 242471, 234472}
+
+	for i, acc := range accs {
+		balance, err := getBalance(acc.ID)
+
+		if err != nil {
+			t.Log(err)
+			t.FailNow()
+		}
+
+		if balance.Balance != expected[i] {
+			t.Error(i, balance.Balance)
+		}
+	}
+}
+
+func TestAccountLifecycle(t *testing.T) {
+	var testAccounts = []accountCreateRequest{
+		accountCreateRequest{
+			Name: "John Doe", CPF: "900.321-11", Secret: "toto"},
+		accountCreateRequest{
+			Name: "Jane Doe", CPF: "901.321-11", Secret: "tata"},
+		accountCreateRequest{
+			Name: "PedroBank", CPF: "902.321-11", Secret: "titi"},
+	}
+
+	var accs [3]*account
+	var tokens [3]string
+
+	for i, testAccount := range testAccounts {
+		acc, err := createTestAccount(testAccount)
+
+		if err != nil {
+			t.Log(err)
+			t.FailNow()
+		}
+
+		accs[i] = acc
+
+		tokens[i], err = loginAs(testAccount.CPF, testAccount.Secret)
+
+		if err != nil {
+			t.Log(err)
+			t.FailNow()
+		}
+	}
+
+	_, err := DB.Exec("update accounts set admin = true where id = $1",
+		accs[2].ID)
+
+	if err != nil {
+		t.Log(err)
+		t.FailNow()
+	}
+
+	transferBody := []byte(fmt.Sprintf(
+		`{"account_destination_id": %d, "amount": 10.00}`, accs[1].ID))
+
+	var steps = []struct {
+		method string
+		path   string
+		token  string
+		body   string
+		status int
+	}{
+		// Freezing needs an admin and a reason
+		{http.MethodPost, fmt.Sprintf("/admin/accounts/%d/freeze",
+			accs[0].ID), tokens[0], `{"reason": "fraud"}`,
+			http.StatusForbidden},
+		{http.MethodPost, fmt.Sprintf("/admin/accounts/%d/freeze",
+			accs[0].ID), tokens[2], `{"reason": ""}`, http.StatusBadRequest},
+		{http.MethodPost, fmt.Sprintf("/admin/accounts/%d/freeze",
+			accs[0].ID), tokens[2], `{"reason": "fraud"}`, http.StatusOK},
+		{http.MethodPost, fmt.Sprintf("/admin/accounts/%d/freeze",
+			accs[0].ID), tokens[2], `{"reason": "fraud"}`,
+			http.StatusConflict},
+		// Frozen accounts can't send money, or close, but can receive it
+		{http.MethodPost, "/transfers", tokens[0], string(transferBody),
+			http.StatusForbidden},
+		{http.MethodPost, fmt.Sprintf("/accounts/%d/close", accs[0].ID),
+			tokens[0], "", http.StatusForbidden},
+		{http.MethodPost, "/transfers", tokens[1], fmt.Sprintf(
+			`{"account_destination_id": %d, "amount": 10.00}`, accs[0].ID),
+			http.StatusCreated},
+		{http.MethodPost, fmt.Sprintf("/admin/accounts/%d/unfreeze",
+			accs[0].ID), tokens[2], `{"reason": "cleared"}`, http.StatusOK},
+		{http.MethodPost, "/transfers", tokens[0], string(transferBody),
+			http.StatusCreated},
+		// Only the owner can close, and the money must go somewhere
+		{http.MethodPost, fmt.Sprintf("/accounts/%d/close", accs[0].ID),
+			tokens[1], "", http.StatusForbidden},
+		{http.MethodPost, fmt.Sprintf("/accounts/%d/close", accs[0].ID),
+			tokens[0], "", http.StatusBadRequest},
+		{http.MethodPost, fmt.Sprintf("/accounts/%d/close", accs[0].ID),
+			tokens[0], fmt.Sprintf(`{"payout_destination_id": %d}`,
+				accs[1].ID), http.StatusOK},
+		// Closed accounts can't receive money
+		{http.MethodPost, "/transfers", tokens[1], fmt.Sprintf(
+			`{"account_destination_id": %d, "amount": 10.00}`, accs[0].ID),
+			http.StatusGone},
+		// And its tokens no longer work
+		{http.MethodPost, "/transfers", tokens[0], string(transferBody),
+			http.StatusUnauthorized},
+	}
+
+	for i, step := range steps {
+		var body []byte
+
+		if step.body != "" {
+			body = []byte(step.body)
+		}
+
+		resp, err := doWithToken(step.method, step.path, step.token, body)
+
+		if err != nil {
+			t.Log(err)
+			t.FailNow()
+		}
+
+		respStr, err := getResponseString(resp)
+
+		if err != nil || resp.StatusCode != step.status {
+			t.Log(i, resp.StatusCode, respStr, err)
+			t.FailNow()
+		}
+	}
+
+	balance, err := getBalance(accs[1].ID)
+
+	if err != nil || balance.Balance != 233472*2 {
+		t.Error(balance, err)
+	}
+
+	if _, err = getBalance(accs[0].ID); err == nil {
+		t.Error("Balance of a closed account")
+	}
+
+	if _, err = loginAs(testAccounts[0].CPF, testAccounts[0].Secret); err ==
+		nil {
+		t.Error("Logged in to a closed account")
+	}
+
+	var changes int
+
+	err = DB.QueryRow(
+		`select count(*) from account_status_changes where account_id = $1`,
+		accs[0].ID).Scan(&changes)
+
+	if err != nil || changes != 3 {
+		t.Error(changes, err)
+	}
+}
+
+// Keeps the last message for each account, instead of sending it.
+type testNotifier struct {
+	messages map[int]string
+	mu       sync.Mutex
+}
+
+func (tn *testNotifier) Notify(accountID int, message string) error {
+	tn.mu.Lock()
+	tn.messages[accountID] = message
+	tn.mu.Unlock()
+	return nil
+}
+
+func TestProfileAndPassword(t *testing.T) {
+	testAccount := accountCreateRequest{
+		Name: "John Doe", CPF: "890.321-11", Secret: "toto"}
+
+	acc, err := createTestAccount(testAccount)
+
+	if err != nil {
+		t.Log(err)
+		t.FailNow()
+	}
+
+	var tokens [2]string
+
+	for i := range tokens {
+		tokens[i], err = loginAs(testAccount.CPF, testAccount.Secret)
+
+		if err != nil {
+			t.Log(err)
+			t.FailNow()
+		}
+	}
+
+	var steps = []struct {
+		method string
+		path   string
+		token  string
+		body   string
+		status int
+	}{
+		{http.MethodPatch, "/accounts/me", tokens[0], `{"name": ""}`,
+			http.StatusBadRequest},
+		{http.MethodPatch, "/accounts/me", tokens[0],
+			`{"name": "John Q. Doe"}`, http.StatusOK},
+		{http.MethodPost, "/accounts/me/password", tokens[0],
+			`{"old_secret": "tata", "new_secret": "tutu"}`,
+			http.StatusBadRequest},
+		{http.MethodPost, "/accounts/me/password", tokens[0],
+			`{"old_secret": "toto", "new_secret": "tutu"}`,
+			http.StatusNoContent},
+		// The other login is gone, but not the one that changed it
+		{http.MethodGet, "/id", tokens[1], "", http.StatusUnauthorized},
+		{http.MethodGet, "/id", tokens[0], "", http.StatusOK},
+	}
+
+	for i, step := range steps {
+		var body []byte
+
+		if step.body != "" {
+			body = []byte(step.body)
+		}
+
+		resp, err := doWithToken(step.method, step.path, step.token, body)
+
+		if err != nil {
+			t.Log(err)
+			t.FailNow()
+		}
+
+		respStr, err := getResponseString(resp)
+
+		if err != nil || resp.StatusCode != step.status {
+			t.Log(i, resp.StatusCode, respStr, err)
+			t.FailNow()
+		}
+	}
+
+	var name string
+
+	err = DB.QueryRow("select name from accounts where id = $1",
+		acc.ID).Scan(&name)
+
+	if err != nil || name != "John Q. Doe" {
+		t.Error(name, err)
+	}
+
+	if _, err = loginAs(testAccount.CPF, "tutu"); err != nil {
+		t.Error(err)
+	}
+
+	// Reset the forgotten password with the code sent to the owner
+	tn := &testNotifier{messages: make(map[int]string)}
+	oldNotifier := notifier
+	SetNotifier(tn)
+	defer SetNotifier(oldNotifier)
+
+	for _, cpf := range []string{testAccount.CPF, "899.999-99"} {
+		resp, err := postJSONBytes("/password-reset",
+			[]byte(fmt.Sprintf(`{"cpf": "%s"}`, cpf)))
+
+		if err != nil {
+			t.Log(err)
+			t.FailNow()
+		}
+
+		resp.Body.Close()
+
+		if resp.StatusCode != http.StatusAccepted {
+			t.Error(cpf, resp.StatusCode)
+		}
+	}
+
+	tn.mu.Lock()
+	code := regexp.MustCompile(`[0-9]{6}`).FindString(tn.messages[acc.ID])
+	tn.mu.Unlock()
+
+	if code == "" {
+		t.Log(tn.messages)
+		t.FailNow()
+	}
+
+	wrongCode := "000000"
+
+	if code == wrongCode {
+		wrongCode = "111111"
+	}
+
+	var confirms = []struct {
+		code   string
+		status int
+	}{
+		{wrongCode, http.StatusBadRequest},
+		{code, http.StatusNoContent},
+		{code, http.StatusBadRequest},
+	}
+
+	for _, confirm := range confirms {
+		resp, err := postJSONBytes("/password-reset/confirm",
+			[]byte(fmt.Sprintf(
+				`{"cpf": "%s", "code": "%s", "new_secret": "tete"}`,
+				testAccount.CPF, confirm.code)))
+
+		if err != nil {
+			t.Log(err)
+			t.FailNow()
+		}
+
+		resp.Body.Close()
+
+		if resp.StatusCode != confirm.status {
+			t.Error(confirm.code, resp.StatusCode)
+		}
+	}
+
+	if _, err = loginAs(testAccount.CPF, "tete"); err != nil {
+		t.Error(err)
+	}
+
+	if _, err = loginAs(testAccount.CPF, "tutu"); err == nil {
+		t.Error("Logged in with the old password")
+	}
+}
+
+func TestOpenAPIConformance(t *testing.T) {
+	doc, err := loadOpenAPIDoc()
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Do a request, check the response against the document and decode
+	// its JSON into out, if not nil.
+	call := func(method string, path string, token string, body string,
+		status int, out interface{}) {
+
+		var bodyBytes []byte
+
+		if body != "" {
+			bodyBytes = []byte(body)
+		}
+
+		resp, err := doWithToken(method, path, token, bodyBytes)
+
+		if err != nil {
+			t.Log(err)
+			t.FailNow()
+		}
+
+		respBytes, err := getResponseBytes(resp)
+
+		if err != nil {
+			t.Log(err)
+			t.FailNow()
+		}
+
+		if resp.StatusCode != status {
+			t.Log(method, path, resp.StatusCode, string(respBytes))
+			t.FailNow()
+		}
+
+		err = doc.validateResponse(method, resp.Request.URL.Path,
+			resp.StatusCode, resp.Header, respBytes)
+
+		if err != nil {
+			t.Error(err)
+		}
+
+		if out != nil {
+			if err = json.Unmarshal(respBytes, out); err != nil {
+				t.Log(err)
+				t.FailNow()
+			}
+		}
+	}
+
+	var accs [3]account
+	var tokens [3]string
+
+	for i := range accs {
+		cpf := fmt.Sprintf("88%d.000-01", i)
+
+		call(http.MethodPost, "/accounts", "", fmt.Sprintf(
+			`{"name": "Spec %d", "cpf": "%s", "secret": "spec"}`, i, cpf),
+			http.StatusCreated, &accs[i])
+
+		var tok tokenResponse
+
+		call(http.MethodPost, "/login", "", fmt.Sprintf(
+			`{"cpf": "%s", "secret": "spec"}`, cpf), http.StatusCreated,
+			&tok)
+
+		tokens[i] = tok.Token
+	}
+
+	_, err = DB.Exec(`update accounts set admin = (id = $1),
+		escrow = (id = $2) where id in ($1, $2) or escrow`, accs[0].ID,
+		accs[2].ID)
+
+	if err != nil {
+		t.Log(err)
+		t.FailNow()
+	}
+
+	call(http.MethodGet, "/openapi.json", "", "", http.StatusOK, nil)
+	call(http.MethodGet, "/accounts?limit=2&sort=name", "", "",
+		http.StatusOK, nil)
+	call(http.MethodGet, "/accounts?sort=name", "", "", http.StatusOK, nil)
+	call(http.MethodGet, fmt.Sprintf("/accounts/%d/balance", accs[0].ID),
+		"", "", http.StatusOK, nil)
+	call(http.MethodGet, "/id", tokens[0], "", http.StatusOK, nil)
+	call(http.MethodPatch, "/accounts/me", tokens[0],
+		`{"name": "Spec Zero"}`, http.StatusOK, nil)
+
+	// Transfers
+	transfer := fmt.Sprintf(`{"account_destination_id": %d,
+		"amount": 10.50, "description": "spec", "reference": "spec-1",
+		"metadata": {"order": "1"}}`, accs[1].ID)
+
+	call(http.MethodPost, "/transfers/quote", tokens[0], transfer,
+		http.StatusOK, nil)
+	call(http.MethodPost, "/transfers", tokens[0], transfer,
+		http.StatusCreated, nil)
+	call(http.MethodPost, "/transfers", tokens[0], fmt.Sprintf(
+		`{"amount": 20.00, "splits": [
+		{"account_destination_id": %d, "amount": 5.00},
+		{"account_destination_id": %d, "percent_bps": 7500}]}`,
+		accs[1].ID, accs[2].ID), http.StatusCreated, nil)
+	call(http.MethodPost, "/transfers", tokens[0], fmt.Sprintf(
+		`{"account_destination_id": %d, "amount": 99999.00}`, accs[1].ID),
+		http.StatusBadRequest, nil)
+	call(http.MethodGet, "/transfers?limit=1&direction=sent", tokens[0], "",
+		http.StatusOK, nil)
+	call(http.MethodGet, "/transfers?direction=sent", tokens[0], "",
+		http.StatusOK, nil)
+
+	var batch transferBatch
+
+	call(http.MethodPost, "/transfers/batch", tokens[0], fmt.Sprintf(
+		`{"transfers": [{"account_destination_id": %d, "amount": 1.00},
+		{"account_destination_id": %d, "amount": 2.00}]}`, accs[1].ID,
+		accs[2].ID), http.StatusCreated, &batch)
+	call(http.MethodGet, fmt.Sprintf("/transfers/batch/%d", batch.ID),
+		tokens[0], "", http.StatusOK, nil)
+
+	// Statements
+	for _, format := range []string{"json", "csv", "ofx"} {
+		call(http.MethodGet, fmt.Sprintf("/accounts/%d/statement?format=%s",
+			accs[0].ID, format), tokens[0], "", http.StatusOK, nil)
+	}
+
+	call(http.MethodGet, fmt.Sprintf("/accounts/%d/statement", accs[1].ID),
+		tokens[0], "", http.StatusForbidden, nil)
+
+	// Limits and keys
+	call(http.MethodGet, "/limits", tokens[0], "", http.StatusOK, nil)
+	call(http.MethodPost, "/limits", tokens[0], `{"nighttime": 900.00}`,
+		http.StatusOK, nil)
+	call(http.MethodPost, "/keys", tokens[1],
+		`{"type": "email", "key": "spec@example.com"}`, http.StatusCreated,
+		nil)
+	call(http.MethodGet, "/keys", tokens[1], "", http.StatusOK, nil)
+	call(http.MethodGet, "/keys/spec@example.com", tokens[0], "",
+		http.StatusOK, nil)
+	call(http.MethodDelete, "/keys/spec@example.com", tokens[1], "",
+		http.StatusNoContent, nil)
+
+	// Payment requests
+	var payReq paymentRequest
+
+	call(http.MethodPost, "/payment-requests", tokens[1],
+		`{"amount": 3.00, "description": "spec"}`, http.StatusCreated,
+		&payReq)
+	call(http.MethodGet, "/payment-requests", tokens[1], "", http.StatusOK,
+		nil)
+	call(http.MethodGet, fmt.Sprintf("/payment-requests/%d", payReq.ID),
+		tokens[0], "", http.StatusOK, nil)
+	call(http.MethodPost, fmt.Sprintf("/payment-requests/%d/pay", payReq.ID),
+		tokens[0], fmt.Sprintf(`{"payload": "%s"}`, payReq.Payload),
+		http.StatusCreated, nil)
+	call(http.MethodPost, "/payment-requests", tokens[1],
+		`{"amount": 3.00, "multi_use": true}`, http.StatusCreated, &payReq)
+	call(http.MethodPost, fmt.Sprintf("/payment-requests/%d/cancel",
+		payReq.ID), tokens[1], "", http.StatusOK, nil)
+
+	// Escrows
+	var esc escrow
+
+	call(http.MethodPost, "/escrows", tokens[0], fmt.Sprintf(
+		`{"payee_id": %d, "amount": 4.00, "deadline": "%s"}`, accs[1].ID,
+		time.Now().Add(time.Hour).UTC().Format(time.RFC3339)),
+		http.StatusCreated, &esc)
+	call(http.MethodGet, "/escrows?status=held", tokens[0], "",
+		http.StatusOK, nil)
+	call(http.MethodGet, fmt.Sprintf("/escrows/%d", esc.ID), tokens[1], "",
+		http.StatusOK, nil)
+	call(http.MethodPost, fmt.Sprintf("/escrows/%d/confirm", esc.ID),
+		tokens[0], "", http.StatusOK, nil)
+	call(http.MethodPost, fmt.Sprintf("/escrows/%d/confirm", esc.ID),
+		tokens[1], "", http.StatusOK, nil)
+	call(http.MethodPost, fmt.Sprintf("/escrows/%d/cancel", esc.ID),
+		tokens[1], "", http.StatusConflict, nil)
+
+	// Admin
+	call(http.MethodGet, "/admin/pending-transfers", tokens[0], "",
+		http.StatusOK, nil)
+	call(http.MethodPost, "/admin/interest?date=2000-01-01", tokens[0], "",
+		http.StatusOK, nil)
+	call(http.MethodPost, fmt.Sprintf("/admin/accounts/%d/overdraft",
+		accs[1].ID), tokens[0], `{"limit": 50.00}`, http.StatusOK, nil)
+	call(http.MethodPost, fmt.Sprintf("/admin/accounts/%d/freeze",
+		accs[1].ID), tokens[0], `{"reason": "spec"}`, http.StatusOK, nil)
+	call(http.MethodPost, fmt.Sprintf("/admin/accounts/%d/unfreeze",
+		accs[1].ID), tokens[0], `{"reason": "spec"}`, http.StatusOK, nil)
+	call(http.MethodGet, "/admin/event-consumers", tokens[0], "",
+		http.StatusOK, nil)
+
+	// Passwords and closing
+	call(http.MethodPost, "/password-reset", "", `{"cpf": "881.000-01"}`,
+		http.StatusAccepted, nil)
+	call(http.MethodPost, "/password-reset/confirm", "",
+		`{"cpf": "881.000-01", "code": "000000", "new_secret": "x"}`,
+		http.StatusBadRequest, nil)
+	call(http.MethodPost, "/accounts/me/password", tokens[1],
+		`{"old_secret": "spec", "new_secret": "spec2"}`,
+		http.StatusNoContent, nil)
+	call(http.MethodPost, fmt.Sprintf("/accounts/%d/close", accs[1].ID),
+		tokens[1], fmt.Sprintf(`{"payout_destination_id": %d}`, accs[0].ID),
+		http.StatusOK, nil)
+}
+
+func TestClientAndIdempotency(t *testing.T) {
+	ctx := context.Background()
+	sdk := bankclient.New(serverURL, &client)
+
+	var accs [2]*bankclient.Account
+
+	for i := range accs {
+		acc, err := sdk.CreateAccount(ctx, bankclient.CreateAccountRequest{
+			Name: "Client", CPF: fmt.Sprintf("87%d.000-01", i),
+			Secret: "client"})
+
+		if err != nil {
+			t.Log(err)
+			t.FailNow()
+		}
+
+		accs[i] = acc
+	}
+
+	_, err := sdk.CreateAccount(ctx, bankclient.CreateAccountRequest{
+		Name: "Client", CPF: "870.000-01", Secret: "client"})
+
+	if !errors.Is(err, bankclient.ErrAccountExists) {
+		t.Error(err)
+	}
+
+	if err = sdk.Login(ctx, "870.000-01", "client"); err != nil {
+		t.Log(err)
+		t.FailNow()
+	}
+
+	// A retry with the same key doesn't transfer again
+	transferReq := bankclient.TransferRequest{DestinationID: accs[1].ID,
+		Amount: 1050, Reference: "client-1", IdempotencyKey: "client-key-1"}
+
+	first, err := sdk.Transfer(ctx, transferReq)
+
+	if err != nil || first.Transfer == nil || first.Replayed {
+		t.Log(first, err)
+		t.FailNow()
+	}
+
+	retry, err := sdk.Transfer(ctx, transferReq)
+
+	if err != nil || retry.Transfer == nil || !retry.Replayed ||
+		retry.Transfer.ID != first.Transfer.ID {
+
+		t.Error(retry, err)
+	}
+
+	balance, err := sdk.Balance(ctx, accs[0].ID)
+
+	if err != nil || balance.Balance != bankclient.Money(accs[0].Balance-
+		1050) {
+
+		t.Error(balance, err)
+	}
+
+	// But the same key can't be used for another transfer
+	transferReq.Amount = 2000
+
+	_, err = sdk.Transfer(ctx, transferReq)
+
+	if !errors.Is(err, bankclient.ErrIdempotencyKeyReused) {
+		t.Error(err)
+	}
+
+	// Nor are errors replayed as anything else
+	_, err = sdk.Transfer(ctx, bankclient.TransferRequest{
+		DestinationID: accs[1].ID, Amount: 99999999})
+
+	if !errors.Is(err, bankclient.ErrInsufficientFunds) &&
+		!errors.Is(err, bankclient.ErrLimitExceeded) {
+
+		t.Error(err)
+	}
+
+	page, err := sdk.ListTransfers(ctx, bankclient.ListTransfersOptions{
+		Direction: "sent", Reference: "client-1"})
+
+	if err != nil || len(page.Transfers) != 1 ||
+		page.Transfers[0].ID != first.Transfer.ID {
+
+		t.Error(page, err)
+	}
+
+	// Keys belong to an account, the other one can use the same
+	other := bankclient.New(serverURL, &client)
+
+	if err = other.Login(ctx, "871.000-01", "client"); err != nil {
+		t.Log(err)
+		t.FailNow()
+	}
+
+	back, err := other.Transfer(ctx, bankclient.TransferRequest{
+		DestinationID: accs[0].ID, Amount: 50,
+		IdempotencyKey: "client-key-1"})
+
+	if err != nil || back.Transfer == nil || back.Replayed {
+		t.Error(back, err)
+	}
+
+	// A logged out client logs in again
+	logoutAccount(accs[0].ID, "")
+
+	if _, err = sdk.ListTransfers(ctx,
+		bankclient.ListTransfersOptions{}); err != nil {
+
+		t.Error(err)
+	}
+}
+
+func TestKeptIdempotencyKey(t *testing.T) {
+	acc, err := createTestAccount(accountCreateRequest{
+		Name: "Kept Key", CPF: "873.000-01", Secret: "kept"})
+
+	if err != nil {
+		t.Log(err)
+		t.FailNow()
+	}
+
+	handled := 0
+	handler := withIdempotency(http.HandlerFunc(
+		func(rw http.ResponseWriter, req *http.Request) {
+			handled++
+
+			if req.URL.Query().Get("keep") != "" {
+				keepIdempotencyKey(req.Context())
+			}
+
+			respondWithError(rw, errors.New("failed halfway"))
+		}))
+
+	serve := func(path string, key string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest(http.MethodPost, path,
+			strings.NewReader("{}"))
+		req.Header.Set(idempotencyKeyHeader, key)
+		req = req.WithContext(context.WithValue(req.Context(), accountIDKey,
+			acc.ID))
+
+		rec := httptest.NewRecorder()
+		handler.ServeHTTP(rec, req)
+
+		return rec
+	}
+
+	// A server error forgets the key, so the retry is handled again
+	for i := 1; i <= 2; i++ {
+		rec := serve("/batch", "forgotten-key")
+
+		if rec.Code != http.StatusInternalServerError || handled != i {
+			t.Error(i, rec.Code, handled)
+		}
+	}
+
+	// Unless the handler kept it, then the failure is replayed
+	for i := 0; i < 2; i++ {
+		rec := serve("/batch?keep=1", "kept-key")
+
+		if rec.Code != http.StatusInternalServerError || handled != 3 ||
+			(rec.Header().Get(idempotentReplayHeader) != "") != (i == 1) ||
+			responseErrorCode(rec.Body.Bytes()) != internalError.code {
+
+			t.Error(i, rec.Code, handled, rec.Header(), rec.Body.String())
+		}
+	}
+}
+
+func TestGRPC(t *testing.T) {
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	conn, err := grpc.DialContext(ctx, strings.TrimPrefix(serverURL,
+		"https://"), grpc.WithTransportCredentials(credentials.NewTLS(
+		&tls.Config{InsecureSkipVerify: true})))
+
+	if err != nil {
+		t.Log(err)
+		t.FailNow()
+	}
+
+	defer conn.Close()
+
+	bank := bankpb.NewBankClient(conn)
+
+	var accs [2]*bankpb.Account
+
+	for i := range accs {
+		accs[i], err = bank.CreateAccount(ctx, &bankpb.CreateAccountRequest{
+			Name: "GRPC", Cpf: fmt.Sprintf("91%d.000-01", i),
+			Secret: "grpc"})
+
+		if err != nil {
+			t.Log(err)
+			t.FailNow()
+		}
+	}
+
+	if accs[0].BalanceCents != 233472 || accs[0].Status != "active" ||
+		accs[0].CreatedAt == nil {
+
+		t.Error(accs[0])
+	}
+
+	// Same errors as the JSON API
+	_, err = bank.CreateAccount(ctx, &bankpb.CreateAccountRequest{
+		Name: "GRPC", Cpf: "910.000-01", Secret: "grpc"})
+
+	if code, info := grpcErrorInfo(err); code != codes.AlreadyExists ||
+		info.Reason != "account_exists" {
+
+		t.Error(err)
+	}
+
+	_, err = bank.Login(ctx, &bankpb.LoginRequest{Cpf: "910.000-01",
+		Secret: "nope"})
+
+	if code, info := grpcErrorInfo(err); code != codes.Unauthenticated ||
+		info.Reason != "wrong_password" {
+
+		t.Error(err)
+	}
+
+	login, err := bank.Login(ctx, &bankpb.LoginRequest{Cpf: "910.000-01",
+		Secret: "grpc"})
+
+	if err != nil {
+		t.Log(err)
+		t.FailNow()
+	}
+
+	// The token works on the JSON API too
+	resp, err := doWithToken(http.MethodGet, "/id", login.Token, nil)
+
+	if err != nil || resp.StatusCode != http.StatusOK {
+		t.Error(resp, err)
+	} else {
+		resp.Body.Close()
+	}
+
+	authCtx := metadata.AppendToOutgoingContext(ctx, "authorization",
+		login.Token, "idempotency-key", "grpc-key-1")
+
+	transferReq := bankpb.TransferRequest{
+		Destination: &bankpb.TransferRequest_DestinationId{
+			DestinationId: accs[1].Id},
+		AmountCents: 1050, Reference: "grpc-1",
+		Metadata: map[string]string{"order": "7"}}
+
+	first, err := bank.Transfer(authCtx, &transferReq)
+
+	if err != nil || first.GetTransfer() == nil ||
+		first.GetTransfer().AmountCents != 1050 ||
+		first.GetTransfer().Metadata["order"] != "7" {
+
+		t.Log(first, err)
+		t.FailNow()
+	}
+
+	// A retry with the same key is replayed
+	var header metadata.MD
+
+	retry, err := bank.Transfer(authCtx, &transferReq, grpc.Header(&header))
+
+	if err != nil || retry.GetTransfer().GetId() !=
+		first.GetTransfer().Id || len(header.Get("idempotent-replayed")) != 1 {
+
+		t.Error(retry, err, header)
+	}
+
+	transferReq.AmountCents = 2000
+
+	_, err = bank.Transfer(authCtx, &transferReq)
+
+	if code, info := grpcErrorInfo(err); code != codes.FailedPrecondition ||
+		info.Reason != "idempotency_key_reused" {
+
+		t.Error(err)
+	}
+
+	balance, err := bank.GetBalance(ctx, &bankpb.GetBalanceRequest{
+		AccountId: accs[0].Id})
+
+	if err != nil || balance.BalanceCents != 233472-1050 ||
+		balance.AvailableCents != balance.BalanceCents {
+
+		t.Error(balance, err)
+	}
+
+	_, err = bank.GetBalance(ctx, &bankpb.GetBalanceRequest{AccountId: 1 << 30})
+
+	if code, _ := grpcErrorInfo(err); code != codes.NotFound {
+		t.Error(err)
+	}
+
+	// A failed transfer is replayed with the same error
+	authCtx = metadata.AppendToOutgoingContext(ctx, "authorization",
+		login.Token, "idempotency-key", "grpc-key-2")
+
+	transferReq = bankpb.TransferRequest{
+		Destination: &bankpb.TransferRequest_DestinationId{
+			DestinationId: accs[1].Id},
+		AmountCents: 99999999}
+
+	for i := 0; i < 2; i++ {
+		header = nil
+		_, err = bank.Transfer(authCtx, &transferReq, grpc.Header(&header))
+		code, info := grpcErrorInfo(err)
+
+		if code != codes.FailedPrecondition ||
+			(info.Reason != "insufficient_funds" &&
+				info.Reason != "limit_exceeded") ||
+			len(header.Get("idempotent-replayed")) != i {
+
+			t.Error(i, err, header)
+		}
+	}
+
+	authCtx = metadata.AppendToOutgoingContext(ctx, "authorization",
+		login.Token)
+
+	page, err := bank.ListTransfers(authCtx, &bankpb.ListTransfersRequest{
+		Direction: "sent", Reference: "grpc-1",
+		Metadata: map[string]string{"order": "7"},
+		From:     timestamppb.New(time.Now().Add(-time.Hour))})
+
+	if err != nil || len(page.Transfers) != 1 ||
+		page.Transfers[0].Id != first.GetTransfer().Id {
+
+		t.Error(page, err)
+	}
+
+	accPage, err := bank.ListAccounts(ctx, &bankpb.ListAccountsRequest{
+		Page: &bankpb.PageRequest{Limit: 1}})
+
+	if err != nil || len(accPage.Accounts) != 1 || accPage.NextCursor == "" {
+		t.Error(accPage, err)
+	}
+}
+
+// An event read from a text/event-stream, without the comments.
+type streamEvent struct {
+	id   string
+	name string
+	data string
+}
+
+// Read the next event from stream.
+func readEvent(stream *bufio.Reader) (*streamEvent, error) {
+	var event streamEvent
+
+	for {
+		line, err := stream.ReadString('\n')
+
+		if err != nil {
+			return nil, err
+		}
+
+		line = strings.TrimSuffix(line, "\n")
+
+		switch {
+		case line == "" && event.name != "":
+			return &event, nil
+		case strings.HasPrefix(line, "id: "):
+			event.id = strings.TrimPrefix(line, "id: ")
+		case strings.HasPrefix(line, "event: "):
+			event.name = strings.TrimPrefix(line, "event: ")
+		case strings.HasPrefix(line, "data: "):
+			event.data = strings.TrimPrefix(line, "data: ")
+		}
+	}
+}
+
+// Open the event stream of the account logged in with token.
+func openEvents(ctx context.Context, token string,
+	lastEventID string) (*http.Response, error) {
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet,
+		serverURL+"/events", nil)
+
+	if err != nil {
+		return nil, err
+	}
+
+	req.Header.Set("Authorization", token)
+
+	if lastEventID != "" {
+		req.Header.Set("Last-Event-ID", lastEventID)
+	}
+
+	return client.Do(req)
+}
+
+func TestEvents(t *testing.T) {
+	var testAccounts = []accountCreateRequest{
+		accountCreateRequest{
+			Name: "John Doe", CPF: "860.321-11", Secret: "toto"},
+		accountCreateRequest{
+			Name: "Jane Doe", CPF: "861.321-11", Secret: "tata"},
+	}
+
+	var accs [2]*account
+	var tokens [2]string
+
+	for i, testAccount := range testAccounts {
+		acc, err := createTestAccount(testAccount)
+
+		if err != nil {
+			t.Log(err)
+			t.FailNow()
+		}
+
+		accs[i] = acc
+		tokens[i], err = loginAs(testAccount.CPF, testAccount.Secret)
+
+		if err != nil {
+			t.Log(err)
+			t.FailNow()
+		}
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	resp, err := openEvents(ctx, tokens[1], "")
+
+	if err != nil || resp.StatusCode != http.StatusOK ||
+		resp.Header.Get("Content-Type") != "text/event-stream" {
+
+		t.Log(resp, err)
+		t.FailNow()
+	}
+
+	stream := bufio.NewReader(resp.Body)
+	event, err := readEvent(stream)
+
+	if err != nil || event.name != "balance" || event.id != "" {
+		t.Log(event, err)
+		t.FailNow()
+	}
+
+	sendTransfer := func(amount string) {
+		resp, err := doWithToken(http.MethodPost, "/transfers", tokens[0],
+			[]byte(fmt.Sprintf(`{"account_destination_id": %d, "amount": %s}`,
+				accs[1].ID, amount)))
+
+		if err != nil || resp.StatusCode != http.StatusCreated {
+			t.Log(resp, err)
+			t.FailNow()
+		}
+
+		resp.Body.Close()
+	}
+
+	// The transfer reaches the destination's stream, with the new balance
+	sendTransfer("10.50")
+
+	event, err = readEvent(stream)
+
+	var transferEvent struct {
+		Direction string   `json:"direction"`
+		Transfer  transfer `json:"transfer"`
+	}
+
+	if err == nil {
+		err = json.Unmarshal([]byte(event.data), &transferEvent)
+	}
+
+	if err != nil || event.name != "transfer" ||
+		transferEvent.Direction != "in" ||
+		transferEvent.Transfer.Amount != 1050 ||
+		event.id != fmt.Sprint(transferEvent.Transfer.ID) {
+
+		t.Log(event, err)
+		t.FailNow()
+	}
+
+	firstID := event.id
+	event, err = readEvent(stream)
+
+	var balance accountBalanceResponse
+
+	if err == nil {
+		err = json.Unmarshal([]byte(event.data), &balance)
+	}
+
+	if err != nil || event.name != "balance" ||
+		balance.Balance != accs[1].Balance+1050 {
+
+		t.Error(event, err)
+	}
+
+	resp.Body.Close()
+
+	// After reconnecting, the transfers since the last event come first
+	sendTransfer("2.00")
+	sendTransfer("3.00")
+
+	resp, err = openEvents(ctx, tokens[1], firstID)
+
+	if err != nil || resp.StatusCode != http.StatusOK {
+		t.Log(resp, err)
+		t.FailNow()
+	}
+
+	defer resp.Body.Close()
+
+	stream = bufio.NewReader(resp.Body)
+
+	for _, expected := range []string{"transfer", "transfer", "balance"} {
+		event, err = readEvent(stream)
+
+		if err != nil || event.name != expected {
+			t.Log(event, err)
+			t.FailNow()
+		}
+	}
+
+	if err = json.Unmarshal([]byte(event.data), &balance); err != nil ||
+		balance.Balance != accs[1].Balance+1550 {
+
+		t.Error(event, err)
+	}
+
+	resp, err = openEvents(ctx, tokens[1], "abc")
+
+	if err != nil {
+		t.Error(err)
+		return
+	}
+
+	if resp.StatusCode != http.StatusBadRequest {
+		t.Error(resp)
+	}
+
+	resp.Body.Close()
+}
+
+// Get the deliveries of the webhook with id, as the account with token.
+func getWebhookDeliveryPage(token string, id int) (*webhookDeliveryPage,
+	error) {
+
+	resp, err := doWithToken(http.MethodGet,
+		fmt.Sprintf("/webhooks/%d/deliveries", id), token, nil)
+
+	if err != nil {
+		return nil, err
+	}
+
+	respBytes, err := getResponseBytes(resp)
+
+	if err != nil {
+		return nil, err
+	}
+
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("got %d: %s", resp.StatusCode, respBytes)
+	}
+
+	var page webhookDeliveryPage
+	err = json.Unmarshal(respBytes, &page)
+
+	return &page, err
+}
+
+// Wait for the newest delivery of the webhook with id to have been tried.
+func waitForWebhookAttempt(token string, id int) (*webhookDelivery, error) {
+	deadline := time.Now().Add(3 * webhookJobInterval)
+
+	for time.Now().Before(deadline) {
+		page, err := getWebhookDeliveryPage(token, id)
+
+		if err != nil {
+			return nil, err
+		}
+
+		if len(page.Deliveries) > 0 &&
+			page.Deliveries[0].LastAttemptAt != nil {
+
+			return &page.Deliveries[0], nil
+		}
+
+		time.Sleep(100 * time.Millisecond)
+	}
+
+	return nil, fmt.Errorf("webhook %d not tried", id)
+}
+
+func TestWebhooks(t *testing.T) {
+	var testAccounts = []accountCreateRequest{
+		accountCreateRequest{
+			Name: "John Doe", CPF: "850.321-11", Secret: "toto"},
+		accountCreateRequest{
+			Name: "Jane Doe", CPF: "851.321-11", Secret: "tata"},
+	}
+
+	var accs [2]*account
+	var tokens [2]string
+
+	for i, testAccount := range testAccounts {
+		acc, err := createTestAccount(testAccount)
+
+		if err != nil {
+			t.Log(err)
+			t.FailNow()
+		}
+
+		accs[i] = acc
+		tokens[i], err = loginAs(testAccount.CPF, testAccount.Secret)
+
+		if err != nil {
+			t.Log(err)
+			t.FailNow()
+		}
+	}
+
+	type receivedWebhook struct {
+		header http.Header
+		body   []byte
+	}
+
+	received := make(chan receivedWebhook, 10)
+
+	receiver := httptest.NewTLSServer(http.HandlerFunc(
+		func(rw http.ResponseWriter, req *http.Request) {
+			if req.URL.Path == "/fail" {
+				rw.WriteHeader(http.StatusInternalServerError)
+				return
+			}
+
+			body, _ := io.ReadAll(req.Body)
+			received <- receivedWebhook{req.Header, body}
+		}))
+
+	defer receiver.Close()
+
+	// The server runs in this process, so it can trust the receiver
+	oldClient := webhookClient
+	defer func() { webhookClient = oldClient }()
+
+	webhookClient = receiver.Client()
+	webhookClient.CheckRedirect = oldClient.CheckRedirect
+
+	createWebhook := func(url string) (*webhook, error) {
+		resp, err := doWithToken(http.MethodPost, "/webhooks", tokens[1],
+			[]byte(fmt.Sprintf(
+				`{"url": %q, "events": ["transfer.received"]}`, url)))
+
+		if err != nil {
+			return nil, err
+		}
+
+		respBytes, err := getResponseBytes(resp)
+
+		if err != nil {
+			return nil, err
+		}
+
+		if resp.StatusCode != http.StatusCreated {
+			return nil, fmt.Errorf("got %d: %s", resp.StatusCode, respBytes)
+		}
+
+		var hook webhook
+		err = json.Unmarshal(respBytes, &hook)
+
+		return &hook, err
+	}
+
+	sendTransfer := func(amount string) {
+		resp, err := doWithToken(http.MethodPost, "/transfers", tokens[0],
+			[]byte(fmt.Sprintf(`{"account_destination_id": %d, "amount": %s}`,
+				accs[1].ID, amount)))
+
+		if err != nil || resp.StatusCode != http.StatusCreated {
+			t.Log(resp, err)
+			t.FailNow()
+		}
+
+		resp.Body.Close()
+	}
+
+	_, err := createWebhook("http://example.com/hook")
+
+	if err == nil || !strings.Contains(err.Error(), "invalid_webhook_url") {
+		t.Error(err)
+	}
+
+	hook, err := createWebhook(receiver.URL + "/hook")
+
+	if err != nil || len(hook.Secret) != 64 {
+		t.Log(hook, err)
+		t.FailNow()
+	}
+
+	// The secret is only sent once
+	resp, err := doWithToken(http.MethodGet, "/webhooks", tokens[1], nil)
+
+	if err != nil {
+		t.Log(err)
+		t.FailNow()
+	}
+
+	respBytes, err := getResponseBytes(resp)
+
+	var hooks []webhook
+
+	if err == nil {
+		err = json.Unmarshal(respBytes, &hooks)
+	}
+
+	if err != nil || len(hooks) != 1 || hooks[0].ID != hook.ID ||
+		hooks[0].Secret != "" {
+
+		t.Error(string(respBytes), err)
+	}
+
+	// A payment to the account reaches the webhook, signed
+	sendTransfer("10.00")
+
+	var delivery receivedWebhook
+
+	select {
+	case delivery = <-received:
+	case <-time.After(3 * webhookJobInterval):
+		t.Log("no delivery")
+		t.FailNow()
+	}
+
+	err = checkWebhookSignature(hook.Secret,
+		delivery.header.Get("PedroBank-Signature"), delivery.body)
+
+	if err != nil {
+		t.Error(err)
+	}
+
+	var payload struct {
+		Type      string   `json:"type"`
+		AccountID int      `json:"account_id"`
+		Data      transfer `json:"data"`
+	}
+
+	err = json.Unmarshal(delivery.body, &payload)
+
+	if err != nil || payload.Type != "transfer.received" ||
+		payload.AccountID != accs[1].ID || payload.Data.Amount != 1000 ||
+		payload.Data.OriginID != accs[0].ID {
+
+		t.Error(string(delivery.body), err)
+	}
+
+	logged, err := waitForWebhookAttempt(tokens[1], hook.ID)
+
+	if err != nil || logged.Status != "delivered" || logged.Attempts != 1 ||
+		logged.LastStatus == nil || *logged.LastStatus != http.StatusOK ||
+		delivery.header.Get("PedroBank-Delivery") != fmt.Sprint(logged.ID) {
+
+		t.Error(logged, err)
+	}
+
+	// Only the owner sees the log
+	resp, err = doWithToken(http.MethodGet,
+		fmt.Sprintf("/webhooks/%d/deliveries", hook.ID), tokens[0], nil)
+
+	if err != nil || resp.StatusCode != http.StatusNotFound {
+		t.Error(resp, err)
+	}
+
+	resp.Body.Close()
+
+	// A failed delivery is tried again later, and can be retried by hand
+	// once dead
+	failing, err := createWebhook(receiver.URL + "/fail")
+
+	if err != nil {
+		t.Log(err)
+		t.FailNow()
+	}
+
+	sendTransfer("5.00")
+	<-received
+
+	failed, err := waitForWebhookAttempt(tokens[1], failing.ID)
+
+	if err != nil || failed.Status != "pending" || failed.Attempts != 1 ||
+		failed.LastStatus == nil ||
+		*failed.LastStatus != http.StatusInternalServerError ||
+		failed.NextAttemptAt == nil ||
+		failed.NextAttemptAt.Before(time.Now().Add(webhookFirstRetry/2)) {
+
+		t.Log(failed, err)
+		t.FailNow()
+	}
+
+	retryPath := func(hookID int, deliveryID int) string {
+		return fmt.Sprintf("/webhooks/%d/deliveries/%d/retry", hookID,
+			deliveryID)
+	}
+
+	resp, err = doWithToken(http.MethodPost, retryPath(failing.ID, failed.ID),
+		tokens[1], nil)
+
+	if err != nil || resp.StatusCode != http.StatusConflict {
+		t.Error(resp, err)
+	}
+
+	resp.Body.Close()
+
+	_, err = DB.Exec(
+		`update webhook_deliveries set status = 'dead' where id = $1`,
+		failed.ID)
+
+	if err != nil {
+		t.Log(err)
+		t.FailNow()
+	}
+
+	resp, err = doWithToken(http.MethodPost, retryPath(failing.ID, failed.ID),
+		tokens[1], nil)
+
+	if err != nil {
+		t.Log(err)
+		t.FailNow()
+	}
+
+	respBytes, err = getResponseBytes(resp)
+
+	var retried webhookDelivery
+
+	if err == nil {
+		err = json.Unmarshal(respBytes, &retried)
+	}
+
+	if err != nil || resp.StatusCode != http.StatusOK ||
+		retried.Status != "pending" || retried.Attempts != 0 {
+
+		t.Error(string(respBytes), err)
+	}
+
+	// Another webhook's delivery isn't found through this one
+	resp, err = doWithToken(http.MethodPost, retryPath(hook.ID, failed.ID),
+		tokens[1], nil)
+
+	if err != nil || resp.StatusCode != http.StatusNotFound {
+		t.Error(resp, err)
+	}
+
+	resp.Body.Close()
+
+	for _, expected := range []int{http.StatusNoContent,
+		http.StatusNotFound} {
+
+		resp, err = doWithToken(http.MethodDelete,
+			fmt.Sprintf("/webhooks/%d", failing.ID), tokens[1], nil)
+
+		if err != nil || resp.StatusCode != expected {
+			t.Error(resp, err)
+		}
+
+		resp.Body.Close()
+	}
+}
+
+// Publish every event to consumer until there are none left, returning them.
+func relayAllEvents(consumer *eventConsumer) ([]DomainEvent, error) {
+	var relayed []DomainEvent
+
+	bus := consumer.publisher.(*EventBus)
+	bus.Subscribe(func(ctx context.Context, event DomainEvent) error {
+		relayed = append(relayed, event)
+		return nil
+	})
+
+	defer func() { bus.subscriptions = bus.subscriptions[:1] }()
+
+	for {
+		published, err := relayDomainEvents(context.Background(), consumer)
+
+		if err != nil || published == 0 {
+			return relayed, err
+		}
+	}
+}
+
+func TestDomainEvents(t *testing.T) {
+	var testAccounts = []accountCreateRequest{
+		accountCreateRequest{
+			Name: "John Doe", CPF: "840.321-11", Secret: "toto"},
+		accountCreateRequest{
+			Name: "Jane Doe", CPF: "841.321-11", Secret: "tata"},
+	}
+
+	// The first handler fails while failing is set
+	failing := false
+	bus := NewEventBus()
+
+	bus.Subscribe(func(ctx context.Context, event DomainEvent) error {
+		if failing {
+			return errors.New("failing")
+		}
+
+		return nil
+	})
+
+	consumer := eventConsumer{"real-test", bus}
+
+	// Skip the events of the other tests
+	if _, err := relayAllEvents(&consumer); err != nil {
+		t.Log(err)
+		t.FailNow()
+	}
+
+	var accs [2]*account
+
+	for i, testAccount := range testAccounts {
+		acc, err := createTestAccount(testAccount)
+
+		if err != nil {
+			t.Log(err)
+			t.FailNow()
+		}
+
+		accs[i] = acc
+	}
+
+	token, err := loginAs(testAccounts[0].CPF, testAccounts[0].Secret)
+
+	if err != nil {
+		t.Log(err)
+		t.FailNow()
+	}
+
+	_, err = loginAs(testAccounts[1].CPF, "wrong")
+
+	if err == nil {
+		t.Error("logged in with the wrong secret")
+	}
+
+	sendTransfer := func(amount string, expected int) {
+		resp, err := doWithToken(http.MethodPost, "/transfers", token,
+			[]byte(fmt.Sprintf(`{"account_destination_id": %d, "amount": %s}`,
+				accs[1].ID, amount)))
+
+		if err != nil || resp.StatusCode != expected {
+			t.Log(resp, err)
+			t.FailNow()
+		}
+
+		resp.Body.Close()
+	}
+
+	sendTransfer("2.50", http.StatusCreated)
+
+	// A transfer that fails leaves no event
+	sendTransfer("1000000.00", http.StatusBadRequest)
+
+	// Publishing fails, so the offset stays
+	failing = true
+	_, err = relayDomainEvents(context.Background(), &consumer)
+
+	if err == nil {
+		t.Error("relayed with a failing publisher")
+	}
+
+	failing = false
+	relayed, err := relayAllEvents(&consumer)
+
+	if err != nil {
+		t.Log(err)
+		t.FailNow()
+	}
+
+	var types []string
+
+	for _, event := range relayed {
+		types = append(types, event.Type)
+	}
+
+	expected := []string{EventAccountCreated, EventAccountCreated,
+		EventLoginSucceeded, EventLoginFailed, EventTransferCompleted}
+
+	if fmt.Sprint(types) != fmt.Sprint(expected) {
+		t.Log(types)
+		t.FailNow()
+	}
+
+	var createdAcc account
+	var failedLogin loginEvent
+	var completed transfer
+
+	err = json.Unmarshal(relayed[1].Data, &createdAcc)
+
+	if err != nil || createdAcc.ID != accs[1].ID || relayed[1].AccountID !=
+		accs[1].ID || strings.Contains(string(relayed[1].Data), "secret") {
+
+		t.Error(string(relayed[1].Data), err)
+	}
+
+	err = json.Unmarshal(relayed[3].Data, &failedLogin)
+
+	if err != nil || failedLogin.AccountID != accs[1].ID ||
+		failedLogin.Reason != "wrong_password" {
+
+		t.Error(string(relayed[3].Data), err)
+	}
+
+	err = json.Unmarshal(relayed[4].Data, &completed)
+
+	if err != nil || completed.Amount != 250 ||
+		completed.OriginID != accs[0].ID ||
+		completed.DestinationID != accs[1].ID {
+
+		t.Error(string(relayed[4].Data), err)
+	}
+
+	for i := 1; i < len(relayed); i++ {
+		if relayed[i].ID <= relayed[i-1].ID {
+			t.Error("out of order", relayed[i-1].ID, relayed[i].ID)
+		}
+	}
+
+	// The offset moved past them
+	relayed, err = relayAllEvents(&consumer)
+
+	if err != nil || len(relayed) != 0 {
+		t.Error(relayed, err)
+	}
+
+	_, err = DB.Exec("update accounts set admin = true where id = $1",
+		accs[0].ID)
+
+	if err != nil {
+		t.Log(err)
+		t.FailNow()
+	}
+
+	resp, err := doWithToken(http.MethodGet, "/admin/event-consumers",
+		token, nil)
+
+	if err != nil {
+		t.Log(err)
+		t.FailNow()
+	}
+
+	respBytes, err := getResponseBytes(resp)
+
+	var consumers []eventConsumerStatus
+
+	if err == nil {
+		err = json.Unmarshal(respBytes, &consumers)
+	}
+
+	found := false
+
+	for _, status := range consumers {
+		if status.Name == consumer.name {
+			found = status.Lag == 0 && status.LastEventID != 0
+		}
+	}
+
+	if err != nil || resp.StatusCode != http.StatusOK || !found {
+		t.Error(resp.StatusCode, string(respBytes), err)
+	}
+
+	// Only admins see them
+	resp, err = doWithToken(http.MethodGet, "/admin/event-consumers", "",
+		nil)
+
+	if err != nil || resp.StatusCode != http.StatusUnauthorized {
+		t.Error(resp, err)
+	}
+
+	resp.Body.Close()
+}
+
+// Scrape /metrics and return the value of each sample, by name and labels.
+func scrapeMetrics() (map[string]float64, error) {
+	resp, err := get("/metrics")
+
+	if err != nil {
+		return nil, err
+	}
+
+	respBytes, err := getResponseBytes(resp)
+
+	if err != nil {
+		return nil, err
+	}
+
+	if resp.StatusCode != http.StatusOK ||
+		!strings.HasPrefix(resp.Header.Get("Content-Type"), "text/plain") {
+
+		return nil, fmt.Errorf("got %d: %s", resp.StatusCode, respBytes)
+	}
+
+	samples := make(map[string]float64)
+
+	for _, line := range strings.Split(string(respBytes), "\n") {
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+
+		space := strings.LastIndex(line, " ")
+		value, err := strconv.ParseFloat(line[space+1:], 64)
+
+		if err != nil {
+			return nil, fmt.Errorf("bad sample %q", line)
+		}
+
+		samples[line[:space]] = value
+	}
+
+	return samples, nil
+}
+
+func TestMetrics(t *testing.T) {
+	var testAccounts = []accountCreateRequest{
+		accountCreateRequest{
+			Name: "John Doe", CPF: "800.321-11", Secret: "toto"},
+		accountCreateRequest{
+			Name: "Jane Doe", CPF: "801.321-11", Secret: "tata"},
+		accountCreateRequest{
+			Name: "Escrow", CPF: "802.321-11", Secret: "titi"},
+	}
+
+	var accs [3]*account
+
+	for i, testAccount := range testAccounts {
+		acc, err := createTestAccount(testAccount)
+
+		if err != nil {
+			t.Log(err)
+			t.FailNow()
+		}
+
+		accs[i] = acc
+	}
+
+	before, err := scrapeMetrics()
+
+	if err != nil {
+		t.Log(err)
+		t.FailNow()
+	}
+
+	token, err := loginAs(testAccounts[0].CPF, testAccounts[0].Secret)
+
+	if err != nil {
+		t.Log(err)
+		t.FailNow()
+	}
+
+	if _, err = loginAs(testAccounts[1].CPF, "wrong"); err == nil {
+		t.Error("logged in with the wrong secret")
+	}
+
+	resp, err := doWithToken(http.MethodPost, "/transfers", token,
+		[]byte(fmt.Sprintf(`{"account_destination_id": %d, "amount": 12.50}`,
+			accs[1].ID)))
+
+	if err != nil || resp.StatusCode != http.StatusCreated {
+		t.Log(resp, err)
+		t.FailNow()
+	}
+
+	resp.Body.Close()
+
+	// Split payments and escrows move money too
+	resp, err = doWithToken(http.MethodPost, "/transfers", token,
+		[]byte(fmt.Sprintf(`{"amount": 10.00,
+		"splits": [{"account_destination_id": %d, "percent_bps": 5000},
+		{"account_destination_id": %d, "percent_bps": 5000}]}`,
+			accs[1].ID, accs[2].ID)))
+
+	if err != nil || resp.StatusCode != http.StatusCreated {
+		t.Log(resp, err)
+		t.FailNow()
+	}
+
+	resp.Body.Close()
+
+	_, err = DB.Exec(
+		"update accounts set escrow = (id = $1) where escrow or id = $1",
+		accs[2].ID)
+
+	if err != nil {
+		t.Log(err)
+		t.FailNow()
+	}
+
+	resp, err = doWithToken(http.MethodPost, "/escrows", token,
+		[]byte(fmt.Sprintf(`{"payee_id": %d, "amount": 3.00,
+		"deadline": "%s", "default_action": "release"}`, accs[1].ID,
+			time.Now().Add(time.Hour).UTC().Format(time.RFC3339))))
+
+	if err != nil || resp.StatusCode != http.StatusCreated {
+		t.Log(resp, err)
+		t.FailNow()
+	}
+
+	resp.Body.Close()
+
+	after, err := scrapeMetrics()
+
+	if err != nil {
+		t.Log(err)
+		t.FailNow()
+	}
+
+	for sample, added := range map[string]float64{
+		`pedrobank_http_requests_total{method="POST",route="/transfers",` +
+			`status="201"}`: 1,
+		`pedrobank_http_requests_total{method="POST",route="/login",` +
+			`status="400"}`: 1,
+		`pedrobank_transfers_total{result="completed"}`:          4,
+		`pedrobank_transfer_amount_reais_sum`:                    25.5,
+		`pedrobank_failed_logins_total{reason="wrong_password"}`: 1,
+		`pedrobank_http_request_duration_seconds_count{method="POST",` +
+			`route="/transfers",status="201"}`: 1,
+	} {
+		if after[sample] != before[sample]+added {
+			t.Error(sample, before[sample], after[sample])
+		}
+	}
+
+	if after["pedrobank_active_sessions"] < 1 ||
+		after["pedrobank_db_open_connections"] < 1 {
+
+		t.Error(after["pedrobank_active_sessions"],
+			after["pedrobank_db_open_connections"])
+	}
+}
+
+func TestMain(m *testing.M) {
+
+	// We don't care about authentication for these tests.
+	tlsConfig := &tls.Config{InsecureSkipVerify: true}
+	tr := &http.Transport{TLSClientConfig: tlsConfig}
+	client = http.Client{Transport: tr}
+
+	var err = OpenDBPool()
+	defer DB.Close()
+
+	if err != nil {
+		fmt.Println("Could not open DB.")
+		os.Exit(1)
+	}
+
+	// Clean up the DB before we test. Tables that reference others come
+	// first.
+	var tables = []string{"event_consumers", "domain_events",
+		"webhook_deliveries", "webhook_events", "webhooks",
+		"idempotency_keys", "password_resets", "account_status_changes",
+		"escrows", "overdraft_charges", "interest_runs", "interest_postings",
+		"interest_accruals", "interest_rates", "payment_request_payments",
+		"payment_requests", "transfer_keys", "transfer_batch_items",
+		"risk_decisions", "pending_transfers", "transfers",
+		"transfer_batches", "account_limits", "fee_schedules", "accounts"}
+
+	for _, table := range tables {
+		_, err = DB.Exec("delete from " + table)
+
+		if err != nil {
+			fmt.Printf("Could not delete %s: %v\n", table, err)
+			os.Exit(1)
+		}
 	}
 
 	go Run("../../certs")
@@ -0,0 +1,212 @@
+package server
+
+import (
+	"crypto/rand"
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"math/big"
+	"net/http"
+	"time"
+)
+
+// JSON that the client sends to ask for a password reset code.
+type resetRequest struct {
+	CPF string `json:"cpf"`
+}
+
+// JSON that the client sends to set a new password with a reset code.
+type resetConfirmRequest struct {
+	CPF       string `json:"cpf"`
+	Code      string `json:"code"`
+	NewSecret string `json:"new_secret"`
+}
+
+// How long a reset code can be used, how often a new one can be sent, and
+// how many wrong codes can be tried before it has to be sent again.
+const resetCodeTTL = 15 * time.Minute
+const resetResendInterval = time.Minute
+const maxResetAttempts = 5
+
+// A random six digit code.
+func generateResetCode() (string, error) {
+	val, err := rand.Int(rand.Reader, big.NewInt(1000000))
+
+	if err != nil {
+		return "", err
+	}
+
+	return fmt.Sprintf("%06d", val.Int64()), nil
+}
+
+// Handler for POST at /password-reset. Sends a one-time code to the owner of
+// the account with the CPF, through the notifier. Responds the same whether
+// the account exists or not, so it can't be used to find accounts. Only
+// sends a new code once every resetResendInterval.
+func requestPasswordReset(rw http.ResponseWriter, req *http.Request) {
+	data, err := readFromReq(req, 128)
+
+	if err != nil {
+		respondWithError(rw, err)
+		return
+	}
+
+	var resetReq resetRequest
+
+	err = json.Unmarshal(data, &resetReq)
+
+	if err != nil {
+		respondWithError(rw, cantParseJSONError)
+		return
+	}
+
+	if !cpfRegex.MatchString(resetReq.CPF) {
+		respondWithError(rw, cpfInvalidError)
+		return
+	}
+
+	code, err := generateResetCode()
+
+	if err != nil {
+		respondWithError(rw, err)
+		return
+	}
+
+	now := time.Now().UTC()
+	var id int
+
+	// Inserts nothing when there's no such active account or a code was sent
+	// recently.
+	err = DB.QueryRowContext(req.Context(),
+		`insert into password_resets (account_id, code_hash, created_at,
+		expires_at)
+		select a.id, $2, $3, $4 from accounts a
+		where a.cpf = $1 and a.status <> 'closed'
+		and not exists (select 1 from password_resets r
+			where r.account_id = a.id and r.used_at is null
+			and r.created_at > $5)
+		returning account_id`,
+		resetReq.CPF, hashSecret(code), now, now.Add(resetCodeTTL),
+		now.Add(-resetResendInterval)).Scan(&id)
+
+	if err == nil {
+		err = notifier.Notify(id, fmt.Sprintf(
+			"Your PedroBank password reset code is %s. It expires in %d "+
+				"minutes.", code, int(resetCodeTTL.Minutes())))
+	} else if err == sql.ErrNoRows {
+		err = nil
+	}
+
+	if err != nil {
+		respondWithError(rw, err)
+		return
+	}
+
+	rw.WriteHeader(http.StatusAccepted)
+}
+
+// Handler for POST at /password-reset/confirm. Sets the new password if the
+// code is the last one sent to the account, not expired or used, and fewer
+// than maxResetAttempts wrong codes were tried. Logs the account out
+// everywhere.
+func confirmPasswordReset(rw http.ResponseWriter, req *http.Request) {
+	data, err := readFromReq(req, 256)
+
+	if err != nil {
+		respondWithError(rw, err)
+		return
+	}
+
+	var confirmReq resetConfirmRequest
+
+	err = json.Unmarshal(data, &confirmReq)
+
+	if err != nil {
+		respondWithError(rw, cantParseJSONError)
+		return
+	}
+
+	if !cpfRegex.MatchString(confirmReq.CPF) {
+		respondWithError(rw, cpfInvalidError)
+		return
+	}
+
+	if err = validateSecret(confirmReq.NewSecret); err != nil {
+		respondWithError(rw, err)
+		return
+	}
+
+	tx, err := DB.BeginTx(req.Context(), &defaultTxOptions)
+
+	if err != nil {
+		logger.Print("Error starting tx to reset password")
+		respondWithError(rw, err)
+		return
+	}
+
+	now := time.Now().UTC()
+	var id, resetID, attempts int
+	var codeHash string
+
+	err = tx.QueryRow(
+		`select a.id, r.id, r.code_hash, r.attempts
+		from password_resets r join accounts a on a.id = r.account_id
+		where a.cpf = $1 and a.status <> 'closed' and r.used_at is null
+		and r.expires_at > $2
+		order by r.created_at desc limit 1
+		for update of r`, confirmReq.CPF, now).Scan(&id, &resetID,
+		&codeHash, &attempts)
+
+	if err == sql.ErrNoRows || (err == nil && attempts >= maxResetAttempts) {
+		rollbackTx(tx)
+		respondWithError(rw, resetCodeInvalidError)
+		return
+	} else if err != nil {
+		rollbackTx(tx)
+		respondWithError(rw, err)
+		return
+	}
+
+	valid := hashSecret(confirmReq.Code) == codeHash
+
+	if valid {
+		_, err = tx.Exec(`update accounts set secret = $1 where id = $2`,
+			hashSecret(confirmReq.NewSecret), id)
+
+		if err == nil {
+			_, err = tx.Exec(
+				`update password_resets set used_at = $1 where id = $2`,
+				now, resetID)
+		}
+	} else {
+		// Counted even though the request fails, so the code can't be
+		// guessed.
+		_, err = tx.Exec(
+			`update password_resets set attempts = attempts + 1
+			where id = $1`, resetID)
+	}
+
+	if err != nil {
+		rollbackTx(tx)
+		respondWithError(rw, err)
+		return
+	}
+
+	err = tx.Commit()
+
+	if err != nil {
+		logger.Print("Error commiting tx")
+		respondWithError(rw, err)
+		return
+	}
+
+	if !valid {
+		respondWithError(rw, resetCodeInvalidError)
+		return
+	}
+
+	logoutAccount(id, "")
+
+	logger.Printf("Reset password of account %d", id)
+	rw.WriteHeader(http.StatusNoContent)
+}
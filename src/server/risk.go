@@ -0,0 +1,542 @@
+package server
+
+import (
+	"database/sql"
+	"fmt"
+	"net/http"
+	"time"
+)
+
+// What a risk rule thinks of a transfer. Ordered by severity, so that the
+// most severe decision among all rules wins.
+type RiskDecision int
+
+const (
+	// Let the transfer through
+	RiskAllow RiskDecision = iota
+	// Park the transfer until an admin approves or rejects it
+	RiskReview
+	// Refuse the transfer
+	RiskDeny
+)
+
+func (decision RiskDecision) String() string {
+	switch decision {
+	case RiskAllow:
+		return "allow"
+	case RiskReview:
+		return "review"
+	case RiskDeny:
+		return "deny"
+	default:
+		return fmt.Sprintf("RiskDecision(%d)", int(decision))
+	}
+}
+
+// A transfer about to be made, as seen by the risk rules.
+type TransferAttempt struct {
+	OriginID      int
+	DestinationID int
+	Amount        money
+	// Non-zero if the transfer is an item of a batch
+	BatchID     int
+	Description string
+	Reference   string
+	Metadata    transferMetadata
+}
+
+// A risk rule is evaluated inside the transfer transaction, after both
+// account rows are locked and before any money moves, so it can query the
+// transfers table without racing other transfers from the same origin.
+type RiskRule interface {
+	// Short name, stored with the decisions the rule makes
+	Name() string
+	Evaluate(tx *sql.Tx, attempt *TransferAttempt) (RiskDecision, error)
+}
+
+// Rules evaluated for every transfer made through insertTransfer.
+var riskRules = []RiskRule{
+	&velocityRule{maxTransfers: 20, window: 10 * time.Minute},
+	&newDestinationRule{threshold: 100000}, // 1000.00
+	&roundTripRule{window: time.Hour},
+}
+
+// Add a rule to the ones evaluated for every transfer. Call this before Run.
+func AddRiskRule(rule RiskRule) {
+	riskRules = append(riskRules, rule)
+}
+
+// Deny transfers from an origin that already made maxTransfers transfers in
+// the last window. A whole batch counts as a single transfer, so the items of
+// a payroll batch don't trip the rule.
+type velocityRule struct {
+	maxTransfers int
+	window       time.Duration
+}
+
+func (rule *velocityRule) Name() string {
+	return "velocity"
+}
+
+func (rule *velocityRule) Evaluate(tx *sql.Tx,
+	attempt *TransferAttempt) (RiskDecision, error) {
+
+	var count int
+
+	var batchID interface{}
+
+	if attempt.BatchID != 0 {
+		batchID = attempt.BatchID
+	}
+
+	// Batch ids are negated so they can't collide with transfer ids. The
+	// batch the attempt belongs to, if any, is left out, as it's the
+	// transfer being counted. Fees aren't transfers the user made.
+	row := tx.QueryRow(
+		`select count(distinct coalesce(-batch_id, id)) from transfers
+		where origin_id = $1 and created_at >= $2 and fee_for is null
+		and ($3::integer is null or batch_id is distinct from $3)`,
+		attempt.OriginID, time.Now().Add(-rule.window).UTC(), batchID)
+
+	err := row.Scan(&count)
+
+	if err != nil {
+		return RiskAllow, err
+	}
+
+	if count >= rule.maxTransfers {
+		return RiskDeny, nil
+	}
+
+	return RiskAllow, nil
+}
+
+// Review the first transfer from an origin to a destination if it's above
+// threshold.
+type newDestinationRule struct {
+	threshold money
+}
+
+func (rule *newDestinationRule) Name() string {
+	return "new_destination"
+}
+
+func (rule *newDestinationRule) Evaluate(tx *sql.Tx,
+	attempt *TransferAttempt) (RiskDecision, error) {
+
+	if attempt.Amount <= rule.threshold {
+		return RiskAllow, nil
+	}
+
+	var known bool
+
+	row := tx.QueryRow(
+		`select exists (select 1 from transfers
+		where origin_id = $1 and destination_id = $2)`,
+		attempt.OriginID, attempt.DestinationID)
+
+	err := row.Scan(&known)
+
+	if err != nil {
+		return RiskAllow, err
+	}
+
+	if !known {
+		return RiskReview, nil
+	}
+
+	return RiskAllow, nil
+}
+
+// Review transfers that send money back to an account it came from in the
+// last window, which is a common way of faking activity.
+type roundTripRule struct {
+	window time.Duration
+}
+
+func (rule *roundTripRule) Name() string {
+	return "round_trip"
+}
+
+func (rule *roundTripRule) Evaluate(tx *sql.Tx,
+	attempt *TransferAttempt) (RiskDecision, error) {
+
+	var roundTrip bool
+
+	row := tx.QueryRow(
+		`select exists (select 1 from transfers
+		where origin_id = $1 and destination_id = $2 and created_at >= $3)`,
+		attempt.DestinationID, attempt.OriginID,
+		time.Now().Add(-rule.window).UTC())
+
+	err := row.Scan(&roundTrip)
+
+	if err != nil {
+		return RiskAllow, err
+	}
+
+	if roundTrip {
+		return RiskReview, nil
+	}
+
+	return RiskAllow, nil
+}
+
+// Returned by transferInTx when a rule denies the transfer. Unwraps to the
+// public error, so the client only sees that the transfer was denied, not by
+// which rule.
+type riskDeniedError struct {
+	rule string
+}
+
+func (err *riskDeniedError) Error() string {
+	return fmt.Sprintf("transfer denied by rule %s", err.rule)
+}
+
+func (err *riskDeniedError) Unwrap() error {
+	return transferDeniedError
+}
+
+// A transfer parked for review by the risk rules. No money moved yet.
+type pendingTransfer struct {
+	ID            int   `json:"id"`
+	OriginID      int   `json:"account_origin_id"`
+	DestinationID int   `json:"account_destination_id"`
+	Amount        money `json:"amount"`
+	// pending, approved or rejected
+	Status    string    `json:"status"`
+	Rule      string    `json:"rule"`
+	CreatedAt time.Time `json:"created_at"`
+	// The transfer made when the pending transfer was approved
+	TransferID  *int             `json:"transfer_id,omitempty"`
+	Description string           `json:"description,omitempty"`
+	Reference   string           `json:"reference,omitempty"`
+	Metadata    transferMetadata `json:"metadata,omitempty"`
+}
+
+// Columns selected for a pending transfer, in the order scanPendingTransfer
+// expects.
+const pendingTransferColumns = `id, origin_id, destination_id, amount,
+	status, rule, created_at, transfer_id, description, reference, metadata`
+
+// Scan a row selected with pendingTransferColumns into pending.
+func scanPendingTransfer(row scanner, pending *pendingTransfer) error {
+	return row.Scan(&pending.ID, &pending.OriginID, &pending.DestinationID,
+		&pending.Amount, &pending.Status, &pending.Rule, &pending.CreatedAt,
+		&pending.TransferID, &pending.Description, &pending.Reference,
+		&pending.Metadata)
+}
+
+// Either *sql.DB or *sql.Tx.
+type execer interface {
+	Exec(query string, args ...interface{}) (sql.Result, error)
+}
+
+// Record a risk decision for attempt. rule is the rule that made the
+// decision, or empty if all rules allowed the transfer. Only one of
+// transferID and pendingID should be set, and only if the transfer was
+// allowed or reviewed, respectively.
+func recordRiskDecision(e execer, attempt *TransferAttempt,
+	decision RiskDecision, rule string, transferID *int,
+	pendingID *int) error {
+
+	var ruleArg interface{}
+
+	if rule != "" {
+		ruleArg = rule
+	}
+
+	_, err := e.Exec(
+		`insert into risk_decisions (origin_id, destination_id, amount,
+		decision, rule, transfer_id, pending_id, created_at)
+		values ($1, $2, $3, $4, $5, $6, $7,
+		current_timestamp at time zone 'UTC')`,
+		attempt.OriginID, attempt.DestinationID, attempt.Amount,
+		decision.String(), ruleArg, transferID, pendingID)
+
+	if err != nil {
+		logger.Printf("Could not record risk decision: %v", err)
+	}
+
+	return err
+}
+
+// Record an admin's decision on a pending transfer, inside the tx that
+// approves or rejects it: approve, with the transfer made for it, or reject.
+func recordReviewDecision(tx *sql.Tx, pending *pendingTransfer,
+	decision string, adminID int, transferID *int) error {
+
+	_, err := tx.Exec(
+		`insert into risk_decisions (origin_id, destination_id, amount,
+		decision, transfer_id, pending_id, decided_by, created_at)
+		values ($1, $2, $3, $4, $5, $6, $7,
+		current_timestamp at time zone 'UTC')`,
+		pending.OriginID, pending.DestinationID, pending.Amount, decision,
+		transferID, pending.ID, adminID)
+
+	return err
+}
+
+// Evaluate all the risk rules for attempt, inside tx. If a rule denies the
+// transfer, return a riskDeniedError. If a rule wants it reviewed, park it in
+// pending_transfers and return the pending transfer. Otherwise return nil for
+// both, and the caller can go on with the transfer.
+func evaluateTransferRisk(tx *sql.Tx,
+	attempt *TransferAttempt) (*pendingTransfer, error) {
+
+	decision := RiskAllow
+	var decidingRule string
+
+	for _, rule := range riskRules {
+		ruleDecision, err := rule.Evaluate(tx, attempt)
+
+		if err != nil {
+			return nil, err
+		}
+
+		if ruleDecision > decision {
+			decision = ruleDecision
+			decidingRule = rule.Name()
+		}
+	}
+
+	switch decision {
+	case RiskDeny:
+		logger.Printf("Transfer from %d to %d denied by rule %s",
+			attempt.OriginID, attempt.DestinationID, decidingRule)
+		return nil, &riskDeniedError{decidingRule}
+	case RiskReview:
+		var pending pendingTransfer
+
+		row := tx.QueryRow(
+			`insert into pending_transfers (origin_id, destination_id,
+			amount, status, rule, created_at, description, reference,
+			metadata)
+			values ($1, $2, $3, 'pending', $4,
+			current_timestamp at time zone 'UTC', $5, $6, $7)
+			returning `+pendingTransferColumns,
+			attempt.OriginID, attempt.DestinationID, attempt.Amount,
+			decidingRule, attempt.Description, attempt.Reference,
+			attempt.Metadata)
+
+		err := scanPendingTransfer(row, &pending)
+
+		if err != nil {
+			return nil, err
+		}
+
+		err = recordRiskDecision(tx, attempt, RiskReview, decidingRule, nil,
+			&pending.ID)
+
+		if err != nil {
+			return nil, err
+		}
+
+		err = recordDomainEvent(tx, EventTransferPendingReview,
+			pending.OriginID, &pending)
+
+		if err != nil {
+			return nil, err
+		}
+
+		logger.Printf("Transfer from %d to %d parked for review by rule %s",
+			attempt.OriginID, attempt.DestinationID, decidingRule)
+
+		return &pending, nil
+	default:
+		return nil, nil
+	}
+}
+
+// Handler for GET at /admin/pending-transfers. Lists the transfers waiting
+// for review.
+func getPendingTransfers(rw http.ResponseWriter, req *http.Request) {
+	rows, err := DB.Query(
+		`select ` + pendingTransferColumns + ` from pending_transfers
+		where status = 'pending' order by id`)
+
+	if err != nil {
+		respondWithError(rw, err)
+		return
+	}
+
+	defer rows.Close()
+
+	var pending pendingTransfer
+
+	// No pagination, there shouldn't be many transfers waiting for review.
+	var pendings []pendingTransfer = make([]pendingTransfer, 0, 16)
+
+	for rows.Next() {
+		err = scanPendingTransfer(rows, &pending)
+
+		if err != nil {
+			logger.Printf("error when querying pending transfers")
+			respondWithError(rw, err)
+			return
+		}
+
+		pendings = append(pendings, pending)
+	}
+
+	if err = rows.Err(); err != nil {
+		logger.Printf("error when querying pending transfers")
+		respondWithError(rw, err)
+		return
+	}
+
+	respondWithJSON(rw, http.StatusOK, pendings)
+}
+
+// Handler for POST at /admin/pending-transfers/<id>/approve. Approve the
+// pending transfer with id, making the transfer. The risk rules
+// are not evaluated again, but the funds and limits are, as they may have
+// changed since the transfer was parked.
+func approvePendingTransfer(rw http.ResponseWriter, req *http.Request) {
+	adminID := accountID(req)
+	id, err := pathID(req, "id")
+
+	if err != nil {
+		respondWithError(rw, err)
+		return
+	}
+
+	var pending pendingTransfer
+
+	tx, err := DB.BeginTx(req.Context(), &defaultTxOptions)
+
+	if err != nil {
+		logger.Print("Error starting tx to approve transfer")
+		respondWithError(rw, err)
+		return
+	}
+
+	row := tx.QueryRow(
+		`select `+pendingTransferColumns+` from pending_transfers
+		where id = $1 and status = 'pending' for update`, id)
+
+	err = scanPendingTransfer(row, &pending)
+
+	if err == sql.ErrNoRows {
+		rollbackTx(tx)
+		respondWithError(rw, noPendingTransferError)
+		return
+	} else if err != nil {
+		rollbackTx(tx)
+		respondWithError(rw, err)
+		return
+	}
+
+	transf, _, err := transferInTx(tx,
+		&TransferAttempt{
+			OriginID:      pending.OriginID,
+			DestinationID: pending.DestinationID,
+			Amount:        pending.Amount,
+			Description:   pending.Description,
+			Reference:     pending.Reference,
+			Metadata:      pending.Metadata},
+		false)
+
+	if err != nil {
+		rollbackTx(tx)
+		respondWithError(rw, err)
+		return
+	}
+
+	_, err = tx.Exec(
+		`update pending_transfers set status = 'approved',
+		reviewed_by = $1, reviewed_at = current_timestamp at time zone 'UTC',
+		transfer_id = $2 where id = $3`, adminID, transf.ID, id)
+
+	if err == nil {
+		err = recordReviewDecision(tx, &pending, "approve", adminID,
+			&transf.ID)
+	}
+
+	if err != nil {
+		rollbackTx(tx)
+		respondWithError(rw, err)
+		return
+	}
+
+	err = tx.Commit()
+
+	if err != nil {
+		logger.Print("Error commiting tx")
+		respondWithError(rw, err)
+		return
+	}
+
+	countTransfer("completed", transf.Amount)
+	logger.Printf("Pending transfer %d approved by %d", id, adminID)
+
+	pending.Status = "approved"
+	pending.TransferID = &transf.ID
+
+	respondWithJSON(rw, http.StatusOK, &pending)
+}
+
+// Handler for POST at /admin/pending-transfers/<id>/reject. Reject the
+// pending transfer with id. No money moves.
+func rejectPendingTransfer(rw http.ResponseWriter, req *http.Request) {
+	adminID := accountID(req)
+	id, err := pathID(req, "id")
+
+	if err != nil {
+		respondWithError(rw, err)
+		return
+	}
+
+	tx, err := DB.BeginTx(req.Context(), &defaultTxOptions)
+
+	if err != nil {
+		logger.Print("Error starting tx to reject pending transfer")
+		respondWithError(rw, err)
+		return
+	}
+
+	var pending pendingTransfer
+
+	row := tx.QueryRow(
+		`update pending_transfers set status = 'rejected',
+		reviewed_by = $1, reviewed_at = current_timestamp at time zone 'UTC'
+		where id = $2 and status = 'pending'
+		returning `+pendingTransferColumns, adminID, id)
+
+	err = scanPendingTransfer(row, &pending)
+
+	if err == sql.ErrNoRows {
+		rollbackTx(tx)
+		respondWithError(rw, noPendingTransferError)
+		return
+	} else if err != nil {
+		rollbackTx(tx)
+		respondWithError(rw, err)
+		return
+	}
+
+	err = recordReviewDecision(tx, &pending, "reject", adminID, nil)
+
+	if err == nil {
+		err = recordDomainEvent(tx, EventTransferRejected, pending.OriginID,
+			&pending)
+	}
+
+	if err != nil {
+		rollbackTx(tx)
+		respondWithError(rw, err)
+		return
+	}
+
+	err = tx.Commit()
+
+	if err != nil {
+		logger.Print("Error commiting tx")
+		respondWithError(rw, err)
+		return
+	}
+
+	logger.Printf("Pending transfer %d rejected by %d", id, adminID)
+
+	respondWithJSON(rw, http.StatusOK, &pending)
+}
@@ -0,0 +1,236 @@
+package server
+
+import (
+	"context"
+	"net/http"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// Wraps a handler with something done around every request, such as
+// authentication or logging.
+type middleware func(http.Handler) http.Handler
+
+// One segment of a route pattern: either a literal, or a parameter that
+// matches any non-empty segment, or only the ones matching its regex.
+type routeSegment struct {
+	literal string
+	param   string
+	regex   *regexp.Regexp
+}
+
+type route struct {
+	method   string
+	pattern  string
+	segments []routeSegment
+	handler  http.Handler
+}
+
+// Routes requests by method and path. Patterns are paths where a segment
+// can be a parameter, like /escrows/{id:[0-9]+}/confirm or /keys/{key}.
+// When more than one pattern matches, literal segments win over parameters,
+// from left to right, so /transfers/quote wins over /transfers/{id}.
+//
+// Paths no pattern matches get invalidURLError, and methods not routed for
+// the pattern get invalidMethodError, with the Allow header set.
+type router struct {
+	routes     []route
+	middleware []middleware
+}
+
+func newRouter() *router {
+	return &router{}
+}
+
+// Add middleware that runs for every request, even the ones that aren't
+// routed. The first one added runs first.
+func (rt *router) use(mws ...middleware) {
+	rt.middleware = append(rt.middleware, mws...)
+}
+
+// Route method requests to pattern to handler, wrapped in mws, the first
+// one running first.
+func (rt *router) handle(method string, pattern string,
+	handler http.HandlerFunc, mws ...middleware) {
+
+	rt.routes = append(rt.routes, route{
+		method:   method,
+		pattern:  pattern,
+		segments: parsePattern(pattern),
+		handler:  chain(handler, mws),
+	})
+}
+
+func splitPath(path string) []string {
+	path = strings.TrimPrefix(path, "/")
+
+	if path == "" {
+		return nil
+	}
+
+	return strings.Split(path, "/")
+}
+
+func parsePattern(pattern string) []routeSegment {
+	parts := splitPath(pattern)
+	segments := make([]routeSegment, len(parts))
+
+	for i, part := range parts {
+		if !strings.HasPrefix(part, "{") || !strings.HasSuffix(part, "}") {
+			segments[i].literal = part
+			continue
+		}
+
+		param := part[1 : len(part)-1]
+
+		if colon := strings.Index(param, ":"); colon >= 0 {
+			segments[i].regex = regexp.MustCompile(
+				"^(?:" + param[colon+1:] + ")$")
+			param = param[:colon]
+		}
+
+		segments[i].param = param
+	}
+
+	return segments
+}
+
+// The parameters in path if it matches the route, or nil if it doesn't.
+func (r *route) match(parts []string) map[string]string {
+	if len(parts) != len(r.segments) {
+		return nil
+	}
+
+	params := make(map[string]string)
+
+	for i, segment := range r.segments {
+		switch {
+		case segment.param == "":
+			if parts[i] != segment.literal {
+				return nil
+			}
+		case parts[i] == "":
+			return nil
+		case segment.regex != nil && !segment.regex.MatchString(parts[i]):
+			return nil
+		default:
+			params[segment.param] = parts[i]
+		}
+	}
+
+	return params
+}
+
+// Whether the route is more specific than other, which matches the same
+// path.
+func (r *route) moreSpecific(other *route) bool {
+	for i, segment := range r.segments {
+		otherSegment := other.segments[i]
+
+		if (segment.param == "") != (otherSegment.param == "") {
+			return segment.param == ""
+		}
+
+		if (segment.regex != nil) != (otherSegment.regex != nil) {
+			return segment.regex != nil
+		}
+	}
+
+	return false
+}
+
+func (rt *router) dispatch(rw http.ResponseWriter, req *http.Request) {
+	parts := splitPath(req.URL.Path)
+
+	var best *route
+	var bestParams map[string]string
+	var allowed []string
+
+	for i := range rt.routes {
+		r := &rt.routes[i]
+		params := r.match(parts)
+
+		if params == nil {
+			continue
+		}
+
+		if best != nil && best.pattern != r.pattern {
+			if !r.moreSpecific(best) {
+				continue
+			}
+
+			best = nil
+			allowed = nil
+		}
+
+		allowed = append(allowed, r.method)
+
+		if best == nil || r.method == req.Method {
+			best, bestParams = r, params
+		}
+	}
+
+	if best == nil {
+		respondWithError(rw, invalidURLError)
+		return
+	}
+
+	setMatchedRoute(req, best.pattern)
+
+	if best.method != req.Method {
+		sort.Strings(allowed)
+		rw.Header().Set("Allow", strings.Join(allowed, ", "))
+		respondWithError(rw, invalidMethodError)
+		return
+	}
+
+	ctx := context.WithValue(req.Context(), pathParamsKey, bestParams)
+	best.handler.ServeHTTP(rw, req.WithContext(ctx))
+}
+
+func (rt *router) ServeHTTP(rw http.ResponseWriter, req *http.Request) {
+	chain(http.HandlerFunc(rt.dispatch), rt.middleware).ServeHTTP(rw, req)
+}
+
+// Wrap handler in mws, the first one outermost.
+func chain(handler http.Handler, mws []middleware) http.Handler {
+	for i := len(mws) - 1; i >= 0; i-- {
+		handler = mws[i](handler)
+	}
+
+	return handler
+}
+
+// Keys for the values that the router and middleware keep in the request
+// context.
+type contextKey int
+
+const (
+	pathParamsKey contextKey = iota
+	accountIDKey
+	tokenKey
+	// For gRPC calls, which have no response header to keep it in
+	requestIDKey
+	matchedRouteKey
+	idempotencyStateKey
+)
+
+// The value of the path parameter name of the route that matched req.
+func pathParam(req *http.Request, name string) string {
+	params, _ := req.Context().Value(pathParamsKey).(map[string]string)
+	return params[name]
+}
+
+// The path parameter name as an id. Routes must only match digits for it,
+// with {name:[0-9]+}, so the only error is a number too large for our ids.
+func pathID(req *http.Request, name string) (int, error) {
+	id64, err := strconv.ParseInt(pathParam(req, name), 10, 32)
+
+	if err != nil {
+		return 0, idTooLargeError
+	}
+
+	return int(id64), nil
+}
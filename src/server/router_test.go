@@ -0,0 +1,208 @@
+package server
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+// A handler that responds with the route's name and path parameters.
+func routeNamed(name string) http.HandlerFunc {
+	return func(rw http.ResponseWriter, req *http.Request) {
+		rw.Write([]byte(name + " " + pathParam(req, "id") +
+			pathParam(req, "key")))
+	}
+}
+
+func TestRouter(t *testing.T) {
+	rt := newRouter()
+	rt.handle(http.MethodGet, "/", routeNamed("root"))
+	rt.handle(http.MethodGet, "/transfers", routeNamed("list"))
+	rt.handle(http.MethodPost, "/transfers", routeNamed("create"))
+	rt.handle(http.MethodPost, "/transfers/quote", routeNamed("quote"))
+	rt.handle(http.MethodGet, "/transfers/{id:[0-9]+}", routeNamed("get"))
+	rt.handle(http.MethodGet, "/transfers/{key}", routeNamed("any"))
+	rt.handle(http.MethodPost, "/escrows/{id:[0-9]+}/confirm",
+		routeNamed("confirm"))
+
+	var values = []struct {
+		method string
+		path   string
+		status int
+		body   string
+		allow  string
+	}{
+		{http.MethodGet, "/", http.StatusOK, "root ", ""},
+		{http.MethodGet, "/transfers", http.StatusOK, "list ", ""},
+		{http.MethodPost, "/transfers", http.StatusOK, "create ", ""},
+		{http.MethodDelete, "/transfers", http.StatusMethodNotAllowed, "",
+			"GET, POST"},
+		{http.MethodPost, "/transfers/quote", http.StatusOK, "quote ", ""},
+		// The literal wins, even though its method doesn't match
+		{http.MethodGet, "/transfers/quote", http.StatusMethodNotAllowed, "",
+			"POST"},
+		{http.MethodGet, "/transfers/42", http.StatusOK, "get 42", ""},
+		{http.MethodGet, "/transfers/abc", http.StatusOK, "any abc", ""},
+		{http.MethodGet, "/transfers/", http.StatusNotFound, "", ""},
+		{http.MethodGet, "/transfers/42/x", http.StatusNotFound, "", ""},
+		{http.MethodPost, "/escrows/7/confirm", http.StatusOK, "confirm 7",
+			""},
+		{http.MethodPost, "/escrows/x/confirm", http.StatusNotFound, "", ""},
+		{http.MethodGet, "/zzz", http.StatusNotFound, "", ""},
+	}
+
+	for _, value := range values {
+		rec := httptest.NewRecorder()
+		rt.ServeHTTP(rec, httptest.NewRequest(value.method, value.path, nil))
+
+		if rec.Code != value.status ||
+			(value.body != "" && rec.Body.String() != value.body) ||
+			rec.Header().Get("Allow") != value.allow {
+			t.Error(value.method, value.path, rec.Code, rec.Body.String(),
+				rec.Header().Get("Allow"))
+		}
+	}
+}
+
+func TestPathID(t *testing.T) {
+	rt := newRouter()
+	rt.handle(http.MethodGet, "/accounts/{id:[0-9]+}",
+		func(rw http.ResponseWriter, req *http.Request) {
+			if _, err := pathID(req, "id"); err != nil {
+				respondWithError(rw, err)
+			}
+		})
+
+	rec := httptest.NewRecorder()
+	rt.ServeHTTP(rec, httptest.NewRequest(http.MethodGet,
+		"/accounts/99999999999", nil))
+
+	if responseErrorCode(rec.Body.Bytes()) != idTooLargeError.code {
+		t.Error(rec.Body.String())
+	}
+}
+
+func TestMiddleware(t *testing.T) {
+	rt := newRouter()
+	rt.use(withRequestID, withRecovery,
+		withCORS([]string{"https://app.example"}), withBodyLimit(8))
+	rt.handle(http.MethodGet, "/panic",
+		func(rw http.ResponseWriter, req *http.Request) {
+			panic("oops")
+		})
+	rt.handle(http.MethodPost, "/echo",
+		func(rw http.ResponseWriter, req *http.Request) {
+			data, err := readFromReq(req, 64)
+
+			if err != nil {
+				respondWithError(rw, err)
+				return
+			}
+
+			rw.Write(data)
+		})
+	rt.handle(http.MethodGet, "/id", getId, withAuth)
+
+	rec := httptest.NewRecorder()
+	rt.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/panic", nil))
+
+	if rec.Code != http.StatusInternalServerError ||
+		responseErrorCode(rec.Body.Bytes()) != internalError.code ||
+		!strings.Contains(rec.Body.String(),
+			rec.Header().Get(requestIDHeader)) {
+		t.Error(rec.Code, rec.Body.String())
+	}
+
+	// Clients can pick the request id
+	req := httptest.NewRequest(http.MethodGet, "/panic", nil)
+	req.Header.Set(requestIDHeader, "client-42")
+
+	rec = httptest.NewRecorder()
+	rt.ServeHTTP(rec, req)
+
+	if rec.Header().Get(requestIDHeader) != "client-42" {
+		t.Error(rec.Header())
+	}
+
+	var bodies = []struct {
+		body   string
+		status int
+	}{
+		{"12345678", http.StatusOK},
+		{"123456789", http.StatusRequestEntityTooLarge},
+	}
+
+	for _, body := range bodies {
+		req := httptest.NewRequest(http.MethodPost, "/echo",
+			strings.NewReader(body.body))
+		// Unknown length, so the body itself has to be cut
+		req.ContentLength = -1
+
+		rec = httptest.NewRecorder()
+		rt.ServeHTTP(rec, req)
+
+		if rec.Code != body.status {
+			t.Error(body.body, rec.Code, rec.Body.String())
+		}
+	}
+
+	rec = httptest.NewRecorder()
+	rt.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/id", nil))
+
+	if responseErrorCode(rec.Body.Bytes()) != noTokenError.code {
+		t.Error(rec.Body.String())
+	}
+
+	// Only withAuth refreshes the login
+	loginTime := time.Now().Add(-time.Minute)
+
+	users.mu.Lock()
+	users.entries["router-test-token"] = userEntry{1, loginTime}
+	users.mu.Unlock()
+
+	defer logoutAccount(1, "")
+
+	rt.handle(http.MethodGet, "/id-no-refresh", getId, withAuthNoRefresh)
+
+	for _, path := range []string{"/id-no-refresh", "/id"} {
+		req = httptest.NewRequest(http.MethodGet, path, nil)
+		req.Header.Set("Authorization", "router-test-token")
+
+		rec = httptest.NewRecorder()
+		rt.ServeHTTP(rec, req)
+
+		users.mu.Lock()
+		refreshed := users.entries["router-test-token"].loginTime.After(
+			loginTime)
+		users.mu.Unlock()
+
+		if rec.Code != http.StatusOK || refreshed != (path == "/id") {
+			t.Error(path, rec.Code, refreshed)
+		}
+	}
+
+	// Preflight requests are answered without a route
+	req = httptest.NewRequest(http.MethodOptions, "/echo", nil)
+	req.Header.Set("Origin", "https://app.example")
+	req.Header.Set("Access-Control-Request-Method", http.MethodPost)
+
+	rec = httptest.NewRecorder()
+	rt.ServeHTTP(rec, req)
+
+	if rec.Code != http.StatusNoContent || rec.Header().Get(
+		"Access-Control-Allow-Origin") != "https://app.example" {
+		t.Error(rec.Code, rec.Header())
+	}
+
+	req.Header.Set("Origin", "https://evil.example")
+
+	rec = httptest.NewRecorder()
+	rt.ServeHTTP(rec, req)
+
+	if rec.Code != http.StatusMethodNotAllowed ||
+		rec.Header().Get("Access-Control-Allow-Origin") != "" {
+		t.Error(rec.Code, rec.Header())
+	}
+}
@@ -12,18 +12,7 @@ import (
 const welcomeSring = "Welcome to PedroBank!\n"
 
 // Respond with a welcome message when client GETs path /
-// Respond with an error for other paths matched by this function.
 func welcomeResponse(rw http.ResponseWriter, req *http.Request) {
-	if req.URL.Path != "/" {
-		respondWithError(rw, invalidURLError)
-		return
-	}
-
-	if req.Method != http.MethodGet {
-		respondWithError(rw, invalidMethodError)
-		return
-	}
-
 	setJSONEncoding(rw)
 	_, err := fmt.Fprint(rw, welcomeSring)
 
@@ -33,21 +22,124 @@ func welcomeResponse(rw http.ResponseWriter, req *http.Request) {
 }
 
 func ping(rw http.ResponseWriter, req *http.Request) {
-	if req.URL.Path != "/ping" {
-		respondWithError(rw, invalidURLError)
-		return
-	}
+	rw.WriteHeader(http.StatusOK)
+}
 
-	if req.Method != http.MethodGet {
-		respondWithError(rw, invalidMethodError)
-		return
-	}
+// Largest request body for any route. Batches are the largest.
+const maxBodyLen = 1 << 20
 
-	rw.WriteHeader(http.StatusOK)
+// Origins of the web apps allowed to call the API, see withCORS.
+var corsOrigins []string
+
+// Let web apps on origins call the API. Call before Run.
+func SetCORSOrigins(origins []string) {
+	corsOrigins = origins
+}
+
+// All of the routes of the API.
+func routes() *router {
+	rt := newRouter()
+	rt.use(withRequestID, withMetrics, withRecovery, withLogging,
+		withCORS(corsOrigins), withBodyLimit(maxBodyLen))
+
+	rt.handle(http.MethodGet, "/", welcomeResponse)
+	rt.handle(http.MethodGet, "/ping", ping)
+	rt.handle(http.MethodGet, "/openapi.json", getOpenAPISpec)
+	rt.handle(http.MethodGet, "/metrics", getMetrics)
+
+	rt.handle(http.MethodGet, "/accounts", getAccounts)
+	rt.handle(http.MethodPost, "/accounts", createAccount)
+	rt.handle(http.MethodGet, "/accounts/{id:[0-9]+}/balance",
+		getAccountBalance)
+	rt.handle(http.MethodGet, "/accounts/{id:[0-9]+}/statement",
+		getAccountStatement, withAuth)
+	rt.handle(http.MethodPost, "/accounts/{id:[0-9]+}/close", closeAccount,
+		withAuth)
+	rt.handle(http.MethodPatch, "/accounts/me", updateProfile, withAuth)
+	rt.handle(http.MethodPost, "/accounts/me/password", changePassword,
+		withAuth)
+
+	rt.handle(http.MethodPost, "/login", login)
+	rt.handle(http.MethodGet, "/id", getId, withAuthNoRefresh)
+	rt.handle(http.MethodPost, "/password-reset", requestPasswordReset)
+	rt.handle(http.MethodPost, "/password-reset/confirm",
+		confirmPasswordReset)
+
+	rt.handle(http.MethodGet, "/transfers", getTransfers, withAuth)
+	rt.handle(http.MethodPost, "/transfers", doTransfer, withAuth,
+		withIdempotency)
+	rt.handle(http.MethodPost, "/transfers/quote", quoteTransfer, withAuth)
+	rt.handle(http.MethodPost, "/transfers/batch", createTransferBatch,
+		withAuth, withIdempotency)
+	rt.handle(http.MethodGet, "/transfers/batch/{id:[0-9]+}",
+		getTransferBatch, withAuth)
+
+	rt.handle(http.MethodGet, "/events", streamEvents, withAuth)
+
+	rt.handle(http.MethodGet, "/webhooks", getWebhooks, withAuth)
+	rt.handle(http.MethodPost, "/webhooks", createWebhook, withAuth)
+	rt.handle(http.MethodDelete, "/webhooks/{id:[0-9]+}", deleteWebhook,
+		withAuth)
+	rt.handle(http.MethodGet, "/webhooks/{id:[0-9]+}/deliveries",
+		getWebhookDeliveries, withAuth)
+	rt.handle(http.MethodPost,
+		"/webhooks/{id:[0-9]+}/deliveries/{delivery:[0-9]+}/retry",
+		retryWebhookDelivery, withAuth)
+
+	rt.handle(http.MethodGet, "/limits", getAccountLimits, withAuth)
+	rt.handle(http.MethodPost, "/limits", updateAccountLimits, withAuth)
+
+	rt.handle(http.MethodGet, "/keys", getKeys, withAuth)
+	rt.handle(http.MethodPost, "/keys", createKey, withAuth)
+	rt.handle(http.MethodGet, "/keys/{key}", lookupKey, withAuth)
+	rt.handle(http.MethodDelete, "/keys/{key}", deleteKey, withAuth)
+
+	rt.handle(http.MethodGet, "/payment-requests", getPaymentRequests,
+		withAuth)
+	rt.handle(http.MethodPost, "/payment-requests", createPaymentRequest,
+		withAuth)
+	rt.handle(http.MethodGet, "/payment-requests/{id:[0-9]+}",
+		getPaymentRequestByID, withAuth)
+	rt.handle(http.MethodPost, "/payment-requests/{id:[0-9]+}/pay",
+		payPaymentRequest, withAuth, withIdempotency)
+	rt.handle(http.MethodPost, "/payment-requests/{id:[0-9]+}/cancel",
+		cancelPaymentRequest, withAuth)
+
+	rt.handle(http.MethodGet, "/escrows", getEscrows, withAuth)
+	rt.handle(http.MethodPost, "/escrows", createEscrow, withAuth,
+		withIdempotency)
+	rt.handle(http.MethodGet, "/escrows/{id:[0-9]+}", getEscrowByID,
+		withAuth)
+	rt.handle(http.MethodPost, "/escrows/{id:[0-9]+}/confirm", confirmEscrow,
+		withAuth)
+	rt.handle(http.MethodPost, "/escrows/{id:[0-9]+}/cancel", cancelEscrow,
+		withAuth)
+
+	rt.handle(http.MethodGet, "/admin/pending-transfers",
+		getPendingTransfers, withAdmin)
+	rt.handle(http.MethodPost, "/admin/pending-transfers/{id:[0-9]+}/approve",
+		approvePendingTransfer, withAdmin)
+	rt.handle(http.MethodPost, "/admin/pending-transfers/{id:[0-9]+}/reject",
+		rejectPendingTransfer, withAdmin)
+	rt.handle(http.MethodPost, "/admin/interest", runInterestForDate,
+		withAdmin)
+	rt.handle(http.MethodPost, "/admin/accounts/{id:[0-9]+}/overdraft",
+		updateOverdraftLimit, withAdmin)
+	rt.handle(http.MethodPost, "/admin/accounts/{id:[0-9]+}/freeze",
+		freezeAccount, withAdmin)
+	rt.handle(http.MethodPost, "/admin/accounts/{id:[0-9]+}/unfreeze",
+		unfreezeAccount, withAdmin)
+	rt.handle(http.MethodGet, "/admin/event-consumers", getEventConsumers,
+		withAdmin)
+
+	return rt
 }
 
 var server http.Server = http.Server{Addr: "localhost:8080"}
 
+// The gRPC API, served by server too, see withGRPC.
+var grpcServer = newGRPCServer()
+
 // Channel that signals when the server finishes
 var ServerFinished = make(chan interface{})
 
@@ -59,19 +151,38 @@ var loginCleanerFinished = make(chan interface{})
 func Run(certsDir string) {
 	var err error
 
-	http.HandleFunc("/ping", ping)
-	http.HandleFunc("/", welcomeResponse)
-	http.HandleFunc("/accounts", handleAccounts)
-	http.HandleFunc("/accounts/", getAccountBalance)
-	http.HandleFunc("/login", login)
-	http.HandleFunc("/id", getId)
-	http.HandleFunc("/transfers", handleTransfers)
+	server.Handler = withGRPC(grpcServer, routes())
 
 	loginCleanerContext, loginCleanerCancelFunc := context.WithCancel(
 		context.Background())
 
 	go loginClean(loginCleanerContext)
 
+	interestJobContext, interestJobCancelFunc := context.WithCancel(
+		context.Background())
+
+	go interestJob(interestJobContext)
+
+	escrowJobContext, escrowJobCancelFunc := context.WithCancel(
+		context.Background())
+
+	go escrowJob(escrowJobContext)
+
+	eventListenerContext, eventListenerCancelFunc := context.WithCancel(
+		context.Background())
+
+	go eventListener(eventListenerContext)
+
+	webhookJobContext, webhookJobCancelFunc := context.WithCancel(
+		context.Background())
+
+	go webhookJob(webhookJobContext)
+
+	eventRelayContext, eventRelayCancelFunc := context.WithCancel(
+		context.Background())
+
+	go eventRelayJob(eventRelayContext)
+
 	logger.Println("Starting PedroBank server")
 
 	err = server.ListenAndServeTLS(
@@ -82,12 +193,30 @@ func Run(certsDir string) {
 
 	loginCleanerCancelFunc()
 
-	// Wait for the login cleaner to finish
+	interestJobCancelFunc()
+
+	escrowJobCancelFunc()
+
+	eventListenerCancelFunc()
+
+	webhookJobCancelFunc()
+
+	eventRelayCancelFunc()
+
+	// Wait for the login cleaner and the jobs to finish
 	<-loginCleanerFinished
+	<-interestJobFinished
+	<-escrowJobFinished
+	<-eventListenerFinished
+	<-webhookJobFinished
+	<-eventRelayFinished
 
 	close(ServerFinished)
 }
 
+// Stop the server, waiting for the requests being handled. The gRPC calls are
+// among them, since they're served by server. The event streams end when Run
+// stops the event listener.
 func Stop() {
 	server.Shutdown(context.Background())
 }
@@ -0,0 +1,225 @@
+package server
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"sort"
+)
+
+// One destination of a split payment, sent in the splits of POST /transfers.
+// The leg gets either a fixed amount or a percentage of what the fixed legs
+// leave, in hundredths of a percent.
+type splitLeg struct {
+	DestinationID int `json:"account_destination_id"`
+	// A key registered by the destination account, instead of its id
+	DestinationKey string `json:"destination_key,omitempty"`
+	Amount         money  `json:"amount,omitempty"`
+	PercentBps     int    `json:"percent_bps,omitempty"`
+}
+
+// A split is a single payment, so it's kept small, unlike batches.
+const maxSplitLegs = 10
+
+// Check each leg on its own. Whether they add up is checked by splitAmounts.
+func validateSplitLegs(legs []splitLeg) error {
+	if len(legs) > maxSplitLegs {
+		return tooManySplitLegsError
+	}
+
+	for i, leg := range legs {
+		if leg.DestinationKey != "" {
+			if leg.DestinationID != 0 {
+				return newSplitLegError(i, twoDestinationsError)
+			}
+
+			if len(leg.DestinationKey) > maxKeyLen {
+				return newSplitLegError(i, keyInvalidError)
+			}
+		} else if leg.DestinationID <= 0 {
+			return newSplitLegError(i, badDestinationIdError)
+		}
+
+		if (leg.Amount == 0) == (leg.PercentBps == 0) {
+			return newSplitLegError(i, splitLegAmountError)
+		}
+
+		if leg.Amount < 0 || leg.PercentBps < 0 || leg.PercentBps > 10000 {
+			return newSplitLegError(i, invalidAmountError)
+		}
+	}
+
+	return nil
+}
+
+// The amount of each leg of a split of total. The fixed amounts come first,
+// and the percentages split what's left, so they must add up to 100%, or be
+// absent if the fixed amounts already add up to total.
+//
+// Percentages are rounded down to the cent, and the cents left over go one
+// each to the legs that lost the largest fractions, the first leg winning
+// ties. So the legs always add up to exactly total.
+func splitAmounts(total money, legs []splitLeg) ([]money, error) {
+	amounts := make([]money, len(legs))
+
+	var fixed int64
+	var totalBps int
+	var percentLegs []int
+
+	for i, leg := range legs {
+		if leg.PercentBps > 0 {
+			totalBps += leg.PercentBps
+			percentLegs = append(percentLegs, i)
+		} else {
+			fixed += int64(leg.Amount)
+			amounts[i] = leg.Amount
+		}
+	}
+
+	rest := int64(total) - fixed
+
+	if rest < 0 || (len(percentLegs) == 0 && rest != 0) ||
+		(len(percentLegs) > 0 && totalBps != 10000) {
+		return nil, splitSumError
+	}
+
+	remainders := make(map[int]int64, len(percentLegs))
+	leftover := rest
+
+	for _, i := range percentLegs {
+		share := rest * int64(legs[i].PercentBps)
+		amounts[i] = money(share / 10000)
+		remainders[i] = share % 10000
+		leftover -= share / 10000
+	}
+
+	// The percentages add up to 100%, so less than a cent is lost per leg.
+	sort.SliceStable(percentLegs, func(a, b int) bool {
+		return remainders[percentLegs[a]] > remainders[percentLegs[b]]
+	})
+
+	for _, i := range percentLegs[:leftover] {
+		amounts[i]++
+	}
+
+	for i, amount := range amounts {
+		if amount == 0 {
+			return nil, newSplitLegError(i, zeroAmountError)
+		}
+	}
+
+	return amounts, nil
+}
+
+// Make the split payment in transferReq from the account with id, as an
+// atomic batch, so either all legs are made or none are. Unlike atomic
+// batches, a failed split isn't recorded, the client gets the error as for a
+// single transfer.
+func insertSplitTransfer(ctx context.Context, id int,
+	transferReq *transferRequest) (*transferBatch, error) {
+
+	amounts, err := splitAmounts(transferReq.Amount, transferReq.Splits)
+
+	if err != nil {
+		return nil, err
+	}
+
+	batch := transferBatch{
+		OriginID:    id,
+		Atomic:      true,
+		Total:       transferReq.Amount,
+		Split:       true,
+		Items:       make([]batchItem, len(amounts)),
+		description: transferReq.Description,
+		reference:   transferReq.Reference,
+		metadata:    transferReq.Metadata,
+	}
+
+	for i, leg := range transferReq.Splits {
+		destID := leg.DestinationID
+
+		if leg.DestinationKey != "" {
+			destID, err = getAccountByKey(DB, leg.DestinationKey)
+
+			var publicError *publicJSONError
+			if errors.As(err, &publicError) {
+				return nil, newSplitLegError(i, publicError)
+			} else if err != nil {
+				return nil, err
+			}
+		}
+
+		batch.Items[i] = batchItem{
+			Index:         i,
+			DestinationID: destID,
+			Amount:        amounts[i],
+		}
+	}
+
+	tx, err := DB.BeginTx(ctx, &defaultTxOptions)
+
+	if err != nil {
+		logger.Print("Error starting tx to insert split transfer")
+		return nil, err
+	}
+
+	failedIndex, err := atomicBatchInTx(tx, &batch)
+
+	if err != nil {
+		rollbackTx(tx)
+
+		var deniedErr *riskDeniedError
+		if errors.As(err, &deniedErr) {
+			item := &batch.Items[failedIndex]
+			recordRiskDecision(DB,
+				&TransferAttempt{
+					OriginID:      id,
+					DestinationID: item.DestinationID,
+					Amount:        item.Amount},
+				RiskDeny, deniedErr.rule, nil, nil)
+		}
+
+		if failedIndex >= 0 {
+			countTransfer(transferResult(nil, err),
+				batch.Items[failedIndex].Amount)
+		}
+
+		var publicError *publicJSONError
+		if failedIndex >= 0 && errors.As(err, &publicError) {
+			err = newSplitLegError(failedIndex, publicError)
+		}
+
+		return nil, err
+	}
+
+	err = tx.Commit()
+
+	if err != nil {
+		logger.Print("Error commiting tx")
+		return nil, err
+	}
+
+	for _, item := range batch.Items {
+		countTransfer("completed", item.Amount)
+	}
+
+	return &batch, nil
+}
+
+// Handler for the split payments of POST /transfers. Responds with the batch
+// the legs were made in, which GET /transfers/batch/<id> also shows.
+func doSplitTransfer(rw http.ResponseWriter, req *http.Request, id int,
+	transferReq *transferRequest) {
+
+	batch, err := insertSplitTransfer(req.Context(), id, transferReq)
+
+	if err != nil {
+		respondWithError(rw, err)
+		return
+	}
+
+	logger.Printf("Split transfer %d from account %d in %d legs", batch.ID,
+		id, len(batch.Items))
+
+	respondWithJSON(rw, http.StatusCreated, batch)
+}
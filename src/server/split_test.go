@@ -0,0 +1,127 @@
+package server
+
+import (
+	"testing"
+)
+
+func TestSplitAmounts(t *testing.T) {
+	var splits = []struct {
+		total   money
+		legs    []splitLeg
+		amounts []money
+	}{
+		// Commission and payout
+		{10000, []splitLeg{{PercentBps: 1000}, {PercentBps: 9000}},
+			[]money{1000, 9000}},
+		// 3 ways: 33.33... each, the first leg gets the extra cent
+		{10000, []splitLeg{{PercentBps: 3333}, {PercentBps: 3333},
+			{PercentBps: 3334}}, []money{3333, 3333, 3334}},
+		{100, []splitLeg{{PercentBps: 3333}, {PercentBps: 3333},
+			{PercentBps: 3334}}, []money{33, 33, 34}},
+		{1001, []splitLeg{{PercentBps: 5000}, {PercentBps: 5000}},
+			[]money{501, 500}},
+		// The first leg loses the larger fraction
+		{999, []splitLeg{{PercentBps: 1250}, {PercentBps: 8750}},
+			[]money{125, 874}},
+		// Fixed first, percentages of the rest
+		{10000, []splitLeg{{Amount: 500}, {PercentBps: 10000}},
+			[]money{500, 9500}},
+		{10000, []splitLeg{{Amount: 2500}, {Amount: 7500}},
+			[]money{2500, 7500}},
+	}
+
+	for _, split := range splits {
+		amounts, err := splitAmounts(split.total, split.legs)
+
+		if err != nil || len(amounts) != len(split.amounts) {
+			t.Error(split, amounts, err)
+			continue
+		}
+
+		var sum money
+
+		for i, amount := range amounts {
+			sum += amount
+
+			if amount != split.amounts[i] {
+				t.Error(split, amounts)
+			}
+		}
+
+		if sum != split.total {
+			t.Error(split, sum)
+		}
+	}
+
+	var badSplits = []struct {
+		total money
+		legs  []splitLeg
+		err   string
+	}{
+		{10000, []splitLeg{{Amount: 2500}, {Amount: 7000}},
+			splitSumError.errMsg},
+		{10000, []splitLeg{{Amount: 12500}, {PercentBps: 10000}},
+			splitSumError.errMsg},
+		{10000, []splitLeg{{PercentBps: 5000}, {PercentBps: 4000}},
+			splitSumError.errMsg},
+		{1, []splitLeg{{PercentBps: 5000}, {PercentBps: 5000}},
+			splitLegErrorMsg},
+		{500, []splitLeg{{Amount: 500}, {PercentBps: 10000}},
+			splitLegErrorMsg},
+	}
+
+	for _, badSplit := range badSplits {
+		_, err := splitAmounts(badSplit.total, badSplit.legs)
+
+		if err == nil || err.Error() != badSplit.err {
+			t.Error(badSplit, err)
+		}
+	}
+}
+
+func TestSplitValidation(t *testing.T) {
+	var transferReq = transferRequest{
+		Amount: 10000,
+		Splits: []splitLeg{
+			{DestinationID: 2, PercentBps: 1000},
+			{DestinationKey: "a@b.com", PercentBps: 9000},
+		},
+	}
+
+	if transferReq.validate() != nil {
+		t.Fail()
+	}
+
+	var badLegs = []splitLeg{
+		{PercentBps: 1000},
+		{DestinationID: 2},
+		{DestinationID: 2, Amount: 100, PercentBps: 1000},
+		{DestinationID: 2, DestinationKey: "a@b.com", Amount: 100},
+		{DestinationID: 2, PercentBps: 10001},
+		{DestinationID: 2, Amount: -100},
+	}
+
+	for _, badLeg := range badLegs {
+		badReq := transferReq
+		badReq.Splits = []splitLeg{badLeg}
+
+		if err := badReq.validate(); err == nil ||
+			err.Error() != splitLegErrorMsg {
+			t.Error(badLeg, err)
+		}
+	}
+
+	badReq := transferReq
+	badReq.DestinationID = 2
+
+	if badReq.validate() != twoDestinationsError {
+		t.Fail()
+	}
+
+	badReq = transferReq
+	badReq.Splits = make([]splitLeg, maxSplitLegs+1)
+
+	if badReq.validate() != tooManySplitLegsError {
+		t.Fail()
+	}
+}
@@ -0,0 +1,388 @@
+package server
+
+import (
+	"database/sql"
+	"encoding/csv"
+	"encoding/xml"
+	"fmt"
+	"net/http"
+	"strconv"
+	"time"
+)
+
+// One movement of a statement.
+type statementEntry struct {
+	TransferID int       `json:"transfer_id"`
+	Date       time.Time `json:"date"`
+	// credit or debit. The amount is always positive.
+	Type           string `json:"type"`
+	Amount         money  `json:"amount"`
+	CounterpartyID int    `json:"counterparty_id"`
+	Description    string `json:"description,omitempty"`
+	Reference      string `json:"reference,omitempty"`
+	// Balance after this movement
+	Balance money `json:"balance"`
+}
+
+// Account statement for a period, from and to inclusive.
+type statement struct {
+	AccountID      int              `json:"account_id"`
+	From           time.Time        `json:"from"`
+	To             time.Time        `json:"to"`
+	OpeningBalance money            `json:"opening_balance"`
+	ClosingBalance money            `json:"closing_balance"`
+	Entries        []statementEntry `json:"entries"`
+}
+
+// Default period, when from is not given.
+const defaultStatementPeriod = 30 * 24 * time.Hour
+
+// Longest period for a statement, so that one request can't go through the
+// whole transfers table.
+const maxStatementPeriod = 366 * 24 * time.Hour
+
+// The balance of the account with id right after t, computed backwards from
+// the current balance, as the starting balance of an account is not a
+// transfer. Use inside a repeatable read tx so that transfers committed in
+// between can't make the two queries disagree.
+func balanceAt(q queryRower, id int, t time.Time) (money, error) {
+	var balance money
+
+	err := q.QueryRow("select balance from accounts where id = $1",
+		id).Scan(&balance)
+
+	if err == sql.ErrNoRows {
+		return 0, noAccountError
+	} else if err != nil {
+		return 0, err
+	}
+
+	// Net of what came in and went out after t
+	var netAfter int64
+
+	err = q.QueryRow(
+		`select coalesce(sum(case when destination_id = $1
+		then amount else -amount end), 0)
+		from transfers where (origin_id = $1 or destination_id = $1)
+		and created_at > $2`, id, t.UTC()).Scan(&netAfter)
+
+	if err != nil {
+		return 0, err
+	}
+
+	return money(int64(balance) - netAfter), nil
+}
+
+// Build the statement for the account with id. The balances are computed
+// backwards from the current balance, so the statement always ties out to
+// accounts.balance.
+//
+// All queries run in the same read-only repeatable read transaction, so they
+// see the same snapshot even if transfers commit in between.
+func buildStatement(req *http.Request, id int, from time.Time,
+	to time.Time) (*statement, error) {
+
+	txOptions := defaultTxOptions
+	txOptions.ReadOnly = true
+
+	tx, err := DB.BeginTx(req.Context(), &txOptions)
+
+	if err != nil {
+		logger.Print("Error starting tx for statement")
+		return nil, err
+	}
+
+	// Read only, nothing to commit.
+	defer rollbackTx(tx)
+
+	stmt := statement{AccountID: id, From: from, To: to}
+
+	stmt.ClosingBalance, err = balanceAt(tx, id, to)
+
+	if err != nil {
+		return nil, err
+	}
+
+	rows, err := tx.Query(
+		`select id, origin_id, destination_id, amount, created_at,
+		description, reference
+		from transfers where (origin_id = $1 or destination_id = $1)
+		and created_at >= $2 and created_at <= $3
+		order by created_at, id`, id, from, to)
+
+	if err != nil {
+		return nil, err
+	}
+
+	defer rows.Close()
+
+	stmt.Entries = make([]statementEntry, 0, 64)
+	var netPeriod int64
+
+	for rows.Next() {
+		var entry statementEntry
+		var origID, destID int
+
+		err = rows.Scan(&entry.TransferID, &origID, &destID, &entry.Amount,
+			&entry.Date, &entry.Description, &entry.Reference)
+
+		if err != nil {
+			logger.Printf("error when querying statement")
+			return nil, err
+		}
+
+		if origID == id {
+			entry.Type = "debit"
+			entry.CounterpartyID = destID
+			netPeriod -= int64(entry.Amount)
+		} else {
+			entry.Type = "credit"
+			entry.CounterpartyID = origID
+			netPeriod += int64(entry.Amount)
+		}
+
+		stmt.Entries = append(stmt.Entries, entry)
+	}
+
+	if err = rows.Err(); err != nil {
+		logger.Printf("error when querying statement")
+		return nil, err
+	}
+
+	stmt.OpeningBalance = money(int64(stmt.ClosingBalance) - netPeriod)
+
+	running := int64(stmt.OpeningBalance)
+
+	for i := range stmt.Entries {
+		if stmt.Entries[i].Type == "debit" {
+			running -= int64(stmt.Entries[i].Amount)
+		} else {
+			running += int64(stmt.Entries[i].Amount)
+		}
+
+		stmt.Entries[i].Balance = money(running)
+	}
+
+	return &stmt, nil
+}
+
+// Write the statement as CSV. The opening and closing balances are the first
+// and last rows, with no transfer.
+func writeStatementCSV(rw http.ResponseWriter, stmt *statement) error {
+	rw.Header().Set("Content-Type", "text/csv;charset=UTF-8")
+	rw.Header().Set("Content-Disposition",
+		fmt.Sprintf(`attachment; filename="statement-%d.csv"`, stmt.AccountID))
+	rw.WriteHeader(http.StatusOK)
+
+	writer := csv.NewWriter(rw)
+
+	writer.Write([]string{"date", "transfer_id", "type", "amount",
+		"counterparty_id", "description", "reference", "balance"})
+
+	writer.Write([]string{stmt.From.Format(time.RFC3339), "", "opening", "",
+		"", "", "", stmt.OpeningBalance.String()})
+
+	for _, entry := range stmt.Entries {
+		writer.Write([]string{
+			entry.Date.Format(time.RFC3339Nano),
+			strconv.Itoa(entry.TransferID),
+			entry.Type,
+			entry.Amount.String(),
+			strconv.Itoa(entry.CounterpartyID),
+			entry.Description,
+			entry.Reference,
+			entry.Balance.String(),
+		})
+	}
+
+	writer.Write([]string{stmt.To.Format(time.RFC3339), "", "closing", "", "",
+		"", "", stmt.ClosingBalance.String()})
+
+	writer.Flush()
+
+	return writer.Error()
+}
+
+// OFX 2 elements, only the ones we fill in. See the OFX spec, section 11.4.
+type ofxStatus struct {
+	Code     int    `xml:"CODE"`
+	Severity string `xml:"SEVERITY"`
+}
+
+type ofxTransaction struct {
+	Type   string `xml:"TRNTYPE"`
+	Posted string `xml:"DTPOSTED"`
+	Amount string `xml:"TRNAMT"`
+	FITID  string `xml:"FITID"`
+	Name   string `xml:"NAME"`
+	Memo   string `xml:"MEMO,omitempty"`
+	RefNum string `xml:"REFNUM,omitempty"`
+}
+
+type ofxDocument struct {
+	XMLName xml.Name `xml:"OFX"`
+	SignOn  struct {
+		Status   ofxStatus `xml:"SONRS>STATUS"`
+		Server   string    `xml:"SONRS>DTSERVER"`
+		Language string    `xml:"SONRS>LANGUAGE"`
+	} `xml:"SIGNONMSGSRSV1"`
+	Statement struct {
+		TrnUID   string    `xml:"TRNUID"`
+		Status   ofxStatus `xml:"STATUS"`
+		Currency string    `xml:"STMTRS>CURDEF"`
+		BankID   string    `xml:"STMTRS>BANKACCTFROM>BANKID"`
+		AcctID   string    `xml:"STMTRS>BANKACCTFROM>ACCTID"`
+		AcctType string    `xml:"STMTRS>BANKACCTFROM>ACCTTYPE"`
+		Start    string    `xml:"STMTRS>BANKTRANLIST>DTSTART"`
+		End      string    `xml:"STMTRS>BANKTRANLIST>DTEND"`
+		// encoding/xml merges consecutive fields with the same parents
+		Transactions []ofxTransaction `xml:"STMTRS>BANKTRANLIST>STMTTRN"`
+		LedgerBal    string           `xml:"STMTRS>LEDGERBAL>BALAMT"`
+		LedgerAsOf   string           `xml:"STMTRS>LEDGERBAL>DTASOF"`
+	} `xml:"BANKMSGSRSV1>STMTTRNRS"`
+}
+
+// OFX dates are YYYYMMDDHHMMSS, with the time zone in brackets.
+func ofxTime(t time.Time) string {
+	return t.UTC().Format("20060102150405") + "[0:UTC]"
+}
+
+// Bank id in the OFX files, there is no real routing number.
+const ofxBankID = "0000"
+
+// Write the statement as an OFX 2.2 file, which most personal finance
+// software can import.
+func writeStatementOFX(rw http.ResponseWriter, stmt *statement) error {
+	var doc ofxDocument
+
+	now := ofxTime(time.Now())
+
+	doc.SignOn.Status = ofxStatus{0, "INFO"}
+	doc.SignOn.Server = now
+	doc.SignOn.Language = "POR"
+
+	doc.Statement.TrnUID = "0"
+	doc.Statement.Status = ofxStatus{0, "INFO"}
+	doc.Statement.Currency = "BRL"
+	doc.Statement.BankID = ofxBankID
+	doc.Statement.AcctID = strconv.Itoa(stmt.AccountID)
+	doc.Statement.AcctType = "CHECKING"
+	doc.Statement.Start = ofxTime(stmt.From)
+	doc.Statement.End = ofxTime(stmt.To)
+	doc.Statement.LedgerBal = stmt.ClosingBalance.String()
+	doc.Statement.LedgerAsOf = ofxTime(stmt.To)
+
+	for _, entry := range stmt.Entries {
+		transaction := ofxTransaction{
+			Type:   "CREDIT",
+			Posted: ofxTime(entry.Date),
+			Amount: entry.Amount.String(),
+			FITID:  strconv.Itoa(entry.TransferID),
+			Name:   fmt.Sprintf("Conta %d", entry.CounterpartyID),
+			Memo:   entry.Description,
+			RefNum: entry.Reference,
+		}
+
+		if entry.Type == "debit" {
+			transaction.Type = "DEBIT"
+			transaction.Amount = "-" + transaction.Amount
+		}
+
+		doc.Statement.Transactions = append(doc.Statement.Transactions,
+			transaction)
+	}
+
+	rw.Header().Set("Content-Type", "application/x-ofx")
+	rw.Header().Set("Content-Disposition",
+		fmt.Sprintf(`attachment; filename="statement-%d.ofx"`, stmt.AccountID))
+	rw.WriteHeader(http.StatusOK)
+
+	_, err := fmt.Fprint(rw, xml.Header+
+		`<?OFX OFXHEADER="200" VERSION="220" SECURITY="NONE"`+
+		` OLDFILEUID="NONE" NEWFILEUID="NONE"?>`+"\n")
+
+	if err != nil {
+		return err
+	}
+
+	encoder := xml.NewEncoder(rw)
+	encoder.Indent("", "  ")
+
+	err = encoder.Encode(&doc)
+
+	if err == nil {
+		_, err = rw.Write([]byte("\n"))
+	}
+
+	return err
+}
+
+// Handles GET requests at /accounts/<id>/statement. Only the account owner
+// can get its statement. The period is given with from and to, see
+// parseTimeParam, and the format with format=json|csv|ofx.
+func getAccountStatement(rw http.ResponseWriter, req *http.Request) {
+	id, err := pathID(req, "id")
+
+	if err != nil {
+		respondWithError(rw, err)
+		return
+	}
+
+	if accountID(req) != id {
+		respondWithError(rw, forbiddenError)
+		return
+	}
+
+	format := req.URL.Query().Get("format")
+
+	if format != "" && format != "json" && format != "csv" &&
+		format != "ofx" {
+		respondWithError(rw, newBadParamError("format"))
+		return
+	}
+
+	to := time.Now().UTC()
+	toParam, err := parseTimeParam(req, "to", true)
+
+	if err != nil {
+		respondWithError(rw, err)
+		return
+	} else if toParam != nil {
+		to = *toParam
+	}
+
+	from := to.Add(-defaultStatementPeriod)
+	fromParam, err := parseTimeParam(req, "from", false)
+
+	if err != nil {
+		respondWithError(rw, err)
+		return
+	} else if fromParam != nil {
+		from = *fromParam
+	}
+
+	if from.After(to) || to.Sub(from) > maxStatementPeriod {
+		respondWithError(rw, badStatementPeriodError)
+		return
+	}
+
+	stmt, err := buildStatement(req, id, from, to)
+
+	if err != nil {
+		respondWithError(rw, err)
+		return
+	}
+
+	switch format {
+	case "csv":
+		err = writeStatementCSV(rw, stmt)
+	case "ofx":
+		err = writeStatementOFX(rw, stmt)
+	default:
+		respondWithJSON(rw, http.StatusOK, stmt)
+	}
+
+	if err != nil {
+		logger.Printf("Could not write response: %v", err)
+	}
+}
@@ -0,0 +1,88 @@
+package server
+
+import (
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+func testStatement() *statement {
+	from := time.Date(2021, time.September, 1, 0, 0, 0, 0, time.UTC)
+	to := time.Date(2021, time.September, 30, 23, 59, 59, 0, time.UTC)
+
+	return &statement{
+		AccountID:      7,
+		From:           from,
+		To:             to,
+		OpeningBalance: 100000,
+		ClosingBalance: 97528,
+		Entries: []statementEntry{
+			{TransferID: 1, Date: from.Add(time.Hour), Type: "debit",
+				Amount: 3472, CounterpartyID: 8, Description: "rent, & more",
+				Balance: 96528},
+			{TransferID: 2, Date: from.Add(2 * time.Hour), Type: "credit",
+				Amount: 1000, CounterpartyID: 9, Reference: "INV-1",
+				Balance: 97528},
+		},
+	}
+}
+
+func TestStatementCSV(t *testing.T) {
+	rec := httptest.NewRecorder()
+
+	err := writeStatementCSV(rec, testStatement())
+
+	if err != nil {
+		t.Log(err)
+		t.FailNow()
+	}
+
+	expected := "date,transfer_id,type,amount,counterparty_id,description," +
+		"reference,balance\n" +
+		"2021-09-01T00:00:00Z,,opening,,,,,1000.00\n" +
+		"2021-09-01T01:00:00Z,1,debit,34.72,8,\"rent, & more\",,965.28\n" +
+		"2021-09-01T02:00:00Z,2,credit,10.00,9,,INV-1,975.28\n" +
+		"2021-09-30T23:59:59Z,,closing,,,,,975.28\n"
+
+	if rec.Body.String() != expected {
+		t.Error(rec.Body.String())
+	}
+}
+
+func TestStatementOFX(t *testing.T) {
+	rec := httptest.NewRecorder()
+
+	err := writeStatementOFX(rec, testStatement())
+
+	if err != nil {
+		t.Log(err)
+		t.FailNow()
+	}
+
+	body := rec.Body.String()
+
+	var expected = []string{
+		`<?OFX OFXHEADER="200" VERSION="220"`,
+		"<ACCTID>7</ACCTID>",
+		"<DTSTART>20210901000000[0:UTC]</DTSTART>",
+		"<TRNTYPE>DEBIT</TRNTYPE>",
+		"<TRNAMT>-34.72</TRNAMT>",
+		"<MEMO>rent, &amp; more</MEMO>",
+		"<TRNAMT>10.00</TRNAMT>",
+		"<REFNUM>INV-1</REFNUM>",
+		"<BALAMT>975.28</BALAMT>",
+	}
+
+	for _, exp := range expected {
+		if !strings.Contains(body, exp) {
+			t.Error(exp)
+		}
+	}
+
+	// Both transactions must be inside the same list
+	if strings.Count(body, "<BANKTRANLIST>") != 1 ||
+		strings.Count(body, "<STMTRS>") != 1 {
+		t.Error(body)
+	}
+}
@@ -0,0 +1,392 @@
+package server
+
+import (
+	"database/sql"
+	"encoding/json"
+	"math"
+	"net/http"
+	"time"
+	"unicode/utf8"
+)
+
+// JSON that the owner can send to close an account with money left in it.
+type accountCloseRequest struct {
+	PayoutDestinationID int `json:"payout_destination_id"`
+	// A key registered by the payout account, instead of its id
+	PayoutKey string `json:"payout_key,omitempty"`
+}
+
+// JSON response to POST /accounts/<id>/close.
+type accountClosure struct {
+	Account account `json:"account"`
+	// The transfer of what was left in the account, if anything
+	PayoutTransferID *int `json:"payout_transfer_id,omitempty"`
+}
+
+// JSON that an admin sends to freeze or unfreeze an account.
+type accountStatusRequest struct {
+	Reason string `json:"reason"`
+}
+
+// A change of an account's status, from account_status_changes.
+type accountStatusChange struct {
+	AccountID int       `json:"account_id"`
+	Status    string    `json:"status"`
+	Reason    string    `json:"reason"`
+	ChangedBy int       `json:"changed_by"`
+	CreatedAt time.Time `json:"created_at"`
+}
+
+const maxReasonLen = 140
+
+func validateReason(reason string) error {
+	if reason == "" || utf8.RuneCountInString(reason) > maxReasonLen {
+		return reasonInvalidError
+	}
+
+	return nil
+}
+
+// Record that the account with id changed to status, inside tx, with its
+// domain event and webhook event.
+func recordStatusChange(tx *sql.Tx, change *accountStatusChange) error {
+	_, err := tx.Exec(
+		`insert into account_status_changes (account_id, status, reason,
+		changed_by, created_at)
+		values ($1, $2, $3, $4, $5)`,
+		change.AccountID, change.Status, change.Reason, change.ChangedBy,
+		change.CreatedAt)
+
+	if err != nil {
+		return err
+	}
+
+	err = recordDomainEvent(tx, statusDomainEvents[change.Status],
+		change.AccountID, change)
+
+	if err != nil {
+		return err
+	}
+
+	return queueWebhookEvent(tx, change.AccountID,
+		statusWebhookEvents[change.Status], change)
+}
+
+// Move the whole balance of the account with id, already locked by tx, to
+// destID, as the last transfer of a closing account. It pays no fee, and the
+// limits and risk rules don't apply, since nothing can be sent after it.
+// Returns the transfer id.
+func payOutBalance(tx *sql.Tx, id int, destID int, balance money) (int,
+	error) {
+
+	if destID == id {
+		return 0, sameAccountError
+	}
+
+	var destBalance money
+	var destStatus string
+
+	err := tx.QueryRow(
+		`select balance, status from accounts where id = $1 for update`,
+		destID).Scan(&destBalance, &destStatus)
+
+	if err == sql.ErrNoRows {
+		return 0, noDestAccountError
+	} else if err != nil {
+		return 0, err
+	}
+
+	if destStatus == "closed" {
+		return 0, destinationClosedError
+	}
+
+	if int64(destBalance)+int64(balance) > math.MaxInt32 {
+		return 0, amountTooLargeError
+	}
+
+	_, err = tx.Exec(`update accounts set balance = 0 where id = $1`, id)
+
+	if err != nil {
+		return 0, err
+	}
+
+	_, err = tx.Exec(
+		`update accounts set balance = balance + $1 where id = $2`,
+		balance, destID)
+
+	if err != nil {
+		return 0, err
+	}
+
+	var transferID int
+
+	err = tx.QueryRow(
+		`insert into transfers (origin_id, destination_id, amount, created_at,
+		description)
+		values ($1, $2, $3, current_timestamp at time zone 'UTC',
+		'account closure payout')
+		returning id`, id, destID, balance).Scan(&transferID)
+
+	if err != nil {
+		return 0, err
+	}
+
+	return transferID, recordTransferEvents(tx, transferID)
+}
+
+// Handler for POST at /accounts/<id>/close. Only the owner can close an
+// account, and only an active one. The balance must be zero, or it's paid
+// out to the destination in the request. The account can't owe its
+// overdraft, nor have transfers waiting for review or held escrows. Logs
+// the account out everywhere.
+func closeAccount(rw http.ResponseWriter, req *http.Request) {
+	id, err := pathID(req, "id")
+
+	if err != nil {
+		respondWithError(rw, err)
+		return
+	}
+
+	if accountID(req) != id {
+		respondWithError(rw, forbiddenError)
+		return
+	}
+
+	var closeReq accountCloseRequest
+
+	// The body is optional, accounts with no money left need no payout.
+	data, err := readFromReq(req, 256)
+
+	if err == nil {
+		err = json.Unmarshal(data, &closeReq)
+
+		if err != nil {
+			respondWithError(rw, cantParseJSONError)
+			return
+		}
+	} else if err != emptyRequestError {
+		respondWithError(rw, err)
+		return
+	}
+
+	if closeReq.PayoutDestinationID != 0 && closeReq.PayoutKey != "" {
+		respondWithError(rw, twoDestinationsError)
+		return
+	}
+
+	if closeReq.PayoutKey != "" {
+		closeReq.PayoutDestinationID, err = getAccountByKey(DB,
+			closeReq.PayoutKey)
+
+		if err != nil {
+			respondWithError(rw, err)
+			return
+		}
+	}
+
+	tx, err := DB.BeginTx(req.Context(), &defaultTxOptions)
+
+	if err != nil {
+		logger.Print("Error starting tx to close account")
+		respondWithError(rw, err)
+		return
+	}
+
+	var closure accountClosure
+	acc := &closure.Account
+
+	err = tx.QueryRow(
+		`select id, name, cpf, balance, created_at, timezone, status
+		from accounts where id = $1 for update`, id).Scan(&acc.ID, &acc.Name,
+		&acc.CPF, &acc.Balance, &acc.CreatedAt, &acc.Timezone, &acc.Status)
+
+	if err == sql.ErrNoRows {
+		err = noAccountError
+	} else if err == nil && acc.Status == "closed" {
+		err = accountClosedError
+	} else if err == nil && acc.Status == "frozen" {
+		err = accountFrozenError
+	} else if err == nil && acc.Balance < 0 {
+		err = closeOverdraftError
+	} else if err == nil && acc.Balance > 0 &&
+		closeReq.PayoutDestinationID == 0 {
+		err = closeBalanceError
+	}
+
+	if err != nil {
+		rollbackTx(tx)
+		respondWithError(rw, err)
+		return
+	}
+
+	var busy bool
+
+	err = tx.QueryRow(
+		`select exists (select 1 from pending_transfers
+		where status = 'pending' and (origin_id = $1 or destination_id = $1))
+		or exists (select 1 from escrows
+		where status = 'held' and (payer_id = $1 or payee_id = $1))`,
+		id).Scan(&busy)
+
+	if err == nil && busy {
+		err = accountBusyError
+	}
+
+	if err == nil && acc.Balance > 0 {
+		var transferID int
+		transferID, err = payOutBalance(tx, id, closeReq.PayoutDestinationID,
+			acc.Balance)
+		closure.PayoutTransferID = &transferID
+		acc.Balance = 0
+	}
+
+	now := time.Now().UTC()
+
+	if err == nil {
+		_, err = tx.Exec(
+			`update accounts set status = 'closed', status_reason = null,
+			closed_at = $1 where id = $2`, now, id)
+	}
+
+	if err == nil {
+		err = recordStatusChange(tx, &accountStatusChange{
+			AccountID: id,
+			Status:    "closed",
+			Reason:    "closed by the owner",
+			ChangedBy: id,
+			CreatedAt: now,
+		})
+	}
+
+	if err != nil {
+		rollbackTx(tx)
+		respondWithError(rw, err)
+		return
+	}
+
+	err = tx.Commit()
+
+	if err != nil {
+		logger.Print("Error commiting tx")
+		respondWithError(rw, err)
+		return
+	}
+
+	logoutAccount(id, "")
+
+	acc.Status = "closed"
+
+	logger.Printf("Account %d closed", id)
+	respondWithJSON(rw, http.StatusOK, &closure)
+}
+
+// Handler for POST at /admin/accounts/<id>/freeze and unfreeze. Frozen
+// accounts can log in and receive money, but can't send it. Both need a
+// reason, kept with the status change.
+func setAccountFrozen(rw http.ResponseWriter, req *http.Request,
+	freeze bool) {
+
+	adminID := accountID(req)
+	id, err := pathID(req, "id")
+
+	if err != nil {
+		respondWithError(rw, err)
+		return
+	}
+
+	data, err := readFromReq(req, 1024)
+
+	if err != nil {
+		respondWithError(rw, err)
+		return
+	}
+
+	var statusReq accountStatusRequest
+
+	err = json.Unmarshal(data, &statusReq)
+
+	if err != nil {
+		respondWithError(rw, cantParseJSONError)
+		return
+	}
+
+	if err = validateReason(statusReq.Reason); err != nil {
+		respondWithError(rw, err)
+		return
+	}
+
+	change := accountStatusChange{
+		AccountID: id,
+		Status:    "active",
+		Reason:    statusReq.Reason,
+		ChangedBy: adminID,
+		CreatedAt: time.Now().UTC(),
+	}
+
+	var statusReason interface{}
+	fromStatus, fromErr := "frozen", accountNotFrozenError
+
+	if freeze {
+		change.Status = "frozen"
+		statusReason = statusReq.Reason
+		fromStatus, fromErr = "active", accountNotActiveError
+	}
+
+	tx, err := DB.BeginTx(req.Context(), &defaultTxOptions)
+
+	if err != nil {
+		logger.Print("Error starting tx to change account status")
+		respondWithError(rw, err)
+		return
+	}
+
+	var status string
+
+	err = tx.QueryRow(
+		`select status from accounts where id = $1 for update`,
+		id).Scan(&status)
+
+	if err == sql.ErrNoRows {
+		err = noAccountError
+	} else if err == nil && status != fromStatus {
+		err = fromErr
+	}
+
+	if err == nil {
+		_, err = tx.Exec(
+			`update accounts set status = $1, status_reason = $2
+			where id = $3`, change.Status, statusReason, id)
+	}
+
+	if err == nil {
+		err = recordStatusChange(tx, &change)
+	}
+
+	if err != nil {
+		rollbackTx(tx)
+		respondWithError(rw, err)
+		return
+	}
+
+	err = tx.Commit()
+
+	if err != nil {
+		logger.Print("Error commiting tx")
+		respondWithError(rw, err)
+		return
+	}
+
+	logger.Printf("Account %d is now %s, changed by %d", id, change.Status,
+		adminID)
+	respondWithJSON(rw, http.StatusOK, &change)
+}
+
+// Handler for POST at /admin/accounts/<id>/freeze, see setAccountFrozen.
+func freezeAccount(rw http.ResponseWriter, req *http.Request) {
+	setAccountFrozen(rw, req, true)
+}
+
+// Handler for POST at /admin/accounts/<id>/unfreeze, see setAccountFrozen.
+func unfreezeAccount(rw http.ResponseWriter, req *http.Request) {
+	setAccountFrozen(rw, req, false)
+}
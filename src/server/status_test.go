@@ -0,0 +1,25 @@
+package server
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestValidateReason(t *testing.T) {
+	var values = []struct {
+		reason string
+		valid  bool
+	}{
+		{"", false},
+		{"suspected fraud", true},
+		{strings.Repeat("a", maxReasonLen), true},
+		{strings.Repeat("ã", maxReasonLen), true},
+		{strings.Repeat("a", maxReasonLen+1), false},
+	}
+
+	for _, value := range values {
+		if err := validateReason(value.reason); (err == nil) != value.valid {
+			t.Error(value.reason, err)
+		}
+	}
+}
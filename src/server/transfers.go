@@ -3,19 +3,33 @@ package server
 import (
 	"context"
 	"database/sql"
+	"database/sql/driver"
 	"encoding/json"
 	"errors"
 	"fmt"
 	"math/big"
 	"net/http"
+	"strconv"
+	"strings"
 	"time"
+	"unicode/utf8"
 )
 
 // JSON that the client sends to create a new account. Fields exported
 // for JSON unmarshalling.
 type transferRequest struct {
-	DestinationID int   `json:"account_destination_id"`
-	Amount        money `json:"amount"`
+	DestinationID int `json:"account_destination_id"`
+	// A key registered by the destination account, instead of its id
+	DestinationKey string `json:"destination_key,omitempty"`
+	Amount         money  `json:"amount"`
+	// Free text, e.g. what the transfer is for
+	Description string `json:"description,omitempty"`
+	// An id from the client's own systems, e.g. an invoice number
+	Reference string           `json:"reference,omitempty"`
+	Metadata  transferMetadata `json:"metadata,omitempty"`
+	// Instead of a destination, split the amount between several, see
+	// split.go
+	Splits []splitLeg `json:"splits,omitempty"`
 }
 
 // Transfer entity
@@ -25,26 +39,245 @@ type transfer struct {
 	DestinationID int       `json:"account_destination_id"`
 	Amount        money     `json:"amount"`
 	CreatedAt     time.Time `json:"created_at"`
+	// Set if the transfer was made as part of a batch
+	BatchID     *int             `json:"batch_id,omitempty"`
+	Description string           `json:"description,omitempty"`
+	Reference   string           `json:"reference,omitempty"`
+	Metadata    transferMetadata `json:"metadata,omitempty"`
+	// Paid by the origin on top of the amount, see fees.go
+	Fee money `json:"fee"`
+	// Set if this transfer is the fee of another one
+	FeeFor *int `json:"fee_for,omitempty"`
 }
 
-// Insert a new transfer
+const maxDescriptionLen = 140
+const maxReferenceLen = 64
+const maxMetadataKeys = 16
+const maxMetadataKeyLen = 32
+const maxMetadataValueLen = 128
+
+// Key/value pairs the client attaches to a transfer. Stored as jsonb, and
+// NULL when empty.
+type transferMetadata map[string]string
+
+func (m transferMetadata) Value() (driver.Value, error) {
+	if len(m) == 0 {
+		return nil, nil
+	}
+
+	jsonBytes, err := json.Marshal(map[string]string(m))
+
+	if err != nil {
+		return nil, err
+	}
+
+	return string(jsonBytes), nil
+}
+
+// Always makes a new map, since transfers scanned in a loop are copied into
+// a slice and would otherwise share it.
+func (m *transferMetadata) Scan(src interface{}) error {
+	*m = nil
+
+	var jsonBytes []byte
+
+	switch src := src.(type) {
+	case nil:
+		return nil
+	case string:
+		jsonBytes = []byte(src)
+	case []byte:
+		jsonBytes = src
+	default:
+		return fmt.Errorf("can't scan %T into transfer metadata", src)
+	}
+
+	var newMetadata transferMetadata
+	err := json.Unmarshal(jsonBytes, &newMetadata)
+
+	if err != nil {
+		return err
+	}
+
+	*m = newMetadata
+
+	return nil
+}
+
+// Check if the transfer request from the client is valid.
+func (transferReq *transferRequest) validate() error {
+	// This can also happen if the user doesn't specify the amount in the
+	// request JSON. Unfortunately we can't tell the stdlib json functions
+	// to require a given field.
+	if transferReq.Amount == 0 {
+		return zeroAmountError
+	} else if transferReq.Amount < 0 {
+		return invalidAmountError
+	}
+
+	// Same here, if no destination_id field in the JSON, it will be 0.
+	// Note that our db assigns account ids starting at 1.
+	if len(transferReq.Splits) > 0 {
+		if transferReq.DestinationID != 0 || transferReq.DestinationKey != "" {
+			return twoDestinationsError
+		}
+
+		if err := validateSplitLegs(transferReq.Splits); err != nil {
+			return err
+		}
+	} else if transferReq.DestinationKey != "" {
+		if transferReq.DestinationID != 0 {
+			return twoDestinationsError
+		}
+
+		if len(transferReq.DestinationKey) > maxKeyLen {
+			return keyInvalidError
+		}
+	} else if transferReq.DestinationID == 0 {
+		return badDestinationIdError
+	}
+
+	if utf8.RuneCountInString(transferReq.Description) > maxDescriptionLen {
+		return descriptionTooLongError
+	}
+
+	if len(transferReq.Reference) > maxReferenceLen {
+		return referenceTooLongError
+	}
+
+	if len(transferReq.Metadata) > maxMetadataKeys {
+		return metadataTooLargeError
+	}
+
+	for key, value := range transferReq.Metadata {
+		if key == "" || len(key) > maxMetadataKeyLen ||
+			len(value) > maxMetadataValueLen {
+			return metadataInvalidError
+		}
+	}
+
+	return nil
+}
+
+// Insert a new transfer, unless the risk rules deny it or send it to review.
+//
+// Exactly one of the returned values is non-nil: the transfer if the money
+// moved, the pending transfer if it was parked for review, or the error.
 func insertTransfer(
 	ctx context.Context,
 	origID int,
 	destID int,
-	amount money) (*transfer, error) {
+	amount money) (*transfer, *pendingTransfer, error) {
+
+	return insertTransferWith(ctx,
+		&TransferAttempt{
+			OriginID:      origID,
+			DestinationID: destID,
+			Amount:        amount},
+		nil)
+}
 
-	var err error
-	var tx *sql.Tx
-	var transf transfer
-	var row *sql.Row
-	var origBalance, destBalance money
+// How many times insertTransferWith tries a transfer whose transaction
+// conflicts with a concurrent one, see txConflictCode.
+const maxTransferTries = 3
+
+// Like insertTransfer, but if then is not nil it's called inside the same tx
+// once the transfer is made or parked, with one of transf and pending set.
+// Callers use it to record their own changes atomically with the transfer.
+// If then returns an error, the tx is rolled back. then is called again if
+// the transfer is retried.
+//
+// A transaction that fails on a concurrent one is retried, up to
+// maxTransferTries times in all, since nothing of it was kept. Each retry is
+// counted in txRetries.
+func insertTransferWith(
+	ctx context.Context,
+	attempt *TransferAttempt,
+	then func(tx *sql.Tx, transf *transfer,
+		pending *pendingTransfer) error) (*transfer, *pendingTransfer, error) {
 
-	tx, err = DB.BeginTx(ctx, &defaultTxOptions)
+	for try := 1; ; try++ {
+		transf, pending, err := tryInsertTransfer(ctx, attempt, then)
+		code := txConflictCode(err)
+
+		if code == "" || try == maxTransferTries || ctx.Err() != nil {
+			countTransfer(transferResult(pending, err), attempt.Amount)
+			return transf, pending, err
+		}
+
+		txRetries.add(1, code)
+	}
+}
+
+// Try the transfer of insertTransferWith once.
+func tryInsertTransfer(
+	ctx context.Context,
+	attempt *TransferAttempt,
+	then func(tx *sql.Tx, transf *transfer,
+		pending *pendingTransfer) error) (*transfer, *pendingTransfer, error) {
+
+	tx, err := DB.BeginTx(ctx, &defaultTxOptions)
 
 	if err != nil {
 		logger.Print("Error starting tx to insert transfer")
-		return nil, err
+		return nil, nil, err
+	}
+
+	transf, pending, err := transferInTx(tx, attempt, true)
+
+	if err == nil && then != nil {
+		err = then(tx, transf, pending)
+	}
+
+	if err != nil {
+		rollbackTx(tx)
+
+		// A denial is recorded outside of the rolled back tx, so that it
+		// isn't lost with it.
+		var deniedErr *riskDeniedError
+		if errors.As(err, &deniedErr) {
+			recordRiskDecision(DB, attempt, RiskDeny, deniedErr.rule, nil,
+				nil)
+		}
+
+		return nil, nil, err
+	}
+
+	err = tx.Commit()
+
+	if err != nil {
+		logger.Print("Error commiting tx")
+		return nil, nil, err
+	}
+
+	return transf, pending, nil
+}
+
+// Move the attempt's amount from origin to destination and record the
+// transfer, inside tx. The caller is responsible for committing, or rolling
+// back on errors.
+//
+// If checkRisk is true, the risk rules are evaluated before moving the money,
+// and the transfer may be parked for review instead, in which case the
+// pending transfer is returned and no money moves.
+func transferInTx(
+	tx *sql.Tx,
+	attempt *TransferAttempt,
+	checkRisk bool) (*transfer, *pendingTransfer, error) {
+
+	origID := attempt.OriginID
+	destID := attempt.DestinationID
+	amount := attempt.Amount
+
+	var err error
+	var transf transfer
+	var row *sql.Row
+	var origBalance, destBalance, overdraftLimit money
+
+	// Both balances would be read before either update, so the second
+	// update would overwrite the first and create money.
+	if origID == destID {
+		return nil, nil, sameAccountError
 	}
 
 	// We lock the account rows with FOR UPDATE in case they get modified
@@ -57,58 +290,91 @@ func insertTransfer(
 	// E.g., if another transfer happens concurrently and we didn't lock the
 	// account row, we could end up setting the final balances from this
 	// transfer and lose the update from the concurrent trasnfer.
-	accQuery := `select balance from accounts where id = $1 for update`
+	var origStatus, destStatus string
 
-	row = tx.QueryRow(accQuery, origID)
-	err = row.Scan(&origBalance)
+	row = tx.QueryRow(
+		`select balance, overdraft_limit, status from accounts where id = $1
+		for update`, origID)
+	err = row.Scan(&origBalance, &overdraftLimit, &origStatus)
 
 	// We need to check that the origin and destination accounts
 	// actually exist in the DB. The login map is in-memory and not
 	// synchronized with the DB, so if someone were to add a feature
 	// to remove accounts in the future, we shouls handle this case.
 	if err == sql.ErrNoRows {
-		rollbackTx(tx)
-		return nil, noOrigAccountError
+		return nil, nil, noOrigAccountError
 	} else if err != nil {
-		rollbackTx(tx)
-		return nil, err
+		return nil, nil, err
 	}
 
-	row = tx.QueryRow(accQuery, destID)
-	err = row.Scan(&destBalance)
+	row = tx.QueryRow(
+		`select balance, status from accounts where id = $1 for update`,
+		destID)
+	err = row.Scan(&destBalance, &destStatus)
 
 	if err == sql.ErrNoRows {
-		rollbackTx(tx)
-		return nil, noDestAccountError
+		return nil, nil, noDestAccountError
 	} else if err != nil {
-		rollbackTx(tx)
-		return nil, err
+		return nil, nil, err
 	}
 
-	if origBalance < amount {
-		rollbackTx(tx)
-		return nil, insufficientFundsError
+	// Frozen accounts can still receive, but not send. Closed accounts do
+	// neither.
+	if origStatus == "frozen" {
+		return nil, nil, accountFrozenError
+	} else if origStatus == "closed" {
+		return nil, nil, accountClosedError
+	} else if destStatus == "closed" {
+		return nil, nil, destinationClosedError
+	}
+
+	fee, err := transferFee(tx, origID, amount)
+
+	if err != nil {
+		return nil, nil, err
+	}
+
+	// The balance can go negative down to the overdraft limit.
+	if int64(origBalance)+int64(overdraftLimit) < int64(amount)+int64(fee) {
+		return nil, nil, insufficientFundsError
+	}
+
+	// The origin row is locked, so no other transfer from this account can
+	// commit between the limit check and ours.
+	err = checkTransferLimits(tx, origID, amount)
+
+	if err != nil {
+		return nil, nil, err
+	}
+
+	if checkRisk {
+		var pending *pendingTransfer
+		pending, err = evaluateTransferRisk(tx, attempt)
+
+		if err != nil || pending != nil {
+			return nil, pending, err
+		}
 	}
 
 	// We represent our money as an int, that is, the actual money * 100,
 	// so we don't have to worry about handling decimal parts, just presenting
 	// correctly to the user.
-	origBalance = origBalance - amount
+	origBalance = origBalance - amount - fee
 
 	bigDestBalance := big.NewInt(int64(destBalance))
 	bigDestBalance.Add(bigDestBalance, big.NewInt(int64(amount)))
 
 	// We used a signed int, so the new balance has to be representable in 31
-	// bits. We don't have negatie balances.
+	// bits. The destination balance may be negative, but adding to it can
+	// only overflow upwards.
 	if bigDestBalance.BitLen() > 31 {
-		rollbackTx(tx)
-		return nil, amountTooLargeError
+		return nil, nil, amountTooLargeError
 	}
 
 	// We know from the previous check that the new balance fits.
 	destBalance = money(bigDestBalance.Int64())
 
-	accQuery = `update accounts set balance = $1 where id = $2`
+	accQuery := `update accounts set balance = $1 where id = $2`
 
 	var res sql.Result
 
@@ -116,18 +382,15 @@ func insertTransfer(
 	res, err = tx.Exec(accQuery, origBalance, origID)
 
 	if err != nil {
-		rollbackTx(tx)
-		return nil, err
+		return nil, nil, err
 	} else {
 		var rowsAffected int64
 		rowsAffected, err = res.RowsAffected()
 
 		if err != nil {
-			rollbackTx(tx)
-			return nil, err
+			return nil, nil, err
 		} else if rowsAffected != 1 {
-			rollbackTx(tx)
-			return nil, fmt.Errorf("unexpected number of affected rows")
+			return nil, nil, fmt.Errorf("unexpected number of affected rows")
 		}
 	}
 
@@ -135,69 +398,116 @@ func insertTransfer(
 	res, err = tx.Exec(accQuery, destBalance, destID)
 
 	if err != nil {
-		rollbackTx(tx)
-		return nil, err
+		return nil, nil, err
 	} else {
 		var rowsAffected int64
 		rowsAffected, err = res.RowsAffected()
 
 		if err != nil {
-			rollbackTx(tx)
-			return nil, err
+			return nil, nil, err
 		} else if rowsAffected != 1 {
-			rollbackTx(tx)
-			return nil, fmt.Errorf("unexpected number of affected rows")
+			return nil, nil, fmt.Errorf("unexpected number of affected rows")
 		}
 	}
 
 	// Now, insert the actual transfer record
 	var id int
 
+	var batchID interface{}
+
+	if attempt.BatchID != 0 {
+		batchID = attempt.BatchID
+	}
+
 	row = tx.QueryRow(
-		`insert into transfers (origin_id, destination_id, amount, created_at)
-		values ($1, $2, $3, current_timestamp at time zone 'UTC')
+		`insert into transfers (origin_id, destination_id, amount, created_at,
+		batch_id, description, reference, metadata, fee)
+		values ($1, $2, $3, current_timestamp at time zone 'UTC', $4, $5, $6,
+		$7, $8)
 		returning id`,
 		origID,
 		destID,
-		amount)
+		amount,
+		batchID,
+		attempt.Description,
+		attempt.Reference,
+		attempt.Metadata,
+		fee)
 
 	err = row.Scan(&id)
 
 	if err != nil {
-		rollbackTx(tx)
-		return nil, err
+		return nil, nil, err
+	}
+
+	if fee > 0 {
+		err = chargeFee(tx, origID, id, fee)
+
+		if err != nil {
+			return nil, nil, err
+		}
+	}
+
+	err = recordTransferEvents(tx, id)
+
+	if err != nil {
+		return nil, nil, err
+	}
+
+	if checkRisk {
+		err = recordRiskDecision(tx, attempt, RiskAllow, "", &id, nil)
+
+		if err != nil {
+			return nil, nil, err
+		}
 	}
 
 	row = tx.QueryRow(
-		`select id, origin_id, destination_id, amount, created_at
-		created_at from transfers where id = $1`, id)
+		`select `+transferColumns+` from transfers where id = $1`, id)
 
-	err = row.Scan(
-		&transf.ID, &transf.OriginID, &transf.DestinationID,
-		&transf.Amount, &transf.CreatedAt)
+	err = scanTransfer(row, &transf)
 
 	if err != nil {
-		rollbackTx(tx)
-		return nil, err
+		return nil, nil, err
 	}
 
-	err = tx.Commit()
+	return &transf, nil, nil
+}
+
+// Make the validated transferReq, without splits, from the account with id.
+// Like insertTransfer, one of the transfer, the pending transfer and the
+// error is returned.
+func makeTransfer(ctx context.Context, id int,
+	transferReq *transferRequest) (*transfer, *pendingTransfer, error) {
+
+	err := transferReq.resolveDestination(DB)
 
 	if err != nil {
-		logger.Print("Error commiting tx")
-		return nil, err
+		return nil, nil, err
 	}
 
-	return &transf, nil
+	return insertTransferWith(ctx,
+		&TransferAttempt{
+			OriginID:      id,
+			DestinationID: transferReq.DestinationID,
+			Amount:        transferReq.Amount,
+			Description:   transferReq.Description,
+			Reference:     transferReq.Reference,
+			Metadata:      transferReq.Metadata},
+		nil)
 }
 
 // Handler for POST at /transfers. Gets the origin id from the token, if any,
 // and the destination id from the request.
-func doTransfer(rw http.ResponseWriter, req *http.Request, id int) {
+func doTransfer(rw http.ResponseWriter, req *http.Request) {
+	id := accountID(req)
+
 	var err error
 	var data []byte
 
-	data, err = readFromReq(req, 128)
+	// The metadata can take up to 16 * (32 + 128) = 2560 bytes, plus the
+	// description, reference and JSON encoding.
+	data, err = readFromReq(req, 4096)
 
 	if err != nil {
 		respondWithError(rw, err)
@@ -217,30 +527,34 @@ func doTransfer(rw http.ResponseWriter, req *http.Request, id int) {
 		return
 	}
 
-	// This can also happen if the user doesn't specify the amount in the
-	// request JSON. Unfortunately we can't tell the stdlib json functions
-	// to require a given field.
-	if transferReq.Amount == 0 {
-		respondWithError(rw, zeroAmountError)
+	err = transferReq.validate()
+
+	if err != nil {
+		respondWithError(rw, err)
 		return
 	}
 
-	// Same here, if no destination_id field in the JSON, it will be 0.
-	// Note that our db assigns account ids starting at 1.
-	if transferReq.DestinationID == 0 {
-		respondWithError(rw, badDestinationIdError)
+	if len(transferReq.Splits) > 0 {
+		doSplitTransfer(rw, req, id, &transferReq)
 		return
 	}
 
 	var transf *transfer
-	transf, err = insertTransfer(req.Context(), id, transferReq.DestinationID,
-		transferReq.Amount)
+	var pending *pendingTransfer
+	transf, pending, err = makeTransfer(req.Context(), id, &transferReq)
 
 	if err != nil {
 		respondWithError(rw, err)
 		return
 	}
 
+	// The money didn't move, let the client know the transfer is waiting
+	// for review.
+	if pending != nil {
+		respondWithJSON(rw, http.StatusAccepted, pending)
+		return
+	}
+
 	var jsonResponse []byte
 	jsonResponse, err = json.Marshal(transf)
 
@@ -268,101 +582,228 @@ func doTransfer(rw http.ResponseWriter, req *http.Request, id int) {
 	}
 }
 
-// Handler for GET at /transfers.
-func getTransfers(rw http.ResponseWriter, req *http.Request, id int) {
-	rows, err := DB.Query(
-		`select id, origin_id, destination_id, amount, created_at
-		 from transfers where origin_id = $1 or destination_id = $1`, id)
+// Columns selected for a transfer, in the order scanTransfer expects.
+const transferColumns = `id, origin_id, destination_id, amount, created_at,
+	batch_id, description, reference, metadata, fee, fee_for`
 
-	if err != nil {
-		respondWithError(rw, err)
-		return
+// Either *sql.Row or *sql.Rows.
+type scanner interface {
+	Scan(dest ...interface{}) error
+}
+
+// Scan a row selected with transferColumns into transf.
+func scanTransfer(row scanner, transf *transfer) error {
+	return row.Scan(&transf.ID, &transf.OriginID, &transf.DestinationID,
+		&transf.Amount, &transf.CreatedAt, &transf.BatchID,
+		&transf.Description, &transf.Reference, &transf.Metadata, &transf.Fee,
+		&transf.FeeFor)
+}
+
+// A page of GET /transfers.
+type transferPage struct {
+	Transfers []transfer `json:"transfers"`
+	// Pass as the cursor query parameter to get the next page. Empty on the
+	// last page.
+	NextCursor string `json:"next_cursor,omitempty"`
+}
+
+// Columns GET /transfers can be sorted by, and their SQL types.
+var transferSortTypes = map[string]string{
+	"id":         "integer",
+	"created_at": "timestamp",
+	"amount":     "integer",
+}
+
+// Build the where clause for GET /transfers from the request's query
+// parameters, for the account with id. The supported filters are:
+//
+//   - direction=sent|received: only transfers the account sent or received
+//   - counterparty=<id>: transfers to or from the account with this id
+//   - min_amount=<amount>, max_amount=<amount>: amount range, inclusive
+//   - from=<time>, to=<time>: creation time range, inclusive, see
+//     parseTimeParam
+//   - reference=<ref>: transfers with exactly this reference
+//   - description=<text>: transfers whose description contains text, ignoring
+//     case
+//   - metadata.<key>=<value>: transfers with this key/value pair in the
+//     metadata. Can be repeated for different keys.
+func transferFilters(req *http.Request, id int) (*whereBuilder, error) {
+	var where whereBuilder
+	query := req.URL.Query()
+
+	switch query.Get("direction") {
+	case "":
+		where.add("(origin_id = %[1]s or destination_id = %[1]s)", id)
+	case "sent":
+		where.add("origin_id = %s", id)
+	case "received":
+		where.add("destination_id = %s", id)
+	default:
+		return nil, newBadParamError("direction")
 	}
 
-	defer rows.Close()
+	if counterparty := query.Get("counterparty"); counterparty != "" {
+		counterpartyID, err := strconv.ParseInt(counterparty, 10, 32)
 
-	var transf transfer
+		if err != nil {
+			return nil, newBadParamError("counterparty")
+		}
 
-	// No pagination for simplicity
-	var transfs []transfer = make([]transfer, 0, 64)
+		where.add(`(case when origin_id = %s then destination_id
+			else origin_id end) = %s`, id, counterpartyID)
+	}
 
-	next_p := rows.Next()
+	for _, amountFilter := range []struct {
+		param string
+		cond  string
+	}{
+		{"min_amount", "amount >= %s"},
+		{"max_amount", "amount <= %s"},
+	} {
+		amount, err := parseMoneyParam(req, amountFilter.param)
 
-	for next_p {
-		err = rows.Scan(&transf.ID, &transf.OriginID, &transf.DestinationID,
-			&transf.Amount, &transf.CreatedAt)
+		if err != nil {
+			return nil, err
+		} else if amount != nil {
+			where.add(amountFilter.cond, *amount)
+		}
+	}
+
+	for _, timeFilter := range []struct {
+		param    string
+		cond     string
+		endOfDay bool
+	}{
+		{"from", "created_at >= %s", false},
+		{"to", "created_at <= %s", true},
+	} {
+		t, err := parseTimeParam(req, timeFilter.param, timeFilter.endOfDay)
 
 		if err != nil {
-			logger.Printf("error when querying transfers")
-			respondWithError(rw, err)
-			return
+			return nil, err
+		} else if t != nil {
+			where.add(timeFilter.cond, *t)
 		}
+	}
 
-		transfs = append(transfs, transf)
+	if reference := query.Get("reference"); reference != "" {
+		where.add("reference = %s", reference)
+	}
 
-		next_p = rows.Next()
+	if description := query.Get("description"); description != "" {
+		where.add("position(lower(%s) in lower(description)) > 0",
+			description)
 	}
 
-	if err = rows.Err(); err != nil {
-		logger.Printf("error when querying transfers")
-		respondWithError(rw, err)
-		return
+	metadata := make(transferMetadata)
+
+	for param, values := range query {
+		if strings.HasPrefix(param, "metadata.") && len(values) > 0 {
+			metadata[strings.TrimPrefix(param, "metadata.")] = values[0]
+		}
 	}
 
-	var jsonResponse []byte
-	jsonResponse, err = json.Marshal(transfs)
+	if len(metadata) > 0 {
+		where.add("metadata @> %s::jsonb", metadata)
+	}
+
+	return &where, nil
+}
+
+// The value of the column transfers are sorted by, for the next page cursor.
+func transferSortValue(transf *transfer, sort string) string {
+	switch sort {
+	case "created_at":
+		return cursorTime(transf.CreatedAt)
+	case "amount":
+		return strconv.Itoa(int(transf.Amount))
+	default:
+		return ""
+	}
+}
+
+// The page of transfers of the account with id for the query of req.
+// Paginated, see parsePageParams, unless all is true, in which case every
+// transfer is in the page. See transferFilters for the filters in the query.
+func listTransfers(req *http.Request, id int, all bool) (*transferPage,
+	error) {
+
+	params, err := parsePageParams(req, transferSortTypes, "id")
 
 	if err != nil {
-		logger.Printf("error when marshalling transfers")
-		respondWithError(rw, err)
-		return
+		return nil, err
 	}
 
-	setJSONEncoding(rw)
+	if all {
+		params.limit = 0
+	}
 
-	_, err = rw.Write(jsonResponse)
+	where, err := transferFilters(req, id)
 
-	if err == nil {
-		_, err = rw.Write([]byte("\n"))
+	if err != nil {
+		return nil, err
 	}
 
+	params.addCursor(where)
+
+	rows, err := DB.QueryContext(req.Context(),
+		`select `+transferColumns+` from transfers where `+where.String()+
+			` `+params.orderAndLimit(), where.args...)
+
 	if err != nil {
-		logger.Printf("Could not write response: %v", err)
+		return nil, err
 	}
-}
 
-// Route requests to /transfers depending on the method (GET or POST)
-func handleTransfers(rw http.ResponseWriter, req *http.Request) {
+	defer rows.Close()
 
-	if req.URL.Path != "/transfers" {
-		respondWithError(rw, invalidURLError)
-		return
+	var transf transfer
+	var transfs []transfer = make([]transfer, 0, params.limit+1)
+
+	for rows.Next() {
+		err = scanTransfer(rows, &transf)
+
+		if err != nil {
+			logger.Printf("error when querying transfers")
+			return nil, err
+		}
+
+		transfs = append(transfs, transf)
 	}
 
-	if req.Method != http.MethodGet && req.Method != http.MethodPost {
-		respondWithError(rw, invalidMethodError)
-		return
+	if err = rows.Err(); err != nil {
+		logger.Printf("error when querying transfers")
+		return nil, err
 	}
 
-	token := req.Header.Get("Authorization")
+	var page transferPage
 
-	if token == "" {
-		respondWithError(rw, noTokenError)
-		return
+	if params.limit > 0 && len(transfs) > params.limit {
+		last := &transfs[params.limit-1]
+		page.NextCursor = params.nextCursor(last.ID,
+			transferSortValue(last, params.sort))
+		transfs = transfs[:params.limit]
 	}
 
-	id, err := getUserByToken(token, true)
+	page.Transfers = transfs
+
+	return &page, nil
+}
+
+// Handler for GET at /transfers, see listTransfers. Without limit or cursor,
+// responds with every transfer as an array, see wantsPage.
+func getTransfers(rw http.ResponseWriter, req *http.Request) {
+	paged := wantsPage(req)
+	page, err := listTransfers(req, accountID(req), !paged)
 
 	if err != nil {
 		respondWithError(rw, err)
 		return
 	}
 
-	if req.Method == http.MethodPost {
-		doTransfer(rw, req, id)
-	} else if req.Method == http.MethodGet {
-		getTransfers(rw, req, id)
-	} else {
-		respondWithError(rw, invalidMethodError)
+	if !paged {
+		respondWithJSON(rw, http.StatusOK, page.Transfers)
+		return
 	}
+
+	respondWithJSON(rw, http.StatusOK, page)
 }
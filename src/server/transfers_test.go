@@ -0,0 +1,118 @@
+package server
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestTransferValidation(t *testing.T) {
+	var transferReq = transferRequest{
+		DestinationID: 2,
+		Amount:        3472,
+		Description:   "Invoice 42",
+		Reference:     "INV-42",
+		Metadata:      transferMetadata{"order": "1234"},
+	}
+
+	if transferReq.validate() != nil {
+		t.Fail()
+	}
+
+	tooManyKeys := make(transferMetadata)
+
+	for i := 0; i <= maxMetadataKeys; i++ {
+		tooManyKeys[strings.Repeat("k", i+1)] = "v"
+	}
+
+	var badTransferReqs = []struct {
+		modify func(*transferRequest)
+		err    *publicJSONError
+	}{
+		{func(req *transferRequest) { req.Amount = 0 }, zeroAmountError},
+		{func(req *transferRequest) { req.Amount = -100 }, invalidAmountError},
+		{func(req *transferRequest) { req.DestinationID = 0 },
+			badDestinationIdError},
+		{func(req *transferRequest) { req.DestinationKey = "a@b.com" },
+			twoDestinationsError},
+		{func(req *transferRequest) {
+			req.Description = strings.Repeat("é", maxDescriptionLen+1)
+		}, descriptionTooLongError},
+		{func(req *transferRequest) {
+			req.Reference = strings.Repeat("r", maxReferenceLen+1)
+		}, referenceTooLongError},
+		{func(req *transferRequest) { req.Metadata = tooManyKeys },
+			metadataTooLargeError},
+		{func(req *transferRequest) {
+			req.Metadata = transferMetadata{"": "empty key"}
+		}, metadataInvalidError},
+		{func(req *transferRequest) {
+			req.Metadata = transferMetadata{
+				"key": strings.Repeat("v", maxMetadataValueLen+1)}
+		}, metadataInvalidError},
+	}
+
+	for _, badTransferReq := range badTransferReqs {
+		badReq := transferReq
+		badTransferReq.modify(&badReq)
+
+		if badReq.validate() != badTransferReq.err {
+			t.Error(badReq)
+		}
+	}
+
+	// A description of maxDescriptionLen multi-byte characters is fine
+	transferReq.Description = strings.Repeat("é", maxDescriptionLen)
+
+	if transferReq.validate() != nil {
+		t.Fail()
+	}
+}
+
+func TestTransferMetadata(t *testing.T) {
+	var metadata transferMetadata
+
+	value, err := metadata.Value()
+
+	if err != nil || value != nil {
+		t.Error(value, err)
+	}
+
+	metadata = transferMetadata{"order": "1234"}
+	value, err = metadata.Value()
+
+	if err != nil || value != `{"order":"1234"}` {
+		t.Error(value, err)
+	}
+
+	var scanned transferMetadata
+	err = scanned.Scan(value)
+
+	if err != nil || len(scanned) != 1 || scanned["order"] != "1234" {
+		t.Error(scanned, err)
+	}
+
+	// Scanning again must not modify the previous map
+	previous := scanned
+	err = scanned.Scan([]byte(`{"order":"5678"}`))
+
+	if err != nil || previous["order"] != "1234" ||
+		scanned["order"] != "5678" {
+		t.Error(previous, scanned, err)
+	}
+
+	err = scanned.Scan(nil)
+
+	if err != nil || scanned != nil {
+		t.Error(scanned, err)
+	}
+}
+
+func TestSameAccountTransfer(t *testing.T) {
+	// Refused before the tx is used
+	_, _, err := transferInTx(nil,
+		&TransferAttempt{OriginID: 1, DestinationID: 1, Amount: 100}, false)
+
+	if err != sameAccountError {
+		t.Error(err)
+	}
+}
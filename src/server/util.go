@@ -1,6 +1,7 @@
 package server
 
 import (
+	"encoding/json"
 	"errors"
 	"fmt"
 	"io"
@@ -17,11 +18,23 @@ var logger = log.New(os.Stdout, "server: ", log.LstdFlags|log.Lmsgprefix)
 // We represent the account balance as the actual balance time 100 (e.g. BRL
 // 223.15 is represented as 22315). We only support addition/substraction so
 // we don't need more decimals than two, for the BRL cents.
+//
+// Balances can be negative when an account uses its overdraft, so money can
+// be too. Amounts sent by clients must be checked to be positive.
 type money int32
 
 // Stringify a money value. The last two digits are the cents.
 func (num money) String() string {
-	return fmt.Sprintf("%d.%d%d", num/100, (num%100)/10, (num%100)%10)
+	// In 64 bits, since the smallest int32 has no positive counterpart.
+	abs := int64(num)
+	sign := ""
+
+	if abs < 0 {
+		abs = -abs
+		sign = "-"
+	}
+
+	return fmt.Sprintf("%s%d.%02d", sign, abs/100, abs%100)
 }
 
 func (num money) MarshalJSON() ([]byte, error) {
@@ -29,7 +42,7 @@ func (num money) MarshalJSON() ([]byte, error) {
 }
 
 var moneyRegex *regexp.Regexp = regexp.MustCompile(
-	`^([0-9]+)\.([0-9][0-9])$`)
+	`^(-?[0-9]+)\.([0-9][0-9])$`)
 
 func (num *money) UnmarshalJSON(bytes []byte) error {
 	strVal := string(bytes)
@@ -40,7 +53,8 @@ func (num *money) UnmarshalJSON(bytes []byte) error {
 
 	strVal = moneyRegex.ReplaceAllString(strVal, "$1$2")
 
-	val, err := strconv.ParseInt(strVal, 0, 32)
+	// Base 10, or amounts under 1.00 like 0.50 would be read as octal.
+	val, err := strconv.ParseInt(strVal, 10, 32)
 
 	if errors.Is(err, strconv.ErrRange) {
 		return amountTooLargeError
@@ -55,29 +69,28 @@ func (num *money) UnmarshalJSON(bytes []byte) error {
 	return nil
 }
 
-// Respond to the client with an error. If err has a public error in its
-// unrwap chain, respond with the message in that error. Otherwise,
-// respond with a generic internal error message and log the error.
+// Respond to the client with an error, in the error envelope. If err has a
+// public error in its unwrap chain, respond with that error. Otherwise,
+// respond with internalError and log err. The envelope has the request id
+// that withRequestID set, so clients can point us to the logs.
 func respondWithError(rw http.ResponseWriter, err error) error {
-
-	setJSONEncoding(rw)
+	requestID := rw.Header().Get(requestIDHeader)
 
 	var publicError *publicJSONError
-	var status int
-	var errMsg string
 
-	if errors.As(err, &publicError) {
-		status = publicError.status
-		errMsg = publicError.errJSON
-	} else {
-		status = http.StatusInternalServerError
-		errMsg = fmt.Sprintf(jsonErrFmt, "internal server error")
-		logger.Println(err)
+	if !errors.As(err, &publicError) {
+		logger.Printf("Request %s: %v", requestID, err)
+		countTxConflict(err)
+		publicError = internalError
 	}
 
-	rw.WriteHeader(status)
+	// The details only have numbers and strings, so this can't fail.
+	data, _ := json.Marshal(publicError.envelope(requestID))
+
+	setJSONEncoding(rw)
+	rw.WriteHeader(publicError.status)
 
-	_, writeErr := fmt.Fprint(rw, errMsg)
+	_, writeErr := rw.Write(append(data, '\n'))
 
 	if writeErr != nil {
 		logger.Printf("Could not write response: %v", writeErr)
@@ -86,6 +99,32 @@ func respondWithError(rw http.ResponseWriter, err error) error {
 	return writeErr
 }
 
+// Respond to the client with v marshalled as JSON, with the given status.
+func respondWithJSON(rw http.ResponseWriter, status int, v interface{}) {
+	jsonResponse, err := json.Marshal(v)
+
+	if err != nil {
+		logger.Printf("Could not marshal json for response")
+		respondWithError(rw, err)
+		return
+	}
+
+	setJSONEncoding(rw)
+	rw.WriteHeader(status)
+
+	_, err = rw.Write(jsonResponse)
+
+	// A whitespace is allowed at the end of json and it's nicer when
+	// curling this serice from the command line.
+	if err == nil {
+		_, err = rw.Write([]byte("\n"))
+	}
+
+	if err != nil {
+		logger.Printf("Could not write response: %v", err)
+	}
+}
+
 // Read from the request body up to maxLen bytes, and return in error if the
 // request is too long or empty.
 func readFromReq(req *http.Request, maxLen int) ([]byte, error) {
@@ -0,0 +1,28 @@
+package server
+
+import (
+	"testing"
+)
+
+func TestMoneyUnmarshal(t *testing.T) {
+	var amounts = []struct {
+		json  string
+		value money
+	}{
+		{"34.72", 3472},
+		// Read in base 10, not as octal because of the leading zero
+		{"0.50", 50},
+		{"0.08", 8},
+		{"10.00", 1000},
+	}
+
+	for _, amount := range amounts {
+		var value money
+
+		if err := value.UnmarshalJSON([]byte(amount.json)); err != nil ||
+			value != amount.value {
+
+			t.Error(amount.json, value, err)
+		}
+	}
+}
@@ -0,0 +1,961 @@
+package server
+
+import (
+	"bytes"
+	"context"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"database/sql"
+	"database/sql/driver"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/url"
+	"strconv"
+	"sync"
+	"syscall"
+	"time"
+)
+
+// A URL an account registered to be told about its events. Fields exported
+// for JSON marshalling.
+type webhook struct {
+	ID        int              `json:"id"`
+	URL       string           `json:"url"`
+	Events    webhookEventList `json:"events"`
+	CreatedAt time.Time        `json:"created_at"`
+	// Only sent back when the webhook is created
+	Secret string `json:"secret,omitempty"`
+}
+
+// JSON that the client sends to register a webhook.
+type webhookCreateRequest struct {
+	URL    string   `json:"url"`
+	Events []string `json:"events"`
+}
+
+// One event sent to one webhook, as listed in the delivery log.
+type webhookDelivery struct {
+	ID        int    `json:"id"`
+	EventID   int    `json:"event_id"`
+	EventType string `json:"event_type"`
+	// pending, delivered or dead
+	Status   string `json:"status"`
+	Attempts int    `json:"attempts"`
+	// Only while pending
+	NextAttemptAt *time.Time `json:"next_attempt_at,omitempty"`
+	LastAttemptAt *time.Time `json:"last_attempt_at,omitempty"`
+	// The HTTP status of the last attempt, if there was a response
+	LastStatus  *int       `json:"last_status,omitempty"`
+	LastError   string     `json:"last_error,omitempty"`
+	DeliveredAt *time.Time `json:"delivered_at,omitempty"`
+	CreatedAt   time.Time  `json:"created_at"`
+}
+
+// A page of GET /webhooks/<id>/deliveries.
+type webhookDeliveryPage struct {
+	Deliveries []webhookDelivery `json:"deliveries"`
+	NextCursor string            `json:"next_cursor,omitempty"`
+}
+
+// The body of the POST a webhook gets for an event.
+type webhookPayload struct {
+	ID        int             `json:"id"`
+	Type      string          `json:"type"`
+	AccountID int             `json:"account_id"`
+	CreatedAt time.Time       `json:"created_at"`
+	Data      json.RawMessage `json:"data"`
+}
+
+// The events a webhook can get, and the status change each account event is
+// for.
+var webhookEventTypes = map[string]bool{
+	"transfer.sent":     true,
+	"transfer.received": true,
+	"account.frozen":    true,
+	"account.unfrozen":  true,
+	"account.closed":    true,
+}
+
+var statusWebhookEvents = map[string]string{
+	"frozen": "account.frozen",
+	"active": "account.unfrozen",
+	"closed": "account.closed",
+}
+
+const maxWebhooksPerAccount = 5
+
+// Same as the column
+const maxWebhookURLLen = 2048
+
+// How often the worker looks for deliveries due, and how many it takes at a
+// time.
+const webhookJobInterval = 5 * time.Second
+const webhookBatchLen = 20
+
+// How long the worker has a delivery before another server can take it.
+// Longer than webhookTimeout, so a delivery is only sent twice if the server
+// sending it died.
+const webhookLease = time.Minute
+const webhookTimeout = 10 * time.Second
+
+// A delivery is tried webhookMaxAttempts times, waiting twice as long after
+// each failure, starting at webhookFirstRetry, before it's dead. About four
+// hours in total.
+const webhookMaxAttempts = 10
+const webhookFirstRetry = 30 * time.Second
+const webhookMaxRetry = 6 * time.Hour
+
+// Channel that signals when the webhook worker finishes
+var webhookJobFinished = make(chan interface{})
+
+// The client the worker posts with. Redirects aren't followed, they count as
+// failures, so a delivery only goes to the URL the account registered. It
+// only connects to public addresses, see checkWebhookAddress, and doesn't use
+// a proxy.
+var webhookClient = &http.Client{
+	Timeout: webhookTimeout,
+	CheckRedirect: func(req *http.Request, via []*http.Request) error {
+		return http.ErrUseLastResponse
+	},
+	Transport: &http.Transport{
+		DialContext: (&net.Dialer{
+			Timeout: webhookTimeout,
+			Control: checkWebhookAddress,
+		}).DialContext,
+		ForceAttemptHTTP2:   true,
+		TLSHandshakeTimeout: webhookTimeout,
+		MaxIdleConns:        webhookBatchLen,
+		IdleConnTimeout:     90 * time.Second,
+	},
+}
+
+var webhookAddressError = errors.New("webhook address is not public")
+
+// Private networks, and others that aren't on the internet, that webhooks
+// can't be sent to.
+var webhookBlockedNets = parseCIDRs("0.0.0.0/8", "10.0.0.0/8",
+	"100.64.0.0/10", "172.16.0.0/12", "192.0.0.0/24", "192.168.0.0/16",
+	"198.18.0.0/15", "240.0.0.0/4", "fc00::/7")
+
+func parseCIDRs(cidrs ...string) []*net.IPNet {
+	nets := make([]*net.IPNet, len(cidrs))
+
+	for i, cidr := range cidrs {
+		_, ipNet, err := net.ParseCIDR(cidr)
+
+		if err != nil {
+			panic(err)
+		}
+
+		nets[i] = ipNet
+	}
+
+	return nets
+}
+
+// Refuse to connect to loopback, private, link-local, multicast and
+// unspecified addresses. It's the dialer's Control, so it checks the address
+// after the host is resolved, when connecting: a webhook host can't resolve
+// to a public address when registered and to an internal one later.
+func checkWebhookAddress(network, address string, c syscall.RawConn) error {
+	host, _, err := net.SplitHostPort(address)
+
+	if err != nil {
+		return err
+	}
+
+	ip := net.ParseIP(host)
+
+	if ip == nil || ip.IsLoopback() || ip.IsUnspecified() ||
+		ip.IsLinkLocalUnicast() || ip.IsMulticast() {
+
+		return webhookAddressError
+	}
+
+	for _, ipNet := range webhookBlockedNets {
+		if ipNet.Contains(ip) {
+			return webhookAddressError
+		}
+	}
+
+	return nil
+}
+
+// The event types of a webhook. Stored as a jsonb array.
+type webhookEventList []string
+
+func (events webhookEventList) Value() (driver.Value, error) {
+	jsonBytes, err := json.Marshal([]string(events))
+
+	if err != nil {
+		return nil, err
+	}
+
+	return string(jsonBytes), nil
+}
+
+func (events *webhookEventList) Scan(src interface{}) error {
+	var jsonBytes []byte
+
+	switch src := src.(type) {
+	case string:
+		jsonBytes = []byte(src)
+	case []byte:
+		jsonBytes = src
+	default:
+		return fmt.Errorf("can't scan %T into webhook events", src)
+	}
+
+	var newEvents webhookEventList
+	err := json.Unmarshal(jsonBytes, &newEvents)
+
+	if err != nil {
+		return err
+	}
+
+	*events = newEvents
+
+	return nil
+}
+
+// Check if the webhook the client wants to register is valid, dropping
+// repeated events.
+func (createReq *webhookCreateRequest) validate() error {
+	if len(createReq.URL) > maxWebhookURLLen {
+		return webhookURLInvalidError
+	}
+
+	webhookURL, err := url.Parse(createReq.URL)
+
+	if err != nil || webhookURL.Scheme != "https" ||
+		webhookURL.Host == "" || webhookURL.User != nil {
+
+		return webhookURLInvalidError
+	}
+
+	if len(createReq.Events) == 0 {
+		return webhookEventsInvalidError
+	}
+
+	seen := make(map[string]bool, len(createReq.Events))
+	events := make([]string, 0, len(createReq.Events))
+
+	for _, event := range createReq.Events {
+		if !webhookEventTypes[event] {
+			return webhookEventsInvalidError
+		}
+
+		if !seen[event] {
+			seen[event] = true
+			events = append(events, event)
+		}
+	}
+
+	createReq.Events = events
+
+	return nil
+}
+
+// Write an event of eventType for the account with id to the outbox, inside
+// tx, with a delivery for each webhook of the account that wants it. Nothing
+// is written if none does.
+func queueWebhookEvent(tx *sql.Tx, id int, eventType string,
+	data interface{}) error {
+
+	jsonBytes, err := json.Marshal(data)
+
+	if err != nil {
+		return err
+	}
+
+	_, err = tx.Exec(
+		`with event as (
+			insert into webhook_events (account_id, type, data, created_at)
+			select $1::integer, $2::varchar, $3::jsonb,
+				current_timestamp at time zone 'UTC'
+			where exists (select 1 from webhooks
+				where account_id = $1 and events ? $2)
+			returning id)
+		insert into webhook_deliveries (webhook_id, event_id,
+			next_attempt_at, created_at)
+		select webhooks.id, event.id, current_timestamp at time zone 'UTC',
+			current_timestamp at time zone 'UTC'
+		from event, webhooks
+		where webhooks.account_id = $1 and webhooks.events ? $2`,
+		id, eventType, string(jsonBytes))
+
+	return err
+}
+
+// Generate the key a webhook's payloads are signed with.
+func generateWebhookSecret() (string, error) {
+	var b [32]byte
+
+	_, err := rand.Read(b[:])
+
+	if err != nil {
+		return "", err
+	}
+
+	return hex.EncodeToString(b[:]), nil
+}
+
+// The PedroBank-Signature header for body, sent at t: the time as a Unix
+// timestamp and the HMAC-SHA256, with the secret as the key, of the
+// timestamp, a dot and the body. Signing the time lets receivers refuse old
+// payloads sent again.
+func signWebhook(secret string, t time.Time, body []byte) string {
+	mac := hmac.New(sha256.New, []byte(secret))
+	fmt.Fprintf(mac, "%d.", t.Unix())
+	mac.Write(body)
+
+	return fmt.Sprintf("t=%d,v1=%x", t.Unix(), mac.Sum(nil))
+}
+
+// How long to wait before trying a delivery again after its attempts-th
+// attempt failed. false if that was the last one.
+func webhookRetryDelay(attempts int) (time.Duration, bool) {
+	if attempts >= webhookMaxAttempts {
+		return 0, false
+	}
+
+	delay := webhookFirstRetry
+
+	for i := 1; i < attempts && delay < webhookMaxRetry; i++ {
+		delay *= 2
+	}
+
+	if delay > webhookMaxRetry {
+		delay = webhookMaxRetry
+	}
+
+	return delay, true
+}
+
+// A delivery the worker took, with what it needs to send it.
+type claimedDelivery struct {
+	id       int
+	attempts int
+	url      string
+	secret   string
+	payload  webhookPayload
+}
+
+// Take up to webhookBatchLen deliveries that are due, counting the attempt
+// and pushing them forward by webhookLease so no other server takes them.
+func claimWebhookDeliveries(ctx context.Context,
+	now time.Time) ([]claimedDelivery, error) {
+
+	rows, err := DB.QueryContext(ctx,
+		`with claimed as (
+			update webhook_deliveries
+			set attempts = attempts + 1, next_attempt_at = $1
+			where id in (select id from webhook_deliveries
+				where status = 'pending' and next_attempt_at <= $2
+				order by next_attempt_at limit $3
+				for update skip locked)
+			returning id, webhook_id, event_id, attempts)
+		select claimed.id, claimed.attempts, webhooks.url, webhooks.secret,
+			webhook_events.id, webhook_events.type, webhook_events.account_id,
+			webhook_events.created_at, webhook_events.data
+		from claimed
+		join webhooks on webhooks.id = claimed.webhook_id
+		join webhook_events on webhook_events.id = claimed.event_id
+		order by claimed.id`,
+		now.Add(webhookLease), now, webhookBatchLen)
+
+	if err != nil {
+		return nil, err
+	}
+
+	defer rows.Close()
+
+	var deliveries []claimedDelivery
+
+	for rows.Next() {
+		var delivery claimedDelivery
+		var data []byte
+
+		err = rows.Scan(&delivery.id, &delivery.attempts, &delivery.url,
+			&delivery.secret, &delivery.payload.ID, &delivery.payload.Type,
+			&delivery.payload.AccountID, &delivery.payload.CreatedAt, &data)
+
+		if err != nil {
+			return nil, err
+		}
+
+		delivery.payload.Data = json.RawMessage(data)
+		deliveries = append(deliveries, delivery)
+	}
+
+	return deliveries, rows.Err()
+}
+
+// POST the delivery's payload to its webhook, signed. Any status but a 2xx
+// is a failure. Returns the status, 0 if there was no response.
+func sendWebhook(ctx context.Context, delivery *claimedDelivery,
+	now time.Time) (int, error) {
+
+	body, err := json.Marshal(&delivery.payload)
+
+	if err != nil {
+		return 0, err
+	}
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost,
+		delivery.url, bytes.NewReader(body))
+
+	if err != nil {
+		return 0, err
+	}
+
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("User-Agent", "PedroBank-Webhooks")
+	req.Header.Set("PedroBank-Event", delivery.payload.Type)
+	req.Header.Set("PedroBank-Delivery", strconv.Itoa(delivery.id))
+	req.Header.Set("PedroBank-Signature", signWebhook(delivery.secret, now,
+		body))
+
+	resp, err := webhookClient.Do(req)
+
+	if err != nil {
+		return 0, err
+	}
+
+	// Reading the body lets the connection be reused
+	io.Copy(io.Discard, io.LimitReader(resp.Body, 4096))
+	resp.Body.Close()
+
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		return resp.StatusCode, fmt.Errorf("webhook responded %d",
+			resp.StatusCode)
+	}
+
+	return resp.StatusCode, nil
+}
+
+// What went wrong with an attempt, for the delivery's last_error. Only the
+// kind of failure: the error itself can tell what's on the network the
+// server is on.
+func webhookErrorCategory(status int, err error) string {
+	var dnsErr *net.DNSError
+	var netErr net.Error
+
+	switch {
+	case status != 0:
+		return fmt.Sprintf("webhook responded %d", status)
+	case errors.Is(err, webhookAddressError):
+		return "address not allowed"
+	case errors.As(err, &dnsErr):
+		return "host not found"
+	case errors.Is(err, context.DeadlineExceeded),
+		errors.As(err, &netErr) && netErr.Timeout():
+
+		return "timed out"
+	case errors.As(err, new(*net.OpError)):
+		return "connection failed"
+	default:
+		return "request failed"
+	}
+}
+
+// Record how the delivery's attempt went: delivered, pending for another
+// attempt, or dead.
+func recordWebhookAttempt(ctx context.Context, delivery *claimedDelivery,
+	now time.Time, status int, sendErr error) error {
+
+	var lastStatus interface{}
+
+	if status != 0 {
+		lastStatus = status
+	}
+
+	if sendErr == nil {
+		_, err := DB.ExecContext(ctx,
+			`update webhook_deliveries
+			set status = 'delivered', last_attempt_at = $1, last_status = $2,
+			last_error = null, delivered_at = $1
+			where id = $3`, now, lastStatus, delivery.id)
+
+		return err
+	}
+
+	newStatus := "dead"
+	nextAttempt := now
+	delay, retry := webhookRetryDelay(delivery.attempts)
+
+	if retry {
+		newStatus = "pending"
+		nextAttempt = now.Add(delay)
+	}
+
+	_, err := DB.ExecContext(ctx,
+		`update webhook_deliveries
+		set status = $1, next_attempt_at = $2, last_attempt_at = $3,
+		last_status = $4, last_error = $5
+		where id = $6`, newStatus, nextAttempt, now, lastStatus,
+		webhookErrorCategory(status, sendErr), delivery.id)
+
+	return err
+}
+
+// Send the deliveries that are due, all at once, and record how each went.
+// Returns how many were taken.
+func deliverWebhooks(ctx context.Context) (int, error) {
+	deliveries, err := claimWebhookDeliveries(ctx, time.Now().UTC())
+
+	if err != nil {
+		return 0, err
+	}
+
+	var wg sync.WaitGroup
+
+	for i := range deliveries {
+		wg.Add(1)
+
+		go func(delivery *claimedDelivery) {
+			defer wg.Done()
+
+			now := time.Now().UTC()
+			status, sendErr := sendWebhook(ctx, delivery, now)
+
+			// The server is stopping. The attempt is tried again once the
+			// lease is over.
+			if ctx.Err() != nil {
+				return
+			}
+
+			if sendErr != nil {
+				logger.Printf("Webhook delivery %d failed: %v", delivery.id,
+					sendErr)
+			}
+
+			err := recordWebhookAttempt(ctx, delivery, now, status, sendErr)
+
+			if err != nil {
+				logger.Printf("Error recording webhook delivery %d: %v",
+					delivery.id, err)
+			}
+		}(&deliveries[i])
+	}
+
+	wg.Wait()
+
+	return len(deliveries), nil
+}
+
+// Send the webhook deliveries that are due every webhookJobInterval. Call
+// this in a goroutine. Cancel the context to stop the goroutine.
+func webhookJob(ctx context.Context) {
+	defer close(webhookJobFinished)
+
+	ticker := time.NewTicker(webhookJobInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			logger.Print("Webhook job exiting...")
+			return
+		case <-ticker.C:
+		}
+
+		// Keep going while there are full batches due
+		for ctx.Err() == nil {
+			taken, err := deliverWebhooks(ctx)
+
+			if err != nil {
+				logger.Printf("Error delivering webhooks: %v", err)
+			}
+
+			if err != nil || taken < webhookBatchLen {
+				break
+			}
+		}
+	}
+}
+
+// Handler for GET at /webhooks. Lists the webhooks of the logged in account,
+// without their secrets.
+func getWebhooks(rw http.ResponseWriter, req *http.Request) {
+	id := accountID(req)
+
+	rows, err := DB.QueryContext(req.Context(),
+		`select id, url, events, created_at from webhooks
+		where account_id = $1 order by id`, id)
+
+	if err != nil {
+		respondWithError(rw, err)
+		return
+	}
+
+	defer rows.Close()
+
+	webhooks := make([]webhook, 0, maxWebhooksPerAccount)
+
+	for rows.Next() {
+		var hook webhook
+
+		err = rows.Scan(&hook.ID, &hook.URL, &hook.Events, &hook.CreatedAt)
+
+		if err != nil {
+			logger.Printf("error when querying webhooks")
+			respondWithError(rw, err)
+			return
+		}
+
+		webhooks = append(webhooks, hook)
+	}
+
+	if err = rows.Err(); err != nil {
+		logger.Printf("error when querying webhooks")
+		respondWithError(rw, err)
+		return
+	}
+
+	respondWithJSON(rw, http.StatusOK, webhooks)
+}
+
+// Handler for POST at /webhooks. Registers a webhook for the logged in
+// account. The response is the only time the secret is sent.
+func createWebhook(rw http.ResponseWriter, req *http.Request) {
+	id := accountID(req)
+
+	data, err := readFromReq(req, 4096)
+
+	if err != nil {
+		respondWithError(rw, err)
+		return
+	}
+
+	var createReq webhookCreateRequest
+
+	err = json.Unmarshal(data, &createReq)
+
+	if err != nil {
+		respondWithError(rw, cantParseJSONError)
+		return
+	}
+
+	if err = createReq.validate(); err != nil {
+		respondWithError(rw, err)
+		return
+	}
+
+	secret, err := generateWebhookSecret()
+
+	if err != nil {
+		respondWithError(rw, err)
+		return
+	}
+
+	hook := webhook{URL: createReq.URL, Events: createReq.Events,
+		CreatedAt: time.Now().UTC(), Secret: secret}
+
+	tx, err := DB.BeginTx(req.Context(), &defaultTxOptions)
+
+	if err != nil {
+		logger.Print("Error starting tx to create webhook")
+		respondWithError(rw, err)
+		return
+	}
+
+	// Locking the account serializes webhook registrations for it, so two
+	// concurrent requests can't both pass the count check.
+	var count int
+
+	_, err = tx.Exec("select id from accounts where id = $1 for update", id)
+
+	if err == nil {
+		err = tx.QueryRow(
+			"select count(*) from webhooks where account_id = $1",
+			id).Scan(&count)
+	}
+
+	if err == nil && count >= maxWebhooksPerAccount {
+		err = tooManyWebhooksError
+	}
+
+	if err == nil {
+		err = tx.QueryRow(
+			`insert into webhooks (account_id, url, secret, events,
+			created_at)
+			values ($1, $2, $3, $4, $5)
+			returning id`, id, hook.URL, hook.Secret, hook.Events,
+			hook.CreatedAt).Scan(&hook.ID)
+	}
+
+	if err != nil {
+		rollbackTx(tx)
+		respondWithError(rw, err)
+		return
+	}
+
+	err = tx.Commit()
+
+	if err != nil {
+		logger.Print("Error commiting tx")
+		respondWithError(rw, err)
+		return
+	}
+
+	logger.Printf("Account %d registered webhook %d", id, hook.ID)
+	respondWithJSON(rw, http.StatusCreated, &hook)
+}
+
+// Handler for DELETE at /webhooks/<id>. Its pending deliveries are dropped.
+func deleteWebhook(rw http.ResponseWriter, req *http.Request) {
+	id := accountID(req)
+	webhookID, err := pathID(req, "id")
+
+	if err != nil {
+		respondWithError(rw, err)
+		return
+	}
+
+	res, err := DB.ExecContext(req.Context(),
+		`delete from webhooks where id = $1 and account_id = $2`,
+		webhookID, id)
+
+	if err != nil {
+		respondWithError(rw, err)
+		return
+	}
+
+	rowsAffected, err := res.RowsAffected()
+
+	if err != nil {
+		respondWithError(rw, err)
+		return
+	} else if rowsAffected != 1 {
+		respondWithError(rw, noWebhookError)
+		return
+	}
+
+	rw.WriteHeader(http.StatusNoContent)
+}
+
+// Columns selected for a delivery from webhookDeliveries, in the order
+// scanWebhookDelivery expects.
+const webhookDeliveryColumns = `id, event_id, event_type, status, attempts,
+	next_attempt_at, last_attempt_at, last_status, last_error, delivered_at,
+	created_at`
+
+// The deliveries with the types of their events.
+const webhookDeliveries = `(select webhook_deliveries.*,
+	webhook_events.type as event_type
+	from webhook_deliveries join webhook_events
+	on webhook_events.id = webhook_deliveries.event_id) as deliveries`
+
+func scanWebhookDelivery(row scanner, delivery *webhookDelivery) error {
+	var nextAttemptAt time.Time
+	var lastError sql.NullString
+
+	err := row.Scan(&delivery.ID, &delivery.EventID, &delivery.EventType,
+		&delivery.Status, &delivery.Attempts, &nextAttemptAt,
+		&delivery.LastAttemptAt, &delivery.LastStatus, &lastError,
+		&delivery.DeliveredAt, &delivery.CreatedAt)
+
+	if err != nil {
+		return err
+	}
+
+	delivery.NextAttemptAt = nil
+
+	if delivery.Status == "pending" {
+		delivery.NextAttemptAt = &nextAttemptAt
+	}
+
+	delivery.LastError = lastError.String
+
+	return nil
+}
+
+// Check that the webhook with webhookID belongs to the account with id.
+func checkWebhookOwner(ctx context.Context, id int, webhookID int) error {
+	var owner int
+
+	err := DB.QueryRowContext(ctx,
+		"select account_id from webhooks where id = $1",
+		webhookID).Scan(&owner)
+
+	if err == sql.ErrNoRows || (err == nil && owner != id) {
+		return noWebhookError
+	}
+
+	return err
+}
+
+// Handler for GET at /webhooks/<id>/deliveries. The delivery log of a
+// webhook of the logged in account, newest first by default. Can be filtered
+// by status, e.g. status=dead.
+func getWebhookDeliveries(rw http.ResponseWriter, req *http.Request) {
+	id := accountID(req)
+	webhookID, err := pathID(req, "id")
+
+	if err != nil {
+		respondWithError(rw, err)
+		return
+	}
+
+	params, err := parsePageParams(req, map[string]string{"id": "integer"},
+		"id")
+
+	if err != nil {
+		respondWithError(rw, err)
+		return
+	}
+
+	if req.URL.Query().Get("order") == "" {
+		params.desc = true
+	}
+
+	if err = checkWebhookOwner(req.Context(), id, webhookID); err != nil {
+		respondWithError(rw, err)
+		return
+	}
+
+	var where whereBuilder
+	where.add("webhook_id = %[1]s", webhookID)
+
+	if status := req.URL.Query().Get("status"); status != "" {
+		if status != "pending" && status != "delivered" && status != "dead" {
+			respondWithError(rw, newBadParamError("status"))
+			return
+		}
+
+		where.add("status = %[1]s", status)
+	}
+
+	params.addCursor(&where)
+
+	rows, err := DB.QueryContext(req.Context(),
+		`select `+webhookDeliveryColumns+` from `+webhookDeliveries+
+			` where `+where.String()+` `+params.orderAndLimit(),
+		where.args...)
+
+	if err != nil {
+		respondWithError(rw, err)
+		return
+	}
+
+	defer rows.Close()
+
+	deliveries := make([]webhookDelivery, 0, params.limit+1)
+
+	for rows.Next() {
+		var delivery webhookDelivery
+
+		err = scanWebhookDelivery(rows, &delivery)
+
+		if err != nil {
+			logger.Printf("error when querying webhook deliveries")
+			respondWithError(rw, err)
+			return
+		}
+
+		deliveries = append(deliveries, delivery)
+	}
+
+	if err = rows.Err(); err != nil {
+		logger.Printf("error when querying webhook deliveries")
+		respondWithError(rw, err)
+		return
+	}
+
+	var page webhookDeliveryPage
+
+	if len(deliveries) > params.limit {
+		page.NextCursor = params.nextCursor(
+			deliveries[params.limit-1].ID, "")
+		deliveries = deliveries[:params.limit]
+	}
+
+	page.Deliveries = deliveries
+
+	respondWithJSON(rw, http.StatusOK, &page)
+}
+
+// Handler for POST at /webhooks/<id>/deliveries/<delivery>/retry. Gives a
+// dead delivery another round of attempts, starting now.
+func retryWebhookDelivery(rw http.ResponseWriter, req *http.Request) {
+	id := accountID(req)
+	webhookID, err := pathID(req, "id")
+
+	if err != nil {
+		respondWithError(rw, err)
+		return
+	}
+
+	deliveryID, err := pathID(req, "delivery")
+
+	if err != nil {
+		respondWithError(rw, err)
+		return
+	}
+
+	if err = checkWebhookOwner(req.Context(), id, webhookID); err != nil {
+		respondWithError(rw, err)
+		return
+	}
+
+	tx, err := DB.BeginTx(req.Context(), &defaultTxOptions)
+
+	if err != nil {
+		logger.Print("Error starting tx to retry webhook delivery")
+		respondWithError(rw, err)
+		return
+	}
+
+	var delivery webhookDelivery
+
+	row := tx.QueryRow(
+		`select `+webhookDeliveryColumns+` from `+webhookDeliveries+
+			` where id = $1 and webhook_id = $2 for update`,
+		deliveryID, webhookID)
+
+	err = scanWebhookDelivery(row, &delivery)
+
+	if err == sql.ErrNoRows {
+		err = noWebhookDeliveryError
+	} else if err == nil && delivery.Status != "dead" {
+		err = webhookDeliveryNotDeadError
+	}
+
+	now := time.Now().UTC()
+
+	if err == nil {
+		_, err = tx.Exec(
+			`update webhook_deliveries
+			set status = 'pending', attempts = 0, next_attempt_at = $1
+			where id = $2`, now, deliveryID)
+	}
+
+	if err != nil {
+		rollbackTx(tx)
+		respondWithError(rw, err)
+		return
+	}
+
+	err = tx.Commit()
+
+	if err != nil {
+		logger.Print("Error commiting tx")
+		respondWithError(rw, err)
+		return
+	}
+
+	delivery.Status = "pending"
+	delivery.Attempts = 0
+	delivery.NextAttemptAt = &now
+
+	logger.Printf("Webhook delivery %d retried by account %d", deliveryID,
+		id)
+	respondWithJSON(rw, http.StatusOK, &delivery)
+}